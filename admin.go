@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+)
+
+// readToken returns content of the token file, empty when path is not set
+func readToken(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// registerAdmin adds debug endpoints to the mux, and profiling when set.
+// When token is set, requests should have `Authorization: Bearer <token>`
+func (s *Parser) registerAdmin(mux *http.ServeMux, token string, profile bool) {
+	handle := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, requireToken(token, h))
+	}
+	handle("/debug/labels", s.debugLabels())
+	handle("/debug/run", s.runs.handler())
+	handle("/debug/status", s.debugStatus())
+	handle("/debug/scan", s.debugScan())
+	handle("/debug/targets", s.debugTargets())
+	if profile {
+		handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+		handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	}
+}
+
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// debugScan starts scan without waiting for --wait interval
+func (s *Parser) debugScan() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to trigger scan", http.StatusMethodNotAllowed)
+			return
+		}
+		select {
+		case s.trigger <- struct{}{}:
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "scan triggered")
+		default:
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprintln(w, "scan is already triggered")
+		}
+	})
+}
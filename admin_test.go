@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterAdmin(t *testing.T) {
+	s := &Parser{trigger: make(chan struct{}, 1), status: newStatus(1, 0)}
+	mux := http.NewServeMux()
+	s.registerAdmin(mux, "secret", false)
+
+	tests := []struct {
+		method, path, auth string
+		want               int
+	}{
+		{"GET", "/debug/status", "", http.StatusUnauthorized},
+		{"GET", "/debug/status", "Bearer wrong", http.StatusUnauthorized},
+		{"GET", "/debug/status", "Bearer secret", http.StatusOK},
+		{"GET", "/debug/scan", "Bearer secret", http.StatusMethodNotAllowed},
+		{"POST", "/debug/scan", "Bearer secret", http.StatusAccepted},
+		{"POST", "/debug/scan", "Bearer secret", http.StatusAccepted},
+		{"GET", "/debug/pprof/", "Bearer secret", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s %s with %q = %d, want %d", tt.method, tt.path, tt.auth, rec.Code, tt.want)
+		}
+	}
+	if len(s.trigger) != 1 {
+		t.Errorf("trigger has %d scans pending, want 1", len(s.trigger))
+	}
+}
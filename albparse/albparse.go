@@ -0,0 +1,267 @@
+// Package albparse parses AWS Application Load Balancer access log lines with
+// the same semantics as alb-logs-shipper, for tools which need typed records
+// of the lines, like Athena preprocessors and test harnesses.
+//
+//	rec, err := albparse.Parse(line)
+//	if err != nil {
+//		return err
+//	}
+//	fmt.Println(rec.Time, rec.ELBStatusCode, rec.Request)
+//
+// Lines are split by Split to raw values of Fields, which are in double quotes
+// for Quoted fields. Parse converts them to Record, decoding ALB escaping.
+package albparse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fields are names of ALB access log fields in order, see
+// https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html#access-log-entry-format
+var Fields = []string{
+	"type", "time", "elb", "client", "target",
+	"request_processing_time", "target_processing_time", "response_processing_time",
+	"elb_status_code", "target_status_code", "received_bytes", "sent_bytes",
+	"request", "user_agent", "ssl_cipher", "ssl_protocol", "target_group_arn",
+	"trace_id", "domain_name", "chosen_cert_arn", "matched_rule_priority",
+	"request_creation_time", "actions_executed", "redirect_url", "error_reason",
+	"targets", "target_status_code_list", "classification", "classification_reason",
+	"conn_trace_id",
+}
+
+// Quoted fields have values in double quotes, with `\"`, `\\` and `\xHH`
+// escapes inside
+var Quoted = map[string]bool{
+	"request":                 true,
+	"user_agent":              true,
+	"trace_id":                true,
+	"domain_name":             true,
+	"chosen_cert_arn":         true,
+	"actions_executed":        true,
+	"redirect_url":            true,
+	"error_reason":            true,
+	"targets":                 true,
+	"target_status_code_list": true,
+	"classification":          true,
+	"classification_reason":   true,
+}
+
+// Record is a parsed ALB access log line. String fields are unquoted and
+// decoded, and keep `-` which ALB logs for missing values
+type Record struct {
+	Type                   string // http, https, h2, grpcs, ws or wss
+	Time                   time.Time
+	ELB                    string
+	Client                 string  // ip:port
+	Target                 string  // ip:port, or `-`
+	RequestProcessingTime  float64 // seconds, -1 when the request was not dispatched
+	TargetProcessingTime   float64
+	ResponseProcessingTime float64
+	ELBStatusCode          int // 0 for `-`
+	TargetStatusCode       int // 0 for `-`
+	ReceivedBytes          int64
+	SentBytes              int64
+	Request                string // method, URL and protocol version
+	UserAgent              string
+	SSLCipher              string
+	SSLProtocol            string
+	TargetGroupARN         string
+	TraceID                string
+	DomainName             string
+	ChosenCertARN          string
+	MatchedRulePriority    int // 0 for `-` or default rule
+	RequestCreationTime    time.Time
+	ActionsExecuted        string
+	RedirectURL            string
+	ErrorReason            string
+	Targets                string
+	TargetStatusCodeList   string
+	Classification         string
+	ClassificationReason   string
+	ConnTraceID            string
+	// Unknown are raw trailing fields, which ALB could add to the end of
+	// lines in the future
+	Unknown string
+}
+
+// Split splits the line to raw values of Fields, followed by trailing unknown
+// fields as one more value, if any
+func Split(line string) ([]string, error) {
+	return Tokenize(line, Fields, Quoted)
+}
+
+// Tokenize splits line to named fields. Unquoted fields end at space,
+// quoted fields should start and end with `"`, and inside them backslash
+// escapes the next byte. Extra trailing fields are returned as one more match
+func Tokenize(line string, names []string, quoted map[string]bool) ([]string, error) {
+	matches := make([]string, 0, len(names))
+	i := 0
+	for _, name := range names {
+		if i >= len(line) {
+			return nil, fmt.Errorf("missing field %s", name)
+		}
+		start := i
+		if quoted[name] {
+			if line[i] != '"' {
+				return nil, fmt.Errorf("field %s is not quoted", name)
+			}
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("unterminated field %s", name)
+			}
+			i++
+			if i < len(line) && line[i] != ' ' {
+				return nil, fmt.Errorf("unexpected data after field %s", name)
+			}
+		} else {
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("empty field %s", name)
+			}
+		}
+		matches = append(matches, line[start:i])
+		i++
+	}
+	if i < len(line) {
+		matches = append(matches, line[i:]) // trailing unknown fields
+	}
+	return matches, nil
+}
+
+// Parse parses ALB access log line to Record
+func Parse(line string) (Record, error) {
+	m, err := Split(line)
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to parse log line %w: %s", err, line)
+	}
+	p := parser{values: m}
+	r := Record{
+		Type:                   m[0],
+		Time:                   p.time(1),
+		ELB:                    m[2],
+		Client:                 m[3],
+		Target:                 m[4],
+		RequestProcessingTime:  p.float(5),
+		TargetProcessingTime:   p.float(6),
+		ResponseProcessingTime: p.float(7),
+		ELBStatusCode:          int(p.int(8)),
+		TargetStatusCode:       int(p.int(9)),
+		ReceivedBytes:          p.int(10),
+		SentBytes:              p.int(11),
+		Request:                Unquote(m[12]),
+		UserAgent:              Unquote(m[13]),
+		SSLCipher:              m[14],
+		SSLProtocol:            m[15],
+		TargetGroupARN:         m[16],
+		TraceID:                Unquote(m[17]),
+		DomainName:             Unquote(m[18]),
+		ChosenCertARN:          Unquote(m[19]),
+		MatchedRulePriority:    int(p.int(20)),
+		RequestCreationTime:    p.time(21),
+		ActionsExecuted:        Unquote(m[22]),
+		RedirectURL:            Unquote(m[23]),
+		ErrorReason:            Unquote(m[24]),
+		Targets:                Unquote(m[25]),
+		TargetStatusCodeList:   Unquote(m[26]),
+		Classification:         Unquote(m[27]),
+		ClassificationReason:   Unquote(m[28]),
+		ConnTraceID:            m[29],
+	}
+	if len(m) > len(Fields) {
+		r.Unknown = m[len(Fields)]
+	}
+	if p.err != nil {
+		return Record{}, fmt.Errorf("failed to parse log line %w: %s", p.err, line)
+	}
+	return r, nil
+}
+
+// parser converts values of fields, keeping the first error
+type parser struct {
+	values []string
+	err    error
+}
+
+func (p *parser) time(i int) time.Time {
+	ts, err := time.Parse(time.RFC3339Nano, p.values[i])
+	p.fail(i, err)
+	return ts
+}
+
+func (p *parser) float(i int) float64 {
+	v, err := strconv.ParseFloat(p.values[i], 64)
+	p.fail(i, err)
+	return v
+}
+
+func (p *parser) int(i int) int64 {
+	if p.values[i] == "-" {
+		return 0
+	}
+	v, err := strconv.ParseInt(p.values[i], 10, 64)
+	p.fail(i, err)
+	return v
+}
+
+func (p *parser) fail(i int, err error) {
+	if err != nil && p.err == nil {
+		p.err = fmt.Errorf("invalid %s: %w", Fields[i], err)
+	}
+}
+
+// Unquote returns value of quoted field without quotes, with ALB escapes
+// decoded. Values which are not quoted are returned as is
+func Unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	end := len(value) - 1
+	if strings.IndexByte(value[1:end], '\\') < 0 {
+		return value[1:end]
+	}
+	b := make([]byte, 0, end-1)
+	for i := 1; i < end; i++ {
+		var c byte
+		c, i = DecodeAt(value, i, end)
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// DecodeAt returns byte of quoted value at i, decoding `\xHH`, `\"` and `\\`
+// escapes which end before end, and index of the last byte of the escape
+func DecodeAt(value string, i, end int) (byte, int) {
+	c := value[i]
+	if c == '\\' && i+1 < end {
+		switch n := value[i+1]; {
+		case n == 'x' && i+3 < end && isHex(value[i+2]) && isHex(value[i+3]):
+			return unhex(value[i+2])<<4 | unhex(value[i+3]), i + 3
+		case n == '"' || n == '\\':
+			return n, i + 1
+		}
+	}
+	return c, i
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,78 @@
+package albparse
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const line = `h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 -1 502 - 34 366 "GET https://www.example.com:443/?q=\x22a\x22 HTTP/2.0" "curl\"7.46.0\\" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "www.example.com" "arn:aws:acm:us-east-2:123456789012:certificate/12345678-1234-1234-1234-123456789012" - 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "-" "-" "-" TID_1234abcd5678ef90 "future" 42`
+
+func TestParse(t *testing.T) {
+	r, err := Parse(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2018, 7, 2, 22, 23, 0, 186641000, time.UTC); !r.Time.Equal(want) {
+		t.Errorf("Time = %v, want %v", r.Time, want)
+	}
+	if r.ResponseProcessingTime != -1 || r.TargetProcessingTime != 0.001 {
+		t.Errorf("processing times = %v, %v", r.TargetProcessingTime, r.ResponseProcessingTime)
+	}
+	if r.ELBStatusCode != 502 || r.TargetStatusCode != 0 || r.MatchedRulePriority != 0 {
+		t.Errorf("codes = %d, %d, %d", r.ELBStatusCode, r.TargetStatusCode, r.MatchedRulePriority)
+	}
+	if r.ReceivedBytes != 34 || r.SentBytes != 366 {
+		t.Errorf("bytes = %d, %d", r.ReceivedBytes, r.SentBytes)
+	}
+	if want := `GET https://www.example.com:443/?q="a" HTTP/2.0`; r.Request != want {
+		t.Errorf("Request = %s, want %s", r.Request, want)
+	}
+	if want := `curl"7.46.0\`; r.UserAgent != want {
+		t.Errorf("UserAgent = %s, want %s", r.UserAgent, want)
+	}
+	if r.RedirectURL != "-" || r.Targets != "10.0.0.1:80" || r.ConnTraceID != "TID_1234abcd5678ef90" {
+		t.Errorf("RedirectURL, Targets, ConnTraceID = %s, %s, %s", r.RedirectURL, r.Targets, r.ConnTraceID)
+	}
+	if r.Unknown != `"future" 42` {
+		t.Errorf("Unknown = %s", r.Unknown)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"truncated", line[:100], "missing field"},
+		{"time", strings.Replace(line, "2018-07-02T22:23:00.186641Z", "yesterday", 1), "invalid time"},
+		{"status", strings.Replace(line, " 502 ", " 5xx ", 1), "invalid elb_status_code"},
+		{"quote", strings.Replace(line, `"forward"`, `forward`, 1), "actions_executed is not quoted"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.in)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := map[string]string{
+		`-`:           `-`,
+		`"-"`:         `-`,
+		`"a\x2Fb"`:    `a/b`,
+		`"a\x2fb"`:    `a/b`,
+		`"a\xZZ"`:     `a\xZZ`,
+		`"a\\\"b"`:    `a\"b`,
+		`"trailing\"`: `trailing\`,
+	}
+	for in, want := range tests {
+		if got := Unquote(in); got != want {
+			t.Errorf("Unquote(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
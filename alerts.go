@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var deleteFailures = newCounter("alb_logs_shipper_delete_failures_total", "Shipped files which failed to be deleted (or moved) from S3")
+
+// alertRules is a Prometheus rule file for the metrics exposed on /metrics
+var alertRules = template.Must(template.New("rules").Parse(`groups:
+- name: alb-logs-shipper
+  rules:
+  - alert: AlbLogsShipperDown
+    expr: up{job="{{.Job}}"} == 0 or absent(up{job="{{.Job}}"})
+    for: 5m
+    labels:
+      severity: critical
+    annotations:
+      summary: alb-logs-shipper is down, ALB logs are not shipped to Loki
+  - alert: AlbLogsShipperLagHigh
+    expr: histogram_quantile(0.9, sum by (le) (rate(alb_logs_shipper_queue_wait_seconds_bucket{job="{{.Job}}"}[10m]))) > {{.Lag}}
+    for: 15m
+    labels:
+      severity: warning
+    annotations:
+      summary: S3 keys wait more than {{.LagText}} for a worker, consider raising --workers
+  - alert: AlbLogsShipperQuarantine
+    expr: alb_logs_shipper_quarantined_files{job="{{.Job}}"} > 0
+    labels:
+      severity: warning
+    annotations:
+      summary: '{{"{{"}} $value {{"}}"}} files failed to ship after all retries, and need manual review'
+  - alert: AlbLogsShipperParkedLoadBalancers
+    expr: alb_logs_shipper_parked_load_balancers{job="{{.Job}}"} > 0
+    for: 30m
+    labels:
+      severity: warning
+    annotations:
+      summary: '{{"{{"}} $value {{"}}"}} load balancers keep failing and their files are not shipped, check logs for "parking load balancer"'
+  - alert: AlbLogsShipperDeleteFailures
+    expr: increase(alb_logs_shipper_delete_failures_total{job="{{.Job}}"}[15m]) > 0
+    labels:
+      severity: warning
+    annotations:
+      summary: Shipped files fail to be deleted from S3 and would be shipped again, check s3:DeleteObject permission
+  - alert: AlbLogsShipperStuckWorkers
+    expr: alb_logs_shipper_stuck_workers{job="{{.Job}}"} > 0
+    for: 10m
+    labels:
+      severity: warning
+    annotations:
+      summary: '{{"{{"}} $value {{"}}"}} workers are stuck in the same stage of a file, check stage of workers at /debug/status'
+  - alert: AlbLogsShipperShedding
+    expr: alb_logs_shipper_shedding{job="{{.Job}}"} > 0
+    for: 30m
+    labels:
+      severity: warning
+    annotations:
+      summary: Access log lines are dropped by --shed-rule for 30m as the queue is overloaded, consider raising --workers
+{{- if .SLO}}
+  - alert: AlbIngressErrorBudgetBurn
+    expr: |
+      (
+        sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_errors_total{job="{{.Job}}"}[1h]))
+        / sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_requests_total{job="{{.Job}}"}[1h])) > {{.Burn1h}}
+      ) and (
+        sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_errors_total{job="{{.Job}}"}[5m]))
+        / sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_requests_total{job="{{.Job}}"}[5m])) > {{.Burn1h}}
+      )
+    labels:
+      severity: critical
+    annotations:
+      summary: '{{"{{"}} $labels.namespace {{"}}"}}/{{"{{"}} $labels.ingress {{"}}"}} burns 2% of {{.SLO}} availability error budget per hour'
+  - alert: AlbIngressErrorBudgetBurnSlow
+    expr: |
+      (
+        sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_errors_total{job="{{.Job}}"}[6h]))
+        / sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_requests_total{job="{{.Job}}"}[6h])) > {{.Burn6h}}
+      ) and (
+        sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_errors_total{job="{{.Job}}"}[30m]))
+        / sum by (cluster, namespace, ingress) (rate(alb_logs_shipper_sli_requests_total{job="{{.Job}}"}[30m])) > {{.Burn6h}}
+      )
+    labels:
+      severity: warning
+    annotations:
+      summary: '{{"{{"}} $labels.namespace {{"}}"}}/{{"{{"}} $labels.ingress {{"}}"}} burns 5% of {{.SLO}} availability error budget per 6h'
+{{- end}}
+`))
+
+// runAlertRules prints Prometheus alerting rules to stdout, returns exit code
+func runAlertRules(args []string) int {
+	fs := pflag.NewFlagSet("alert-rules", pflag.ContinueOnError)
+	job := fs.StringP("job", "", "alb-logs-shipper", "Prometheus job label of alb-logs-shipper targets")
+	lag := fs.DurationP("lag", "", 10*time.Minute, "Queue wait (p90) to alert on")
+	slo := fs.Float64P("slo", "", 0, "Availability objective (like 0.999) to add multiwindow burn rate alerts per ingress on --sli metrics (0 to disable)")
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	if *slo < 0 || *slo >= 1 {
+		fmt.Fprintln(os.Stderr, "--slo should be between 0 and 1")
+		return 1
+	}
+	// histogram_quantile() can't exceed the largest bucket of queue wait (~55m)
+	if top := queueWait.buckets[len(queueWait.buckets)-1]; lag.Seconds() >= top {
+		fmt.Fprintf(os.Stderr, "--lag should be below %s, the largest bucket of queue wait\n", time.Duration(top*float64(time.Second)))
+		return 1
+	}
+	// burn rates of 30d budget: 2% per hour, and 5% per 6h
+	err := alertRules.Execute(os.Stdout, struct {
+		Job     string
+		Lag     float64
+		LagText string
+		SLO     float64
+		Burn1h  string
+		Burn6h  string
+	}{*job, lag.Seconds(), lag.String(), *slo, fmt.Sprintf("%.6g", 14.4*(1-*slo)), fmt.Sprintf("%.6g", 6*(1-*slo))})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
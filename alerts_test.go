@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAlertRules_metrics(t *testing.T) {
+	newRetryQueue(0, 1)   // registers quarantined files gauge
+	newParking(0, 0)      // registers parked load balancers gauge
+	newStatus(0, 0)       // registers stuck workers gauge
+	newShedder(0, 0, nil) // registers shedding gauge
+	var rules bytes.Buffer
+	if err := alertRules.Execute(&rules, map[string]any{"Job": "test", "Lag": 600, "LagText": "10m", "SLO": 0.999, "Burn1h": "0.0144", "Burn6h": "0.006"}); err != nil {
+		t.Fatal(err)
+	}
+	var exposed bytes.Buffer
+	for _, m := range registry {
+		m.write(&exposed)
+	}
+	for _, name := range regexp.MustCompile(`alb_logs_shipper_\w+`).FindAllString(rules.String(), -1) {
+		name = strings.TrimSuffix(name, "_bucket")
+		if !strings.Contains(exposed.String(), "# TYPE "+name+" ") {
+			t.Errorf("alert rules use metric %s which is not exposed", name)
+		}
+	}
+}
+
+func TestRunAlertRules_lag(t *testing.T) {
+	// p90 of queue wait can't exceed its largest bucket
+	if code := runAlertRules([]string{"--lag=2h"}); code != 1 {
+		t.Errorf("runAlertRules(--lag=2h) = %d, want 1", code)
+	}
+}
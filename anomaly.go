@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// anomalyMinRequests is the minimal number of requests in a window to be evaluated
+const anomalyMinRequests = 50
+
+var anomaliesTotal = newCounter("alb_logs_shipper_anomalies_total", "Windows when ingress error rate or latency exceeded thresholds", "reason")
+
+// Anomaly is passed to the hook as JSON
+type Anomaly struct {
+	Cluster    string   `json:"cluster"`
+	Namespace  string   `json:"namespace"`
+	Ingress    string   `json:"ingress"`
+	Reasons    []string `json:"reasons"`
+	Window     string   `json:"window"`
+	WindowEnd  string   `json:"window_end"`
+	Requests   int      `json:"requests"`
+	Errors     int      `json:"errors"`
+	ErrorRate  float64  `json:"error_rate"`
+	LatencyAvg float64  `json:"latency_avg_seconds"`
+}
+
+// anomalyWindow accumulates stats of an ingress in the current window
+type anomalyWindow struct {
+	values     []string
+	requests   int
+	errors     int
+	latencySum float64
+	latencyN   int
+}
+
+// anomalies evaluates per-ingress error rate and average latency over a
+// window of shipped logs, and invokes a webhook or command when thresholds
+// are exceeded
+type anomalies struct {
+	opts   Options
+	logger *slog.Logger
+	http   *http.Client
+	mu     sync.Mutex
+	data   map[string]*anomalyWindow
+}
+
+func newAnomalies(opts Options, logger *slog.Logger) *anomalies {
+	return &anomalies{
+		opts:   opts,
+		logger: logger,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		data:   make(map[string]*anomalyWindow),
+	}
+}
+
+// add accounts SLI of a shipped file to the window of its stream labels
+func (a *anomalies) add(labels map[string]string, st *sliStats) {
+	values := make([]string, len(volumeLabels))
+	for i, l := range volumeLabels {
+		values[i] = labels[l]
+	}
+	key := strings.Join(values, "\xff")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	w, ok := a.data[key]
+	if !ok {
+		w = &anomalyWindow{values: values}
+		a.data[key] = w
+	}
+	w.requests += st.requests
+	w.errors += st.errors
+	for _, v := range st.latencies {
+		w.latencySum += v
+	}
+	w.latencyN += len(st.latencies)
+}
+
+// run evaluates windows until the context is done
+func (a *anomalies) run(ctx context.Context) {
+	t := time.NewTicker(a.opts.AnomalyWindow)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for _, an := range a.evaluate() {
+				anomaliesTotal.Inc(strings.Join(an.Reasons, ","))
+				a.logger.Warn("anomaly detected", "cluster", an.Cluster, "namespace", an.Namespace, "ingress", an.Ingress, "reasons", an.Reasons, "error_rate", an.ErrorRate, "latency_avg", an.LatencyAvg)
+				if err := a.hook(ctx, an); err != nil {
+					a.logger.Error("failed to invoke anomaly hook", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// evaluate returns anomalies of the current window and starts a new one
+func (a *anomalies) evaluate() []Anomaly {
+	a.mu.Lock()
+	data := a.data
+	a.data = make(map[string]*anomalyWindow)
+	a.mu.Unlock()
+
+	var res []Anomaly
+	for _, key := range sortedKeys(data) {
+		w := data[key]
+		if w.requests < anomalyMinRequests {
+			continue
+		}
+		an := Anomaly{
+			Cluster:   w.values[0],
+			Namespace: w.values[1],
+			Ingress:   w.values[2],
+			Window:    a.opts.AnomalyWindow.String(),
+			WindowEnd: time.Now().UTC().Format(time.RFC3339),
+			Requests:  w.requests,
+			Errors:    w.errors,
+			ErrorRate: float64(w.errors) / float64(w.requests),
+		}
+		if w.latencyN > 0 {
+			an.LatencyAvg = w.latencySum / float64(w.latencyN)
+		}
+		if a.opts.AnomalyErrorRate > 0 && an.ErrorRate > a.opts.AnomalyErrorRate {
+			an.Reasons = append(an.Reasons, "error_rate")
+		}
+		if a.opts.AnomalyLatency > 0 && an.LatencyAvg > a.opts.AnomalyLatency.Seconds() {
+			an.Reasons = append(an.Reasons, "latency")
+		}
+		if len(an.Reasons) > 0 {
+			res = append(res, an)
+		}
+	}
+	return res
+}
+
+// hook posts the anomaly as JSON to --anomaly-webhook, or passes it to
+// stdin of --anomaly-exec command
+func (a *anomalies) hook(ctx context.Context, an Anomaly) error {
+	body, err := json.Marshal(an)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if a.opts.AnomalyWebhook != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.opts.AnomalyWebhook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "alb-logs-shipper")
+		resp, err := a.http.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook returned HTTP status %s", resp.Status)
+		}
+	}
+	if a.opts.AnomalyExec != "" {
+		cmd := exec.CommandContext(ctx, a.opts.AnomalyExec)
+		cmd.Stdin = bytes.NewReader(body)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s failed: %w: %s", a.opts.AnomalyExec, err, out)
+		}
+	}
+	return nil
+}
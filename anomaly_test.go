@@ -0,0 +1,28 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAnomalies_evaluate(t *testing.T) {
+	a := newAnomalies(Options{AnomalyWindow: time.Minute, AnomalyErrorRate: 0.05, AnomalyLatency: time.Second}, nil)
+	a.add(map[string]string{"namespace": "ns", "ingress": "errors"}, &sliStats{requests: 100, errors: 10, latencies: []float64{0.1, 0.3}})
+	a.add(map[string]string{"namespace": "ns", "ingress": "slow"}, &sliStats{requests: 60, errors: 1, latencies: []float64{1, 2}})
+	a.add(map[string]string{"namespace": "ns", "ingress": "slow"}, &sliStats{requests: 40, latencies: []float64{3}})
+	a.add(map[string]string{"namespace": "ns", "ingress": "ok"}, &sliStats{requests: 100, latencies: []float64{0.1}})
+	a.add(map[string]string{"namespace": "ns", "ingress": "quiet"}, &sliStats{requests: 10, errors: 10})
+
+	got := map[string][]string{}
+	for _, an := range a.evaluate() {
+		got[an.Ingress] = an.Reasons
+	}
+	want := map[string][]string{"errors": {"error_rate"}, "slow": {"latency"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("evaluate() = %v, want %v", got, want)
+	}
+	if len(a.evaluate()) != 0 {
+		t.Error("evaluate() should start a new window")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// auditFlushInterval is how often buffered records are written to S3 or Loki
+const auditFlushInterval = time.Minute
+
+var auditFailures = newCounter("alb_logs_shipper_audit_failures_total", "Failed writes of audit records")
+
+// shipment is a file shipped to Loki
+type shipment struct {
+	key     string
+	size    int64
+	lines   int
+	batches []string
+	spooled int // batches waiting in --spool-dir for replay
+}
+
+// auditRecord is a JSON line of the audit trail
+type auditRecord struct {
+	Time      string   `json:"time"`
+	Action    string   `json:"action"` // shipped, deleted, moved, delete_failed, move_failed
+	Key       string   `json:"key"`
+	Size      int64    `json:"size,omitempty"`
+	Lines     int      `json:"lines,omitempty"`
+	Batches   []string `json:"batches,omitempty"`
+	ShippedAt string   `json:"shipped_at,omitempty"`
+	Archive   string   `json:"archive,omitempty"` // bucket/key the file is moved to
+	Replica   string   `json:"replica"`
+}
+
+// auditLog is an append-only trail of shipped and deleted files, written to
+// a local file (file:<path>), S3 prefix of the bucket (s3:<prefix>) or Loki
+// stream (loki)
+type auditLog struct {
+	opts     Options
+	s3Client *s3.Client
+	client   *lokiClient
+	logger   *slog.Logger
+	file     *os.File
+	prefix   string
+	loki     bool
+	mu       sync.Mutex
+	buf      [][]byte
+}
+
+func newAuditLog(opts Options, s3Client *s3.Client, client *lokiClient, logger *slog.Logger) (*auditLog, error) {
+	a := &auditLog{opts: opts, s3Client: s3Client, client: client, logger: logger}
+	kind, target, _ := strings.Cut(opts.Audit, ":")
+	switch {
+	case kind == "file" && target != "":
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit file: %w", err)
+		}
+		a.file = f
+	case kind == "s3" && target != "":
+		a.prefix = target
+	case opts.Audit == "loki":
+		a.loki = true
+	default:
+		return nil, fmt.Errorf("invalid audit target %q (file:<path>, s3:<prefix>, loki)", opts.Audit)
+	}
+	return a, nil
+}
+
+// shipped records the file shipped and tagged for deletion after retention
+func (a *auditLog) shipped(sh *shipment) {
+	a.write(auditRecord{Action: "shipped", Key: sh.key, Size: sh.size, Lines: sh.lines, Batches: sh.batches})
+}
+
+// deleted records the file deleted right after shipping, or after retention
+// when shipment is unknown. Records of deletes and moves are written before
+// them, as intent
+func (a *auditLog) deleted(key string, sh *shipment, shippedAt time.Time) {
+	rec := auditRecord{Action: "deleted", Key: key}
+	if sh != nil {
+		rec.Size, rec.Lines, rec.Batches = sh.size, sh.lines, sh.batches
+	}
+	if !shippedAt.IsZero() {
+		rec.ShippedAt = shippedAt.UTC().Format(time.RFC3339)
+	}
+	a.write(rec)
+}
+
+// moved records the file moved to the archive right after shipping
+func (a *auditLog) moved(sh *shipment, archive string) {
+	a.write(auditRecord{Action: "moved", Key: sh.key, Size: sh.size, Lines: sh.lines, Batches: sh.batches, Archive: archive})
+}
+
+// failed records that delete or move of the file recorded before has failed,
+// so the file is still in the bucket
+func (a *auditLog) failed(action, key string) {
+	a.write(auditRecord{Action: action + "_failed", Key: key})
+}
+
+func (a *auditLog) write(rec auditRecord) {
+	rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	rec.Replica = a.opts.ReplicaID
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil {
+		// synced on each record, as it is written before the object is deleted
+		if _, err = a.file.Write(append(line, '\n')); err == nil {
+			err = a.file.Sync()
+		}
+		if err != nil {
+			auditFailures.Inc()
+			a.logger.Error("failed to write audit record", "key", rec.Key, "err", err)
+		}
+		return
+	}
+	a.buf = append(a.buf, line)
+}
+
+// run flushes buffered records until the context is done
+func (a *auditLog) run(ctx context.Context) {
+	t := time.NewTicker(auditFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			a.flush(ctx)
+		}
+	}
+}
+
+// flush writes buffered records, which are kept for the next flush on error
+func (a *auditLog) flush(ctx context.Context) {
+	a.mu.Lock()
+	buf := a.buf
+	a.buf = nil
+	a.mu.Unlock()
+	if len(buf) == 0 {
+		return
+	}
+
+	var err error
+	if a.prefix != "" {
+		key := a.prefix + time.Now().UTC().Format("2006/01/02/150405.000") + "-" + a.opts.ReplicaID + ".jsonl"
+		_, err = a.s3Client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:              &a.opts.BucketName,
+			Key:                 &key,
+			Body:                bytes.NewReader(append(bytes.Join(buf, []byte("\n")), '\n')),
+			ExpectedBucketOwner: &a.opts.BucketOwner,
+		})
+	} else if a.loki {
+		b := newBatch(map[string]string{"job": "alb-logs-shipper-audit", "replica": a.opts.ReplicaID}, a.client)
+		for _, line := range buf {
+			b.add(logproto.Entry{Timestamp: time.Now(), Line: string(line)})
+		}
+		_, err = b.push()
+	}
+	if err != nil {
+		auditFailures.Inc()
+		a.logger.Error("failed to write audit records", "records", len(buf), "err", err)
+		a.mu.Lock()
+		a.buf = append(buf, a.buf...)
+		a.mu.Unlock()
+	}
+}
+
+// Close flushes buffered records and closes the file
+func (a *auditLog) Close() {
+	a.flush(context.Background())
+	if a.file != nil {
+		a.file.Close()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog_file(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditLog(Options{Audit: "file:" + fn, ReplicaID: "r1"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.deleted("a.log.gz", &shipment{key: "a.log.gz", size: 10, lines: 2, batches: []string{"0123"}}, time.Time{})
+	a.shipped(&shipment{key: "b.log.gz", lines: 1})
+	a.deleted("b.log.gz", nil, time.Date(2025, 5, 30, 8, 25, 0, 0, time.UTC))
+	a.failed("delete", "b.log.gz")
+	a.Close()
+
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d records, want 4", len(lines))
+	}
+	var rec auditRecord
+	if err = json.Unmarshal([]byte(lines[0]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Action != "deleted" || rec.Key != "a.log.gz" || rec.Lines != 2 || rec.Size != 10 || len(rec.Batches) != 1 || rec.Replica != "r1" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	rec = auditRecord{}
+	if err = json.Unmarshal([]byte(lines[2]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Action != "deleted" || rec.ShippedAt != "2025-05-30T08:25:00Z" || rec.Lines != 0 {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	rec = auditRecord{}
+	if err = json.Unmarshal([]byte(lines[3]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Action != "delete_failed" || rec.Key != "b.log.gz" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+
+	for _, target := range []string{"file:", "s3", "stdout"} {
+		if _, err = newAuditLog(Options{Audit: target}, nil, nil, nil); err == nil {
+			t.Errorf("expected error for audit target %q", target)
+		}
+	}
+}
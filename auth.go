@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// authProvider adds credentials to push request. Providers are chained, and
+// applied to each request in order, so signing providers should be the last
+type authProvider interface {
+	auth(req *http.Request, body []byte) error
+}
+
+// newAuthChain returns basic auth for --loki-user, Bearer token of
+// --loki-bearer-token-file or OAuth2, followed by providers of --loki-auth specs.
+// OAuth2 tokens are requested with the transport, which has TLS config of Loki
+func newAuthChain(opts Options, transport http.RoundTripper) ([]authProvider, error) {
+	var chain []authProvider
+	if opts.LokiUser != "" && opts.LokiPassword != "" {
+		chain = append(chain, basicAuth{opts.LokiUser, opts.LokiPassword})
+	}
+	if opts.LokiBearerTokenFile != "" {
+		a := &bearerAuth{file: opts.LokiBearerTokenFile}
+		if _, err := a.token(); err != nil {
+			return nil, fmt.Errorf("failed to read --loki-bearer-token-file: %w", err)
+		}
+		chain = append(chain, a)
+	}
+	if opts.LokiOAuth2TokenURL != "" {
+		secret, err := os.ReadFile(opts.LokiOAuth2Secret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --loki-oauth2-client-secret-file: %w", err)
+		}
+		cfg := clientcredentials.Config{
+			ClientID:     opts.LokiOAuth2ClientID,
+			ClientSecret: strings.TrimSpace(string(secret)),
+			TokenURL:     opts.LokiOAuth2TokenURL,
+			Scopes:       opts.LokiOAuth2Scopes,
+		}
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport, Timeout: 30 * time.Second})
+		chain = append(chain, oauth2Auth{cfg.TokenSource(ctx)})
+	}
+	for _, spec := range opts.LokiAuth {
+		p, err := newAuthProvider(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --loki-auth %q: %w", spec, err)
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+// newAuthProvider parses spec like `header:X-Scope-OrgID=tenant`,
+// `hmac:X-Signature=/path/to/secret` or `sigv4:execute-api/eu-west-1`
+func newAuthProvider(spec string) (authProvider, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "header":
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("should be header:<name>=<value>")
+		}
+		return headerAuth{name, value}, nil
+	case "hmac":
+		name, file, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || file == "" {
+			return nil, fmt.Errorf("should be hmac:<header>=<secret-file>")
+		}
+		secret, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return hmacAuth{name, []byte(strings.TrimSpace(string(secret)))}, nil
+	case "sigv4":
+		service, region, ok := strings.Cut(arg, "/")
+		if !ok || service == "" || region == "" {
+			return nil, fmt.Errorf("should be sigv4:<service>/<region>")
+		}
+		cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
+		if err != nil {
+			return nil, err
+		}
+		return sigv4Auth{v4.NewSigner(), cfg.Credentials, service, region}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %s (header, hmac, sigv4)", kind)
+}
+
+type basicAuth struct {
+	user, password string
+}
+
+func (a basicAuth) auth(req *http.Request, _ []byte) error {
+	req.SetBasicAuth(a.user, a.password)
+	return nil
+}
+
+// bearerAuth sets Authorization header to token read from the file, which is
+// read again when its modification time changes, like of projected tokens
+type bearerAuth struct {
+	file  string
+	mu    sync.Mutex
+	value string
+	mtime time.Time
+}
+
+func (a *bearerAuth) token() (string, error) {
+	st, err := os.Stat(a.file)
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if st.ModTime().Equal(a.mtime) {
+		return a.value, nil
+	}
+	b, err := os.ReadFile(a.file)
+	if err != nil {
+		return "", err
+	}
+	a.value, a.mtime = strings.TrimSpace(string(b)), st.ModTime()
+	return a.value, nil
+}
+
+func (a *bearerAuth) auth(req *http.Request, _ []byte) error {
+	token, err := a.token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// oauth2Auth sets Authorization header to token of OAuth2 client credentials
+// flow, which is cached and refreshed before it expires
+type oauth2Auth struct {
+	src oauth2.TokenSource
+}
+
+func (a oauth2Auth) auth(req *http.Request, _ []byte) error {
+	token, err := a.src.Token()
+	if err != nil {
+		return err
+	}
+	token.SetAuthHeader(req)
+	return nil
+}
+
+// headerAuth sets static header, like API key of a gateway
+type headerAuth struct {
+	name, value string
+}
+
+func (a headerAuth) auth(req *http.Request, _ []byte) error {
+	req.Header.Set(a.name, a.value)
+	return nil
+}
+
+// hmacAuth sets header to hex HMAC-SHA256 of the request body
+type hmacAuth struct {
+	name   string
+	secret []byte
+}
+
+func (a hmacAuth) auth(req *http.Request, body []byte) error {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(body)
+	req.Header.Set(a.name, hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// sigv4Auth signs request with AWS credentials, for Loki behind API Gateway
+// or other IAM authenticated endpoint
+type sigv4Auth struct {
+	signer  *v4.Signer
+	creds   aws.CredentialsProvider
+	service string
+	region  string
+}
+
+func (a sigv4Auth) auth(req *http.Request, body []byte) error {
+	creds, err := a.creds.Retrieve(req.Context())
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	return a.signer.SignHTTP(req.Context(), creds, req, hex.EncodeToString(sum[:]), a.service, a.region, time.Now())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthChain(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := newAuthChain(Options{
+		LokiUser:     "user",
+		LokiPassword: "pass",
+		LokiAuth:     []string{"header:X-Scope-OrgID=tenant", "hmac:X-Signature=" + secret},
+	}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("body")
+	req, _ := http.NewRequest("POST", "http://loki", nil)
+	for _, a := range chain {
+		if err = a.auth(req, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(body)
+	if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+		t.Errorf("basic auth = %s:%s", user, pass)
+	}
+	if got := req.Header.Get("X-Scope-OrgID"); got != "tenant" {
+		t.Errorf("X-Scope-OrgID = %q, want tenant", got)
+	}
+	if got, want := req.Header.Get("X-Signature"), hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("X-Signature = %q, want %q", got, want)
+	}
+
+	for _, spec := range []string{"header:", "hmac:X-Signature", "sigv4:execute-api", "token:abc"} {
+		if _, err = newAuthProvider(spec); err == nil {
+			t.Errorf("newAuthProvider(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := newAuthChain(Options{LokiBearerTokenFile: file}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "http://loki", nil)
+	if err = chain[0].auth(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("Authorization = %q, want Bearer abc", got)
+	}
+
+	// rotated token
+	if err = os.WriteFile(file, []byte("def"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(file, time.Time{}, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = chain[0].auth(req, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer def" {
+		t.Errorf("Authorization after rotation = %q, want Bearer def", got)
+	}
+
+	if _, err = newAuthChain(Options{LokiBearerTokenFile: file + ".missing"}, http.DefaultTransport); err == nil {
+		t.Error("newAuthChain() of missing token file error = nil")
+	}
+}
+
+func TestOAuth2Auth(t *testing.T) {
+	var issued int
+	// token endpoint with self-signed certificate, trusted by the transport only
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "shipper" || pass != "s3cr3t" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "logs:write" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		issued++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, issued)
+	}))
+	defer srv.Close()
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cr3t\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := newAuthChain(Options{LokiOAuth2TokenURL: srv.URL, LokiOAuth2ClientID: "shipper", LokiOAuth2Secret: secret, LokiOAuth2Scopes: []string{"logs:write"}}, srv.Client().Transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		req, _ := http.NewRequest("POST", "http://loki", nil)
+		if err = chain[0].auth(req, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := req.Header.Get("Authorization"); got != "Bearer token-1" {
+			t.Errorf("Authorization = %q, want cached Bearer token-1", got)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of pushing while Loki is considered down
+var errCircuitOpen = errors.New("loki circuit breaker is open")
+
+// breaker stops pushes to Loki after consecutive failed sends (each already
+// retried with backoff), so workers don't spend minutes per batch during an
+// outage. After cooldown the next push is a probe, and its failure opens the
+// circuit again
+type breaker struct {
+	after    int
+	cooldown time.Duration
+	mu       sync.Mutex
+	failures int
+	until    time.Time
+}
+
+func newBreaker(after int, cooldown time.Duration) *breaker {
+	b := &breaker{after: after, cooldown: cooldown}
+	newGaugeFunc("alb_logs_shipper_loki_circuit_open", "Whether pushes to Loki are stopped after --loki-breaker-after consecutive failures", func() float64 {
+		if b.isOpen() {
+			return 1
+		}
+		return 0
+	})
+	return b
+}
+
+// isOpen returns true while pushes should not be tried
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.until)
+}
+
+// done records result of a send, returns true when the circuit gets opened
+func (b *breaker) done(failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < b.after {
+		return false
+	}
+	b.until = time.Now().Add(b.cooldown)
+	return true
+}
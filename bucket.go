@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// checkBucket verifies on start that --bucket-name is owned by
+// --expected-bucket-owner, and warns when its policy allows public access, as
+// anyone could write files to be shipped to such bucket
+func checkBucket(ctx context.Context, client *s3.Client, opts Options, logger *slog.Logger) error {
+	if opts.BucketOwner != "" {
+		if _, err := client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &opts.BucketName, ExpectedBucketOwner: &opts.BucketOwner}); err != nil {
+			return fmt.Errorf("bucket %s is not owned by --expected-bucket-owner %s: %w", opts.BucketName, opts.BucketOwner, err)
+		}
+	}
+	out, err := client.GetBucketPolicyStatus(ctx, &s3.GetBucketPolicyStatusInput{Bucket: &opts.BucketName, ExpectedBucketOwner: &opts.BucketOwner})
+	var apiErr smithy.APIError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchBucketPolicy":
+	case err != nil:
+		logger.Warn("failed to check bucket policy status, s3:GetBucketPolicyStatus is required", "bucket", opts.BucketName, "err", err)
+	case out.PolicyStatus != nil && out.PolicyStatus.IsPublic != nil && *out.PolicyStatus.IsPublic:
+		logger.Warn("bucket policy allows public access, files written by anyone would be shipped", "bucket", opts.BucketName)
+	}
+	return nil
+}
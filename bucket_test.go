@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestCheckBucket(t *testing.T) {
+	const owner = "123456789012"
+	public := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Amz-Expected-Bucket-Owner"); got != "" && got != owner {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if _, ok := r.URL.Query()["policyStatus"]; ok {
+			fmt.Fprintf(w, `<PolicyStatus><IsPublic>%v</IsPublic></PolicyStatus>`, public)
+		}
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), UsePathStyle: true, Credentials: aws.AnonymousCredentials{}})
+
+	tests := []struct {
+		name   string
+		owner  string
+		public bool
+		err    bool
+		warn   bool
+	}{
+		{"owner", owner, false, false, false},
+		{"no owner", "", false, false, false},
+		{"other owner", "999999999999", false, true, false},
+		{"public", owner, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			public = tt.public
+			var logs bytes.Buffer
+			err := checkBucket(context.Background(), client, Options{BucketName: "alb-logs", BucketOwner: tt.owner}, slog.New(slog.NewTextHandler(&logs, nil)))
+			if (err != nil) != tt.err {
+				t.Errorf("checkBucket() error = %v, want error %v", err, tt.err)
+			}
+			if got := strings.Contains(logs.String(), "allows public access"); got != tt.warn {
+				t.Errorf("checkBucket() logs = %s, want warning %v", logs.String(), tt.warn)
+			}
+		})
+	}
+}
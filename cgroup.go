@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// cpuQuota returns container CPU limit from cgroup v2 or v1, 0 when unlimited
+func cpuQuota() float64 {
+	// cgroup v2: "max 100000" or "200000 100000"
+	if b, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		f := strings.Fields(string(b))
+		if len(f) == 2 && f[0] != "max" {
+			return ratio(f[0], f[1])
+		}
+		return 0
+	}
+	// cgroup v1: quota is -1 when unlimited
+	quota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return ratio(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func ratio(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
+
+// setMaxProcs sizes GOMAXPROCS to container CPU limit (rounded up), unless
+// GOMAXPROCS env is set explicitly. Returns the resulting value
+func setMaxProcs() int {
+	if _, ok := os.LookupEnv("GOMAXPROCS"); !ok {
+		if quota := cpuQuota(); quota > 0 {
+			procs := max(int(math.Ceil(quota)), 1)
+			if procs < runtime.NumCPU() {
+				runtime.GOMAXPROCS(procs)
+			}
+		}
+	}
+	return runtime.GOMAXPROCS(0)
+}
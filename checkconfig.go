@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqstypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/spf13/pflag"
+)
+
+// runCheckConfig validates options the same way as the shipper does on start,
+// and prints the effective configuration. With --probe it also checks access
+// to the bucket, Loki and --role-arn roles. Returns exit code
+func runCheckConfig(args []string) int {
+	fs := pflag.NewFlagSet("check-config", pflag.ContinueOnError)
+	probe := fs.BoolP("probe", "", false, "Check access to S3 bucket, Loki and --role-arn roles")
+	opts, err := parseOptions(fs, args)
+	if err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if _, err = newLabelTemplates(opts.TagLabels, opts.Labels); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid label template:", err)
+		return 1
+	}
+	if _, err = newTransformers(opts.Transforms); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if opts.SSECKeyFile != "" {
+		if _, err = newSSECustomerKey(opts.SSECKeyFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	client, err := newLokiClient(opts, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	elbMeta, err := NewELBMeta(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid ALB metadata options:", err)
+		return 1
+	}
+
+	if err = printConfig(os.Stdout, opts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !*probe {
+		return 0
+	}
+
+	code := 0
+	for _, c := range probes(opts, elbMeta, client) {
+		if err := c.check(context.TODO()); err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", c.name, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "OK   %s\n", c.name)
+	}
+	return code
+}
+
+// printConfig writes options as JSON, with durations as strings and secrets masked
+func printConfig(w io.Writer, opts Options) error {
+	if opts.LokiPassword != "" {
+		opts.LokiPassword = "<secret>"
+	}
+	opts.LokiAuth = maskAuth(opts.LokiAuth)
+	opts.RemoteWriteAuth = maskAuth(opts.RemoteWriteAuth)
+	for _, u := range []*string{&opts.LokiURL, &opts.OTLPEndpoint, &opts.OpenSearchURL, &opts.RemoteWriteURL, &opts.PushgatewayURL, &opts.AnomalyWebhook, &opts.LokiOAuth2TokenURL} {
+		*u = stripUserinfo(*u)
+	}
+	res := make(map[string]any)
+	v := reflect.ValueOf(opts)
+	for i := range v.NumField() {
+		f := v.Field(i)
+		if d, ok := f.Interface().(time.Duration); ok {
+			res[v.Type().Field(i).Name] = d.String()
+			continue
+		}
+		res[v.Type().Field(i).Name] = f.Interface()
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(res)
+}
+
+// maskAuth returns copy of --loki-auth specs with values of headers masked
+func maskAuth(specs []string) []string {
+	res := make([]string, len(specs))
+	for i, spec := range specs {
+		if name, _, ok := strings.Cut(spec, "="); ok && strings.HasPrefix(spec, "header:") {
+			spec = name + "=<secret>"
+		}
+		res[i] = spec
+	}
+	return res
+}
+
+// stripUserinfo returns URL without user and password
+func stripUserinfo(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
+
+type probe struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// probes returns access checks of the configured endpoints
+func probes(opts Options, elbMeta *ELBMeta, client *lokiClient) []probe {
+	res := []probe{
+		{"s3 " + opts.BucketName, func(ctx context.Context) error {
+			cfg, err := config.LoadDefaultConfig(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = s3.NewFromConfig(cfg).ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+				Bucket:              &opts.BucketName,
+				Prefix:              &opts.Prefix,
+				MaxKeys:             aws.Int32(1),
+				ExpectedBucketOwner: &opts.BucketOwner,
+			})
+			return err
+		}},
+		{opts.Output + " " + client.LokiURL, func(ctx context.Context) error {
+			// empty push request is accepted by Loki without writing anything
+			b := newBatch(nil, client)
+			encoding := b.client.encoding()
+			buf, err := b.encode(encoding)
+			if err != nil {
+				return err
+			}
+			_, err = b.client.req(buf, encoding, b.tenant, pushID(buf))
+			return err
+		}},
+	}
+	if opts.SQSQueueURL != "" {
+		res = append(res, probe{"sqs " + opts.SQSQueueURL, func(ctx context.Context) error {
+			cfg, err := config.LoadDefaultConfig(ctx)
+			if err != nil {
+				return err
+			}
+			_, err = sqs.NewFromConfig(cfg).GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+				QueueUrl:       &opts.SQSQueueURL,
+				AttributeNames: []sqstypes.QueueAttributeName{sqstypes.QueueAttributeNameApproximateNumberOfMessages},
+			})
+			return err
+		}})
+	}
+	for _, accountID := range sortedKeys(opts.Roles) {
+		res = append(res, probe{"role " + opts.Roles[accountID], func(ctx context.Context) error {
+			cfg, err := elbMeta.config(accountID)
+			if err != nil {
+				return err
+			}
+			_, err = sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+			return err
+		}})
+	}
+	return res
+}
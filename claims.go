@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// tableClaims claims files in DynamoDB table of --claim-table with conditional
+// writes, so multiple replicas listing the same bucket don't ship a file twice.
+// Items are keyed by `key` (string) of the S3 key, with `owner` replica ID and
+// `expires` unix time, which could be used as TTL attribute of the table
+type tableClaims struct {
+	client *dynamodb.Client
+	table  string
+	owner  string
+	ttl    time.Duration
+}
+
+func newTableClaims(client *dynamodb.Client, table, owner string, ttl time.Duration) *tableClaims {
+	return &tableClaims{client: client, table: table, owner: owner, ttl: ttl}
+}
+
+// claim writes item of the key unless it is claimed by another replica and
+// not expired yet. Returns false when the key is claimed by another replica
+func (c *tableClaims) claim(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	_, err := c.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &c.table,
+		Item: map[string]types.AttributeValue{
+			"key":     &types.AttributeValueMemberS{Value: key},
+			"owner":   &types.AttributeValueMemberS{Value: c.owner},
+			"expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(c.ttl).Unix(), 10)},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#key) OR #owner = :owner OR #expires < :now"),
+		ExpressionAttributeNames: map[string]string{"#key": "key", "#owner": "owner", "#expires": "expires"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: c.owner},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release deletes own claim of the key, so the file which failed to ship
+// could be retried by other replicas without waiting for the claim to expire
+func (c *tableClaims) release(ctx context.Context, key string) error {
+	_, err := c.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                &c.table,
+		Key:                      map[string]types.AttributeValue{"key": &types.AttributeValueMemberS{Value: key}},
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: c.owner},
+		},
+	})
+	var conflict *types.ConditionalCheckFailedException
+	if errors.As(err, &conflict) {
+		return nil
+	}
+	return err
+}
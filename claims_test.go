@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+type claimItem struct {
+	owner   string
+	expires int64
+}
+
+// claimsTable returns client of fake DynamoDB table of claims by key, which
+// evaluates conditions of tableClaims
+func claimsTable(t *testing.T) (*dynamodb.Client, map[string]claimItem) {
+	var mu sync.Mutex
+	items := map[string]claimItem{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var req struct {
+			Item                      map[string]map[string]string
+			Key                       map[string]map[string]string
+			ExpressionAttributeValues map[string]map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		owner := req.ExpressionAttributeValues[":owner"]["S"]
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."); op {
+		case "PutItem":
+			key := req.Item["key"]["S"]
+			now, _ := strconv.ParseInt(req.ExpressionAttributeValues[":now"]["N"], 10, 64)
+			if cur, ok := items[key]; ok && cur.owner != owner && cur.expires >= now {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`)
+				return
+			}
+			expires, _ := strconv.ParseInt(req.Item["expires"]["N"], 10, 64)
+			items[key] = claimItem{owner: req.Item["owner"]["S"], expires: expires}
+		case "DeleteItem":
+			key := req.Key["key"]["S"]
+			if cur, ok := items[key]; ok && cur.owner != owner {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`)
+				return
+			}
+			delete(items, key)
+		default:
+			t.Errorf("unexpected operation %s", op)
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	t.Cleanup(srv.Close)
+	return dynamodb.New(dynamodb.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), Credentials: aws.AnonymousCredentials{}}), items
+}
+
+func TestTableClaims(t *testing.T) {
+	client, items := claimsTable(t)
+	a := newTableClaims(client, "claims", "replica-a", time.Hour)
+	b := newTableClaims(client, "claims", "replica-b", time.Hour)
+	ctx := context.Background()
+
+	check := func(c *tableClaims, want bool) {
+		t.Helper()
+		ok, err := c.claim(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("claim() of %s = %v, want %v", c.owner, ok, want)
+		}
+	}
+	check(a, true)
+	check(a, true) // retry of own claim
+	check(b, false)
+	if err := b.release(ctx, "key"); err != nil {
+		t.Errorf("release() of other's claim error = %v", err)
+	}
+	check(b, false)
+	if err := a.release(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	check(b, true)
+
+	items["key"] = claimItem{owner: "replica-b", expires: time.Now().Add(-time.Minute).Unix()}
+	check(a, true) // expired claim
+}
+
+func TestProcess_releaseClaim(t *testing.T) {
+	client, items := claimsTable(t)
+	j, err := openJournal(filepath.Join(t.TempDir(), "journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.file.Close() // intents fail to be written
+	s := &Parser{
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		retries: newRetryQueue(time.Minute, 3),
+		parking: newParking(0, 0),
+		journal: j,
+		claims:  newTableClaims(client, "claims", "replica-a", time.Hour),
+		status:  newStatus(1, 0),
+	}
+	const key = "AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz"
+	if s.process(t.Context(), queueItem{key: key, enqueued: time.Now()}) {
+		t.Fatal("process() with failing journal = true")
+	}
+	if _, ok := items[key]; ok {
+		t.Error("claim of not shipped file is not released")
+	}
+}
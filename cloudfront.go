@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+var (
+	// source:  https://docs.aws.amazon.com/AmazonCloudFront/latest/DeveloperGuide/standard-logs-reference.html
+	// format:  bucket[/prefix]/distribution-ID.YYYY-MM-DD-HH.unique-ID.gz
+	// example: my-bucket/cloudfront/E2QWRUHAPOMQZL.2019-12-04-21.d111111a.gz
+	cfFnRegex = regexp.MustCompile(`(?:^|\/)(?P<id>E[A-Z0-9]+)\.(?P<year>\d{4})-(?P<month>\d{2})-(?P<day>\d{2})-(?P<hour>\d{2})\.[a-zA-Z0-9]+\.gz$`)
+	// names of #Fields header, with `-` and `()` replaced by `_`
+	cfFields = []string{"date", "time", "x_edge_location", "sc_bytes", "c_ip", "cs_method", "cs_host", "cs_uri_stem", "sc_status", "cs_referer", "cs_user_agent", "cs_uri_query", "cs_cookie", "x_edge_result_type", "x_edge_request_id", "x_host_header", "cs_protocol", "cs_bytes", "time_taken", "x_forwarded_for", "ssl_protocol", "ssl_cipher", "x_edge_response_result_type", "cs_protocol_version", "fle_status", "fle_encrypted_fields", "c_port", "time_to_first_byte", "x_edge_detailed_result_type", "sc_content_type", "sc_content_len", "sc_range_start", "sc_range_end"}
+	// fields written to logs since 2019 are optional, older lines end at fle_encrypted_fields
+	cfMinFields = slices.Index(cfFields, "c_port")
+	cfFormat    = &otherFormat{
+		fields: cfFields,
+		skip: map[string]bool{
+			"fle_status":           true, // field-level encryption is rarely used
+			"fle_encrypted_fields": true,
+		},
+		number: map[string]bool{
+			"sc_bytes":           true,
+			"sc_status":          true,
+			"cs_bytes":           true,
+			"time_taken":         true,
+			"c_port":             true,
+			"time_to_first_byte": true,
+			"sc_content_len":     true,
+			"sc_range_start":     true,
+			"sc_range_end":       true,
+		},
+		timestamp: cfTime,
+	}
+)
+
+// LineCloudFront parses CloudFront standard log lines, which are tab
+// separated and URL encoded. Field options are applied by cfFields names
+type LineCloudFront struct{ FieldOptions }
+
+var _ LineParser = &LineCloudFront{}
+
+// As parses CloudFront log line and converts it to the specified format
+func (r *LineCloudFront) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields splits CloudFront log line to values of cfFields. Missing optional
+// fields are set to `-`, and trailing unknown fields are kept as one value
+func (r *LineCloudFront) Fields(line string) ([]string, error) {
+	matches := strings.SplitN(line, "\t", len(cfFields)+1)
+	if len(matches) < cfMinFields {
+		return nil, fmt.Errorf("failed to parse CloudFront log line, %d fields: %s", len(matches), line)
+	}
+	for len(matches) < len(cfFields) {
+		matches = append(matches, "-")
+	}
+	return matches, nil
+}
+
+// LineAs converts fields of CloudFront log line to the specified format
+func (r *LineCloudFront) LineAs(format, line string, matches []string) (logproto.Entry, error) {
+	buf, entry, err := r.AppendLine(make([]byte, 0, 1024), format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(buf), len(buf))
+	return entry, nil
+}
+
+// AppendLine appends fields of CloudFront log line in the specified format to dst
+func (r *LineCloudFront) AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error) {
+	return r.appendOther(dst, format, line, matches, cfFormat)
+}
+
+// cfTime parses UTC date and time fields of CloudFront log line
+func cfTime(matches []string) (time.Time, error) {
+	return time.Parse("2006-01-02 15:04:05", matches[0]+" "+matches[1])
+}
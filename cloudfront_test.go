@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineCloudFront_As(t *testing.T) {
+	in := strings.Join([]string{"2019-12-04", "21:02:31", "LAX1-C3", "392", "192.0.2.100", "GET", "d111111abcdef8.cloudfront.net", "/index.html", "200", "-", "Mozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64)", "-", "-", "Hit", "SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==", "d111111abcdef8.cloudfront.net", "https", "23", "0.001", "-", "TLSv1.2", "ECDHE-RSA-AES128-GCM-SHA256", "Hit", "HTTP/2.0", "-", "-", "11040", "0.001", "Hit", "text/html", "78", "-", "-"}, "\t")
+	tests := []struct {
+		name   string
+		format string
+		line   string
+		opts   FieldOptions
+		out    string
+	}{
+		{
+			name:   "logfmt",
+			format: "logfmt",
+			line:   in,
+			out:    `date=2019-12-04 time=21:02:31 x_edge_location=LAX1-C3 sc_bytes=392 c_ip=192.0.2.100 cs_method=GET cs_host=d111111abcdef8.cloudfront.net cs_uri_stem=/index.html sc_status=200 cs_referer=- cs_user_agent=Mozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64) cs_uri_query=- cs_cookie=- x_edge_result_type=Hit x_edge_request_id=SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ== x_host_header=d111111abcdef8.cloudfront.net cs_protocol=https cs_bytes=23 time_taken=0.001 x_forwarded_for=- ssl_protocol=TLSv1.2 ssl_cipher=ECDHE-RSA-AES128-GCM-SHA256 x_edge_response_result_type=Hit cs_protocol_version=HTTP/2.0 c_port=11040 time_to_first_byte=0.001 x_edge_detailed_result_type=Hit sc_content_type=text/html sc_content_len=78 sc_range_start=- sc_range_end=-`,
+		},
+		{
+			name:   "json of line without optional fields",
+			format: "json",
+			line:   strings.Join(strings.Split(in, "\t")[:26], "\t"),
+			opts:   FieldOptions{Transformers: []Transformer{dropField("cs_cookie")}},
+			out:    `{"date":"2019-12-04","time":"21:02:31","x_edge_location":"LAX1-C3","sc_bytes":392,"c_ip":"192.0.2.100","cs_method":"GET","cs_host":"d111111abcdef8.cloudfront.net","cs_uri_stem":"/index.html","sc_status":200,"cs_referer":"-","cs_user_agent":"Mozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64)","cs_uri_query":"-","x_edge_result_type":"Hit","x_edge_request_id":"SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==","x_host_header":"d111111abcdef8.cloudfront.net","cs_protocol":"https","cs_bytes":23,"time_taken":0.001,"x_forwarded_for":"-","ssl_protocol":"TLSv1.2","ssl_cipher":"ECDHE-RSA-AES128-GCM-SHA256","x_edge_response_result_type":"Hit","cs_protocol_version":"HTTP/2.0","c_port":"-","time_to_first_byte":"-","x_edge_detailed_result_type":"-","sc_content_type":"-","sc_content_len":"-","sc_range_start":"-","sc_range_end":"-"}`,
+		},
+		{
+			name:   "extra",
+			format: "logfmt",
+			line:   in + "\tnew",
+			opts:   FieldOptions{Extra: "extra", Transformers: []Transformer{dropField("cs_user_agent"), dropField("x_edge_request_id")}},
+			out:    `date=2019-12-04 time=21:02:31 x_edge_location=LAX1-C3 sc_bytes=392 c_ip=192.0.2.100 cs_method=GET cs_host=d111111abcdef8.cloudfront.net cs_uri_stem=/index.html sc_status=200 cs_referer=- cs_uri_query=- cs_cookie=- x_edge_result_type=Hit x_host_header=d111111abcdef8.cloudfront.net cs_protocol=https cs_bytes=23 time_taken=0.001 x_forwarded_for=- ssl_protocol=TLSv1.2 ssl_cipher=ECDHE-RSA-AES128-GCM-SHA256 x_edge_response_result_type=Hit cs_protocol_version=HTTP/2.0 c_port=11040 time_to_first_byte=0.001 x_edge_detailed_result_type=Hit sc_content_type=text/html sc_content_len=78 sc_range_start=- sc_range_end=- extra="{\"fle_status\":\"-\",\"fle_encrypted_fields\":\"-\",\"unknown\":\"new\"}"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := (&LineCloudFront{tt.opts}).As(tt.format, tt.line)
+			if err != nil {
+				t.Fatalf("LineCloudFront.As() error = %v", err)
+			}
+			if want := time.Date(2019, 12, 4, 21, 2, 31, 0, time.UTC); !entry.Timestamp.Equal(want) {
+				t.Errorf("LineCloudFront.As() ts = %v, want %v", entry.Timestamp, want)
+			}
+			if entry.Line != tt.out {
+				t.Errorf("LineCloudFront.As() out:\n%v\nwant:\n%v", entry.Line, tt.out)
+			}
+			if tt.format == "json" && !json.Valid([]byte(entry.Line)) {
+				t.Errorf("LineCloudFront.As() out is not valid JSON")
+			}
+		})
+	}
+
+	if _, err := (&LineCloudFront{}).As("logfmt", "2019-12-04\t21:02:31\tLAX1-C3"); err == nil {
+		t.Errorf("LineCloudFront.As() of truncated line error = nil")
+	}
+}
+
+func TestCfFnRegex(t *testing.T) {
+	tests := map[string]string{
+		"cloudfront/E2QWRUHAPOMQZL.2019-12-04-21.d111111a.gz": "E2QWRUHAPOMQZL",
+		"E2QWRUHAPOMQZL.2019-12-04-21.d111111a.gz":            "E2QWRUHAPOMQZL",
+		"cloudfront/E2QWRUHAPOMQZL.2019-12-04-21.d111111a":    "",
+		"AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz": "",
+	}
+	for key, want := range tests {
+		var got string
+		if matches := cfFnRegex.FindStringSubmatch(key); matches != nil {
+			got = matches[cfFnRegex.SubexpIndex("id")]
+		}
+		if got != want {
+			t.Errorf("distribution of %q = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+var configReloads = newCounter("alb_logs_shipper_config_reloads_total", "Reloads of --config on SIGHUP by result (success, failure)", "result")
+
+// loadConfig sets flags from YAML file of --config, which keys are flag names.
+// Values could be scalars, lists for flags which can be specified multiple
+// times, or maps for key=value ones, like:
+//
+//	bucket-name: alb-logs
+//	label:
+//	  cluster: prod
+//	transform:
+//	  - drop:user_agent
+//
+// Flags set in args take precedence over the file
+func loadConfig(fs *pflag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+	var cfg map[string]any
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("unknown option %q in config %s", name, path)
+		}
+		if f.Changed {
+			continue
+		}
+		values, err := configValues(cfg[name])
+		if err != nil {
+			return fmt.Errorf("invalid option %q in config %s: %w", name, path, err)
+		}
+		for _, v := range values {
+			if err = fs.Set(name, v); err != nil {
+				return fmt.Errorf("invalid option %q in config %s: %w", name, path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValues returns flag values of the YAML value
+func configValues(v any) ([]string, error) {
+	var res []string
+	switch v := v.(type) {
+	case nil:
+	case []any:
+		for _, item := range v {
+			if !scalar(item) {
+				return nil, fmt.Errorf("nested value in list")
+			}
+			res = append(res, fmt.Sprint(item))
+		}
+	case map[string]any:
+		for k, item := range v {
+			if !scalar(item) {
+				return nil, fmt.Errorf("nested value of %s", k)
+			}
+			res = append(res, k+"="+fmt.Sprint(item))
+		}
+		slices.Sort(res)
+	default:
+		res = append(res, fmt.Sprint(v))
+	}
+	return res, nil
+}
+
+func scalar(v any) bool {
+	switch v.(type) {
+	case []any, map[string]any:
+		return false
+	}
+	return true
+}
+
+// renderLabels returns stream labels of the metadata by current templates
+func (s *Parser) renderLabels(meta Meta) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.labels.render(meta)
+}
+
+// reloadableFlags are options applied by reload, others require restart. Tags
+// of --tag-label are fetched by ELB metadata cache of the ones set on start
+var reloadableFlags = []string{"label", "format-label", "transform", "shed-rule"}
+
+// reload applies labels, transforms and shed rules of the options, parsed
+// again with --config on SIGHUP. Other options require restart, so reload with
+// any of them changed is rejected, instead of silently ignoring them
+func (s *Parser) reload(opts Options) error {
+	var changed []string
+	for name, value := range opts.Flags {
+		if !slices.Contains(reloadableFlags, name) && value != s.opts.Flags[name] {
+			changed = append(changed, "--"+name)
+		}
+	}
+	if len(changed) > 0 {
+		slices.Sort(changed)
+		return fmt.Errorf("%s could not be changed without restart", strings.Join(changed, ", "))
+	}
+	if len(opts.ShedRules) > 0 && s.shed == nil {
+		return fmt.Errorf("--shed-rule requires restart, as --shed-queue was not set on start")
+	}
+	labels, err := newLabelTemplates(opts.TagLabels, opts.Labels)
+	if err != nil {
+		return err
+	}
+	if opts.FormatLabel != "" {
+		labels.set(opts.FormatLabel, opts.Format)
+	}
+	rules, err := newShedRules(opts.ShedRules)
+	if err != nil {
+		return err
+	}
+	transformers, err := newTransformers(opts.Transforms)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.labels = labels
+	s.mu.Unlock()
+	if s.chain != nil {
+		// processes of replaced exec transformers are stopped
+		closeTransformers(s.chain.store(transformers))
+	} else {
+		closeTransformers(transformers)
+	}
+	if s.shed != nil {
+		s.shed.setRules(rules)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `
+bucket-name: alb-logs
+loki-url: http://loki
+workers: 8
+sli: true
+label:
+  cluster: prod
+  env: "{{.Account}}"
+transform:
+  - drop:user_agent
+  - mask-ip:client
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	opts, err := parseOptions(fs, []string{"--config", path, "-n", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.BucketName != "alb-logs" || opts.LokiURL != "http://loki" || !opts.SLI {
+		t.Errorf("options of config = %+v", opts)
+	}
+	if opts.Workers != 2 {
+		t.Errorf("workers = %d, want 2 from args over config", opts.Workers)
+	}
+	if opts.Labels["cluster"] != "prod" || opts.Labels["env"] != "{{.Account}}" {
+		t.Errorf("labels = %v", opts.Labels)
+	}
+	if !slices.Equal(opts.Transforms, []string{"drop:user_agent", "mask-ip:client"}) {
+		t.Errorf("transforms = %v", opts.Transforms)
+	}
+
+	for _, config := range []string{"unknown-flag: 1", "workers: many", "label: [{cluster: prod}]", "bucket-name: ["} {
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		if _, err := parseOptions(fs, []string{"--config", path, "-H", "http://loki"}); err == nil {
+			t.Errorf("parseOptions() of config %q error = nil", config)
+		}
+	}
+}
+
+func TestParserReload(t *testing.T) {
+	labels, err := newLabelTemplates(nil, map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Parser{labels: labels, chain: newTransformChain(nil)}
+	fields := []Field{{Name: "client", Value: "192.168.131.39:2817"}, {Name: "user_agent", Value: `"curl/7.46.0"`, Quoted: true}}
+	if got := s.chain.Transform(slices.Clone(fields)); len(got) != 2 {
+		t.Fatalf("Transform() before reload = %v", got)
+	}
+
+	if err = s.reload(Options{Labels: map[string]string{"env": "staging"}, Transforms: []string{"drop:user_agent"}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.renderLabels(Meta{})
+	if err != nil || got["env"] != "staging" {
+		t.Errorf("renderLabels() after reload = %v, %v", got, err)
+	}
+	if got := s.chain.Transform(slices.Clone(fields)); len(got) != 1 || got[0].Name != "client" {
+		t.Errorf("Transform() after reload = %v", got)
+	}
+
+	if err = s.reload(Options{Transforms: []string{"unknown:field"}}); err == nil {
+		t.Error("reload() of invalid transform error = nil")
+	}
+	for _, opts := range []Options{{ShedRules: []string{"namespace=staging-*:2xx"}}, {Flags: map[string]string{"loki-tenant": "{{.namespace}}"}}} {
+		if err = s.reload(opts); err == nil {
+			t.Errorf("reload() of options requiring restart %+v error = nil", opts)
+		}
+	}
+	if got, _ := s.renderLabels(Meta{}); got["env"] != "staging" {
+		t.Errorf("labels after failed reload = %v", got)
+	}
+
+	if err = s.reload(Options{Transforms: []string{"exec:cat"}}); err != nil {
+		t.Fatal(err)
+	}
+	exec := (*s.chain.current.Load())[0].(execTransformer)
+	if got := s.chain.Transform(slices.Clone(fields)); len(got) != 2 || exec.p.cmd == nil {
+		t.Fatalf("Transform() by exec = %v", got)
+	}
+	if err = s.reload(Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if exec.p.cmd != nil || !exec.p.closed {
+		t.Error("replaced exec transformer is not closed")
+	}
+}
+
+func TestParserReload_restart(t *testing.T) {
+	parse := func(args ...string) Options {
+		fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		opts, err := parseOptions(fs, append([]string{"-b", "bucket", "-H", "http://loki"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return opts
+	}
+	s := &Parser{opts: parse("-o", "logfmt", "-l", "env=prod"), chain: newTransformChain(nil)}
+	if err := s.reload(parse("-o", "logfmt", "-l", "env=staging", "--transform", "drop:user_agent")); err != nil {
+		t.Errorf("reload() of labels and transforms error = %v", err)
+	}
+	err := s.reload(parse("-o", "json", "--workers", "8", "-l", "env=staging"))
+	if err == nil || err.Error() != "--format, --workers could not be changed without restart" {
+		t.Errorf("reload() of --format and --workers error = %v", err)
+	}
+}
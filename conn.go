@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/sepich/alb-logs-shipper/albparse"
+)
+
+var (
+	// source:  https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-connection-logs.html
+	// format:  bucket[/prefix]/AWSLogs/aws-account-id/elasticloadbalancing/region/yyyy/mm/dd/conn_log.aws-account-id_elasticloadbalancing_region_app.load-balancer-id_end-time_random-string.log.gz
+	connFnRegex = regexp.MustCompile(`(?:(?P<org>o-[a-z0-9]{10,32})\/)?AWSLogs\/(?:(?P<org_id>o-[a-z0-9]{10,32})\/)?(?P<account_id>\d+)\/elasticloadbalancing\/(?P<region>[\w-]+)\/(?P<year>\d+)\/(?P<month>\d+)\/(?P<day>\d+)\/conn_log\.\d+\_elasticloadbalancing_(?:\w+-\w+-(?:\w+-)?\d)_app\.(?P<id>[a-zA-Z0-9\-]+)\..+\.log\.gz`)
+	connFields  = []string{"timestamp", "client_ip", "client_port", "listener_port", "tls_protocol", "tls_cipher", "tls_handshake_latency", "leaf_client_cert_subject", "leaf_client_cert_validity", "leaf_client_cert_serial_number", "tls_verify_status", "conn_trace_id"}
+	connQuoted  = map[string]bool{"leaf_client_cert_subject": true}
+	connFormat  = &otherFormat{
+		fields:    connFields,
+		quoted:    connQuoted,
+		number:    map[string]bool{"client_port": true, "listener_port": true, "tls_handshake_latency": true},
+		timestamp: timeField(slices.Index(connFields, "timestamp")),
+	}
+	// connMTLSFields are added to access log entries with --mtls-fields
+	connMTLSFields = []string{"leaf_client_cert_subject", "leaf_client_cert_validity", "leaf_client_cert_serial_number", "tls_verify_status"}
+
+	connTraceIdx     = slices.Index(subexpNames, "conn_trace_id")
+	connTimestampIdx = slices.Index(connFields, "timestamp")
+	connLatencyIdx   = slices.Index(connFields, "tls_handshake_latency")
+	connConnTraceIdx = slices.Index(connFields, "conn_trace_id")
+	connMTLSIdx      = slices.Index(connFields, connMTLSFields[0])
+
+	correlations = newCounter("alb_logs_shipper_correlations_total", "Access log entries looked up in connection logs by conn_trace_id", "result")
+	evictedConns = newCounter("alb_logs_shipper_evicted_connections_total", "Connections dropped from --correlate-connections cache within the window, as it is over --correlate-max-connections")
+)
+
+// LineConn parses ALB connection log lines, shipped with --ship-connections.
+// Field options are applied by connection log field names
+type LineConn struct{ FieldOptions }
+
+var _ LineParser = &LineConn{}
+
+// As parses connection log line and converts it to the specified format
+func (r *LineConn) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields splits connection log line to values of connFields
+func (r *LineConn) Fields(line string) ([]string, error) {
+	matches, err := albparse.Tokenize(line, connFields, connQuoted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse connection log line %w: %s", err, line)
+	}
+	return matches, nil
+}
+
+// LineAs converts fields of connection log line to the specified format
+func (r *LineConn) LineAs(format, line string, matches []string) (logproto.Entry, error) {
+	buf, entry, err := r.AppendLine(make([]byte, 0, 1024), format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(buf), len(buf))
+	return entry, nil
+}
+
+// AppendLine appends fields of connection log line in the specified format to dst
+func (r *LineConn) AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error) {
+	return r.appendOther(dst, format, line, matches, connFormat)
+}
+
+// connInfo is a connection log entry to enrich access log entries with
+type connInfo struct {
+	handshakeLatency string
+	mtls             []string  // values of connMTLSFields, when enabled
+	ts               time.Time // of the connection log line
+}
+
+// connCache keeps connection log entries by conn_trace_id for a window of log
+// timestamps, in buckets per minute of the connection timestamp. Buckets older
+// than the window before the latest connection are dropped, and the oldest
+// ones are evicted when there are more than limit connections
+type connCache struct {
+	window time.Duration
+	limit  int
+	mtls   bool // keep connMTLSFields
+	mu     sync.RWMutex
+	data   map[int64]map[string]connInfo
+	size   int
+	latest time.Time            // of connection log lines read
+	seen   map[string]time.Time // connection log files already read
+}
+
+func newConnCache(window time.Duration, limit int, mtls bool) *connCache {
+	return &connCache{
+		window: window,
+		limit:  limit,
+		mtls:   mtls,
+		data:   make(map[int64]map[string]connInfo),
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Get returns connection info by conn_trace_id, if the connection is within
+// the window of ts of the access log entry
+func (c *connCache) Get(id string, ts time.Time) (connInfo, bool) {
+	var info connInfo
+	ok := false
+	c.mu.RLock()
+	for _, bucket := range c.data {
+		if info, ok = bucket[id]; ok {
+			break
+		}
+	}
+	c.mu.RUnlock()
+	if ok && (info.ts.Sub(ts) > c.window || ts.Sub(info.ts) > c.window) {
+		ok = false
+	}
+	if ok {
+		correlations.Inc("hit")
+	} else {
+		correlations.Inc("miss")
+	}
+	return info, ok
+}
+
+func (c *connCache) add(ids []string, infos []connInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, id := range ids {
+		minute := infos[i].ts.Unix() / 60
+		bucket, ok := c.data[minute]
+		if !ok {
+			bucket = make(map[string]connInfo)
+			c.data[minute] = bucket
+		}
+		if _, ok = bucket[id]; !ok {
+			c.size++
+		}
+		bucket[id] = infos[i]
+		if infos[i].ts.After(c.latest) {
+			c.latest = infos[i].ts
+		}
+	}
+	oldest := c.latest.Add(-c.window).Unix() / 60
+	for minute, bucket := range c.data {
+		if minute < oldest {
+			c.size -= len(bucket)
+			delete(c.data, minute)
+		}
+	}
+	for c.limit > 0 && c.size > c.limit && len(c.data) > 1 {
+		oldest = math.MaxInt64
+		for minute := range c.data {
+			oldest = min(oldest, minute)
+		}
+		evictedConns.Add(float64(len(c.data[oldest])))
+		c.size -= len(c.data[oldest])
+		delete(c.data, oldest)
+	}
+}
+
+// forget drops files read more than a day ago, which are listed again only
+// when --processed-action has failed for them
+func (c *connCache) forget() {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for fn, ts := range c.seen {
+		if now.Sub(ts) > 24*time.Hour {
+			delete(c.seen, fn)
+		}
+	}
+}
+
+// markSeen returns false if the file was already read
+func (c *connCache) markSeen(fn string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.seen[fn]; ok {
+		return false
+	}
+	c.seen[fn] = time.Now()
+	return true
+}
+
+// parse returns conn_trace_id and info of connection log line, or empty id
+// when the connection has no TLS handshake
+func (c *connCache) parse(line string) (string, connInfo, error) {
+	fields, err := albparse.Tokenize(line, connFields, connQuoted)
+	if err != nil {
+		return "", connInfo{}, err
+	}
+	if fields[connLatencyIdx] == "-" {
+		return "", connInfo{}, nil
+	}
+	ts, err := time.Parse(time.RFC3339, fields[connTimestampIdx])
+	if err != nil {
+		return "", connInfo{}, fmt.Errorf("invalid timestamp %w", err)
+	}
+	info := connInfo{handshakeLatency: fields[connLatencyIdx], ts: ts}
+	if c.mtls {
+		info.mtls = fields[connMTLSIdx : connMTLSIdx+len(connMTLSFields)]
+	}
+	return fields[connConnTraceIdx], info, nil
+}
+
+// readConnections loads connection log file to the cache
+func (s *Parser) readConnections(ctx context.Context, fn string) error {
+	if !s.conns.markSeen(fn) {
+		return nil
+	}
+	gzreader, err := s.open(ctx, fn)
+	if err != nil {
+		return err
+	}
+	defer gzreader.Close()
+
+	var ids []string
+	var infos []connInfo
+	scanner := bufio.NewScanner(gzreader)
+	for scanner.Scan() {
+		id, info, err := s.conns.parse(scanner.Text())
+		if err != nil {
+			s.logger.Debug("skipping invalid connection log line", "key", fn, "err", err)
+			continue
+		}
+		if id == "" {
+			continue
+		}
+		ids = append(ids, id)
+		infos = append(infos, info)
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to scan file %s: %w", fn, err)
+	}
+	s.conns.forget()
+	s.conns.add(ids, infos)
+	s.logger.Debug("read connection log", "key", fn, "connections", len(ids))
+	return nil
+}
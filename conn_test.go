@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLineConn_As(t *testing.T) {
+	in := `2023-12-04T18:45:52.456000Z 203.0.113.1 53466 443 TLSv1.2 ECDHE-RSA-AES128-GCM-SHA256 2 "CN=example.com,O=Example Corp" NotAfter=2024-12-04T18:45:52Z;NotBefore=2023-12-04T18:45:52Z FEF257C0AA8C4D13 Success TID_1ac8c2a4b9e0e5f6a7b8c9d0e1f2a3b4`
+	tests := []struct {
+		name   string
+		format string
+		opts   FieldOptions
+		out    string
+	}{
+		{
+			name:   "logfmt",
+			format: "logfmt",
+			out:    `timestamp=2023-12-04T18:45:52.456000Z client_ip=203.0.113.1 client_port=53466 listener_port=443 tls_protocol=TLSv1.2 tls_cipher=ECDHE-RSA-AES128-GCM-SHA256 tls_handshake_latency=2 leaf_client_cert_subject="CN=example.com,O=Example Corp" leaf_client_cert_validity=NotAfter=2024-12-04T18:45:52Z;NotBefore=2023-12-04T18:45:52Z leaf_client_cert_serial_number=FEF257C0AA8C4D13 tls_verify_status=Success conn_trace_id=TID_1ac8c2a4b9e0e5f6a7b8c9d0e1f2a3b4`,
+		},
+		{
+			name:   "json",
+			format: "json",
+			out:    `{"timestamp":"2023-12-04T18:45:52.456000Z","client_ip":"203.0.113.1","client_port":53466,"listener_port":443,"tls_protocol":"TLSv1.2","tls_cipher":"ECDHE-RSA-AES128-GCM-SHA256","tls_handshake_latency":2,"leaf_client_cert_subject":"CN=example.com,O=Example Corp","leaf_client_cert_validity":"NotAfter=2024-12-04T18:45:52Z;NotBefore=2023-12-04T18:45:52Z","leaf_client_cert_serial_number":"FEF257C0AA8C4D13","tls_verify_status":"Success","conn_trace_id":"TID_1ac8c2a4b9e0e5f6a7b8c9d0e1f2a3b4"}`,
+		},
+		{
+			name:   "transform",
+			format: "logfmt",
+			opts:   FieldOptions{Transformers: []Transformer{dropField("leaf_client_cert_validity")}},
+			out:    `timestamp=2023-12-04T18:45:52.456000Z client_ip=203.0.113.1 client_port=53466 listener_port=443 tls_protocol=TLSv1.2 tls_cipher=ECDHE-RSA-AES128-GCM-SHA256 tls_handshake_latency=2 leaf_client_cert_subject="CN=example.com,O=Example Corp" leaf_client_cert_serial_number=FEF257C0AA8C4D13 tls_verify_status=Success conn_trace_id=TID_1ac8c2a4b9e0e5f6a7b8c9d0e1f2a3b4`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := (&LineConn{tt.opts}).As(tt.format, in)
+			if err != nil {
+				t.Fatalf("LineConn.As() error = %v", err)
+			}
+			if want := time.Date(2023, 12, 4, 18, 45, 52, 456000000, time.UTC); !entry.Timestamp.Equal(want) {
+				t.Errorf("LineConn.As() ts = %v, want %v", entry.Timestamp, want)
+			}
+			if entry.Line != tt.out {
+				t.Errorf("LineConn.As() out:\n%v\nwant:\n%v", entry.Line, tt.out)
+			}
+			if tt.format == "json" && !json.Valid([]byte(entry.Line)) {
+				t.Errorf("LineConn.As() out is not valid JSON")
+			}
+		})
+	}
+
+	if _, err := (&LineConn{}).As("logfmt", "2023-12-04T18:45:52.456000Z 203.0.113.1 53466"); err == nil {
+		t.Errorf("LineConn.As() of truncated line error = nil")
+	}
+}
+
+func TestConnFnRegex(t *testing.T) {
+	const file = "123456789012/elasticloadbalancing/us-east-1/2023/12/04/conn_log.123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20231204T1845Z_0.0.0.0_2et2e1mx.log.gz"
+	tests := map[string]string{
+		"AWSLogs/" + file:              "",
+		"o-a1b2c3d4e5/AWSLogs/" + file: "o-a1b2c3d4e5",
+		"AWSLogs/o-a1b2c3d4e5/" + file: "o-a1b2c3d4e5",
+	}
+	for key, want := range tests {
+		matches := connFnRegex.FindStringSubmatch(key)
+		if len(matches) == 0 {
+			t.Errorf("connFnRegex does not match %q", key)
+			continue
+		}
+		if got := keyOrg(connFnRegex, matches); got != want {
+			t.Errorf("keyOrg(%q) = %q, want %q", key, got, want)
+		}
+		if got := matches[connFnRegex.SubexpIndex("id")]; got != "my-loadbalancer" {
+			t.Errorf("id of %q = %q", key, got)
+		}
+		if fnRegex.MatchString(key) {
+			t.Errorf("fnRegex matches connection log key %q", key)
+		}
+	}
+}
+
+func TestConnCache(t *testing.T) {
+	start := time.Date(2023, 12, 4, 18, 0, 0, 0, time.UTC)
+	c := newConnCache(10*time.Minute, 3, false)
+	c.add([]string{"TID_1", "TID_2"}, []connInfo{{handshakeLatency: "1", ts: start}, {handshakeLatency: "2", ts: start}})
+	c.add([]string{"TID_3"}, []connInfo{{handshakeLatency: "3", ts: start.Add(5 * time.Minute)}})
+	tests := []struct {
+		id   string
+		ts   time.Time
+		want bool
+	}{
+		{"TID_1", start.Add(time.Minute), true},
+		{"TID_1", start.Add(11 * time.Minute), false}, // out of window of the access entry
+		{"TID_3", start.Add(6 * time.Minute), true},
+		{"TID_4", start, false},
+	}
+	for _, tt := range tests {
+		if _, ok := c.Get(tt.id, tt.ts); ok != tt.want {
+			t.Errorf("Get(%s, %s) = %v, want %v", tt.id, tt.ts.Format(time.TimeOnly), ok, tt.want)
+		}
+	}
+
+	// the oldest minute is evicted over the limit
+	c.add([]string{"TID_4"}, []connInfo{{ts: start.Add(6 * time.Minute)}})
+	if _, ok := c.Get("TID_1", start); ok || c.size != 2 {
+		t.Errorf("Get(TID_1) after eviction = %v, size %d", ok, c.size)
+	}
+	// and minutes out of window of the latest connection are dropped
+	c.add([]string{"TID_5"}, []connInfo{{ts: start.Add(16 * time.Minute)}})
+	if _, ok := c.Get("TID_3", start.Add(6*time.Minute)); ok || c.size != 2 {
+		t.Errorf("Get(TID_3) after window = %v, size %d", ok, c.size)
+	}
+}
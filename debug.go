@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// labelsDebug is the result of resolving an S3 key to Loki stream
+type labelsDebug struct {
+	Key       string            `json:"key"`
+	AccountID string            `json:"account_id"`
+	ID        string            `json:"load_balancer_id"`
+	Metadata  Meta              `json:"metadata"`
+	Labels    map[string]string `json:"labels"`
+	Stream    string            `json:"stream"`
+	Tenant    string            `json:"tenant"`
+	URL       string            `json:"url"`
+	Parked    bool              `json:"parked"`
+}
+
+// debugLabels returns handler which resolves ALB metadata and stream labels
+// for S3 key from `key` query parameter, without reading or shipping the file
+func (s *Parser) debugLabels() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		matches := fnRegex.FindStringSubmatch(key)
+		if len(matches) == 0 {
+			http.Error(w, "key query parameter should be ALB access log file", http.StatusBadRequest)
+			return
+		}
+		res := labelsDebug{
+			Key:       key,
+			AccountID: matches[fnRegex.SubexpIndex("account_id")],
+			ID:        matches[fnRegex.SubexpIndex("id")],
+		}
+		var err error
+		if res.Metadata, err = s.elbMeta.Get(res.AccountID, res.ID); err != nil {
+			http.Error(w, "failed to get metadata: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		res.Metadata.Org, res.Metadata.Type = keyOrg(fnRegex, matches), matches[fnRegex.SubexpIndex("type")]
+		if res.Labels, err = s.renderLabels(res.Metadata); err != nil {
+			http.Error(w, "failed to render labels: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b := newBatch(res.Labels, s.loki)
+		if b.tenantErr != nil {
+			http.Error(w, b.tenantErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		res.Stream = b.stream.Labels
+		res.Tenant = b.client.tenant(b.tenant)
+		res.URL = b.client.LokiURL
+		res.Parked = s.parking.isParked(res.AccountID + "/" + res.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		_ = e.Encode(res)
+	})
+}
+
+// targetDebug is a known load balancer with its stream labels
+type targetDebug struct {
+	AccountID    string            `json:"account_id"`
+	Account      string            `json:"account,omitempty"`
+	LoadBalancer string            `json:"load_balancer"`
+	Cluster      string            `json:"cluster"`
+	Namespace    string            `json:"namespace"`
+	Ingress      string            `json:"ingress"`
+	Scheme       string            `json:"scheme,omitempty"`
+	IPType       string            `json:"ip_type,omitempty"`
+	Labels       map[string]string `json:"labels"`
+	Fetched      time.Time         `json:"fetched"`
+	AgeSeconds   float64           `json:"age_seconds"`
+}
+
+// debugTargets returns handler which lists all load balancers in metadata
+// cache with their stream labels and cache age, for external automation
+func (s *Parser) debugTargets() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res := []targetDebug{}
+		for _, meta := range s.elbMeta.All() {
+			labels, err := s.renderLabels(meta)
+			if err != nil {
+				http.Error(w, "failed to render labels: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res = append(res, targetDebug{
+				AccountID:    meta.AccountID,
+				Account:      meta.Account,
+				LoadBalancer: meta.LoadBalancer,
+				Cluster:      meta.Cluster,
+				Namespace:    meta.Namespace,
+				Ingress:      meta.Ingress,
+				Scheme:       meta.Scheme,
+				IPType:       meta.IPType,
+				Labels:       labels,
+				Fetched:      meta.Fetched,
+				AgeSeconds:   time.Since(meta.Fetched).Seconds(),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		_ = e.Encode(res)
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDebugLabels(t *testing.T) {
+	opts := Options{LokiURL: "http://loki/loki/api/v1/push", LokiUser: "tenant"}
+	e, err := NewELBMeta(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.data.Store("123456789012/my-loadbalancer", Meta{Cluster: "prod", Namespace: "shop", Ingress: "web", AccountID: "123456789012", LoadBalancer: "my-loadbalancer"})
+	labels, err := newLabelTemplates(nil, map[string]string{"env": "production"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loki, err := newLokiClient(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Parser{opts: opts, elbMeta: e, labels: labels, loki: loki, parking: newParking(3, time.Minute)}
+
+	key := "AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz"
+	rec := httptest.NewRecorder()
+	s.debugLabels().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/labels?key="+key, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	var got labelsDebug
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := `{cluster="prod", env="production", index="prod-shop", ingress="web", namespace="shop"}`
+	if got.Stream != want || got.Tenant != "tenant" || got.URL != opts.LokiURL {
+		t.Errorf("debugLabels() = %+v, want stream %s", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	s.debugLabels().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/labels?key=foo", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status for invalid key = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestDebugTargets(t *testing.T) {
+	e, err := NewELBMeta(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched := time.Now().Add(-time.Hour)
+	e.data.Store("222222222222/b", Meta{Cluster: "prod", Namespace: "shop", Ingress: "web", AccountID: "222222222222", LoadBalancer: "b", Fetched: fetched})
+	e.data.Store("111111111111/a", Meta{Cluster: "dev", Namespace: "shop", Ingress: "api", AccountID: "111111111111", LoadBalancer: "a", Fetched: fetched})
+	labels, err := newLabelTemplates(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Parser{elbMeta: e, labels: labels}
+
+	rec := httptest.NewRecorder()
+	s.debugTargets().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/targets", nil))
+	var got []targetDebug
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].LoadBalancer != "a" || got[1].Labels["ingress"] != "web" || got[1].AgeSeconds < 3600 {
+		t.Errorf("debugTargets() = %+v", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+var reappearedFiles = newCounter("alb_logs_shipper_reappeared_files_total", "Files shipped again within --dedup-window after they were deleted")
+
+// recentKeys remembers deleted S3 keys for a window. A deleted key listed and
+// shipped again means bucket replication loop, or versioning restoring
+// objects, and its lines are duplicated in Loki
+type recentKeys struct {
+	window time.Duration
+	mu     sync.Mutex
+	keys   map[string]time.Time
+	pruned time.Time
+}
+
+func newRecentKeys(window time.Duration) *recentKeys {
+	return &recentKeys{window: window, keys: make(map[string]time.Time)}
+}
+
+// add records deleted key
+func (r *recentKeys) add(key string) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.pruned) > time.Minute {
+		for k, ts := range r.keys {
+			if now.Sub(ts) > r.window {
+				delete(r.keys, k)
+			}
+		}
+		r.pruned = now
+	}
+	r.keys[key] = now
+}
+
+// seen returns true if the key was deleted within the window
+func (r *recentKeys) seen(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ts, ok := r.keys[key]
+	return ok && time.Since(ts) <= r.window
+}
+
+var duplicateFiles = newCounter("alb_logs_shipper_duplicate_files_total", "Files not shipped, as their copy is shipped from another bucket by --dedup-bucket marker")
+
+// dedupShipped prefixes bucket name in markers, which are written after the
+// file is shipped. Markers of older versions have bucket name only, and are
+// written before shipping, so they do not mean the file is shipped
+const dedupShipped = "shipped:"
+
+// bucketDedup marks shipped files by hash of their name in a bucket shared by
+// shippers of replicated buckets, like primary and DR one. Copies of a marked
+// file in other buckets are completed without shipping
+type bucketDedup struct {
+	client *s3.Client
+	bucket string // of markers
+	prefix string
+	own    string // bucket of shipped files, written to markers
+}
+
+// markerKey returns key of the marker by hash of the file name, which is the
+// same in replicated buckets with other prefixes
+func (d *bucketDedup) markerKey(key string) string {
+	sum := sha256.Sum256([]byte(path.Base(key)))
+	h := hex.EncodeToString(sum[:])
+	return d.prefix + h[:2] + "/" + h
+}
+
+// shippedBy returns bucket of the marker of the file, or empty string when it
+// is not marked. done is false for markers which do not record completed ship
+func (d *bucketDedup) shippedBy(ctx context.Context, key string) (owner string, done bool, err error) {
+	marker := d.markerKey(key)
+	obj, err := d.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &d.bucket,
+		Key:    &marker,
+	})
+	if err != nil {
+		if strings.Contains(err.Error(), "NoSuchKey") {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	defer obj.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(obj.Body, 1024))
+	if err != nil {
+		return "", false, err
+	}
+	owner, done = strings.CutPrefix(string(body), dedupShipped)
+	return owner, done, nil
+}
+
+// mark writes marker of the shipped file unless it exists, via S3 conditional
+// write. Returns bucket of the existing marker, when the file is shipped from
+// another bucket at the same time
+func (d *bucketDedup) mark(ctx context.Context, key string) (string, error) {
+	marker := d.markerKey(key)
+	_, err := d.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &d.bucket,
+		Key:    &marker,
+		Body:   strings.NewReader(dedupShipped + d.own),
+	}, s3.WithAPIOptions(smithyhttp.AddHeaderValue("If-None-Match", "*")))
+	if err == nil {
+		return "", nil
+	}
+	if !strings.Contains(err.Error(), "PreconditionFailed") {
+		return "", err
+	}
+	owner, _, err := d.shippedBy(ctx, key)
+	if err != nil || owner == d.own {
+		return "", err
+	}
+	return owner, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestRecentKeys(t *testing.T) {
+	r := newRecentKeys(time.Hour)
+	r.add("a")
+	if !r.seen("a") {
+		t.Errorf("seen(a) = false, want true")
+	}
+	if r.seen("b") {
+		t.Errorf("seen(b) = true, want false")
+	}
+
+	r.keys["a"] = time.Now().Add(-2 * time.Hour)
+	if r.seen("a") {
+		t.Errorf("seen(a) out of window = true, want false")
+	}
+	r.pruned = time.Time{}
+	r.add("b")
+	if _, ok := r.keys["a"]; ok {
+		t.Errorf("expired key is not pruned")
+	}
+}
+
+func TestBucketDedup(t *testing.T) {
+	// markers store with conditional writes
+	var mu sync.Mutex
+	markers := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			if _, ok := markers[r.URL.Path]; ok && r.Header.Get("If-None-Match") == "*" {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				fmt.Fprint(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			markers[r.URL.Path] = string(body)
+		case http.MethodGet:
+			body, ok := markers[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+				return
+			}
+			fmt.Fprint(w, body)
+		}
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), UsePathStyle: true, Credentials: aws.AnonymousCredentials{}})
+	primary := &bucketDedup{client: client, bucket: "markers", prefix: "dedup/", own: "logs"}
+	dr := &bucketDedup{client: client, bucket: "markers", prefix: "dedup/", own: "logs-dr"}
+
+	const file = "123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz"
+	key, replica := "AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/"+file, "replica/AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/"+file
+	check := func(d *bucketDedup, key, wantOwner string, wantDone bool) {
+		t.Helper()
+		owner, done, err := d.shippedBy(t.Context(), key)
+		if err != nil {
+			t.Fatalf("shippedBy() error = %v", err)
+		}
+		if owner != wantOwner || done != wantDone {
+			t.Errorf("shippedBy(%s) from %s = %s, %v, want %s, %v", key, d.own, owner, done, wantOwner, wantDone)
+		}
+	}
+	// not marked until shipped
+	check(primary, key, "", false)
+	check(dr, replica, "", false)
+
+	if owner, err := primary.mark(t.Context(), key); err != nil || owner != "" {
+		t.Fatalf("mark() = %s, %v", owner, err)
+	}
+	check(dr, replica, "logs", true)
+	check(primary, key, "logs", true)
+	// retry of own marker
+	if owner, err := primary.mark(t.Context(), key); err != nil || owner != "" {
+		t.Errorf("mark() again = %s, %v, want no owner", owner, err)
+	}
+	// shipped from both buckets at the same time
+	if owner, err := dr.mark(t.Context(), replica); err != nil || owner != "logs" {
+		t.Errorf("mark() of shipped copy = %s, %v, want logs", owner, err)
+	}
+
+	// marker of older version, written before shipping
+	markers["/markers/"+dr.markerKey("other.log.gz")] = "logs"
+	check(dr, "replica/other.log.gz", "logs", false)
+	if len(markers) != 2 {
+		t.Errorf("got %d markers, want 2", len(markers))
+	}
+}
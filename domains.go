@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+)
+
+var (
+	domainIdx = slices.Index(subexpNames, "domain_name")
+	statusIdx = slices.Index(subexpNames, "elb_status_code")
+
+	domainRequests = newCounter("alb_logs_shipper_domain_requests_total", "Requests to domains of --domain-metrics by ELB status code class", "domain", "code")
+)
+
+// observeDomain counts request of the line, when its domain is in --domain-metrics allowlist
+func (s *Parser) observeDomain(matches []string) {
+	domain := unquote(matches[domainIdx])
+	if !s.opts.DomainMetrics[domain] {
+		return
+	}
+	domainRequests.Inc(domain, statusClass(matches[statusIdx]))
+}
+
+// statusClass returns class of HTTP status code like "5xx", or "-" when ALB
+// did not respond (connection closed by client)
+func statusClass(code string) string {
+	if len(code) != 3 || code[0] < '1' || code[0] > '5' {
+		return "-"
+	}
+	return code[:1] + "xx"
+}
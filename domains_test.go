@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestStatusClass(t *testing.T) {
+	tests := map[string]string{
+		"200": "2xx",
+		"302": "3xx",
+		"404": "4xx",
+		"503": "5xx",
+		"-":   "-",
+		"000": "-",
+	}
+	for code, want := range tests {
+		if got := statusClass(code); got != want {
+			t.Errorf("statusClass(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
@@ -1,43 +1,146 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"log/slog"
+	"slices"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2"
+	"github.com/aws/aws-sdk-go-v2/service/elasticloadbalancingv2/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
 type ELBMeta struct {
-	data  sync.Map
-	roles map[string]string
+	data      sync.Map
+	accounts  sync.Map // account ID to alias
+	group     singleflight.Group
+	limiter   *rate.Limiter
+	roles     map[string]string
+	tagLabels map[string]string
+	aliases   map[string]string
+	resolve   bool         // resolve account aliases via IAM
+	logger    *slog.Logger // set by main
+
+	// namespace/ingress of CloudFront distributions by ID
+	cloudfront map[string]string
+
+	// templates of namespace and ingress for ALBs without ingress tags
+	fallbackNamespace *template.Template
+	fallbackIngress   *template.Template
 }
 
 type Meta struct {
-	Cluster   string
-	Namespace string
-	Ingress   string
+	Cluster      string
+	Namespace    string
+	Ingress      string
+	Account      string // account alias, empty when resolution is disabled
+	AccountID    string
+	LoadBalancer string
+	Org          string            // AWS Organizations ID from key of centralized logging bucket
+	Type         string            // app or net, from key of the file
+	LogType      string            // access or connection, from key of the file
+	Scheme       string            // internal or internet-facing, from DescribeLoadBalancers
+	IPType       string            // ipv4, dualstack or dualstack-without-public-ipv4
+	Labels       map[string]string // from --tag-label mapping
+	Fetched      time.Time         // when described via API, for cache age
+}
+
+func NewELBMeta(opts Options) (*ELBMeta, error) {
+	limit := rate.Inf
+	if opts.ELBAPIRate > 0 {
+		limit = rate.Limit(opts.ELBAPIRate)
+	}
+	e := &ELBMeta{
+		data:       sync.Map{},
+		limiter:    rate.NewLimiter(limit, max(int(opts.ELBAPIRate), 1)),
+		roles:      opts.Roles,
+		tagLabels:  opts.TagLabels,
+		aliases:    opts.AccountAliases,
+		resolve:    opts.ResolveAliases,
+		cloudfront: opts.Distributions,
+		logger:     slog.Default(),
+	}
+	var err error
+	if e.fallbackNamespace, err = template.New("namespace").Option("missingkey=error").Parse(opts.FallbackNamespace); err != nil {
+		return nil, fmt.Errorf("invalid fallback namespace template: %w", err)
+	}
+	if e.fallbackIngress, err = template.New("ingress").Option("missingkey=error").Parse(opts.FallbackIngress); err != nil {
+		return nil, fmt.Errorf("invalid fallback ingress template: %w", err)
+	}
+	return e, nil
 }
 
-func NewELBMeta(roles map[string]string) *ELBMeta {
-	return &ELBMeta{
-		data:  sync.Map{},
-		roles: roles,
+// Distribution returns metadata of CloudFront distribution from
+// --cloudfront-distribution, or with fallback namespace and ingress
+func (e *ELBMeta) Distribution(id string) (Meta, error) {
+	meta := Meta{Labels: make(map[string]string)}
+	if v, ok := e.cloudfront[id]; ok {
+		meta.Namespace, meta.Ingress, _ = strings.Cut(v, "/")
 	}
+	return e.complete(meta, "", id, "")
 }
 
-// Get lazily returns metadata for a load balancer
+// Resource returns metadata of VPC flow log or WAF web ACL, with fallback
+// namespace and ingress and account alias
+func (e *ELBMeta) Resource(accountID, id string) (Meta, error) {
+	account, err := e.account(accountID)
+	if err != nil {
+		return Meta{}, err
+	}
+	return e.complete(Meta{Labels: make(map[string]string)}, accountID, id, account)
+}
+
+// Get lazily returns metadata for a load balancer. Concurrent calls for the
+// same load balancer share a single lookup
 func (e *ELBMeta) Get(accountID, lbName string) (Meta, error) {
-	if meta, ok := e.data.Load(accountID + "/" + lbName); ok {
+	key := accountID + "/" + lbName
+	if meta, ok := e.data.Load(key); ok {
 		return meta.(Meta), nil
 	}
+	meta, err, _ := e.group.Do(key, func() (any, error) {
+		return e.lookup(accountID, lbName)
+	})
+	if err != nil {
+		return Meta{}, err
+	}
+	return meta.(Meta), nil
+}
+
+// All returns cached metadata of all known load balancers, sorted by
+// account and name
+func (e *ELBMeta) All() []Meta {
+	var res []Meta
+	e.data.Range(func(_, v any) bool {
+		res = append(res, v.(Meta))
+		return true
+	})
+	slices.SortFunc(res, func(a, b Meta) int {
+		return cmp.Or(strings.Compare(a.AccountID, b.AccountID), strings.Compare(a.LoadBalancer, b.LoadBalancer))
+	})
+	return res
+}
 
+// lookup describes the load balancer and its tags, API calls are rate limited
+// by --elb-api-rate to not get throttled on cold cache
+func (e *ELBMeta) lookup(accountID, lbName string) (Meta, error) {
+	ctx := context.TODO()
 	cli := e.client(accountID)
-	lbs, err := cli.DescribeLoadBalancers(context.TODO(), &elasticloadbalancingv2.DescribeLoadBalancersInput{
+	if err := e.limiter.Wait(ctx); err != nil {
+		return Meta{}, err
+	}
+	lbs, err := cli.DescribeLoadBalancers(ctx, &elasticloadbalancingv2.DescribeLoadBalancersInput{
 		Names: []string{lbName},
 	})
 	if err != nil {
@@ -47,35 +150,249 @@ func (e *ELBMeta) Get(accountID, lbName string) (Meta, error) {
 		return Meta{}, fmt.Errorf("load balancer %s not found", lbName)
 	}
 
-	tags, err := cli.DescribeTags(context.TODO(), &elasticloadbalancingv2.DescribeTagsInput{
+	if err := e.limiter.Wait(ctx); err != nil {
+		return Meta{}, err
+	}
+	tags, err := cli.DescribeTags(ctx, &elasticloadbalancingv2.DescribeTagsInput{
 		ResourceArns: []string{*lbs.LoadBalancers[0].LoadBalancerArn},
 	})
 	if err != nil {
 		return Meta{}, err
 	}
 
-	meta := Meta{}
-	for _, tag := range tags.TagDescriptions[0].Tags {
-		switch *tag.Key {
-		case "ingress.k8s.aws/stack":
-			tmp := strings.Split(*tag.Value, "/")
-			if len(tmp) != 2 {
-				return Meta{}, fmt.Errorf("invalid ingress tag format: %s", *tag.Value)
+	meta, err := e.metaFromTags(tagMap(tags.TagDescriptions[0].Tags))
+	if err != nil {
+		return Meta{}, err
+	}
+	account, err := e.account(accountID)
+	if err != nil {
+		return Meta{}, err
+	}
+	if meta, err = e.complete(meta, accountID, lbName, account); err != nil {
+		return Meta{}, err
+	}
+	meta.Scheme, meta.IPType = string(lbs.LoadBalancers[0].Scheme), string(lbs.LoadBalancers[0].IpAddressType)
+	meta.Fetched = time.Now()
+	e.data.Store(accountID+"/"+lbName, meta)
+	return meta, nil
+}
+
+// Prefetch warms the cache with all application and network load balancers of the own
+// account and accounts of --role-arn. Tags are described in batches of 20,
+// which is much cheaper than lazy lookups one by one. Returns number of cached
+// load balancers
+func (e *ELBMeta) Prefetch(ctx context.Context) (int, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return 0, err
+	}
+	self, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get own account: %w", err)
+	}
+	accounts := []string{*self.Account}
+	for _, id := range sortedKeys(e.roles) {
+		if id != *self.Account {
+			accounts = append(accounts, id)
+		}
+	}
+
+	num := 0
+	for _, accountID := range accounts {
+		n, err := e.prefetchAccount(ctx, accountID)
+		num += n
+		if err != nil {
+			return num, fmt.Errorf("failed to prefetch load balancers of account %s: %w", accountID, err)
+		}
+	}
+	return num, nil
+}
+
+func (e *ELBMeta) prefetchAccount(ctx context.Context, accountID string) (int, error) {
+	cli := e.client(accountID)
+	if cli == nil {
+		return 0, fmt.Errorf("failed to load AWS config")
+	}
+	described := make(map[string]types.LoadBalancer) // by ARN
+	paginator := elasticloadbalancingv2.NewDescribeLoadBalancersPaginator(cli, &elasticloadbalancingv2.DescribeLoadBalancersInput{})
+	for paginator.HasMorePages() {
+		if err := e.limiter.Wait(ctx); err != nil {
+			return 0, err
+		}
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, lb := range page.LoadBalancers {
+			isLogged := lb.Type == types.LoadBalancerTypeEnumApplication || lb.Type == types.LoadBalancerTypeEnumNetwork
+			if isLogged && lb.LoadBalancerArn != nil && lb.LoadBalancerName != nil {
+				described[*lb.LoadBalancerArn] = lb
+			}
+		}
+	}
+	account, err := e.account(accountID)
+	if err != nil {
+		return 0, err
+	}
+
+	num := 0
+	arns := sortedKeys(described)
+	for i := 0; i < len(arns); i += 20 {
+		if err := e.limiter.Wait(ctx); err != nil {
+			return num, err
+		}
+		tags, err := cli.DescribeTags(ctx, &elasticloadbalancingv2.DescribeTagsInput{
+			ResourceArns: arns[i:min(i+20, len(arns))],
+		})
+		if err != nil {
+			return num, err
+		}
+		for _, td := range tags.TagDescriptions {
+			if td.ResourceArn == nil {
+				continue
+			}
+			meta, err := e.metaFromTags(tagMap(td.Tags))
+			if err != nil {
+				continue // would fail on lazy lookup with the same error
+			}
+			lb := described[*td.ResourceArn]
+			if meta, err = e.complete(meta, accountID, *lb.LoadBalancerName, account); err != nil {
+				return num, err
 			}
-			meta.Namespace, meta.Ingress = tmp[0], tmp[1]
-		case "cluster-id":
-			meta.Cluster = *tag.Value
+			meta.Scheme, meta.IPType = string(lb.Scheme), string(lb.IpAddressType)
+			meta.Fetched = time.Now()
+			e.data.Store(accountID+"/"+*lb.LoadBalancerName, meta)
+			num++
 		}
 	}
-	e.data.Store(accountID+"/"+lbName, meta)
+	return num, nil
+}
+
+func tagMap(tags []types.Tag) map[string]string {
+	tm := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if tag.Key != nil && tag.Value != nil {
+			tm[*tag.Key] = *tag.Value
+		}
+	}
+	return tm
+}
+
+// complete sets account and load balancer of the metadata, and renders
+// fallback namespace and ingress for ALBs without ingress tags
+func (e *ELBMeta) complete(meta Meta, accountID, lbName, account string) (Meta, error) {
+	meta.Account, meta.AccountID, meta.LoadBalancer = account, accountID, lbName
+	if meta.Namespace != "" || meta.Ingress != "" {
+		return meta, nil
+	}
+	var b strings.Builder
+	if err := e.fallbackNamespace.Execute(&b, meta); err != nil {
+		return Meta{}, fmt.Errorf("failed to render fallback namespace: %w", err)
+	}
+	ns := b.String()
+	b.Reset()
+	if err := e.fallbackIngress.Execute(&b, meta); err != nil {
+		return Meta{}, fmt.Errorf("failed to render fallback ingress: %w", err)
+	}
+	meta.Namespace, meta.Ingress = ns, b.String()
 	return meta, nil
 }
 
+// metaFromTags converts ALB tags to metadata. Besides aws-load-balancer-controller
+// tags, conventions of legacy alb-ingress-controller and Terraform are supported
+func (e *ELBMeta) metaFromTags(tags map[string]string) (Meta, error) {
+	meta := Meta{Labels: make(map[string]string)}
+	if v, ok := tags["ingress.k8s.aws/stack"]; ok {
+		tmp := strings.Split(v, "/")
+		if len(tmp) != 2 {
+			return Meta{}, fmt.Errorf("invalid ingress tag format: %s", v)
+		}
+		meta.Namespace, meta.Ingress = tmp[0], tmp[1]
+	} else if v, ok := tags["service.k8s.aws/stack"]; ok {
+		// NLB of LoadBalancer service, which name is used as ingress
+		tmp := strings.Split(v, "/")
+		if len(tmp) != 2 {
+			return Meta{}, fmt.Errorf("invalid service tag format: %s", v)
+		}
+		meta.Namespace, meta.Ingress = tmp[0], tmp[1]
+	} else {
+		meta.Namespace, meta.Ingress = tags["kubernetes.io/namespace"], tags["kubernetes.io/ingress-name"]
+	}
+
+	switch {
+	case tags["cluster-id"] != "":
+		meta.Cluster = tags["cluster-id"]
+	case tags["elbv2.k8s.aws/cluster"] != "":
+		meta.Cluster = tags["elbv2.k8s.aws/cluster"]
+	default:
+		// kubernetes.io/cluster/<name>: owned|shared
+		for _, k := range sortedKeys(tags) {
+			if name, ok := strings.CutPrefix(k, "kubernetes.io/cluster/"); ok && name != "" {
+				meta.Cluster = name
+				break
+			}
+		}
+	}
+
+	for label, tag := range e.tagLabels {
+		if v := tags[tag]; v != "" {
+			meta.Labels[label] = v
+		}
+	}
+	return meta, nil
+}
+
+// account returns alias of the account from the static map, or from IAM when
+// enabled. Accounts without alias are returned as ID
+func (e *ELBMeta) account(accountID string) (string, error) {
+	if alias, ok := e.aliases[accountID]; ok {
+		return alias, nil
+	}
+	if !e.resolve {
+		if len(e.aliases) > 0 {
+			return accountID, nil
+		}
+		return "", nil
+	}
+	if alias, ok := e.accounts.Load(accountID); ok {
+		return alias.(string), nil
+	}
+
+	cfg, err := e.config(accountID)
+	if err != nil {
+		return "", err
+	}
+	if err = e.limiter.Wait(context.TODO()); err != nil {
+		return "", err
+	}
+	out, err := iam.NewFromConfig(cfg).ListAccountAliases(context.TODO(), &iam.ListAccountAliasesInput{})
+	if err != nil {
+		// not cached, to be resolved by the next lookup
+		e.logger.Warn("failed to get account alias, using account ID", "account", accountID, "err", err)
+		return accountID, nil
+	}
+	alias := accountID
+	if len(out.AccountAliases) > 0 {
+		alias = out.AccountAliases[0]
+	}
+	e.accounts.Store(accountID, alias)
+	return alias, nil
+}
+
 func (e *ELBMeta) client(accountID string) *elasticloadbalancingv2.Client {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	cfg, err := e.config(accountID)
 	if err != nil {
 		return nil
 	}
+	return elasticloadbalancingv2.NewFromConfig(cfg)
+}
+
+// config returns AWS config for the account, assuming --role-arn if any
+func (e *ELBMeta) config(accountID string) (aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return aws.Config{}, err
+	}
 
 	if e.roles[accountID] != "" {
 		roleAssumptionProvider := stscreds.NewAssumeRoleProvider(
@@ -89,8 +406,8 @@ func (e *ELBMeta) client(accountID string) *elasticloadbalancingv2.Client {
 			config.WithCredentialsProvider(roleAssumptionProvider),
 		)
 		if err != nil {
-			return nil
+			return aws.Config{}, err
 		}
 	}
-	return elasticloadbalancingv2.NewFromConfig(cfg)
+	return cfg, nil
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestELBMeta_metaFromTags(t *testing.T) {
+	e, err := NewELBMeta(Options{TagLabels: map[string]string{"app": "app.kubernetes.io/name"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		tags map[string]string
+		want Meta
+		err  bool
+	}{
+		{
+			name: "aws-load-balancer-controller",
+			tags: map[string]string{"ingress.k8s.aws/stack": "ns/ing", "elbv2.k8s.aws/cluster": "eks", "cluster-id": "prod"},
+			want: Meta{Cluster: "prod", Namespace: "ns", Ingress: "ing", Labels: map[string]string{}},
+		},
+		{
+			name: "ingress group",
+			tags: map[string]string{"ingress.k8s.aws/stack": "group", "elbv2.k8s.aws/cluster": "eks"},
+			err:  true,
+		},
+		{
+			name: "nlb of service",
+			tags: map[string]string{"service.k8s.aws/stack": "ns/svc", "service.k8s.aws/resource": "LoadBalancer", "elbv2.k8s.aws/cluster": "eks"},
+			want: Meta{Cluster: "eks", Namespace: "ns", Ingress: "svc", Labels: map[string]string{}},
+		},
+		{
+			name: "legacy alb-ingress-controller",
+			tags: map[string]string{"kubernetes.io/namespace": "ns", "kubernetes.io/ingress-name": "ing", "kubernetes.io/cluster/eks": "owned"},
+			want: Meta{Cluster: "eks", Namespace: "ns", Ingress: "ing", Labels: map[string]string{}},
+		},
+		{
+			name: "terraform",
+			tags: map[string]string{"kubernetes.io/cluster/eks": "shared", "app.kubernetes.io/name": "web"},
+			want: Meta{Cluster: "eks", Labels: map[string]string{"app": "web"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.metaFromTags(tt.tags)
+			if (err != nil) != tt.err {
+				t.Fatalf("metaFromTags() error = %v, wantErr %v", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("metaFromTags() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestELBMeta_account(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases map[string]string
+		id      string
+		want    string
+	}{
+		{name: "disabled", id: "123456789012", want: ""},
+		{name: "static", aliases: map[string]string{"123456789012": "prod"}, id: "123456789012", want: "prod"},
+		{name: "static fallback to id", aliases: map[string]string{"123456789012": "prod"}, id: "210987654321", want: "210987654321"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewELBMeta(Options{AccountAliases: tt.aliases})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.account(tt.id)
+			if err != nil {
+				t.Fatalf("account() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("account() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestELBMeta_complete(t *testing.T) {
+	e, err := NewELBMeta(Options{FallbackNamespace: "{{or .Account .AccountID}}", FallbackIngress: "alb-{{.LoadBalancer}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		meta    Meta
+		account string
+		want    Meta
+	}{
+		{
+			name: "tagged",
+			meta: Meta{Namespace: "ns", Ingress: "ing"},
+			want: Meta{Namespace: "ns", Ingress: "ing", AccountID: "123456789012", LoadBalancer: "my-lb"},
+		},
+		{
+			name: "untagged",
+			meta: Meta{Cluster: "prod"},
+			want: Meta{Cluster: "prod", Namespace: "123456789012", Ingress: "alb-my-lb", AccountID: "123456789012", LoadBalancer: "my-lb"},
+		},
+		{
+			name:    "untagged with alias",
+			account: "shared",
+			want:    Meta{Namespace: "shared", Ingress: "alb-my-lb", Account: "shared", AccountID: "123456789012", LoadBalancer: "my-lb"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.complete(tt.meta, "123456789012", "my-lb", tt.account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("complete() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err = NewELBMeta(Options{FallbackIngress: "{{.LoadBalancer"}); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
+
+func TestELBMeta_Distribution(t *testing.T) {
+	e, err := NewELBMeta(Options{FallbackNamespace: "{{or .Account .AccountID}}", FallbackIngress: "{{.LoadBalancer}}", Distributions: map[string]string{"E2QWRUHAPOMQZL": "shop/web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := e.Distribution("E2QWRUHAPOMQZL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Meta{Namespace: "shop", Ingress: "web", LoadBalancer: "E2QWRUHAPOMQZL", Labels: map[string]string{}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Distribution() = %+v, want %+v", got, want)
+	}
+	got, err = e.Distribution("E1UNMAPPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Namespace != "" || got.Ingress != "E1UNMAPPED" {
+		t.Errorf("Distribution() of unmapped = %+v, want fallback ingress", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/sepich/alb-logs-shipper/albparse"
+)
+
+var (
+	// source:  https://docs.aws.amazon.com/vpc/latest/userguide/flow-logs-s3-path.html
+	// format:  bucket[/prefix]/AWSLogs/aws-account-id/vpcflowlogs/region/yyyy/mm/dd[/hh]/aws-account-id_vpcflowlogs_region_flow-log-id_YYYYMMDDTHHmmZ_hash.log.gz
+	flowFnRegex = regexp.MustCompile(`(?:(?P<org>o-[a-z0-9]{10,32})\/)?AWSLogs\/(?:(?P<org_id>o-[a-z0-9]{10,32})\/)?(?P<account_id>\d+)\/vpcflowlogs\/(?P<region>[\w-]+)\/(?P<year>\d+)\/(?P<month>\d+)\/(?P<day>\d+)\/(?:\d+\/)?\d+_vpcflowlogs_[\w-]+_(?P<id>fl-[0-9a-f]+)_\w+_\w+\.log\.gz`)
+	// flowFields are all fields of custom formats, with `-` replaced by `_`
+	flowFields = []string{"version", "account_id", "interface_id", "srcaddr", "dstaddr", "srcport", "dstport", "protocol", "packets", "bytes", "start", "end", "action", "log_status", "vpc_id", "subnet_id", "instance_id", "tcp_flags", "type", "pkt_srcaddr", "pkt_dstaddr", "region", "az_id", "sublocation_type", "sublocation_id", "pkt_src_aws_service", "pkt_dst_aws_service", "flow_direction", "traffic_path", "ecs_cluster_arn", "ecs_cluster_name", "ecs_container_instance_arn", "ecs_container_instance_id", "ecs_container_id", "ecs_second_container_id", "ecs_service_name", "ecs_task_definition_arn", "ecs_task_arn", "ecs_task_id", "reject_reason"}
+	// flowDefaultHeader is the default format, for files without header line
+	flowDefaultHeader = "version account-id interface-id srcaddr dstaddr srcport dstport protocol packets bytes start end action log-status"
+	flowNumFields     = map[string]bool{
+		"version":      true,
+		"srcport":      true,
+		"dstport":      true,
+		"protocol":     true,
+		"packets":      true,
+		"bytes":        true,
+		"start":        true,
+		"end":          true,
+		"tcp_flags":    true,
+		"traffic_path": true,
+	}
+)
+
+// LineFlow parses VPC flow log records of the format from the header line
+// of the file. Field options are applied by flowFields names
+type LineFlow struct {
+	FieldOptions
+	format *otherFormat
+}
+
+var _ LineParser = &LineFlow{}
+
+// newLineFlow returns parser of the records of the header line, like
+// `version account-id interface-id srcaddr ...`
+func newLineFlow(fo FieldOptions, header string) (*LineFlow, error) {
+	names := strings.Fields(strings.ReplaceAll(header, "-", "_"))
+	idx := slices.Index(names, "start")
+	if idx < 0 {
+		idx = slices.Index(names, "end")
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("VPC flow log format has no start or end field: %s", header)
+	}
+	return &LineFlow{fo, &otherFormat{fields: names, number: flowNumFields, timestamp: unixField(idx)}}, nil
+}
+
+// isFlowHeader returns true for the header line of VPC flow log file
+func isFlowHeader(line string) bool {
+	first, _, _ := strings.Cut(line, " ")
+	return slices.Contains(flowFields, strings.ReplaceAll(first, "-", "_"))
+}
+
+// As parses VPC flow log record and converts it to the specified format
+func (r *LineFlow) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields splits VPC flow log record to values of the header fields
+func (r *LineFlow) Fields(line string) ([]string, error) {
+	matches, err := albparse.Tokenize(line, r.format.fields, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse VPC flow log record %w: %s", err, line)
+	}
+	return matches, nil
+}
+
+// LineAs converts fields of VPC flow log record to the specified format
+func (r *LineFlow) LineAs(format, line string, matches []string) (logproto.Entry, error) {
+	buf, entry, err := r.AppendLine(make([]byte, 0, 512), format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(buf), len(buf))
+	return entry, nil
+}
+
+// AppendLine appends fields of VPC flow log record in the specified format to dst
+func (r *LineFlow) AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error) {
+	return r.appendOther(dst, format, line, matches, r.format)
+}
+
+// unixField returns timestamp func of otherFormat, which parses the field
+// in unix seconds
+func unixField(idx int) func(matches []string) (time.Time, error) {
+	return func(matches []string) (time.Time, error) {
+		sec, err := strconv.ParseInt(matches[idx], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(sec, 0).UTC(), nil
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLineFlow_As(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		format string
+		line   string
+		out    string
+	}{
+		{
+			name:   "default logfmt",
+			header: flowDefaultHeader,
+			format: "logfmt",
+			line:   "2 123456789010 eni-1235b8ca123456789 172.31.16.139 172.31.16.21 20641 22 6 20 4249 1418530010 1418530070 ACCEPT OK",
+			out:    "version=2 account_id=123456789010 interface_id=eni-1235b8ca123456789 srcaddr=172.31.16.139 dstaddr=172.31.16.21 srcport=20641 dstport=22 protocol=6 packets=20 bytes=4249 start=1418530010 end=1418530070 action=ACCEPT log_status=OK",
+		},
+		{
+			name:   "default json of nodata",
+			header: flowDefaultHeader,
+			format: "json",
+			line:   "2 123456789010 eni-1235b8ca123456789 - - - - - - - 1418530010 1418530070 - NODATA",
+			out:    `{"version":2,"account_id":"123456789010","interface_id":"eni-1235b8ca123456789","srcaddr":"-","dstaddr":"-","srcport":"-","dstport":"-","protocol":"-","packets":"-","bytes":"-","start":1418530010,"end":1418530070,"action":"-","log_status":"NODATA"}`,
+		},
+		{
+			name:   "custom json",
+			header: "vpc-id subnet-id instance-id interface-id srcaddr dstaddr start tcp-flags flow-direction",
+			format: "json",
+			line:   "vpc-abcdefab012345678 subnet-aaaaaaaa012345678 i-01234567890123456 eni-1235b8ca123456789 10.0.1.5 10.0.0.220 1418530010 19 ingress",
+			out:    `{"vpc_id":"vpc-abcdefab012345678","subnet_id":"subnet-aaaaaaaa012345678","instance_id":"i-01234567890123456","interface_id":"eni-1235b8ca123456789","srcaddr":"10.0.1.5","dstaddr":"10.0.0.220","start":1418530010,"tcp_flags":19,"flow_direction":"ingress"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !isFlowHeader(tt.header) {
+				t.Errorf("isFlowHeader(%q) = false", tt.header)
+			}
+			if isFlowHeader(tt.line) {
+				t.Errorf("isFlowHeader(%q) = true", tt.line)
+			}
+			lp, err := newLineFlow(FieldOptions{}, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := lp.As(tt.format, tt.line)
+			if err != nil {
+				t.Fatalf("LineFlow.As() error = %v", err)
+			}
+			if want := time.Unix(1418530010, 0); !entry.Timestamp.Equal(want) {
+				t.Errorf("LineFlow.As() ts = %v, want %v", entry.Timestamp, want)
+			}
+			if entry.Line != tt.out {
+				t.Errorf("LineFlow.As() out:\n%v\nwant:\n%v", entry.Line, tt.out)
+			}
+			if tt.format == "json" && !json.Valid([]byte(entry.Line)) {
+				t.Errorf("LineFlow.As() out is not valid JSON")
+			}
+		})
+	}
+
+	if _, err := newLineFlow(FieldOptions{}, "srcaddr dstaddr"); err == nil {
+		t.Errorf("newLineFlow() of format without time error = nil")
+	}
+	lp, _ := newLineFlow(FieldOptions{}, flowDefaultHeader)
+	if _, err := lp.As("logfmt", "2 123456789010 eni-1235b8ca123456789"); err == nil {
+		t.Errorf("LineFlow.As() of truncated line error = nil")
+	}
+}
+
+func TestFlowFnRegex(t *testing.T) {
+	tests := map[string]string{
+		"AWSLogs/123456789012/vpcflowlogs/us-east-1/2024/03/01/123456789012_vpcflowlogs_us-east-1_fl-1234abcd5678ef901_20240301T0000Z_ab12cd34.log.gz":         "fl-1234abcd5678ef901",
+		"flow/AWSLogs/123456789012/vpcflowlogs/us-east-1/2024/03/01/12/123456789012_vpcflowlogs_us-east-1_fl-1234abcd5678ef901_20240301T1200Z_ab12cd34.log.gz": "fl-1234abcd5678ef901",
+		"AWSLogs/123456789012/vpcflowlogs/us-east-1/2024/03/01/123456789012_vpcflowlogs_us-east-1_fl-1234abcd5678ef901_20240301T0000Z_ab12cd34.log.parquet":    "",
+	}
+	for key, want := range tests {
+		var got string
+		if matches := flowFnRegex.FindStringSubmatch(key); matches != nil {
+			got = matches[flowFnRegex.SubexpIndex("id")]
+		}
+		if got != want {
+			t.Errorf("flow log of %q = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// idleMode reduces resources of the shipper while scans find no files for
+// --idle-after: only the first worker takes files, pooled buffers and idle
+// connections are released, and scans wait for --idle-wait. It is left by the
+// first scan which finds files
+type idleMode struct {
+	after   time.Duration
+	wait    time.Duration
+	logger  *slog.Logger
+	release func() // called on entering idle mode
+	mu      sync.Mutex
+	idle    bool
+	active  chan struct{} // closed while not idle
+	entered chan struct{} // closed while idle
+	last    time.Time     // of the last scan which found files
+}
+
+func newIdleMode(after, wait time.Duration, logger *slog.Logger, release func()) *idleMode {
+	m := &idleMode{after: after, wait: wait, logger: logger, release: release, active: make(chan struct{}), entered: make(chan struct{}), last: time.Now()}
+	close(m.active)
+	newGaugeFunc("alb_logs_shipper_idle", "Whether the shipper is in idle mode, as scans found no files for --idle-after", func() float64 {
+		if m.isIdle() {
+			return 1
+		}
+		return 0
+	})
+	return m
+}
+
+func (m *idleMode) isIdle() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.idle
+}
+
+// update records number of files found by a scan, and returns interval to
+// wait for the next scan, which is at least --idle-wait in idle mode
+func (m *idleMode) update(found int, wait time.Duration, now time.Time) time.Duration {
+	if m == nil {
+		return wait
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if found > 0 {
+		m.last = now
+		if m.idle {
+			m.logger.Info("files found, leaving idle mode", "files", found)
+			m.leave()
+		}
+		return wait
+	}
+	if !m.idle && now.Sub(m.last) >= m.after {
+		m.logger.Info("no files found, entering idle mode", "since", m.last.Format(time.RFC3339), "wait", m.wait)
+		m.idle = true
+		m.active = make(chan struct{})
+		close(m.entered)
+		if m.release != nil {
+			m.release()
+		}
+	}
+	if m.idle {
+		return max(wait, m.wait)
+	}
+	return wait
+}
+
+// leave switches from idle mode, should be called with the lock held
+func (m *idleMode) leave() {
+	m.idle = false
+	close(m.active)
+	m.entered = make(chan struct{})
+}
+
+// waitActive blocks while in idle mode, for workers other than the first one.
+// Returns channel which is closed on entering idle mode again, for the worker
+// waiting for a file to stop waiting
+func (m *idleMode) waitActive() <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	active := m.active
+	m.mu.Unlock()
+	<-active
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.entered
+}
+
+// stop leaves idle mode on shutdown, so waiting workers exit
+func (m *idleMode) stop() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.idle {
+		m.leave()
+	}
+}
+
+// freeMemory returns unused memory to the OS, including pools of push and
+// parse buffers. Pooled objects survive one GC in the victim cache of pools,
+// so they are freed by the second one
+func freeMemory() {
+	debug.FreeOSMemory()
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleMode(t *testing.T) {
+	released := 0
+	m := newIdleMode(10*time.Minute, 5*time.Minute, slog.New(slog.NewTextHandler(io.Discard, nil)), func() { released++ })
+	start := m.last
+	tests := []struct {
+		found    int
+		at       time.Duration
+		want     time.Duration
+		wantIdle bool
+	}{
+		{found: 0, at: time.Minute, want: time.Minute},
+		{found: 3, at: 5 * time.Minute, want: time.Minute},
+		{found: 0, at: 14 * time.Minute, want: time.Minute},
+		{found: 0, at: 15 * time.Minute, want: 5 * time.Minute, wantIdle: true},
+		{found: 0, at: 20 * time.Minute, want: 5 * time.Minute, wantIdle: true},
+		{found: 1, at: 25 * time.Minute, want: time.Minute},
+	}
+	for i, tt := range tests {
+		if got := m.update(tt.found, time.Minute, start.Add(tt.at)); got != tt.want {
+			t.Errorf("update() of scan %d = %s, want %s", i, got, tt.want)
+		}
+		if m.isIdle() != tt.wantIdle {
+			t.Errorf("isIdle() after scan %d = %v, want %v", i, m.isIdle(), tt.wantIdle)
+		}
+	}
+	if released != 1 {
+		t.Errorf("released %d times, want 1", released)
+	}
+
+	// worker waiting for a file before idle mode stops waiting on entering it
+	entered := m.waitActive()
+	select {
+	case <-entered:
+		t.Fatal("waitActive() channel is closed while not idle")
+	default:
+	}
+	m.update(0, time.Minute, start.Add(time.Hour))
+	select {
+	case <-entered:
+	case <-time.After(time.Second):
+		t.Fatal("waitActive() channel is not closed on entering idle mode")
+	}
+	done := make(chan struct{})
+	go func() {
+		m.waitActive()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("waitActive() returned in idle mode")
+	case <-time.After(10 * time.Millisecond):
+	}
+	m.stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitActive() blocked after stop()")
+	}
+}
+
+func TestFreeMemory(t *testing.T) {
+	// no GC moves buffers to the victim cache before freeMemory
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var pool sync.Pool
+	for range 64 {
+		buf := make([]byte, 1<<20)
+		pool.Put(&buf)
+	}
+	freeMemory()
+	runtime.ReadMemStats(&after)
+	if after.HeapInuse > before.HeapInuse+32<<20 {
+		t.Errorf("heap in use after freeMemory() = %d, before pooled buffers %d", after.HeapInuse, before.HeapInuse)
+	}
+	runtime.KeepAlive(&pool)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// journalCompactAfter is the number of appended records to rewrite the journal
+// with pending keys only
+const journalCompactAfter = 10000
+
+// journal states of a key
+const (
+	journalIntent  = "intent"  // shipping started, some batches may be pushed
+	journalShipped = "shipped" // all batches acknowledged by Loki
+	journalDone    = "done"    // deleted or tagged as shipped
+)
+
+type journalRecord struct {
+	Key     string   `json:"key"`
+	State   string   `json:"state"`
+	Batches []string `json:"batches,omitempty"`
+}
+
+// journal is a local write-ahead log of shipping. Files are deleted only after
+// all their batches are acknowledged and recorded, and files which were
+// shipped but failed to be deleted are not shipped again, also after restart
+type journal struct {
+	path    string
+	mu      sync.Mutex
+	file    *os.File
+	keys    map[string]journalRecord // not done
+	appends int
+}
+
+// openJournal loads pending keys from the journal file and compacts it
+func openJournal(path string) (*journal, error) {
+	j := &journal{path: path, keys: make(map[string]journalRecord)}
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var rec journalRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue // torn write of the last record
+			}
+			if rec.State == journalDone {
+				delete(j.keys, rec.Key)
+			} else {
+				j.keys[rec.Key] = rec
+			}
+		}
+		f.Close()
+		if err = scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read journal: %w", err)
+		}
+	}
+	if err = j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// compact rewrites the journal with pending keys only
+func (j *journal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range sortedKeys(j.keys) {
+		line, _ := json.Marshal(j.keys[key])
+		w.Write(append(line, '\n'))
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	j.appends = 0
+	return err
+}
+
+// append writes the record and syncs it to disk
+func (j *journal) append(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if rec.State == journalDone {
+		delete(j.keys, rec.Key)
+	} else {
+		j.keys[rec.Key] = rec
+	}
+	if _, err = j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = j.file.Sync(); err != nil {
+		return err
+	}
+	if j.appends++; j.appends >= journalCompactAfter {
+		return j.compact()
+	}
+	return nil
+}
+
+func (j *journal) intent(key string) error {
+	return j.append(journalRecord{Key: key, State: journalIntent})
+}
+
+func (j *journal) shipped(key string, batches []string) error {
+	return j.append(journalRecord{Key: key, State: journalShipped, Batches: batches})
+}
+
+func (j *journal) done(key string) error {
+	return j.append(journalRecord{Key: key, State: journalDone})
+}
+
+// isShipped returns true if all batches of the key were acknowledged, but it
+// was not deleted yet
+func (j *journal) isShipped(key string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.keys[key].State == journalShipped
+}
+
+func (j *journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, err := openJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range []error{
+		j.intent("a"), j.shipped("a", []string{"01"}), j.done("a"), // deleted
+		j.intent("b"), j.shipped("b", []string{"02"}), // delete failed
+		j.intent("c"), // push failed
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// torn write on crash
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"key":"d","sta`)
+	f.Close()
+
+	if j, err = openJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j.isShipped("a") || !j.isShipped("b") || j.isShipped("c") || j.isShipped("d") {
+		t.Errorf("unexpected pending keys after restart: %v", j.keys)
+	}
+	if len(j.keys) != 2 {
+		t.Errorf("got %d pending keys, want 2", len(j.keys))
+	}
+}
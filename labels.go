@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// defaultLabels are stream labels rendered from ALB metadata, overridden by --label
+var defaultLabels = map[string]string{
+	"cluster":   "{{.Cluster}}",
+	"namespace": "{{.Namespace}}",
+	"ingress":   "{{.Ingress}}",
+	"account":   "{{.Account}}",
+	"index":     "{{if .Cluster}}{{.Cluster}}-{{.Namespace}}{{end}}",
+	"log_type":  `{{if eq .LogType "connection"}}connection{{end}}`,
+}
+
+// labelTemplates render Loki stream labels from ALB metadata
+type labelTemplates map[string]*template.Template
+
+// newLabelTemplates parses default labels, --tag-label and --label values as templates
+func newLabelTemplates(tagLabels, labels map[string]string) (labelTemplates, error) {
+	src := make(map[string]string, len(defaultLabels)+len(tagLabels)+len(labels))
+	for k, v := range defaultLabels {
+		src[k] = v
+	}
+	for k := range tagLabels {
+		src[k] = fmt.Sprintf("{{index .Labels %q}}", k)
+	}
+	for k, v := range labels {
+		src[k] = v
+	}
+
+	res := make(labelTemplates, len(src))
+	for k, v := range src {
+		t, err := template.New(k).Option("missingkey=zero").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of label %s: %w", k, err)
+		}
+		res[k] = t
+	}
+	return res, nil
+}
+
+// set adds label with static value
+func (l labelTemplates) set(name, value string) {
+	l[name] = template.Must(template.New(name).Parse("{{" + strconv.Quote(value) + "}}"))
+}
+
+// render returns labels for the metadata, labels rendered empty are dropped
+func (l labelTemplates) render(meta Meta) (map[string]string, error) {
+	res := make(map[string]string, len(l))
+	var b strings.Builder
+	for k, t := range l {
+		b.Reset()
+		if err := t.Execute(&b, meta); err != nil {
+			return nil, fmt.Errorf("failed to render label %s: %w", k, err)
+		}
+		if b.Len() > 0 {
+			res[k] = b.String()
+		}
+	}
+	return res, nil
+}
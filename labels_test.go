@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabelTemplates_render(t *testing.T) {
+	tests := []struct {
+		name      string
+		tagLabels map[string]string
+		labels    map[string]string
+		static    map[string]string
+		meta      Meta
+		want      map[string]string
+	}{
+		{
+			name: "defaults",
+			meta: Meta{Cluster: "prod", Namespace: "ns", Ingress: "ing"},
+			want: map[string]string{"cluster": "prod", "namespace": "ns", "ingress": "ing", "index": "prod-ns"},
+		},
+		{
+			name: "no cluster",
+			meta: Meta{Namespace: "ns", Ingress: "ing", Account: "shared"},
+			want: map[string]string{"namespace": "ns", "ingress": "ing", "account": "shared"},
+		},
+		{
+			name: "connection log",
+			meta: Meta{Namespace: "ns", LogType: kindConnection},
+			want: map[string]string{"namespace": "ns", "log_type": "connection"},
+		},
+		{
+			name:      "tag labels and overrides",
+			tagLabels: map[string]string{"app": "app.kubernetes.io/name", "team": "team"},
+			labels:    map[string]string{"index": "{{.Cluster}}-{{.Namespace}}-alb", "job": "alb", "ingress": ""},
+			meta:      Meta{Cluster: "prod", Namespace: "ns", Ingress: "ing", Labels: map[string]string{"app": "web"}},
+			want:      map[string]string{"cluster": "prod", "namespace": "ns", "index": "prod-ns-alb", "job": "alb", "app": "web"},
+		},
+		{
+			name:   "scheme labels",
+			labels: map[string]string{"scheme": "{{.Scheme}}", "ip_type": "{{.IPType}}"},
+			meta:   Meta{Namespace: "ns", Scheme: "internet-facing", IPType: "dualstack"},
+			want:   map[string]string{"namespace": "ns", "scheme": "internet-facing", "ip_type": "dualstack"},
+		},
+		{
+			name:   "static",
+			static: map[string]string{"format": "json", "raw": "{{.Cluster}}\""},
+			meta:   Meta{Namespace: "ns"},
+			want:   map[string]string{"namespace": "ns", "format": "json", "raw": "{{.Cluster}}\""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newLabelTemplates(tt.tagLabels, tt.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.static {
+				l.set(k, v)
+			}
+			got, err := l.render(tt.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("render() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newLabelTemplates(nil, map[string]string{"index": "{{.Cluster"}); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
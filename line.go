@@ -2,48 +2,164 @@ package main
 
 import (
 	"fmt"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/sepich/alb-logs-shipper/albparse"
 )
 
 // LineParser defines the interface for converting log lines to different formats
 type LineParser interface {
-	As(format, line string) (*time.Time, string, error)
+	As(format, line string) (logproto.Entry, error)
+	// Fields splits the line to values of subexpNames, followed by trailing
+	// unknown fields as one value, if any and supported by the tokenizer
+	Fields(line string) ([]string, error)
+	// LineAs converts fields of the line to the specified format
+	LineAs(format, line string, matches []string) (logproto.Entry, error)
+	// AppendLine is LineAs appending the formatted line to dst
+	AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error)
 }
 
 // Cache the subexp names to avoid repeated calls
 var subexpNames = evRegex.SubexpNames()[1:]
 
-type LineRegex struct{}
+var (
+	typeIdx = slices.Index(subexpNames, "type")
+	// targetStatusIdx is mapped to grpc_status field of gRPC lines
+	targetStatusIdx = slices.Index(subexpNames, "target_status_code")
+	timeIdx         = slices.Index(subexpNames, "time")
+	// quotedIdx is quoteFields by index of subexpNames
+	quotedIdx = func() []bool {
+		q := make([]bool, len(subexpNames))
+		for i, name := range subexpNames {
+			q[i] = quoteFields[name]
+		}
+		return q
+	}()
+)
+
+// fieldSpec is the layout of a formatted field, precomputed once instead of
+// map lookups for each field of each line
+type fieldSpec struct {
+	idx      int // index in matches
+	name     string
+	quoted   bool
+	number   bool
+	limit    int    // --max-field-length, 0 when not limited
+	metadata string // --metadata key, empty when not set
+	extra    bool   // packed to --extra-field
+}
+
+// FieldOptions are applied to field values when converting a line
+type FieldOptions struct {
+	// MaxLength limits field value length in bytes, longer values are truncated
+	MaxLength map[string]int
+	// Metadata maps field names to Loki structured metadata keys
+	Metadata map[string]string
+	// MetadataOnly drops fields of Metadata from lines
+	MetadataOnly bool
+	// Connections enrich entries by conn_trace_id when set
+	Connections *connCache
+	// Transformers are applied in order to fields of each line before formatting
+	Transformers []Transformer
+	// SanitizeUTF8 replaces invalid UTF-8 sequences with U+FFFD in any format,
+	// JSON entries are always sanitized
+	SanitizeUTF8 bool
+	// Extra is the name of field to pack skipped and trailing unknown fields
+	// to as JSON object, they are dropped when empty
+	Extra string
+	// Protocol adds protocol field normalized from request type after it
+	Protocol bool
+
+	layout []fieldSpec // set by Compile
+}
+
+// Compile precomputes layout of fields with the options. Options which are
+// not compiled build the layout for each line
+func (o FieldOptions) Compile() FieldOptions {
+	o.layout = o.fieldLayout()
+	return o
+}
+
+// fieldLayout returns specs of fields to be formatted, skipFields are only
+// included to be packed to Extra
+func (o FieldOptions) fieldLayout() []fieldSpec {
+	layout := make([]fieldSpec, 0, len(subexpNames))
+	for i, name := range subexpNames {
+		if skipFields[name] {
+			if o.Extra != "" {
+				layout = append(layout, fieldSpec{idx: i, name: name, quoted: quoteFields[name], extra: true})
+			}
+			continue // drop non relevant for EKS ALB
+		}
+		spec := fieldSpec{idx: i, name: name, quoted: quoteFields[name], number: numFields[name], metadata: o.Metadata[name]}
+		if !spec.number {
+			spec.limit = o.MaxLength[name]
+		}
+		layout = append(layout, spec)
+	}
+	return layout
+}
+
+// truncatedMarker is appended to truncated field values
+const truncatedMarker = "[truncated]"
+
+var truncatedFields = newCounter("alb_logs_shipper_truncated_fields_total", "Field values truncated to --max-field-length", "field")
+
+var invalidUTF8 = newCounter("alb_logs_shipper_invalid_utf8_total", "Field values with invalid UTF-8 sequences replaced by U+FFFD", "field")
+
+type LineRegex struct{ FieldOptions }
 
 var _ LineParser = &LineRegex{}
 
 // As parses log line via regex and converts it to the specified format
-func (r *LineRegex) As(format, line string) (*time.Time, string, error) {
+func (r *LineRegex) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields parses log line via regex
+func (r *LineRegex) Fields(line string) ([]string, error) {
 	matches := evRegex.FindStringSubmatch(line)
 	if len(matches) == 0 {
-		return nil, "", fmt.Errorf("failed to parse log line: %s", line)
+		return nil, fmt.Errorf("failed to parse log line: %s", line)
 	}
-	return LineAs(format, line, matches[1:])
+	return matches[1:], nil
 }
 
-type LineSlice struct{}
+type LineSlice struct{ FieldOptions }
 
 var _ LineParser = &LineSlice{}
 
 // As parses log line by slice and converts it to the specified format
-func (r *LineSlice) As(format, line string) (*time.Time, string, error) {
+func (r *LineSlice) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields parses log line by slice
+func (r *LineSlice) Fields(line string) ([]string, error) {
 	matches := []string{}
 	start := 0
 	end := 0
-	for _, name := range subexpNames {
+	for _, quoted := range quotedIdx {
 		if start >= len(line) {
-			return nil, "", fmt.Errorf("failed to parse log line: %s", line)
+			return nil, fmt.Errorf("failed to parse log line: %s", line)
 		}
 		for end = start + 1; end < len(line); end++ {
 			if line[end] == ' ' {
-				if !quoteFields[name] || (line[end-1] == '"' && line[end-2] != '\\') {
+				if !quoted || (line[end-1] == '"' && line[end-2] != '\\') {
 					break
 				}
 			}
@@ -51,64 +167,540 @@ func (r *LineSlice) As(format, line string) (*time.Time, string, error) {
 		matches = append(matches, line[start:end])
 		start = end + 1
 	}
-	return LineAs(format, line, matches)
+	if start < len(line) {
+		matches = append(matches, line[start:]) // trailing unknown fields
+	}
+	return matches, nil
 }
 
-func LineAs(format, line string, matches []string) (*time.Time, string, error) {
-	var builder strings.Builder
-	builder.Grow(1024) // Preallocate builder with estimated capacity
+var parserMismatches = newCounter("alb_logs_shipper_parser_mismatches_total", "Lines rejected by strict tokenizer and parsed by regex instead")
 
-	var ts time.Time
-	var err error
-	isFirst := true
-	isJSON := format == "json"
-	if isJSON {
-		builder.WriteByte('{')
+type LineStrict struct{ FieldOptions }
+
+var _ LineParser = &LineStrict{}
+
+// As parses log line by state-machine tokenizer and converts it to the specified format
+func (r *LineStrict) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
 	}
+	return r.LineAs(format, line, matches)
+}
 
-	for i, name := range subexpNames {
-		if skipFields[name] {
-			continue // drop non relevant for EKS ALB
+// Fields parses log line by state-machine tokenizer, and falls back to regex
+// when the line does not match the expected structure
+func (r *LineStrict) Fields(line string) ([]string, error) {
+	matches, err := albparse.Tokenize(line, subexpNames, quoteFields)
+	if err != nil {
+		parserMismatches.Inc()
+		return (&LineRegex{r.FieldOptions}).Fields(line)
+	}
+	return matches, nil
+}
+
+// Kinds of log lines, detected by the first tokens
+const (
+	kindAccess     = "access"
+	kindConnection = "connection"
+	kindNLB        = "nlb"
+	kindCloudFront = "cloudfront"
+	kindFlow       = "vpcflow"
+	kindWAF        = "waf"
+	kindUnknown    = "unknown"
+)
+
+// protocol returns protocol of the request type: http, http2, grpc or
+// websocket. Unknown types are returned as is
+func protocol(typ string) string {
+	switch typ {
+	case "http", "https":
+		return "http"
+	case "h2":
+		return "http2"
+	case "grpcs":
+		return "grpc"
+	case "ws", "wss":
+		return "websocket"
+	}
+	return typ
+}
+
+// grpcStatus returns gRPC status code name of HTTP status of gRPC response,
+// mapped like gRPC clients do for responses without grpc-status. Status of
+// responses with HTTP 200 is sent in trailers, which ALB does not log, so it
+// is returned as `-`
+func grpcStatus(status string) string {
+	switch status {
+	case "-", "200":
+		return "-"
+	case "400":
+		return "INTERNAL"
+	case "401":
+		return "UNAUTHENTICATED"
+	case "403":
+		return "PERMISSION_DENIED"
+	case "404":
+		return "UNIMPLEMENTED"
+	case "429", "502", "503", "504":
+		return "UNAVAILABLE"
+	}
+	return "UNKNOWN"
+}
+
+// lineKind detects kind of the log line: ALB access log starts with request
+// type, NLB access log with `tls 2.0`, ALB connection log with timestamp, and
+// CloudFront log is tab separated
+func lineKind(line string) string {
+	first, rest, _ := strings.Cut(line, " ")
+	if strings.IndexByte(first, '\t') > 0 {
+		return kindCloudFront
+	}
+	switch first {
+	case "http", "https", "h2", "grpcs", "ws", "wss":
+		return kindAccess
+	case "tls":
+		if strings.HasPrefix(rest, "2.0 ") {
+			return kindNLB
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, first); err == nil {
+		return kindConnection
+	}
+	return kindUnknown
+}
+
+// fieldsPool reuses fields of formatted lines
+var fieldsPool = sync.Pool{New: func() any {
+	f := make([]Field, 0, len(subexpNames)+3+len(connMTLSFields))
+	return &f
+}}
+
+// fields appends fields of the line to be formatted, with --max-field-length
+// and --metadata applied, and sets entry timestamp
+func (o FieldOptions) fields(fields []Field, line string, matches []string, entry *logproto.Entry) ([]Field, error) {
+	layout := o.layout
+	if layout == nil {
+		layout = o.fieldLayout()
+	}
+	var extra lineBuffer
+	for _, spec := range layout {
+		value := matches[spec.idx]
+		if spec.extra {
+			extra = appendExtra(extra, spec.name, value, spec.quoted)
+			continue
+		}
+		if spec.idx == timeIdx {
+			var err error
+			if entry.Timestamp, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("skipping log line with invalid timestamp %w: %s", err, line)
+			}
+		}
+
+		if spec.limit > 0 && len(value) > spec.limit {
+			value = truncate(value, spec.limit, spec.quoted)
+			truncatedFields.Inc(spec.name)
+		}
+
+		if spec.metadata != "" {
+			o.addMetadata(entry, spec.metadata, unquote(value))
 		}
+		if spec.metadata == "" || !o.MetadataOnly {
+			fields = append(fields, Field{Name: spec.name, Value: value, Quoted: spec.quoted, Number: spec.number})
+		}
+		if o.Protocol && spec.idx == typeIdx {
+			fields = append(fields, Field{Name: "protocol", Value: protocol(value)})
+		}
+		if o.Protocol && spec.idx == targetStatusIdx && matches[typeIdx] == "grpcs" {
+			fields = append(fields, Field{Name: "grpc_status", Value: grpcStatus(value)})
+		}
+	}
 
-		value := matches[i]
-		if name == "time" {
-			if ts, err = time.Parse(time.RFC3339, value); err != nil {
-				return nil, "", fmt.Errorf("skipping log line with invalid timestamp %w: %s", err, line)
+	if o.Connections != nil {
+		if info, ok := o.Connections.Get(matches[connTraceIdx], entry.Timestamp); ok {
+			fields = append(fields, Field{Name: "tls_handshake_latency", Value: info.handshakeLatency, Number: true})
+			for i, value := range info.mtls {
+				if value == "-" {
+					continue // no client certificate
+				}
+				name := connMTLSFields[i]
+				if key, ok := o.Metadata[name]; ok {
+					o.addMetadata(entry, key, unquote(value))
+					if o.MetadataOnly {
+						continue
+					}
+				}
+				fields = append(fields, Field{Name: name, Value: value, Quoted: connQuoted[name]})
 			}
 		}
+	}
+
+	if o.Extra != "" {
+		if len(matches) > len(subexpNames) {
+			extra = appendExtra(extra, "unknown", matches[len(subexpNames)], false)
+		}
+		if len(extra) > 0 {
+			extra = append(extra, '}')
+			fields = append(fields, Field{Name: o.Extra, Value: string(extra), Object: true})
+		}
+	}
+	return fields, nil
+}
+
+// appendExtra appends the field to JSON object of --extra-field
+func appendExtra(b lineBuffer, name, value string, quoted bool) lineBuffer {
+	if len(b) == 0 {
+		b = append(b, '{')
+	} else {
+		b = append(b, ',')
+	}
+	b = append(b, '"')
+	b = append(b, name...)
+	b = append(b, `":`...)
+	if !quoted {
+		value = quote(value)
+	}
+	if writeUnescaped(&b, value, true) > 0 {
+		invalidUTF8.Inc(name)
+	}
+	return b
+}
+
+// addMetadata adds structured metadata to the entry, skipping empty values
+func (o FieldOptions) addMetadata(entry *logproto.Entry, key, value string) {
+	if value == "" || value == "-" {
+		return
+	}
+	if o.SanitizeUTF8 && !utf8.ValidString(value) {
+		value = strings.ToValidUTF8(value, "\uFFFD")
+	}
+	entry.StructuredMetadata = append(entry.StructuredMetadata, logproto.LabelAdapter{Name: key, Value: value})
+}
+
+// LineAs converts fields of the line to the specified format
+func (o FieldOptions) LineAs(format, line string, matches []string) (logproto.Entry, error) {
+	buf, entry, err := o.AppendLine(make([]byte, 0, 1024), format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(buf), len(buf))
+	return entry, nil
+}
+
+// AppendLine appends fields of the line in the specified format to dst, and
+// returns the extended buffer and the entry without Line, to be set by caller
+func (o FieldOptions) AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error) {
+	var entry logproto.Entry
+	pooled := fieldsPool.Get().(*[]Field)
+	fields, err := o.fields((*pooled)[:0], line, matches, &entry)
+	defer func() {
+		if fields != nil {
+			*pooled = fields[:0]
+		}
+		fieldsPool.Put(pooled)
+	}()
+	if err != nil {
+		return dst, logproto.Entry{}, err
+	}
+	return o.appendFields(dst, format, fields), entry, nil
+}
+
+// appendFields applies transformers to the fields, and appends them in the
+// specified format to dst
+func (o FieldOptions) appendFields(dst []byte, format string, fields []Field) []byte {
+	for _, t := range o.Transformers {
+		fields = t.Transform(fields)
+	}
 
+	builder := lineBuffer(dst)
+
+	isJSON := format == "json"
+	if isJSON {
+		builder.WriteByte('{')
+	}
+	for i, f := range fields {
 		// separator
-		if !isFirst {
+		if i > 0 {
 			if isJSON {
 				builder.WriteByte(',')
 			} else {
 				builder.WriteByte(' ')
 			}
 		}
-		isFirst = false
 
-		// unescape
-		if quoteFields[name] {
-			s, err := strconv.Unquote(value) // `\x5C` to `"`
-			if err == nil {
-				value = strconv.Quote(s)
-			}
-		}
 		if isJSON {
-			builder.WriteString(`"` + name + `":`)
-			if numFields[name] || quoteFields[name] {
-				builder.WriteString(value)
-			} else {
-				builder.WriteString(`"` + value + `"`)
-			}
+			builder.WriteString(`"` + f.Name + `":`)
 		} else {
-			builder.WriteString(name + "=" + value)
+			builder.WriteString(f.Name + "=")
+		}
+		var replaced int
+		switch {
+		case f.Object && isJSON:
+			builder.WriteString(f.Value)
+		case f.Object:
+			writeUnescaped(&builder, quote(f.Value), false)
+		case f.Quoted:
+			replaced = writeUnescaped(&builder, f.Value, isJSON || o.SanitizeUTF8)
+		case isJSON && f.Number && isNumber(f.Value):
+			builder.WriteString(f.Value)
+		case isJSON && !isPlain(f.Value):
+			replaced = writeUnescaped(&builder, quote(f.Value), true)
+		case isJSON:
+			builder.WriteString(`"` + f.Value + `"`)
+		case o.SanitizeUTF8 && !utf8.ValidString(f.Value):
+			builder.WriteString(strings.ToValidUTF8(f.Value, "\uFFFD"))
+			replaced = 1
+		default:
+			builder.WriteString(f.Value)
+		}
+		if replaced > 0 {
+			invalidUTF8.Inc(f.Name)
 		}
 	}
-
 	if isJSON {
 		builder.WriteByte('}')
 	}
-	return &ts, builder.String(), nil
+	return builder
+}
+
+// lineBuffer is a byte slice formatted lines are appended to
+type lineBuffer []byte
+
+func (b *lineBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+func (b *lineBuffer) WriteByte(c byte) error {
+	*b = append(*b, c)
+	return nil
+}
+
+func (b *lineBuffer) WriteString(s string) (int, error) {
+	*b = append(*b, s...)
+	return len(s), nil
+}
+
+const (
+	// lineChunk is the size of buffers shared by formatted lines of a batch
+	lineChunk = 64 << 10
+	// lineReserve is the free space of the chunk to append the next line to,
+	// otherwise a new chunk is allocated
+	lineReserve = 4 << 10
+)
+
+// lineArena appends formatted lines to shared chunks, to allocate a chunk per
+// many lines instead of a string per line. Chunks are never written over, as
+// lines of flushed batches could still be referenced, but dropped when full
+type lineArena struct{ buf []byte }
+
+// LineAs converts fields of the line to the specified format, with Line
+// referencing the arena
+func (a *lineArena) LineAs(p LineParser, format, line string, matches []string) (logproto.Entry, error) {
+	if cap(a.buf)-len(a.buf) < lineReserve {
+		a.buf = make([]byte, 0, lineChunk)
+	}
+	dst := a.buf[len(a.buf):]
+	out, entry, err := p.AppendLine(dst, format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	if cap(out) == cap(dst) {
+		a.buf = a.buf[:len(a.buf)+len(out)] // otherwise the line outgrew the chunk
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(out), len(out))
+	return entry, nil
+}
+
+// truncate cuts value to limit bytes including appended truncatedMarker, not
+// splitting escape sequences or UTF-8 runes. Quotes of quoted values are kept
+func truncate(value string, limit int, quoted bool) string {
+	quoted = quoted && len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"'
+	if quoted {
+		value = value[1 : len(value)-1]
+	}
+	cut := min(max(limit-len(truncatedMarker), 0), len(value))
+	if i := strings.LastIndexByte(value[max(cut-3, 0):cut], '\\'); i >= 0 {
+		cut = max(cut-3, 0) + i
+	}
+	for cut > 0 && cut < len(value) && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	value = value[:cut] + truncatedMarker
+	if quoted {
+		value = `"` + value + `"`
+	}
+	return value
+}
+
+// writeUnescaped decodes ALB escaping (`\xHH`, `\"`, `\\`) of a quoted field
+// value and writes it back quoted, escaped to be valid both as JSON and logfmt.
+// Invalid escape sequences are kept as literal backslash. With sanitize set,
+// invalid UTF-8 sequences are replaced with U+FFFD, as JSON should be UTF-8.
+// Returns count of replaced sequences
+func writeUnescaped(b *lineBuffer, value string, sanitize bool) int {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		b.WriteString(value)
+		return 0
+	}
+	var replaced int
+	end := len(value) - 1
+	b.WriteByte('"')
+	for i := 1; i < end; i++ {
+		var c byte
+		c, i = albparse.DecodeAt(value, i, end)
+		if c < utf8.RuneSelf || !sanitize {
+			writeEscaped(b, c)
+			continue
+		}
+		// collect decoded bytes of the rune, and positions they end at
+		var buf [utf8.UTFMax]byte
+		var ends [utf8.UTFMax]int
+		buf[0], ends[0] = c, i
+		n := 1
+		for ; n < utf8.UTFMax && ends[n-1]+1 < end; n++ {
+			next, j := albparse.DecodeAt(value, ends[n-1]+1, end)
+			if utf8.RuneStart(next) {
+				break
+			}
+			buf[n], ends[n] = next, j
+		}
+		r, size := utf8.DecodeRune(buf[:n])
+		if r == utf8.RuneError && size <= 1 {
+			b.WriteString("\uFFFD")
+			replaced++
+			continue
+		}
+		b.Write(buf[:size])
+		i = ends[size-1]
+	}
+	b.WriteByte('"')
+	return replaced
+}
+
+// isPlain reports whether unquoted value could be written to JSON string
+// as is, without escaping
+func isPlain(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < 0x20 || c >= 0x7f || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// isNumber reports whether value is a valid JSON number, like `-1` or
+// `0.001`. ALB writes `-` for missing numbers, which should be quoted in JSON
+func isNumber(value string) bool {
+	value = strings.TrimPrefix(value, "-")
+	digits, frac, dot := strings.Cut(value, ".")
+	if digits == "" || dot && frac == "" {
+		return false
+	}
+	for _, part := range []string{digits, frac} {
+		for i := 0; i < len(part); i++ {
+			if part[i] < '0' || part[i] > '9' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// unquote returns decoded value of a quoted field, unquoted values are returned as is
+func unquote(value string) string {
+	return albparse.Unquote(value)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeEscaped writes a byte of a quoted string value
+func writeEscaped(b *lineBuffer, c byte) {
+	switch {
+	case c == '"' || c == '\\':
+		b.WriteByte('\\')
+		b.WriteByte(c)
+	case c == '\n':
+		b.WriteString(`\n`)
+	case c == '\r':
+		b.WriteString(`\r`)
+	case c == '\t':
+		b.WriteString(`\t`)
+	case c < 0x20 || c == 0x7f:
+		b.WriteString(`\u00`)
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&0xf])
+	default:
+		b.WriteByte(c)
+	}
+}
+
+// otherFormat describes fields of log lines other than ALB access log, which
+// are formatted as split, without fields derived from access log ones
+type otherFormat struct {
+	fields []string
+	quoted map[string]bool // values in double quotes
+	skip   map[string]bool // dropped by default, kept in --extra-field
+	number map[string]bool // written as JSON numbers
+	// timestamp returns time of the entry from fields of the line
+	timestamp func(matches []string) (time.Time, error)
+}
+
+// appendOther appends fields of the line of other format to dst
+func (o FieldOptions) appendOther(dst []byte, format, line string, matches []string, f *otherFormat) ([]byte, logproto.Entry, error) {
+	var entry logproto.Entry
+	ts, err := f.timestamp(matches)
+	if err != nil {
+		return dst, logproto.Entry{}, fmt.Errorf("skipping log line with invalid timestamp %w: %s", err, line)
+	}
+	entry.Timestamp = ts
+
+	pooled := fieldsPool.Get().(*[]Field)
+	defer fieldsPool.Put(pooled)
+	fields := (*pooled)[:0]
+	var extra lineBuffer
+	for i, name := range f.fields {
+		value, quoted := matches[i], f.quoted[name]
+		if f.skip[name] {
+			if o.Extra != "" {
+				extra = appendExtra(extra, name, value, quoted)
+			}
+			continue
+		}
+		number := f.number[name]
+		if limit := o.MaxLength[name]; !number && limit > 0 && len(value) > limit {
+			value = truncate(value, limit, quoted)
+			truncatedFields.Inc(name)
+		}
+		if key, ok := o.Metadata[name]; ok {
+			o.addMetadata(&entry, key, unquote(value))
+			if o.MetadataOnly {
+				continue
+			}
+		}
+		fields = append(fields, Field{Name: name, Value: value, Quoted: quoted, Number: number})
+	}
+	if o.Extra != "" {
+		if len(matches) > len(f.fields) {
+			extra = appendExtra(extra, "unknown", matches[len(f.fields)], false)
+		}
+		if len(extra) > 0 {
+			extra = append(extra, '}')
+			fields = append(fields, Field{Name: o.Extra, Value: string(extra), Object: true})
+		}
+	}
+	dst = o.appendFields(dst, format, fields)
+	*pooled = fields[:0]
+	return dst, entry, nil
+}
+
+// timeField returns timestamp func of otherFormat, which parses the field of
+// NLB and connection log lines. NLB ones have no time zone and are UTC
+func timeField(idx int) func(matches []string) (time.Time, error) {
+	return func(matches []string) (time.Time, error) {
+		if ts, err := time.Parse(time.RFC3339, matches[idx]); err == nil {
+			return ts, nil
+		}
+		return time.Parse("2006-01-02T15:04:05", matches[idx])
+	}
 }
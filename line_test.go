@@ -2,8 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"github.com/sepich/alb-logs-shipper/albparse"
 )
 
 func TestLineParser_As(t *testing.T) {
@@ -55,69 +62,391 @@ func TestLineParser_As(t *testing.T) {
 			out:    `{"type":"h2","time":"2018-07-02T22:23:00.186641Z","elb":"app/my-loadbalancer/50dc6c495c0c9188","client":"10.0.1.252:48160","target":"10.0.0.66:9000","request_processing_time":0.000,"target_processing_time":0.002,"response_processing_time":0.000,"elb_status_code":200,"target_status_code":200,"received_bytes":5,"sent_bytes":257,"request":"GET https://10.0.2.105:773/ HTTP/2.0","user_agent":"user\"agent\" UpstreamClient(Apache-HttpClient/5.0.3 \\(Java/21.0.4\\))","ssl_cipher":"ECDHE-RSA-AES128-GCM-SHA256","ssl_protocol":"TLSv1.2","trace_id":"Root=1-58337327-72bd00b0343d75b906739c42","domain_name":"-","request_creation_time":"2018-07-02T22:22:48.364000Z","actions_executed":"redirect","redirect_url":"https://example.com:80/"}`,
 			err:    false,
 		},
+		{
+			name:   "http invalid escape logfmt",
+			format: "logfmt",
+			in:     `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl\x2G \x22x\q\x09" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`,
+			ts:     time.Date(2018, time.July, 2, 22, 23, 0, 186641000, time.UTC),
+			out:    `type=http time=2018-07-02T22:23:00.186641Z elb=app/my-loadbalancer/50dc6c495c0c9188 client=192.168.131.39:2817 target=10.0.0.1:80 request_processing_time=0.000 target_processing_time=0.001 response_processing_time=0.000 elb_status_code=200 target_status_code=200 received_bytes=34 sent_bytes=366 request="GET http://www.example.com:80/ HTTP/1.1" user_agent="curl\\x2G \"x\\q\t" ssl_cipher=- ssl_protocol=- trace_id="Root=1-58337262-36d228ad5d99923122bbe354" domain_name="-" request_creation_time=2018-07-02T22:22:48.364000Z actions_executed="forward" redirect_url="-"`,
+			err:    false,
+		},
+		{
+			name:   "http invalid escape json",
+			format: "json",
+			in:     `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl\x2G \x22x\q\x01" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`,
+			ts:     time.Date(2018, time.July, 2, 22, 23, 0, 186641000, time.UTC),
+			out:    `{"type":"http","time":"2018-07-02T22:23:00.186641Z","elb":"app/my-loadbalancer/50dc6c495c0c9188","client":"192.168.131.39:2817","target":"10.0.0.1:80","request_processing_time":0.000,"target_processing_time":0.001,"response_processing_time":0.000,"elb_status_code":200,"target_status_code":200,"received_bytes":34,"sent_bytes":366,"request":"GET http://www.example.com:80/ HTTP/1.1","user_agent":"curl\\x2G \"x\\q\u0001","ssl_cipher":"-","ssl_protocol":"-","trace_id":"Root=1-58337262-36d228ad5d99923122bbe354","domain_name":"-","request_creation_time":"2018-07-02T22:22:48.364000Z","actions_executed":"forward","redirect_url":"-"}`,
+			err:    false,
+		},
+		{
+			name:   "grpc json",
+			format: "json",
+			in:     `grpcs 2021-04-07T22:39:02.385254Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "POST https://10.0.2.105:443/helloworld.Greeter/SayHello HTTP/2.0" "grpc-java-netty/1.22.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "-" 1 2021-04-07T22:39:02.385000Z "forward" "-" "-" "10.0.0.66:9000" "200" "-" "-" TID_1234abcd5678ef90`,
+			ts:     time.Date(2021, time.April, 7, 22, 39, 2, 385254000, time.UTC),
+			out:    `{"type":"grpcs","time":"2021-04-07T22:39:02.385254Z","elb":"app/my-loadbalancer/50dc6c495c0c9188","client":"10.0.1.252:48160","target":"10.0.0.66:9000","request_processing_time":0.000,"target_processing_time":0.002,"response_processing_time":0.000,"elb_status_code":200,"target_status_code":200,"received_bytes":5,"sent_bytes":257,"request":"POST https://10.0.2.105:443/helloworld.Greeter/SayHello HTTP/2.0","user_agent":"grpc-java-netty/1.22.0","ssl_cipher":"ECDHE-RSA-AES128-GCM-SHA256","ssl_protocol":"TLSv1.2","trace_id":"Root=1-58337327-72bd00b0343d75b906739c42","domain_name":"-","request_creation_time":"2021-04-07T22:39:02.385000Z","actions_executed":"forward","redirect_url":"-"}`,
+			err:    false,
+		},
+		{
+			name:   "websocket logfmt",
+			format: "logfmt",
+			in:     `wss 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.0.140:44244 10.0.0.171:8010 0.000 0.001 0.000 101 101 218 786 "GET https://10.0.0.30:443/ HTTP/1.1" "-" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "-" "-" "-" 1 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.171:8010" "101" "-" "-" TID_1234abcd5678ef90`,
+			ts:     time.Date(2018, time.July, 2, 22, 23, 0, 186641000, time.UTC),
+			out:    `type=wss time=2018-07-02T22:23:00.186641Z elb=app/my-loadbalancer/50dc6c495c0c9188 client=10.0.0.140:44244 target=10.0.0.171:8010 request_processing_time=0.000 target_processing_time=0.001 response_processing_time=0.000 elb_status_code=101 target_status_code=101 received_bytes=218 sent_bytes=786 request="GET https://10.0.0.30:443/ HTTP/1.1" user_agent="-" ssl_cipher=ECDHE-RSA-AES128-GCM-SHA256 ssl_protocol=TLSv1.2 trace_id="-" domain_name="-" request_creation_time=2018-07-02T22:22:48.364000Z actions_executed="forward" redirect_url="-"`,
+			err:    false,
+		},
 	}
 
-	lr := &LineRegex{}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ts, out, err := lr.As(tt.format, tt.in)
+	parsers := []struct {
+		name string
+		lp   LineParser
+	}{
+		{"LineRegex", &LineRegex{}},
+		{"LineSlice", &LineSlice{}},
+		{"LineStrict", &LineStrict{}},
+	}
+	for _, p := range parsers {
+		for _, tt := range tests {
+			t.Run(p.name+"/"+tt.name, func(t *testing.T) {
+				entry, err := p.lp.As(tt.format, tt.in)
+				ts, out := entry.Timestamp, entry.Line
 
-			if (err != nil) != tt.err {
-				t.Errorf("LineRegex.As() error = %v, wantErr %v", err, tt.err)
-				return
-			}
+				if (err != nil) != tt.err {
+					t.Errorf("%s.As() error = %v, wantErr %v", p.name, err, tt.err)
+					return
+				}
 
-			if tt.err {
-				return
-			}
+				if tt.err {
+					return
+				}
 
-			if !ts.Equal(tt.ts) {
-				t.Errorf("LineRegex.As() ts = %v, want %v", ts, tt.ts)
-			}
+				if !ts.Equal(tt.ts) {
+					t.Errorf("%s.As() ts = %v, want %v", p.name, ts, tt.ts)
+				}
 
-			if out != tt.out {
-				t.Errorf("LineRegex.As() out:\n%v\nwant:\n%v", out, tt.out)
-			}
-			if tt.format == "json" {
-				if !json.Valid([]byte(out)) {
-					t.Errorf("LineRegex.As() out is not valid JSON")
+				if out != tt.out {
+					t.Errorf("%s.As() out:\n%v\nwant:\n%v", p.name, out, tt.out)
 				}
-			}
-		})
+				if tt.format == "json" {
+					if !json.Valid([]byte(out)) {
+						t.Errorf("%s.As() out is not valid JSON", p.name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLineAs_Metadata(t *testing.T) {
+	in := `h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0" "user\x22agent\x22" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "-" 1 2018-07-02T22:22:48.364000Z "redirect" "https://example.com:80/" "-" "10.0.0.66:9000" "200" "-" "-" TID_1234abcd5678ef90`
+	ls := &LineSlice{FieldOptions{Metadata: map[string]string{
+		"trace_id":    "trace_id",
+		"user_agent":  "ua",
+		"client":      "client",
+		"domain_name": "domain",
+	}}.Compile()}
+	entry, err := ls.As("logfmt", in)
+	if err != nil {
+		t.Fatalf("LineSlice.As() error = %v", err)
 	}
+	want := map[string]string{
+		"trace_id": "Root=1-58337327-72bd00b0343d75b906739c42",
+		"ua":       `user"agent"`,
+		"client":   "10.0.1.252:48160",
+	}
+	if len(entry.StructuredMetadata) != len(want) {
+		t.Fatalf("LineSlice.As() metadata = %v, want %v", entry.StructuredMetadata, want)
+	}
+	for _, l := range entry.StructuredMetadata {
+		if want[l.Name] != l.Value {
+			t.Errorf("LineSlice.As() metadata %s = %q, want %q", l.Name, l.Value, want[l.Name])
+		}
+	}
+}
+
+func TestLineAs_MetadataOnly(t *testing.T) {
+	in := `h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0" "curl/8.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "-" 1 2018-07-02T22:22:48.364000Z "redirect" "https://example.com:80/" "-" "10.0.0.66:9000" "200" "-" "-" TID_1234abcd5678ef90`
+	ls := &LineSlice{FieldOptions{MetadataOnly: true, Metadata: map[string]string{
+		"trace_id": "trace_id",
+		"client":   "client",
+	}}.Compile()}
+	for _, format := range []string{"logfmt", "json", "raw"} {
+		entry, err := ls.As(format, in)
+		if err != nil {
+			t.Fatalf("LineSlice.As(%s) error = %v", format, err)
+		}
+		if strings.Contains(entry.Line, "Root=1-58337327") || strings.Contains(entry.Line, "10.0.1.252:48160") {
+			t.Errorf("LineSlice.As(%s) kept --metadata fields in line: %s", format, entry.Line)
+		}
+		if !strings.Contains(entry.Line, "curl/8.0") {
+			t.Errorf("LineSlice.As(%s) dropped other fields: %s", format, entry.Line)
+		}
+		if len(entry.StructuredMetadata) != 2 {
+			t.Errorf("LineSlice.As(%s) metadata = %v, want trace_id and client", format, entry.StructuredMetadata)
+		}
+	}
+}
 
+func TestLineAs_JSONEscaping(t *testing.T) {
+	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 - -1 -1 -1 460 - 34 0 "GET http://www.example.com:80/\xff HTTP/1.1" "\x01bad\xff\xc3\xa9\xe2\x82\x09agent\\x" - - - "-" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "-" "-" "-" "-" TID_1234abcd5678ef90`
 	ls := &LineSlice{}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ts, out, err := ls.As(tt.format, tt.in)
+	entry, err := ls.As("json", in)
+	if err != nil {
+		t.Fatalf("LineSlice.As() error = %v", err)
+	}
+	var got map[string]any
+	if err = json.Unmarshal([]byte(entry.Line), &got); err != nil {
+		t.Fatalf("LineSlice.As() = %s, invalid JSON: %v", entry.Line, err)
+	}
+	want := map[string]any{
+		"user_agent":         "\x01bad�é��\tagent\\x",
+		"request":            "GET http://www.example.com:80/� HTTP/1.1",
+		"target_status_code": "-",
+		"elb_status_code":    float64(460),
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("LineSlice.As() %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
 
-			if (err != nil) != tt.err {
-				t.Errorf("LineSlice.As() error = %v, wantErr %v", err, tt.err)
-				return
-			}
+func TestLineAs_SanitizeUTF8(t *testing.T) {
+	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 - -1 -1 -1 460 - 34 0 "GET http://www.example.com:80/ HTTP/1.1" "bad\xff\xc3\xa9agent" - - - "-" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "-" "-" "-" "-" TID_1234abcd5678ef90`
+	for _, sanitize := range []bool{false, true} {
+		ls := &LineSlice{FieldOptions{SanitizeUTF8: sanitize, Metadata: map[string]string{"user_agent": "ua"}}}
+		entry, err := ls.As("logfmt", in)
+		if err != nil {
+			t.Fatalf("LineSlice.As() error = %v", err)
+		}
+		if got := utf8.ValidString(entry.Line) && utf8.ValidString(entry.StructuredMetadata[0].Value); got != sanitize {
+			t.Errorf("LineSlice.As() with sanitize %v is valid UTF-8 %v: %q", sanitize, got, entry.Line)
+		}
+		if sanitize && !strings.Contains(entry.Line, `user_agent="bad�éagent"`) {
+			t.Errorf("LineSlice.As() = %s, want user_agent=\"bad�éagent\"", entry.Line)
+		}
+	}
+}
 
-			if tt.err {
-				return
-			}
+func TestLineAs_Extra(t *testing.T) {
+	in := `h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "arn:aws:acm:us-east-2:123456789012:certificate/12345678" 1 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.66:9000" "200" "Rule" "Ambiguous \"URI\"" TID_1234abcd5678ef90 new "field"`
+	want := `{"target_group_arn":"arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067","chosen_cert_arn":"arn:aws:acm:us-east-2:123456789012:certificate/12345678","matched_rule_priority":"1","error_reason":"-","targets":"10.0.0.66:9000","target_status_code_list":"200","classification":"Rule","classification_reason":"Ambiguous \"URI\"","conn_trace_id":"TID_1234abcd5678ef90","unknown":"new \"field\""}`
+	for _, p := range []LineParser{&LineSlice{FieldOptions{Extra: "extra"}}, &LineStrict{FieldOptions{Extra: "extra"}}} {
+		entry, err := p.As("json", in)
+		if err != nil {
+			t.Fatalf("%T.As() error = %v", p, err)
+		}
+		var got map[string]json.RawMessage
+		if err = json.Unmarshal([]byte(entry.Line), &got); err != nil {
+			t.Fatalf("%T.As() is not valid JSON: %v\n%s", p, err, entry.Line)
+		}
+		if string(got["extra"]) != want {
+			t.Errorf("%T.As() extra = %s, want %s", p, got["extra"], want)
+		}
 
-			if !ts.Equal(tt.ts) {
-				t.Errorf("LineSlice.As() ts = %v, want %v", ts, tt.ts)
-			}
+		entry, err = p.As("logfmt", in)
+		if err != nil {
+			t.Fatalf("%T.As() error = %v", p, err)
+		}
+		_, extra, _ := strings.Cut(entry.Line, " extra=")
+		if extra, err = strconv.Unquote(extra); err != nil || extra != want {
+			t.Errorf("%T.As() logfmt extra = %s, want %s", p, extra, want)
+		}
+	}
+
+	entry, err := (&LineSlice{}).As("json", in)
+	if err != nil {
+		t.Fatalf("LineSlice.As() error = %v", err)
+	}
+	if strings.Contains(entry.Line, "extra") || strings.Contains(entry.Line, "classification") {
+		t.Errorf("LineSlice.As() without extra field = %s", entry.Line)
+	}
+}
 
-			if out != tt.out {
-				t.Errorf("LineSlice.As() out:\n%v\nwant:\n%v", out, tt.out)
+func TestLineAs_Protocol(t *testing.T) {
+	tests := []struct {
+		typ  string
+		want string
+	}{
+		{"http", "http"},
+		{"https", "http"},
+		{"h2", "http2"},
+		{"grpcs", "grpc"},
+		{"ws", "websocket"},
+		{"wss", "websocket"},
+	}
+	in := ` 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "-" 1 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.66:9000" "200" "-" "-" TID_1234abcd5678ef90`
+	for _, tt := range tests {
+		for _, p := range []LineParser{&LineRegex{FieldOptions{Protocol: true}}, &LineSlice{FieldOptions{Protocol: true}}} {
+			entry, err := p.As("logfmt", tt.typ+in)
+			if err != nil {
+				t.Fatalf("%T.As() error = %v", p, err)
 			}
-			if tt.format == "json" {
-				if !json.Valid([]byte(out)) {
-					t.Errorf("LineSlice.As() out is not valid JSON")
-				}
+			want := "type=" + tt.typ + " protocol=" + tt.want + " time="
+			if !strings.HasPrefix(entry.Line, want) {
+				t.Errorf("%T.As(%s) = %.60s, want prefix %s", p, tt.typ, entry.Line, want)
 			}
-		})
+			if strings.Contains(entry.Line, "grpc_status=") != (tt.typ == "grpcs") {
+				t.Errorf("%T.As(%s) = %s, want grpc_status only for grpcs", p, tt.typ, entry.Line)
+			}
+		}
+	}
+
+	grpc := strings.Replace("grpcs"+in, " 200 200 ", " 502 503 ", 1)
+	entry, err := (&LineSlice{FieldOptions{Protocol: true}}).As("logfmt", grpc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(entry.Line, " target_status_code=503 grpc_status=UNAVAILABLE ") {
+		t.Errorf("LineSlice.As(grpcs) = %s, want grpc_status=UNAVAILABLE", entry.Line)
+	}
+}
+
+func TestGrpcStatus(t *testing.T) {
+	tests := map[string]string{"200": "-", "-": "-", "400": "INTERNAL", "401": "UNAUTHENTICATED", "403": "PERMISSION_DENIED", "404": "UNIMPLEMENTED", "429": "UNAVAILABLE", "504": "UNAVAILABLE", "500": "UNKNOWN"}
+	for status, want := range tests {
+		if got := grpcStatus(status); got != want {
+			t.Errorf("grpcStatus(%s) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestLineAs_MTLS(t *testing.T) {
+	in := `h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "-" 1 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.66:9000" "200" "-" "-" TID_1234abcd5678ef90`
+	conns := newConnCache(time.Minute, 0, true)
+	conns.add([]string{"TID_1234abcd5678ef90"}, []connInfo{{
+		handshakeLatency: "0.008",
+		ts:               time.Date(2018, 7, 2, 22, 22, 48, 0, time.UTC),
+		mtls:             []string{`"CN=client,O=Example"`, "NotBefore=2024-01-01T00:00:00Z;NotAfter=2025-01-01T00:00:00Z", "12345", "Success"},
+	}})
+	ls := &LineSlice{FieldOptions{Connections: conns, Metadata: map[string]string{"leaf_client_cert_subject": "client_cert"}}}
+	entry, err := ls.As("logfmt", in)
+	if err != nil {
+		t.Fatalf("LineSlice.As() error = %v", err)
+	}
+	want := `tls_handshake_latency=0.008 leaf_client_cert_subject="CN=client,O=Example" leaf_client_cert_validity=NotBefore=2024-01-01T00:00:00Z;NotAfter=2025-01-01T00:00:00Z leaf_client_cert_serial_number=12345 tls_verify_status=Success`
+	if !strings.HasSuffix(entry.Line, want) {
+		t.Errorf("LineSlice.As() = %s, want suffix %s", entry.Line, want)
+	}
+	if len(entry.StructuredMetadata) != 1 || entry.StructuredMetadata[0].Value != "CN=client,O=Example" {
+		t.Errorf("LineSlice.As() metadata = %v, want client_cert", entry.StructuredMetadata)
+	}
+}
+
+func TestLineKind(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0"`, kindAccess},
+		{`wss 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.0.140:40914 10.0.1.192:8010 0.001 0.003 0.000 101 101 218 587`, kindAccess},
+		{`2023-12-04T18:45:52.456000Z 10.0.1.252 48160 443 TLSv1.2 ECDHE-RSA-AES128-GCM-SHA256 4 "-" - - - TID_1234abcd5678ef90`, kindConnection},
+		{`tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99`, kindNLB},
+		{"2019-12-04\t21:02:31\tLAX1-C3\t392\t192.0.2.100\tGET\td111111abcdef8.cloudfront.net\t/index.html\t200", kindCloudFront},
+		{`#Fields: date time x-edge-location`, kindUnknown},
+		{`tls 1.0 something`, kindUnknown},
+		{``, kindUnknown},
+	}
+	for _, tt := range tests {
+		if got := lineKind(tt.line); got != tt.want {
+			t.Errorf("lineKind(%.20q) = %s, want %s", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLineArena(t *testing.T) {
+	l := &LineSlice{FieldOptions{}.Compile()}
+	var arena lineArena
+	var entries []string
+	var want []string
+	for i := range 300 {
+		ua := strings.Repeat("a", i)
+		if i == 100 {
+			ua = strings.Repeat("b", 2*lineChunk) // outgrows the chunk
+		}
+		in := fmt.Sprintf(`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:%d 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "%s" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`, i, ua)
+		matches, err := l.Fields(in)
+		if err != nil {
+			t.Fatalf("LineSlice.Fields() error = %v", err)
+		}
+		entry, err := arena.LineAs(l, "json", in, matches)
+		if err != nil {
+			t.Fatalf("lineArena.LineAs() error = %v", err)
+		}
+		expected, _ := l.LineAs("json", in, matches)
+		entries = append(entries, entry.Line)
+		want = append(want, expected.Line)
+	}
+	for i := range entries {
+		if entries[i] != want[i] {
+			t.Errorf("lineArena.LineAs() line %d = %.80s, want %.80s", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	// escaped backslash before closing quote is mis-split by LineSlice
+	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl\\" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`
+	matches, err := albparse.Tokenize(in, subexpNames, quoteFields)
+	if err != nil {
+		t.Fatalf("Tokenize() error = %v", err)
+	}
+	if got := matches[fieldIndex("user_agent")]; got != `"curl\\"` {
+		t.Errorf("Tokenize() user_agent = %s, want %s", got, `"curl\\"`)
+	}
+	if got := matches[fieldIndex("ssl_cipher")]; got != "-" {
+		t.Errorf("Tokenize() ssl_cipher = %s, want -", got)
+	}
+
+	bad := []string{
+		`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188`,
+		`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 GET "curl"`,
+		`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET "curl"`,
+	}
+	for _, in := range bad {
+		if _, err := albparse.Tokenize(in, subexpNames, quoteFields); err == nil {
+			t.Errorf("Tokenize(%q) expected error", in)
+		}
+	}
+}
+
+func TestAlbparseFields(t *testing.T) {
+	// albparse should stay in sync with evRegex, as both parse the same lines
+	if !slices.Equal(subexpNames, albparse.Fields) {
+		t.Errorf("albparse.Fields = %v, want %v", albparse.Fields, subexpNames)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		value  string
+		limit  int
+		quoted bool
+		want   string
+	}{
+		{`"GET http://example.com/path HTTP/1.1"`, 21, true, `"GET http:/[truncated]"`},
+		{`"agent\x22quoted\x22"`, 18, true, `"agent[truncated]"`},
+		{`"agent\x22quoted\x22"`, 20, true, `"agent\x22[truncated]"`},
+		{`"привет"`, 16, true, `"пр[truncated]"`},
+		{`app/my-loadbalancer/50dc6c495c0c9188`, 17, false, `app/my[truncated]`},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.value, tt.limit, tt.quoted); got != tt.want {
+			t.Errorf("truncate(%s, %d) = %s, want %s", tt.value, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func fieldIndex(name string) int {
+	for i, n := range subexpNames {
+		if n == name {
+			return i
+		}
 	}
+	return -1
 }
 
 func BenchmarkLineRegex_AsLogfmt(b *testing.B) {
-	lr := &LineRegex{}
+	lr := &LineRegex{FieldOptions{}.Compile()}
 	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`
 	for b.Loop() {
 		lr.As("logfmt", in)
@@ -125,7 +454,7 @@ func BenchmarkLineRegex_AsLogfmt(b *testing.B) {
 }
 
 func BenchmarkLineRegex_AsJson(b *testing.B) {
-	lr := &LineRegex{}
+	lr := &LineRegex{FieldOptions{}.Compile()}
 	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`
 	for b.Loop() {
 		lr.As("json", in)
@@ -133,7 +462,7 @@ func BenchmarkLineRegex_AsJson(b *testing.B) {
 }
 
 func BenchmarkLineSlice_AsLogfmt(b *testing.B) {
-	l := &LineSlice{}
+	l := &LineSlice{FieldOptions{}.Compile()}
 	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`
 	for b.Loop() {
 		l.As("logfmt", in)
@@ -141,9 +470,19 @@ func BenchmarkLineSlice_AsLogfmt(b *testing.B) {
 }
 
 func BenchmarkLineSlice_AsJson(b *testing.B) {
-	l := &LineSlice{}
+	l := &LineSlice{FieldOptions{}.Compile()}
 	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`
 	for b.Loop() {
 		l.As("json", in)
 	}
 }
+
+func BenchmarkLineArena_AsJson(b *testing.B) {
+	l := &LineSlice{FieldOptions{}.Compile()}
+	var arena lineArena
+	in := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`
+	for b.Loop() {
+		matches, _ := l.Fields(in)
+		arena.LineAs(l, "json", in, matches)
+	}
+}
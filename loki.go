@@ -3,20 +3,30 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
-	"github.com/gogo/protobuf/proto"
-
 	"github.com/golang/snappy"
 	"github.com/grafana/dskit/backoff"
 	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/prometheus/common/version"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -26,130 +36,690 @@ const (
 	maxRetries = 10
 )
 
+var (
+	batchRawBytes     = newCounter("alb_logs_shipper_batch_raw_bytes_total", "Bytes of marshaled push requests before snappy compression", "tenant")
+	batchEncodedBytes = newCounter("alb_logs_shipper_batch_encoded_bytes_total", "Bytes of push requests after snappy compression", "tenant")
+	pushThrottled     = newCounter("alb_logs_shipper_push_throttled_total", "Push requests which waited for --loki-max-inflight slot", "tenant")
+	streamThrottled   = newCounter("alb_logs_shipper_stream_throttled_seconds_total", "Time batches waited to not exceed --loki-stream-rate", "tenant")
+	pushRetries       = newCounter("alb_logs_shipper_push_retries_total", "Push requests retried, by reason (429, 5xx, connection)", "tenant", "reason")
+	pushBackoff       = newHistogram("alb_logs_shipper_push_backoff_seconds", "Time a push spent waiting between retries", exponentialBuckets(0.1, 2, 13), "tenant")
+)
+
 type batch struct {
-	stream *logproto.Stream
-	lines  int
-	client *lokiClient
+	stream    *logproto.Stream
+	labels    map[string]string
+	lines     int
+	client    *lokiClient
+	tenant    string   // X-Scope-OrgID of push requests, empty to not send
+	tenantErr error    // of rendering the tenant, batch is not pushed then
+	ids       []string // of sent push requests
+	spool     *spool   // to write batches to while circuit breaker is open
+	key       string   // S3 key of the file
+	spooled   int
+	span      time.Duration // max time range of entries, 0 for unlimited
+	trace     *fileTrace    // to record pushes to, when set
+	first     time.Time     // min and max timestamps of entries
+	last      time.Time
+	arena     lineArena     // lines of entries are formatted to
+	limits    batchLimits   // to flush at
+	bytes     int           // of entries, as counted by size()
+	started   time.Time     // when the first entry was added
+	pipe      *pushPipeline // to push in background, with --push-pipeline
+	piped     bool          // pushed by pipe, concurrently with parsing
+}
+
+// batchLimits are thresholds to flush batch at, 0 for unlimited
+type batchLimits struct {
+	lines int
+	bytes int
+	wait  time.Duration
 }
 
-func newBatch(labels map[string]string, opts Options, logger *slog.Logger) *batch {
+func newBatch(labels map[string]string, client *lokiClient) *batch {
 	ls := make([]string, 0, len(labels))
 	for l, v := range labels {
 		ls = append(ls, fmt.Sprintf("%s=%q", l, v))
 	}
 	sort.Strings(ls)
+	tenant, err := client.tenantOf(labels)
 	return &batch{
 		stream: &logproto.Stream{
 			Labels: fmt.Sprintf("{%s}", strings.Join(ls, ", ")),
 		},
-		client: newLokiClient(opts.LokiURL, opts.LokiUser, opts.LokiPassword, logger),
+		labels:    labels,
+		client:    client,
+		tenant:    tenant,
+		tenantErr: err,
+		limits:    batchLimits{lines: 100},
 	}
 }
 
-func (b *batch) add(ts time.Time, line string) error {
-	b.stream.Entries = append(b.stream.Entries, logproto.Entry{
-		Timestamp: ts,
-		Line:      line,
-	})
+func (b *batch) add(entry logproto.Entry) {
+	if b.lines == 0 || entry.Timestamp.Before(b.first) {
+		b.first = entry.Timestamp
+	}
+	if b.lines == 0 || entry.Timestamp.After(b.last) {
+		b.last = entry.Timestamp
+	}
+	if b.lines == 0 && b.limits.wait > 0 {
+		b.started = time.Now()
+	}
+	b.stream.Entries = append(b.stream.Entries, entry)
 	b.lines++
-	if b.lines >= 100 {
-		return b.flush()
+	b.bytes += entrySize(entry)
+}
+
+// full returns true when the batch should be flushed, as it reached
+// --batch-lines or waits for longer than --batch-max-wait. The wait is only
+// checked on adding lines, so a batch of a stalled download waits for the
+// next line or the end of the file. Batches do not span files
+func (b *batch) full() bool {
+	l := b.limits
+	return l.lines > 0 && b.lines >= l.lines ||
+		l.wait > 0 && b.lines > 0 && time.Since(b.started) >= l.wait
+}
+
+// size returns bytes of entries, as Loki counts them for rate limits
+func (b *batch) size() int {
+	n := 0
+	for _, e := range b.stream.Entries {
+		n += entrySize(e)
 	}
-	return nil
+	return n
+}
+
+func entrySize(e logproto.Entry) int {
+	n := len(e.Line)
+	for _, m := range e.StructuredMetadata {
+		n += len(m.Name) + len(m.Value)
+	}
+	return n
+}
+
+var tiedEntries = newCounter("alb_logs_shipper_tied_entries_total", "Entries with nanoseconds added to their timestamp by --tie-break, as previous entry of the file has the same timestamp")
+
+// tieBreaker adds nanoseconds to timestamps of consecutive entries with the
+// same timestamp, as Loki drops entries of a stream with the same timestamp and
+// line as duplicates. Offsets only depend on order of lines of the file, so a
+// file shipped again gets the same timestamps, and entries of a partial push
+// are still dropped as duplicates
+type tieBreaker struct {
+	prev time.Time // timestamp of the previous entry, before offset
+	ties int
+}
+
+func (t *tieBreaker) next(ts time.Time) time.Time {
+	if !ts.Equal(t.prev) {
+		t.prev, t.ties = ts, 0
+		return ts
+	}
+	t.ties++
+	tiedEntries.Inc()
+	return ts.Add(time.Duration(t.ties))
+}
+
+// exceeds returns true when the batch should be flushed before adding the
+// entry, to not span more than the time range, or to not exceed --batch-bytes.
+// Entry larger than --batch-bytes is pushed in a batch of its own
+func (b *batch) exceeds(entry logproto.Entry) bool {
+	if b.lines == 0 {
+		return false
+	}
+	if b.limits.bytes > 0 && b.bytes+entrySize(entry) > b.limits.bytes {
+		return true
+	}
+	if b.span == 0 {
+		return false
+	}
+	return entry.Timestamp.Sub(b.first) > b.span || b.last.Sub(entry.Timestamp) > b.span
 }
 
 func (b *batch) flush() error {
 	if b.lines == 0 {
 		return nil
 	}
+	if b.tenantErr != nil {
+		return b.tenantErr
+	}
+	if b.pipe != nil {
+		return b.pipe.add(b.detach())
+	}
 
-	buf, err := b.encode()
+	buf, err := b.push()
 	if err != nil {
 		return err
 	}
-	if err = b.client.send(buf); err != nil {
-		return err
+	volumes.record(b.labels, b.stream.Entries)
+	if b.client.sink != nil {
+		b.client.sink.write(b.labels, b.stream.Entries)
 	}
+	b.ids = append(b.ids, pushID(buf))
+	putBuf(buf)
 
-	b.lines = 0
+	b.lines, b.bytes = 0, 0
 	b.stream.Entries = b.stream.Entries[:0]
 	return nil
 }
 
-func (b *batch) encode() ([]byte, error) {
-	req := logproto.PushRequest{
-		Streams: []logproto.Stream{*b.stream},
-	}
-	buf, err := proto.Marshal(&req)
+// push sends the batch and returns the request body. In auto mode the batch
+// is sent again as gzip JSON when the endpoint rejects snappy protobuf
+func (b *batch) push() ([]byte, error) {
+	encoding := b.client.encoding()
+	buf, err := b.encode(encoding)
 	if err != nil {
 		return nil, err
 	}
+	b.client.waitStream(b.tenant, b.stream.Labels, b.size())
+	var bt *batchTrace
+	if b.trace != nil {
+		bt = &batchTrace{Lines: b.lines, Pipelined: b.piped}
+		start := time.Now()
+		defer func() {
+			bt.Bytes, bt.Seconds = len(buf), time.Since(start).Seconds()
+			b.trace.batch(*bt)
+		}()
+	}
+	err = b.client.sendTraced(buf, encoding, b.tenant, bt)
+	if errors.Is(err, errCircuitOpen) && b.spool != nil {
+		if err = b.spool.add(b.key, buf, encoding, b.tenant); err == nil {
+			b.spooled++
+		}
+	}
+	if errors.Is(err, errSnappyRejected) {
+		b.client.logger.Warn("Loki rejected snappy protobuf push, switching to gzip JSON", "url", b.client.LokiURL, "err", err)
+		b.client.gzip.Store(true)
+		if buf, err = b.encode("gzip"); err != nil {
+			return nil, err
+		}
+		err = b.client.sendTraced(buf, "gzip", b.tenant, bt)
+	}
+	return buf, err
+}
+
+// encode marshals the batch to push request body: snappy compressed protobuf,
+// gzip compressed JSON, OTLP protobuf or OpenSearch bulk request. Empty batch is
+// encoded as push request without streams, or empty bulk request
+func (b *batch) encode(encoding string) ([]byte, error) {
+	var buf, enc []byte
+	var err error
+	if encoding == "bulk" && len(b.stream.Entries) == 0 {
+		return nil, nil
+	}
+	if encoding != "snappy" {
+		marshal := b.marshalJSON
+		switch encoding {
+		case "otlp":
+			marshal = b.marshalOTLP
+		case "bulk":
+			marshal = b.marshalBulk
+		}
+		if buf, err = marshal(); err != nil {
+			return nil, err
+		}
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		if _, err = w.Write(buf); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		enc = gz.Bytes()
+	} else {
+		req := logproto.PushRequest{}
+		if len(b.stream.Entries) > 0 {
+			req.Streams = []logproto.Stream{*b.stream}
+		}
+		raw := getBuf(req.Size())
+		defer putBuf(*raw)
+		n, err := req.MarshalToSizedBuffer(*raw)
+		if err != nil {
+			return nil, err
+		}
+		buf = (*raw)[len(*raw)-n:]
+		enc = snappy.Encode(*getBuf(snappy.MaxEncodedLen(len(buf))), buf)
+	}
+	batchRawBytes.Add(float64(len(buf)), b.client.tenant(b.tenant))
+	batchEncodedBytes.Add(float64(len(enc)), b.client.tenant(b.tenant))
+	return enc, nil
+}
+
+// bufPool reuses protobuf marshal and snappy buffers of push requests across
+// flushes, instead of allocating two batch sized buffers per push
+var bufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// getBuf returns a buffer of n bytes from the pool
+func getBuf(n int) *[]byte {
+	p := bufPool.Get().(*[]byte)
+	if cap(*p) < n {
+		*p = make([]byte, n)
+	}
+	*p = (*p)[:n]
+	return p
+}
+
+// putBuf returns the buffer to the pool, it should not be referenced anymore
+func putBuf(b []byte) {
+	bufPool.Put(&b)
+}
+
+// marshalJSON returns the batch in Loki JSON push format
+func (b *batch) marshalJSON() ([]byte, error) {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][]any           `json:"values"`
+	}
+	req := struct {
+		Streams []stream `json:"streams"`
+	}{Streams: []stream{}}
+	if len(b.stream.Entries) > 0 {
+		st := stream{Stream: b.labels, Values: make([][]any, 0, len(b.stream.Entries))}
+		for _, e := range b.stream.Entries {
+			v := []any{strconv.FormatInt(e.Timestamp.UnixNano(), 10), e.Line}
+			if len(e.StructuredMetadata) > 0 {
+				md := make(map[string]string, len(e.StructuredMetadata))
+				for _, l := range e.StructuredMetadata {
+					md[l.Name] = l.Value
+				}
+				v = append(v, md)
+			}
+			st.Values = append(st.Values, v)
+		}
+		req.Streams = append(req.Streams, st)
+	}
+	return json.Marshal(req)
+}
 
-	return snappy.Encode(nil, buf), nil
+// pushID returns ID of push request by its body, which is sent in
+// --loki-request-id-header and recorded as batch ID of the file
+func pushID(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:8])
 }
 
+// errSnappyRejected is returned in auto encoding mode, when the endpoint
+// fails to decode snappy protobuf body
+var errSnappyRejected = errors.New("snappy protobuf push rejected")
+
 type lokiClient struct {
 	http         *http.Client
 	logger       *slog.Logger
 	LokiURL      string
 	LokiUser     string
 	LokiPassword string
+	LokiEncoding string
+	output       string         // --output
+	otlpFormat   string         // of lines, to map their fields to attributes
+	bulkFormat   string         // of lines, to index their fields
+	index        *indexTemplate // of --opensearch-index
+	dropRejected bool           // --opensearch-drop-rejected
+	userAgent    string
+	requestID    string // header name
+	auth         []authProvider
+	tenants      *template.Template // of --loki-tenant
+	breaker      *breaker
+	transport    *http.Transport
+	rotator      *rotator
+	gzip         atomic.Bool // negotiated in auto encoding mode
+	maxInflight  int
+	mu           sync.Mutex
+	inflight     map[string]chan struct{} // by tenant
+	streamRate   rate.Limit
+	streams      map[string]*rate.Limiter // by stream labels
+	pruned       time.Time                // when idle stream limiters were dropped
+	sink         *execSink
 }
 
-func newLokiClient(lokiURL, lokiUser, lokiPassword string, logger *slog.Logger) *lokiClient {
+// newLokiClient returns client shared by all batches
+func newLokiClient(opts Options, logger *slog.Logger) (*lokiClient, error) {
+	var err error
+	var tenants *template.Template
+	if opts.LokiTenant != "" {
+		if tenants, err = template.New("tenant").Option("missingkey=error").Parse(opts.LokiTenant); err != nil {
+			return nil, fmt.Errorf("invalid template of --loki-tenant: %w", err)
+		}
+	}
+	var brk *breaker
+	if opts.LokiBreakerAfter > 0 {
+		brk = newBreaker(opts.LokiBreakerAfter, opts.LokiBreakerCooldown)
+	}
+	userAgent := opts.LokiUserAgent
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("alb-logs-shipper/%s (%s)", version.Version, opts.ReplicaID)
+	}
+	var sink *execSink
+	if opts.ExecSink != "" {
+		if sink, err = newExecSink(opts.ExecSink, opts.ExecSinkQueue, logger); err != nil {
+			return nil, fmt.Errorf("--exec-sink: %w", err)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.TLSClientConfig, err = lokiTLSConfig(opts); err != nil {
+		return nil, err
+	}
+	// token endpoint is not dialed to --loki-addresses
+	auth, err := newAuthChain(opts, transport.Clone())
+	if err != nil {
+		return nil, err
+	}
+	url := opts.LokiURL
+	var index *indexTemplate
+	switch opts.Output {
+	case "otlp":
+		url = opts.OTLPEndpoint
+	case "opensearch":
+		url = strings.TrimSuffix(opts.OpenSearchURL, "/") + "/_bulk"
+		if index, err = newIndexTemplate(opts.OpenSearchIndex); err != nil {
+			return nil, fmt.Errorf("invalid --opensearch-index: %w", err)
+		}
+	}
+	var rot *rotator
+	if len(opts.LokiAddresses) > 0 || opts.LokiResolveInterval > 0 {
+		if rot, err = newRotator(url, opts.LokiAddresses, opts.LokiResolveInterval); err != nil {
+			return nil, err
+		}
+		transport.DialContext = rot.dial
+	}
 	return &lokiClient{
-		http:         &http.Client{},
+		http:         &http.Client{Transport: transport},
+		transport:    transport,
+		rotator:      rot,
 		logger:       logger,
-		LokiURL:      lokiURL,
-		LokiUser:     lokiUser,
-		LokiPassword: lokiPassword,
+		LokiURL:      url,
+		LokiUser:     opts.LokiUser,
+		LokiPassword: opts.LokiPassword,
+		LokiEncoding: opts.LokiEncoding,
+		output:       opts.Output,
+		otlpFormat:   cmp.Or(opts.OTLPFormat, opts.Format),
+		bulkFormat:   cmp.Or(opts.OpenSearchFormat, opts.Format),
+		index:        index,
+		dropRejected: opts.OpenSearchDrop,
+		userAgent:    userAgent,
+		requestID:    opts.LokiRequestID,
+		auth:         auth,
+		tenants:      tenants,
+		maxInflight:  opts.LokiMaxInflight,
+		inflight:     make(map[string]chan struct{}),
+		streamRate:   rate.Limit(opts.LokiStreamRate),
+		streams:      make(map[string]*rate.Limiter),
+		breaker:      brk,
+		sink:         sink,
+	}, nil
+}
+
+// encoding returns push body encoding, in auto mode snappy is used until the
+// endpoint rejects it
+func (c *lokiClient) encoding() string {
+	switch c.output {
+	case "otlp":
+		return "otlp"
+	case "opensearch":
+		return "bulk"
+	}
+	switch c.LokiEncoding {
+	case "gzip":
+		return "gzip"
+	case "auto":
+		if c.gzip.Load() {
+			return "gzip"
+		}
+	}
+	return "snappy"
+}
+
+// tenantOf returns X-Scope-OrgID of pushes of the stream labels, rendered by
+// --loki-tenant template. Labels missing in the template, and empty or invalid
+// tenant IDs are errors, so streams are not pushed to another tenant
+func (c *lokiClient) tenantOf(labels map[string]string) (string, error) {
+	if c == nil || c.tenants == nil {
+		return "", nil
+	}
+	var b strings.Builder
+	if err := c.tenants.Execute(&b, labels); err != nil {
+		return "", fmt.Errorf("failed to render --loki-tenant of labels %v: %w", labels, err)
+	}
+	if err := validTenant(b.String()); err != nil {
+		return "", fmt.Errorf("invalid --loki-tenant of labels %v: %w", labels, err)
 	}
+	return b.String(), nil
 }
 
-func (c *lokiClient) send(buf []byte) error {
+// validTenant returns error for tenant IDs which Loki rejects: empty, longer
+// than 150 chars, "." and "..", or with chars other than alphanumerics and
+// !-_.*'()
+func validTenant(id string) error {
+	switch {
+	case id == "":
+		return fmt.Errorf("empty tenant ID")
+	case len(id) > 150:
+		return fmt.Errorf("tenant ID %s is longer than 150 chars", id)
+	case id == "." || id == "..":
+		return fmt.Errorf("tenant ID %s is not allowed", id)
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!-_.*'()", r)) {
+			return fmt.Errorf("tenant ID %s has unsupported char %q", id, r)
+		}
+	}
+	return nil
+}
+
+// tenant returns the Loki tenant pushes with the X-Scope-OrgID are accounted
+// to. Without explicit tenant header, Loki gateways map basic auth user to tenant
+func (c *lokiClient) tenant(orgID string) string {
+	if orgID != "" {
+		return orgID
+	}
+	if c.LokiUser != "" {
+		return c.LokiUser
+	}
+	return "fake"
+}
+
+func (c *lokiClient) send(buf []byte, encoding, orgID string) error {
+	return c.sendTraced(buf, encoding, orgID, nil)
+}
+
+// sendTraced is send which records push attempts to the trace, when set
+func (c *lokiClient) sendTraced(buf []byte, encoding, orgID string, trace *batchTrace) error {
+	if c.breaker != nil && c.breaker.isOpen() {
+		return errCircuitOpen
+	}
 	backoff := backoff.New(context.Background(), backoff.Config{
 		MinBackoff: minBackoff,
 		MaxBackoff: maxBackoff,
 		MaxRetries: maxRetries,
 	})
+	id := pushID(buf)
+	if trace != nil {
+		trace.ID = id
+	}
 	var status int
 	var err error
+	var waited time.Duration
+	defer func() { pushBackoff.Observe(waited.Seconds(), c.tenant(orgID)) }()
 	for {
-		status, err = c.req(buf)
+		start := time.Now()
+		status, err = c.req(buf, encoding, orgID, id)
+		if trace != nil {
+			a := pushAttempt{Status: status, Seconds: time.Since(start).Seconds()}
+			if err != nil {
+				a.Error = err.Error()
+			}
+			trace.Attempts = append(trace.Attempts, a)
+		}
 
 		// Only retry 429s, 5xx, and connection-level errors.
 		if status > 0 && status != 429 && status/100 != 5 {
 			break
 		}
-		c.logger.Error("error sending batch, will retry", "status", status, "err", err)
+		c.logger.Error("error sending batch, will retry", "request_id", id, "status", status, "err", err)
+		start = time.Now()
 		backoff.Wait()
+		waited += time.Since(start)
 
 		// Make sure it sends at least once before checking for retry.
 		if !backoff.Ongoing() {
 			break
 		}
+		pushRetries.Inc(c.tenant(orgID), retryReason(status))
 	}
 
+	if err == nil {
+		c.logger.Debug("pushed batch", "request_id", id, "status", status, "bytes", len(buf))
+	}
+	// only outage of Loki opens the circuit, not rejected batches
+	if c.breaker != nil && c.breaker.done(err != nil && (status <= 0 || status == 429 || status/100 == 5)) {
+		c.logger.Error("opening Loki circuit breaker after consecutive failures", "until", time.Now().Add(c.breaker.cooldown).Format(time.RFC3339))
+	}
+	if c.LokiEncoding == "auto" && encoding == "snappy" && isSnappyRejected(status, err) {
+		return fmt.Errorf("%w: %v", errSnappyRejected, err)
+	}
 	return err
 }
 
-func (c *lokiClient) req(buf []byte) (int, error) {
+// retryReason returns reason of retried push by its status: 429 for rate
+// limiting by Loki, 5xx for its errors, or connection for network errors
+func retryReason(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "429"
+	case status/100 == 5:
+		return "5xx"
+	}
+	return "connection"
+}
+
+// isSnappyRejected returns true when response means that the body could not be
+// decoded, like when a proxy in front of Loki mangles it
+func isSnappyRejected(status int, err error) bool {
+	if status == http.StatusUnsupportedMediaType {
+		return true
+	}
+	if status != http.StatusBadRequest || err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "snappy") || strings.Contains(msg, "decompress") || strings.Contains(msg, "proto")
+}
+
+// acquire waits for a free slot of in-flight push requests to the tenant,
+// and returns function to release it
+func (c *lokiClient) acquire(orgID string) func() {
+	if c.maxInflight <= 0 {
+		return func() {}
+	}
+	tenant := c.tenant(orgID)
+	c.mu.Lock()
+	slots, ok := c.inflight[tenant]
+	if !ok {
+		slots = make(chan struct{}, c.maxInflight)
+		c.inflight[tenant] = slots
+	}
+	c.mu.Unlock()
+	select {
+	case slots <- struct{}{}:
+	default:
+		pushThrottled.Inc(tenant)
+		slots <- struct{}{}
+	}
+	return func() { <-slots }
+}
+
+// waitStream delays push of the stream entries of size bytes, to not exceed
+// --loki-stream-rate. Burst is 5x of the rate, like Loki defaults, and at
+// least 1 byte for rates under 0.2, to reserve batches in chunks of it
+func (c *lokiClient) waitStream(orgID, stream string, size int) {
+	if c.streamRate <= 0 {
+		return
+	}
+	burst := max(int(5*c.streamRate), 1)
+	now := time.Now()
+	c.mu.Lock()
+	if now.Sub(c.pruned) > time.Minute {
+		// limiters with full burst are the same as new ones
+		for k, l := range c.streams {
+			if l.TokensAt(now) >= float64(burst) {
+				delete(c.streams, k)
+			}
+		}
+		c.pruned = now
+	}
+	l, ok := c.streams[orgID+stream]
+	if !ok {
+		l = rate.NewLimiter(c.streamRate, burst)
+		c.streams[orgID+stream] = l
+	}
+	c.mu.Unlock()
+	// ReserveN fails for n over burst, so batches larger than that are
+	// reserved in chunks, and wait for the last one
+	var d time.Duration
+	for ; size > 0; size -= burst {
+		d = l.ReserveN(now, min(size, burst)).DelayFrom(now)
+	}
+	if d > 0 {
+		streamThrottled.Add(d.Seconds(), c.tenant(orgID))
+		time.Sleep(d)
+	}
+}
+
+// req sends push request with the ID to the X-Scope-OrgID tenant, returns
+// HTTP status or -1 on connection error
+func (c *lokiClient) req(buf []byte, encoding, orgID, id string) (int, error) {
+	defer c.acquire(orgID)()
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
-	req, err := http.NewRequest("POST", c.LokiURL, bytes.NewReader(buf))
+	method, url := "POST", c.LokiURL
+	if encoding == "bulk" && len(buf) == 0 {
+		// OpenSearch rejects empty bulk request, so check the cluster instead
+		method, url = "GET", strings.TrimSuffix(url, "_bulk")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(buf))
 	if err != nil {
 		return -1, err
 	}
+	var body *closedBody
+	if len(buf) > 0 {
+		// buf is reused after the push, so wait for transport to stop reading
+		// it. Transport always closes the body, even on errors or timeout, but
+		// could do that after Do returns
+		body = &closedBody{Reader: bytes.NewReader(buf), closed: make(chan struct{})}
+		req.Body = body
+	}
 	// snappy-encoded protobufs over http by default.
 	req.Header.Set("Content-Type", "application/x-protobuf")
-	req.Header.Set("User-Agent", "alb-logs-shipper")
+	switch encoding {
+	case "gzip":
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+	case "otlp":
+		req.Header.Set("Content-Encoding", "gzip")
+	case "bulk":
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.requestID != "" {
+		req.Header.Set(c.requestID, id)
+	}
+	if orgID != "" {
+		req.Header.Set("X-Scope-OrgID", orgID)
+	}
 
-	if c.LokiUser != "" && c.LokiPassword != "" {
-		req.SetBasicAuth(c.LokiUser, c.LokiPassword)
+	if c.rotator != nil && c.rotator.refresh(ctx) {
+		c.transport.CloseIdleConnections()
+	}
+	for _, a := range c.auth {
+		if err = a.auth(req, buf); err != nil {
+			return -1, fmt.Errorf("failed to authenticate request: %w", err)
+		}
 	}
 
-	resp, err := c.http.Do(req.WithContext(ctx))
+	if body != nil {
+		defer func() { <-body.closed }()
+	}
+	resp, err := c.http.Do(req)
 	if err != nil {
 		return -1, err
 	}
@@ -161,7 +731,21 @@ func (c *lokiClient) req(buf []byte) (int, error) {
 			line = scanner.Text()
 		}
 		err = fmt.Errorf("server returned HTTP status %s (%d): %s", resp.Status, resp.StatusCode, line)
+	} else if encoding == "bulk" && len(buf) > 0 {
+		return c.bulkStatus(resp.StatusCode, resp.Body)
 	}
 
 	return resp.StatusCode, err
 }
+
+// closedBody is request body which signals when transport closes it
+type closedBody struct {
+	*bytes.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (b *closedBody) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"golang.org/x/time/rate"
+)
+
+func TestPushEncoding(t *testing.T) {
+	var got struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]any           `json:"values"`
+		} `json:"streams"`
+	}
+	// proxy which mangles snappy bodies
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "snappy: corrupt input", http.StatusBadRequest)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(gz)
+		if err = json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	client, err := newLokiClient(Options{LokiURL: srv.URL, LokiEncoding: "snappy"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBatch(map[string]string{"ingress": "web"}, client)
+	b.add(logproto.Entry{Timestamp: time.Unix(1, 5), Line: "line"})
+	if err := b.flush(); err == nil {
+		t.Errorf("flush() with snappy encoding succeeded, want error")
+	}
+
+	b.client.LokiEncoding = "auto"
+	if err := b.flush(); err != nil {
+		t.Fatalf("flush() with auto encoding error = %v", err)
+	}
+	if len(got.Streams) != 1 || got.Streams[0].Stream["ingress"] != "web" || len(got.Streams[0].Values) != 1 || got.Streams[0].Values[0][0] != "1000000005" {
+		t.Errorf("pushed %+v", got)
+	}
+	if enc := b.client.encoding(); enc != "gzip" {
+		t.Errorf("negotiated encoding = %s, want gzip", enc)
+	}
+}
+
+func TestPushHeaders(t *testing.T) {
+	var ua, id string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua, id = r.Header.Get("User-Agent"), r.Header.Get("X-Request-ID")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	client, err := newLokiClient(Options{LokiURL: srv.URL, ReplicaID: "shipper-0", LokiRequestID: "X-Request-ID"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBatch(map[string]string{"ingress": "web"}, client)
+	b.add(logproto.Entry{Timestamp: time.Unix(1, 0), Line: "line"})
+	if err := b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(ua, "alb-logs-shipper/") || !strings.HasSuffix(ua, " (shipper-0)") {
+		t.Errorf("User-Agent = %q", ua)
+	}
+	if len(b.ids) != 1 || id != b.ids[0] {
+		t.Errorf("X-Request-ID = %q, want batch ID %v", id, b.ids)
+	}
+
+	client.userAgent, client.requestID = "custom", ""
+	if _, err := client.req(nil, "snappy", "", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	if ua != "custom" || id != "" {
+		t.Errorf("User-Agent = %q, X-Request-ID = %q with custom agent and no ID header", ua, id)
+	}
+}
+
+func TestPushTenant(t *testing.T) {
+	var orgIDs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orgIDs = append(orgIDs, r.Header.Get("X-Scope-OrgID"))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	client, err := newLokiClient(Options{LokiURL: srv.URL, LokiTenant: `{{or (index . "account") "shared"}}`}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, labels := range []map[string]string{{"account": "prod"}, {"ingress": "web"}} {
+		b := newBatch(labels, client)
+		b.add(logproto.Entry{Timestamp: time.Unix(1, 0), Line: "line"})
+		if err := b.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(orgIDs, []string{"prod", "shared"}) {
+		t.Errorf("X-Scope-OrgID = %v, want [prod shared]", orgIDs)
+	}
+	if got := client.tenant(""); got != "fake" {
+		t.Errorf("tenant() without X-Scope-OrgID = %s, want fake", got)
+	}
+
+	if _, err = newLokiClient(Options{LokiURL: srv.URL, LokiTenant: "{{.account"}, logger); err == nil {
+		t.Error("newLokiClient() of invalid --loki-tenant error = nil")
+	}
+
+	client, err = newLokiClient(Options{LokiURL: srv.URL, LokiTenant: "{{.account}}"}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, labels := range []map[string]string{{"ingress": "web"}, {"account": ""}, {"account": "a/b"}, {"account": ".."}} {
+		b := newBatch(labels, client)
+		b.add(logproto.Entry{Timestamp: time.Unix(1, 0), Line: "line"})
+		if err := b.flush(); err == nil {
+			t.Errorf("flush() of labels %v with invalid tenant error = nil", labels)
+		}
+	}
+	if len(orgIDs) != 2 {
+		t.Errorf("pushed %d times, want no pushes with invalid tenants", len(orgIDs)-2)
+	}
+}
+
+func TestRetryReason(t *testing.T) {
+	tests := map[int]string{
+		http.StatusTooManyRequests:    "429",
+		http.StatusBadGateway:         "5xx",
+		http.StatusServiceUnavailable: "5xx",
+		-1:                            "connection",
+	}
+	for status, want := range tests {
+		if got := retryReason(status); got != want {
+			t.Errorf("retryReason(%d) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestEncodeReuse(t *testing.T) {
+	client, err := newLokiClient(Options{LokiURL: "http://localhost"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lines := range []int{1000, 10, 1} {
+		b := newBatch(map[string]string{"ingress": "web"}, client)
+		for i := range lines {
+			b.add(logproto.Entry{Timestamp: time.Unix(int64(i), 0), Line: strings.Repeat("x", lines-i)})
+		}
+		buf, err := b.encode("snappy")
+		if err != nil {
+			t.Fatalf("encode() error = %v", err)
+		}
+		raw, err := snappy.Decode(nil, buf)
+		if err != nil {
+			t.Fatalf("encode() of %d lines is not snappy: %v", lines, err)
+		}
+		var req logproto.PushRequest
+		if err = req.Unmarshal(raw); err != nil {
+			t.Fatalf("encode() of %d lines is not protobuf: %v", lines, err)
+		}
+		if len(req.Streams) != 1 || len(req.Streams[0].Entries) != lines || req.Streams[0].Entries[lines-1].Line != "x" {
+			t.Errorf("encode() of %d lines decoded to %d streams", lines, len(req.Streams))
+		}
+		putBuf(buf)
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	var active, peak atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := active.Add(1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		active.Add(-1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	client, err := newLokiClient(Options{LokiURL: srv.URL, LokiMaxInflight: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.req(nil, "snappy", "", ""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if p := peak.Load(); p > 2 {
+		t.Errorf("peak in-flight requests = %d, want at most 2", p)
+	}
+}
+
+func TestBatchFull(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits batchLimits
+		lines  int
+		wait   time.Duration
+		want   bool
+	}{
+		{"default", batchLimits{lines: 100}, 99, 0, false},
+		{"lines", batchLimits{lines: 100}, 100, 0, true},
+		{"wait", batchLimits{lines: 100, wait: time.Minute}, 1, 2 * time.Minute, true},
+		{"under wait", batchLimits{lines: 100, wait: time.Minute}, 1, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBatch(nil, nil)
+			b.limits = tt.limits
+			for range tt.lines {
+				b.add(logproto.Entry{Line: "0123456789"})
+			}
+			b.started = b.started.Add(-tt.wait)
+			if got := b.full(); got != tt.want {
+				t.Errorf("full() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTieBreaker(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 186641000, time.UTC)
+	t1 := t0.Add(time.Microsecond)
+	in := []time.Time{t0, t0, t0, t1, t1, t0}
+	want := []time.Time{t0, t0.Add(1), t0.Add(2), t1, t1.Add(1), t0}
+	var ties tieBreaker
+	for i, ts := range in {
+		if got := ties.next(ts); !got.Equal(want[i]) {
+			t.Errorf("next() of entry %d = %s, want %s", i, got.Format(time.RFC3339Nano), want[i].Format(time.RFC3339Nano))
+		}
+	}
+}
+
+func TestBatchExceeds(t *testing.T) {
+	b := newBatch(nil, nil)
+	b.span = 5 * time.Minute
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if b.exceeds(logproto.Entry{Timestamp: start}) {
+		t.Error("exceeds() of empty batch = true")
+	}
+	b.add(logproto.Entry{Timestamp: start})
+	b.add(logproto.Entry{Timestamp: start.Add(-time.Minute)})
+	tests := []struct {
+		ts   time.Time
+		want bool
+	}{
+		{start.Add(4 * time.Minute), false},
+		{start.Add(5 * time.Minute), true},
+		{start.Add(-6 * time.Minute), true},
+		{start.Add(-5 * time.Minute), false},
+	}
+	for _, tt := range tests {
+		if got := b.exceeds(logproto.Entry{Timestamp: tt.ts}); got != tt.want {
+			t.Errorf("exceeds(%s) = %v, want %v", tt.ts.Sub(start), got, tt.want)
+		}
+	}
+
+	b = newBatch(nil, nil)
+	b.limits.bytes = 25
+	if b.exceeds(logproto.Entry{Line: strings.Repeat("0", 30)}) {
+		t.Error("exceeds() of empty batch by large entry = true")
+	}
+	b.add(logproto.Entry{Line: "0123456789"})
+	b.add(logproto.Entry{Line: "0123456789"})
+	if !b.exceeds(logproto.Entry{Line: "012345"}) {
+		t.Error("exceeds() over --batch-bytes = false")
+	}
+	if b.exceeds(logproto.Entry{Line: "01234"}) {
+		t.Error("exceeds() up to --batch-bytes = true")
+	}
+}
+
+func TestWaitStream(t *testing.T) {
+	client, err := newLokiClient(Options{LokiURL: "http://loki", LokiStreamRate: 100000}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	client.waitStream("", `{ingress="web"}`, 500000) // burst
+	client.waitStream("", `{ingress="api"}`, 1000)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst of each stream waited %s", d)
+	}
+	client.waitStream("", `{ingress="web"}`, 10000)
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("waited %s, want 100ms over the rate", d)
+	}
+
+	// batches over burst wait for all of their bytes
+	start = time.Now()
+	client.waitStream("", `{ingress="big"}`, 520000)
+	if d := time.Since(start); d < 190*time.Millisecond {
+		t.Errorf("batch over burst waited %s, want 200ms", d)
+	}
+
+	// idle streams are dropped
+	client.pruned = time.Time{}
+	client.streams[`{ingress="api"}`] = rate.NewLimiter(client.streamRate, 500000)
+	client.waitStream("", `{ingress="web"}`, 1)
+	if _, ok := client.streams[`{ingress="api"}`]; ok || len(client.streams) != 2 {
+		t.Errorf("streams after prune: %d", len(client.streams))
+	}
+
+	// rate under 0.2 has burst of 1 byte
+	client.streamRate = 0.1
+	done := make(chan struct{})
+	go func() {
+		client.waitStream("", `{ingress="slow"}`, 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitStream() with rate under 0.2 does not return")
+	}
+}
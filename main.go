@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"os"
@@ -13,131 +15,224 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/prometheus/common/version"
 	"github.com/spf13/pflag"
 )
 
-type Options struct {
-	BucketName   string
-	WaitInterval time.Duration
-	Format       string
-	LokiURL      string
-	LokiUser     string
-	LokiPassword string
-	Labels       map[string]string
-	Workers      int
-	Port         int
-}
-
 func main() {
-	var opts Options
-	opts.Labels = make(map[string]string)
-	pflag.StringVarP(&opts.BucketName, "bucket-name", "b", "", "Name of the S3 bucket with ALB logs (required)")
-	pflag.DurationVarP(&opts.WaitInterval, "wait", "w", 60*time.Second, "Interval to wait between runs")
-	pflag.StringVarP(&opts.LokiURL, "loki-url", "H", "", "URL to Loki API (required)")
-	pflag.StringVarP(&opts.LokiUser, "loki-user", "u", "", "User to use for Loki authentication")
-	var logLevel = pflag.StringP("log-level", "", "info", "Log level (info, debug)")
-	pflag.StringVarP(&opts.Format, "format", "o", "raw", "Format to parse and ship log lines as (logfmt, json, raw)")
-	var labels = pflag.StringArrayP("label", "l", []string{}, "Label to add to Loki stream, can be specified multiple times (key=value)")
-	var roles = pflag.StringArrayP("role-arn", "a", []string{}, "ARN of the IAM role to assume to access ALB tags, can be specified multiple times")
-	pflag.IntVarP(&opts.Workers, "workers", "n", 4, "Number of workers to run")
-	pflag.IntVarP(&opts.Port, "port", "p", 8080, "Port to expose metrics on")
-	var ver = pflag.BoolP("version", "v", false, "Show version and exit")
-	pflag.Parse()
-	if *ver {
+	if len(os.Args) > 1 && os.Args[1] == "alert-rules" {
+		os.Exit(runAlertRules(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(runCheckConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		os.Exit(runTop(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
+	opts, err := parseOptions(pflag.CommandLine, os.Args[1:])
+	if err == pflag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		getLogger("info").Error("invalid options", "err", err)
+		os.Exit(1)
+	}
+	if opts.Version {
 		fmt.Println(version.Print("alb-logs-shipper"))
 		os.Exit(0)
 	}
-	logger := getLogger(*logLevel)
+	logger := getLogger(opts.LogLevel)
 
-	if opts.BucketName == "" {
-		logger.Error("--bucket-name is required")
-		os.Exit(1)
+	procs := setMaxProcs()
+	if opts.ParseWorkers <= 0 {
+		opts.ParseWorkers = procs
 	}
 
-	if opts.LokiURL == "" {
-		logger.Error("--loki-url is required")
+	logger.Info("Starting alb-logs-shipper", "version", version.Version, "metrics-port", opts.Port, "admin-port", opts.AdminPort, "gomaxprocs", procs, "workers", opts.Workers, "parse-workers", opts.ParseWorkers, "parse-threads", opts.ParseThreads)
+	cfg, err := config.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		logger.Error("unable to load AWS SDK config", "err", err)
 		os.Exit(1)
 	}
 
-	if opts.LokiUser != "" && os.Getenv("LOKI_PASSWORD") == "" {
-		logger.Error("LOKI_PASSWORD environment variable is required")
+	s3Client := s3.NewFromConfig(cfg, newS3Costs(opts.S3PutPrice, opts.S3GetPrice).apply)
+	elbMeta, err := NewELBMeta(opts)
+	if err != nil {
+		logger.Error("invalid ALB metadata options", "err", err)
 		os.Exit(1)
 	}
-	opts.LokiPassword = os.Getenv("LOKI_PASSWORD")
-
-	for _, label := range *labels {
-		parts := strings.SplitN(label, "=", 2)
-		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
-			logger.Error("invalid label format (k=v)", "label", label)
-			os.Exit(1)
+	elbMeta.logger = logger
+	if opts.Prefetch {
+		start := time.Now()
+		n, err := elbMeta.Prefetch(context.TODO())
+		if err != nil {
+			logger.Warn("failed to prefetch ALB metadata, will look up lazily", "err", err)
 		}
-		opts.Labels[parts[0]] = parts[1]
+		logger.Info("prefetched ALB metadata", "load-balancers", n, "duration", time.Since(start))
 	}
-
-	roleMap := make(map[string]string)
-	for _, role := range *roles {
-		id := strings.Split(role, ":")
-		if len(id) != 6 {
-			logger.Error("invalid role ARN", "role", role)
-			os.Exit(1)
-		}
-		roleMap[id[4]] = role
+	if err = checkBucket(context.TODO(), s3Client, opts, logger); err != nil {
+		logger.Error("invalid bucket", "err", err)
+		os.Exit(1)
 	}
-
-	logger.Info("Starting alb-logs-shipper", "version", version.Version, "metrics-port", opts.Port)
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+	parser, err := NewParser(opts, elbMeta, s3Client, logger)
 	if err != nil {
-		logger.Error("unable to load AWS SDK config", "err", err)
+		logger.Error("invalid parser options", "err", err)
 		os.Exit(1)
 	}
-
-	s3Client := s3.NewFromConfig(cfg)
-	elbMeta := NewELBMeta(roleMap)
-	parser := NewParser(opts, elbMeta, s3Client, logger)
+	if opts.ClaimTable != "" {
+		parser.claims = newTableClaims(dynamodb.NewFromConfig(cfg), opts.ClaimTable, opts.ReplicaID, opts.ClaimTTL)
+	} else if opts.ClaimTTL > 0 {
+		logger.Warn("claims by S3 object tags are best-effort, and a file could still be shipped by two replicas, use --claim-table for atomic claims")
+	}
 
 	sgnl := make(chan os.Signal, 1)
 	signal.Notify(sgnl, syscall.SIGINT, syscall.SIGTERM)
-	waitTimer := time.NewTimer(0)
-
-	go func() {
-		for {
-			select {
-			case <-waitTimer.C:
-				waitTimer.Reset(opts.WaitInterval)
-				if err := parser.scan(); err != nil {
-					logger.Error("scan S3 failed", "err", err)
+	if opts.ConfigFile != "" {
+		go reloadConfig(parser, logger)
+	}
+
+	if opts.SQSQueueURL != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		consumer := newSQSConsumer(sqs.NewFromConfig(cfg), opts.SQSQueueURL, parser, logger)
+		go func() {
+			if err := consumer.run(ctx); err != nil {
+				logger.Error("receive SQS messages failed", "err", err)
+			}
+			parser.Stop()
+		}()
+		go func() {
+			<-sgnl
+			logger.Info("received SIGINT or SIGTERM, shutting down...")
+			cancel()
+		}()
+	} else {
+		waitTimer := time.NewTimer(0)
+		wait := opts.WaitInterval
+		go func() {
+			for {
+				select {
+				case <-waitTimer.C:
+					found, full, err := parser.scan()
+					if errors.Is(err, errScanSkipped) {
+						logger.Debug("skipping scan, previous files are still queued", "queue", len(parser.queue))
+						waitTimer.Reset(wait)
+						continue
+					}
+					if err != nil {
+						logger.Error("scan S3 failed", "err", err)
+						parser.Stop()
+						return
+					}
+					wait = parser.idle.update(found, nextWait(wait, found, full, opts), time.Now())
+					waitTimer.Reset(wait)
+				case <-parser.trigger:
+					logger.Info("scan triggered by /debug/scan")
+					waitTimer.Reset(0)
+				case <-sgnl:
+					logger.Info("received SIGINT or SIGTERM, shutting down...")
 					parser.Stop()
 					return
 				}
-			case <-sgnl:
-				logger.Info("received SIGINT or SIGTERM, shutting down...")
-				parser.Stop()
-				return
 			}
-		}
-	}()
+		}()
+	}
 
-	go func() {
-		http.Handle("/metrics", parser.metrics())
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", opts.Port), nil); err != nil {
-			logger.Error("metrics server failed", "err", err)
-			parser.Stop()
+	if parser.anomaly != nil {
+		go parser.anomaly.run(context.Background())
+	}
+	if parser.audit != nil {
+		go parser.audit.run(context.Background())
+	}
+	if parser.spool != nil {
+		go parser.spool.run(context.Background(), parser.replayed)
+	}
+	var remote *remoteWriter
+	if opts.RemoteWriteURL != "" {
+		if remote, err = newRemoteWriter(opts, parser.writeMetrics, logger); err != nil {
+			logger.Error("invalid remote-write options", "err", err)
+			os.Exit(1)
 		}
-	}()
+		go remote.run(context.Background(), opts.RemoteWriteInterval)
+	}
+
+	if opts.VolumeSummary > 0 {
+		go func() {
+			for range time.Tick(opts.VolumeSummary) {
+				volumes.summary(logger, opts.VolumeSummary)
+			}
+		}()
+	}
+
+	token, err := readToken(opts.AdminTokenFile)
+	if err != nil {
+		logger.Error("failed to read admin token", "err", err)
+		os.Exit(1)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", parser.metrics())
+	if opts.AdminPort > 0 {
+		admin := http.NewServeMux()
+		parser.registerAdmin(admin, token, true)
+		go serve(fmt.Sprintf("%s:%d", opts.AdminBind, opts.AdminPort), admin, "admin", logger, parser)
+	} else {
+		parser.registerAdmin(mux, token, false)
+	}
+	go serve(fmt.Sprintf(":%d", opts.Port), mux, "metrics", logger, parser)
 
 	var wg sync.WaitGroup
 	for i := 0; i < opts.Workers; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			if err := parser.worker(); err != nil {
-				parser.Stop() // pod restart instead of deletion of not-shipped file
-			}
+			parser.worker(i)
 		}()
 	}
 	wg.Wait()
+	if parser.audit != nil {
+		parser.audit.Close()
+	}
+	if parser.journal != nil {
+		parser.journal.Close()
+	}
+	if remote != nil {
+		if err := remote.push(); err != nil {
+			logger.Error("failed to remote-write metrics", "err", err)
+		}
+	}
+	if opts.PushgatewayURL != "" {
+		if err := parser.pushMetrics(opts.PushgatewayURL, opts.PushgatewayJob, opts.ReplicaID); err != nil {
+			logger.Error("failed to push metrics to Pushgateway", "err", err)
+		} else {
+			logger.Info("pushed metrics to Pushgateway", "url", opts.PushgatewayURL)
+		}
+	}
+}
+
+// nextWait adapts interval between scans: halves it while scans stop at
+// --scan-max-keys (backlog), doubles it while nothing is found, bounded by --wait-min/max
+func nextWait(cur time.Duration, found int, full bool, opts Options) time.Duration {
+	switch {
+	case full:
+		return max(min(cur, opts.WaitInterval)/2, opts.WaitMin)
+	case found == 0:
+		return min(max(cur, opts.WaitInterval)*2, opts.WaitMax)
+	}
+	return opts.WaitInterval
+}
+
+// serve runs http server, and stops the parser when it fails
+func serve(addr string, h http.Handler, name string, logger *slog.Logger, parser *Parser) {
+	if err := http.ListenAndServe(addr, h); err != nil {
+		logger.Error(name+" server failed", "err", err)
+		parser.Stop()
+	}
 }
 
 func getLogger(logLevel string) *slog.Logger {
@@ -165,3 +260,25 @@ func getLogger(logLevel string) *slog.Logger {
 		},
 	}))
 }
+
+// reloadConfig parses options with --config again on SIGHUP, and applies
+// reloadable ones to the parser
+func reloadConfig(parser *Parser, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		fs := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		opts, err := parseOptions(fs, os.Args[1:])
+		if err == nil {
+			err = parser.reload(opts)
+		}
+		if err != nil {
+			configReloads.Inc("failure")
+			logger.Error("failed to reload config, keeping the previous one", "config", opts.ConfigFile, "err", err)
+			continue
+		}
+		configReloads.Inc("success")
+		logger.Info("reloaded config", "config", opts.ConfigFile, "labels", len(opts.Labels), "transforms", len(opts.Transforms), "shed-rules", len(opts.ShedRules))
+	}
+}
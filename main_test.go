@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextWait(t *testing.T) {
+	opts := Options{WaitInterval: time.Minute, WaitMin: 10 * time.Second, WaitMax: 5 * time.Minute}
+	tests := []struct {
+		name  string
+		cur   time.Duration
+		found int
+		full  bool
+		want  time.Duration
+	}{
+		{name: "full page halves", cur: time.Minute, found: 1000, full: true, want: 30 * time.Second},
+		{name: "full page bounded by min", cur: 15 * time.Second, found: 1000, full: true, want: 10 * time.Second},
+		{name: "full page after idle", cur: 4 * time.Minute, found: 1000, full: true, want: 30 * time.Second},
+		{name: "empty doubles", cur: time.Minute, found: 0, want: 2 * time.Minute},
+		{name: "empty bounded by max", cur: 4 * time.Minute, found: 0, want: 5 * time.Minute},
+		{name: "empty after backlog", cur: 10 * time.Second, found: 0, want: 2 * time.Minute},
+		{name: "some files resets", cur: 10 * time.Second, found: 10, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextWait(tt.cur, tt.found, tt.full, opts); got != tt.want {
+				t.Errorf("nextWait() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	fixed := Options{WaitInterval: time.Minute, WaitMin: time.Minute, WaitMax: time.Minute}
+	if got := nextWait(time.Minute, 0, false, fixed); got != time.Minute {
+		t.Errorf("nextWait() without adaptive bounds = %v, want %v", got, time.Minute)
+	}
+}
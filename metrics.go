@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is anything which can render itself in Prometheus text exposition format
+type metric interface {
+	write(w io.Writer)
+}
+
+// registry of all metrics exposed on /metrics, in order of registration
+var registry []metric
+
+// counter is a minimal Prometheus-compatible counter with optional labels
+type counter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*counterSeries),
+	}
+	registry = append(registry, c)
+	return c
+}
+
+// Add increments the counter series selected by label values
+func (c *counter) Add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: values}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// Inc increments the counter series selected by label values by 1
+func (c *counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, wrapLabels(labelPairs(c.labels, s.values)), formatFloat(s.value))
+	}
+}
+
+// histogram is a minimal Prometheus-compatible histogram with optional labels
+type histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	h := &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registry = append(registry, h)
+	return h
+}
+
+// Observe adds a value to the histogram series selected by label values
+func (h *histogram) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{values: values, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	if len(h.labels) == 0 && len(h.series) == 0 {
+		h.series[""] = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+	}
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		ls := labelPairs(h.labels, s.values)
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, joinLabels(ls, `le="`+formatFloat(b)+`"`), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.name, joinLabels(ls, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, wrapLabels(ls), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, wrapLabels(ls), s.count)
+	}
+}
+
+// gaugeFunc is a gauge with value read on each scrape
+type gaugeFunc struct {
+	name string
+	help string
+	mu   sync.Mutex
+	fn   func() float64
+}
+
+// newGaugeFunc registers a gauge, or replaces fn of the registered gauge of
+// the same name, as its owner could be created again (like in tests, or on
+// reload) and the registry should not grow
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	for _, m := range registry {
+		if g, ok := m.(*gaugeFunc); ok && g.name == name {
+			g.mu.Lock()
+			g.fn = fn
+			g.mu.Unlock()
+			return g
+		}
+	}
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	registry = append(registry, g)
+	return g
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.mu.Lock()
+	fn := g.fn
+	g.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(fn()))
+}
+
+// exponentialBuckets returns count buckets starting at start, each factor times the previous
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, n := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", n, values[i])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+func wrapLabels(ls string) string {
+	if ls == "" {
+		return ""
+	}
+	return "{" + ls + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"unsafe"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/sepich/alb-logs-shipper/albparse"
+)
+
+var (
+	// source:  https://docs.aws.amazon.com/elasticloadbalancing/latest/network/load-balancer-access-logs.html#access-log-entry-format
+	// example: tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com - - - 2018-12-20T02:59:30
+	nlbFields     = []string{"type", "version", "time", "elb", "listener", "client", "destination", "connection_time", "tls_handshake_time", "received_bytes", "sent_bytes", "incoming_tls_alert", "chosen_cert_arn", "chosen_cert_serial", "tls_cipher", "tls_protocol_version", "tls_named_group", "domain_name", "alpn_fe_protocol", "alpn_be_protocol", "alpn_client_preference_list", "tls_connection_creation_time"}
+	nlbSkipFields = map[string]bool{
+		"version":            true, // always 2.0
+		"chosen_cert_arn":    true, // same as for ALB
+		"chosen_cert_serial": true,
+	}
+	nlbNumFields = map[string]bool{
+		"connection_time":    true,
+		"tls_handshake_time": true,
+		"received_bytes":     true,
+		"sent_bytes":         true,
+	}
+	nlbFormat = &otherFormat{fields: nlbFields, skip: nlbSkipFields, number: nlbNumFields, timestamp: timeField(slices.Index(nlbFields, "time"))}
+)
+
+// LineNLB parses Network Load Balancer access log lines, which are written
+// for TLS listeners only. Field options are applied by NLB field names
+type LineNLB struct{ FieldOptions }
+
+var _ LineParser = &LineNLB{}
+
+// As parses NLB log line and converts it to the specified format
+func (r *LineNLB) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields splits NLB log line to values of nlbFields, none of them is quoted
+func (r *LineNLB) Fields(line string) ([]string, error) {
+	matches, err := albparse.Tokenize(line, nlbFields, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse NLB log line %w: %s", err, line)
+	}
+	return matches, nil
+}
+
+// LineAs converts fields of NLB log line to the specified format
+func (r *LineNLB) LineAs(format, line string, matches []string) (logproto.Entry, error) {
+	buf, entry, err := r.AppendLine(make([]byte, 0, 1024), format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(buf), len(buf))
+	return entry, nil
+}
+
+// AppendLine appends fields of NLB log line in the specified format to dst
+func (r *LineNLB) AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error) {
+	return r.appendOther(dst, format, line, matches, nlbFormat)
+}
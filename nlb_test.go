@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLineNLB_As(t *testing.T) {
+	in := `tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com - - - 2018-12-20T02:59:30`
+	tests := []struct {
+		name   string
+		format string
+		opts   FieldOptions
+		out    string
+	}{
+		{
+			name:   "logfmt",
+			format: "logfmt",
+			out:    `type=tls time=2018-12-20T02:59:40 elb=net/my-network-loadbalancer/c6e77e28c25b2234 listener=g3d4b5e8bb8464cd client=72.21.218.154:51341 destination=172.100.100.185:443 connection_time=5 tls_handshake_time=2 received_bytes=98 sent_bytes=246 incoming_tls_alert=- tls_cipher=ECDHE-RSA-AES128-SHA tls_protocol_version=tlsv12 tls_named_group=- domain_name=my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com alpn_fe_protocol=- alpn_be_protocol=- alpn_client_preference_list=- tls_connection_creation_time=2018-12-20T02:59:30`,
+		},
+		{
+			name:   "json",
+			format: "json",
+			out:    `{"type":"tls","time":"2018-12-20T02:59:40","elb":"net/my-network-loadbalancer/c6e77e28c25b2234","listener":"g3d4b5e8bb8464cd","client":"72.21.218.154:51341","destination":"172.100.100.185:443","connection_time":5,"tls_handshake_time":2,"received_bytes":98,"sent_bytes":246,"incoming_tls_alert":"-","tls_cipher":"ECDHE-RSA-AES128-SHA","tls_protocol_version":"tlsv12","tls_named_group":"-","domain_name":"my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com","alpn_fe_protocol":"-","alpn_be_protocol":"-","alpn_client_preference_list":"-","tls_connection_creation_time":"2018-12-20T02:59:30"}`,
+		},
+		{
+			name:   "extra and transform",
+			format: "logfmt",
+			opts:   FieldOptions{Extra: "extra", Transformers: []Transformer{dropField("domain_name")}},
+			out:    `type=tls time=2018-12-20T02:59:40 elb=net/my-network-loadbalancer/c6e77e28c25b2234 listener=g3d4b5e8bb8464cd client=72.21.218.154:51341 destination=172.100.100.185:443 connection_time=5 tls_handshake_time=2 received_bytes=98 sent_bytes=246 incoming_tls_alert=- tls_cipher=ECDHE-RSA-AES128-SHA tls_protocol_version=tlsv12 tls_named_group=- alpn_fe_protocol=- alpn_be_protocol=- alpn_client_preference_list=- tls_connection_creation_time=2018-12-20T02:59:30 extra="{\"version\":\"2.0\",\"chosen_cert_arn\":\"arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99\",\"chosen_cert_serial\":\"-\"}"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := (&LineNLB{tt.opts}).As(tt.format, in)
+			if err != nil {
+				t.Fatalf("LineNLB.As() error = %v", err)
+			}
+			if want := time.Date(2018, time.December, 20, 2, 59, 40, 0, time.UTC); !entry.Timestamp.Equal(want) {
+				t.Errorf("LineNLB.As() ts = %v, want %v", entry.Timestamp, want)
+			}
+			if entry.Line != tt.out {
+				t.Errorf("LineNLB.As() out:\n%v\nwant:\n%v", entry.Line, tt.out)
+			}
+			if tt.format == "json" && !json.Valid([]byte(entry.Line)) {
+				t.Errorf("LineNLB.As() out is not valid JSON")
+			}
+		})
+	}
+
+	if _, err := (&LineNLB{}).As("logfmt", "tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234"); err == nil {
+		t.Errorf("LineNLB.As() of truncated line error = nil")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-logfmt/logfmt"
+)
+
+var rejectedDocs = newCounter("alb_logs_shipper_opensearch_rejected_documents_total", "Documents rejected by OpenSearch bulk API with non-retryable errors, by error type", "type")
+
+// indexTemplate renders OpenSearch index name of an entry, like Logstash
+// `alb-%{+yyyy.MM.dd}` with date of the entry in UTC, or `%{namespace}` with
+// value of the stream label
+type indexTemplate struct {
+	parts []indexPart
+}
+
+type indexPart struct {
+	text   string // literal text, or stream label name
+	label  bool
+	layout string // Go time layout of a date part
+}
+
+// dateTokens are Joda date patterns of index templates and their Go layouts
+var dateTokens = strings.NewReplacer("yyyy", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15")
+
+func newIndexTemplate(s string) (*indexTemplate, error) {
+	t := &indexTemplate{}
+	for s != "" {
+		start := strings.Index(s, "%{")
+		if start < 0 {
+			t.parts = append(t.parts, indexPart{text: s})
+			break
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated %%{ in %s", s)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, indexPart{text: s[:start]})
+		}
+		name := s[start+2 : start+end]
+		if pattern, ok := strings.CutPrefix(name, "+"); ok {
+			layout := dateTokens.Replace(pattern)
+			if strings.Trim(layout, "0123456789.-_") != "" {
+				return nil, fmt.Errorf("unsupported date pattern %s, should be of yyyy, yy, MM, dd, HH", pattern)
+			}
+			t.parts = append(t.parts, indexPart{layout: layout})
+		} else if name != "" {
+			t.parts = append(t.parts, indexPart{text: name, label: true})
+		} else {
+			return nil, fmt.Errorf("empty %%{} in %s", s)
+		}
+		s = s[start+end+1:]
+	}
+	return t, nil
+}
+
+// render returns index name of the entry, which is lowercased and sanitized as
+// OpenSearch requires, as label values could have any chars
+func (t *indexTemplate) render(labels map[string]string, ts time.Time) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.layout != "":
+			b.WriteString(ts.UTC().Format(p.layout))
+		case p.label:
+			b.WriteString(labels[p.text])
+		default:
+			b.WriteString(p.text)
+		}
+	}
+	return sanitizeIndex(b.String())
+}
+
+// sanitizeIndex returns lowercase index name with chars which are not allowed
+// in names (\/*?"<>| ,#:) replaced by _, without leading -_+ and up to 255 bytes
+func sanitizeIndex(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '_'
+		}
+		return unicode.ToLower(r)
+	}, name)
+	name = strings.TrimLeft(name, "-_+")
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[:255], "")
+	}
+	return name
+}
+
+// marshalBulk returns the batch as OpenSearch bulk API request, for
+// --output=opensearch. Each entry is a document of fields of the line, with
+// `@timestamp`, stream labels in `labels` and structured metadata. Document
+// IDs are hashes of the stream, timestamp and line, so batches retried or
+// shipped again are not duplicated, like Loki drops such entries
+func (b *batch) marshalBulk() ([]byte, error) {
+	var buf bytes.Buffer
+	labels, err := json.Marshal(b.labels)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range b.stream.Entries {
+		doc, err := bulkFields(b.client.bulkFormat, e.Line)
+		if err != nil {
+			return nil, err
+		}
+		ts, _ := json.Marshal(e.Timestamp.UTC().Format(time.RFC3339Nano))
+		doc["@timestamp"], doc["labels"] = ts, labels
+		for _, m := range e.StructuredMetadata {
+			if doc[m.Name], err = json.Marshal(m.Value); err != nil {
+				return nil, err
+			}
+		}
+		sum := sha256.Sum256([]byte(b.stream.Labels + strconv.FormatInt(e.Timestamp.UnixNano(), 10) + e.Line))
+		action := map[string]map[string]string{"index": {
+			"_index": b.client.index.render(b.labels, e.Timestamp),
+			"_id":    hex.EncodeToString(sum[:16]),
+		}}
+		if err = json.NewEncoder(&buf).Encode(action); err != nil {
+			return nil, err
+		}
+		if err = json.NewEncoder(&buf).Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// bulkFields returns fields of the formatted line as raw JSON values. Raw
+// lines are formatted as logfmt, so values of both are strings
+func bulkFields(format, line string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	switch format {
+	case "json":
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			return nil, fmt.Errorf("failed to decode line to document: %w", err)
+		}
+	case "logfmt", "raw":
+		d := logfmt.NewDecoder(strings.NewReader(line))
+		for d.ScanRecord() {
+			for d.ScanKeyval() {
+				v, err := json.Marshal(string(d.Value()))
+				if err != nil {
+					return nil, err
+				}
+				fields[string(d.Key())] = v
+			}
+		}
+		if err := d.Err(); err != nil {
+			return nil, fmt.Errorf("failed to decode line to document: %w", err)
+		}
+	}
+	return fields, nil
+}
+
+// bulkStatus returns status of bulk API response by its items, as OpenSearch
+// responds 200 when some of documents fail. Documents rejected by rate
+// limits or failed shards are retried with the whole request. Others like
+// mapping errors are counted, and fail the request without retries, as
+// retrying would not help, unless --opensearch-drop-rejected is set
+func (c *lokiClient) bulkStatus(status int, body io.Reader) (int, error) {
+	var res struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		return status, fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+	if !res.Errors {
+		return status, nil
+	}
+	retry, rejected := 0, 0
+	var first error
+	for _, item := range res.Items {
+		for _, r := range item {
+			switch {
+			case r.Status < 300:
+			case r.Status == http.StatusTooManyRequests || r.Status/100 == 5:
+				retry = r.Status
+			default:
+				rejectedDocs.Inc(r.Error.Type)
+				if rejected == 0 {
+					first = fmt.Errorf("HTTP status %d %s: %s", r.Status, r.Error.Type, r.Error.Reason)
+					status = r.Status
+				}
+				rejected++
+			}
+		}
+	}
+	if retry > 0 {
+		return retry, fmt.Errorf("bulk request has documents failed with HTTP status %d", retry)
+	}
+	if rejected > 0 && c.dropRejected {
+		c.logger.Warn("dropped documents rejected by OpenSearch", "documents", rejected, "err", first)
+		return http.StatusOK, nil
+	}
+	if rejected > 0 {
+		return status, fmt.Errorf("bulk request has %d documents rejected, the first with %w", rejected, first)
+	}
+	return status, nil
+}
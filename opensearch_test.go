@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestIndexTemplate(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 23, 30, 0, 0, time.FixedZone("CET", 3600))
+	labels := map[string]string{"namespace": "shop"}
+	tests := []struct {
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{tmpl: "alb-%{+yyyy.MM.dd}", want: "alb-2024.03.01"},
+		{tmpl: "alb-%{namespace}-%{+yyyy.MM}", want: "alb-shop-2024.03"},
+		{tmpl: "alb-%{+yy-MM-dd_HH}", want: "alb-24-03-01_22"},
+		{tmpl: "alb", want: "alb"},
+		{tmpl: "ALB-%{namespace}", want: "alb-shop"},
+		{tmpl: "alb-%{+yyyy.MMM}", wantErr: true},
+		{tmpl: "alb-%{+yyyy", wantErr: true},
+		{tmpl: "alb-%{}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tmpl, func(t *testing.T) {
+			idx, err := newIndexTemplate(tt.tmpl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newIndexTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && idx.render(labels, ts) != tt.want {
+				t.Errorf("render() = %s, want %s", idx.render(labels, ts), tt.want)
+			}
+		})
+	}
+}
+
+func TestPushOpenSearch(t *testing.T) {
+	var pushes int
+	var lines []map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("push to %s with headers %v", r.URL.Path, r.Header)
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = nil
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var v map[string]any
+			if err = json.Unmarshal(scanner.Bytes(), &v); err != nil {
+				t.Error(err)
+			}
+			lines = append(lines, v)
+		}
+		pushes++
+		if pushes == 1 {
+			// rejected by a full write queue
+			io.WriteString(w, `{"errors":true,"items":[{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},{"index":{"status":201}}]}`)
+			return
+		}
+		io.WriteString(w, `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`)
+	}))
+	defer srv.Close()
+
+	opts := Options{Output: "opensearch", OpenSearchURL: srv.URL + "/", OpenSearchIndex: "alb-%{+yyyy.MM.dd}", Format: "logfmt", OpenSearchFormat: "json", OpenSearchDrop: true}
+	client, err := newLokiClient(opts, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBatch(map[string]string{"ingress": "web"}, client)
+	ts := time.Date(2024, 3, 1, 0, 0, 0, 186641000, time.UTC)
+	b.add(logproto.Entry{Timestamp: ts, Line: `{"elb_status_code":200,"request":"GET / HTTP/1.1"}`, StructuredMetadata: []logproto.LabelAdapter{{Name: "trace", Value: "Root=1"}}})
+	b.add(logproto.Entry{Timestamp: ts, Line: `{"elb_status_code":"-"}`})
+	if err = b.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if pushes != 2 {
+		t.Errorf("pushed %d times, want 2 with retry of 429", pushes)
+	}
+	if len(lines) != 4 {
+		t.Fatalf("bulk request has %d lines, want 4", len(lines))
+	}
+	action := lines[0]["index"].(map[string]any)
+	if action["_index"] != "alb-2024.03.01" || len(action["_id"].(string)) != 32 {
+		t.Errorf("bulk action = %v", action)
+	}
+	doc := lines[1]
+	if doc["@timestamp"] != "2024-03-01T00:00:00.186641Z" || doc["elb_status_code"] != 200.0 || doc["trace"] != "Root=1" || doc["labels"].(map[string]any)["ingress"] != "web" {
+		t.Errorf("document = %v", doc)
+	}
+	if lines[2]["index"].(map[string]any)["_id"] == action["_id"] {
+		t.Errorf("documents have the same _id")
+	}
+}
+
+func TestBulkFields(t *testing.T) {
+	tests := []struct {
+		format string
+		line   string
+		want   string
+	}{
+		{"json", `{"elb_status_code":200,"httpRequest":{"uri":"/"}}`, `{"elb_status_code":200,"httpRequest":{"uri":"/"}}`},
+		{"logfmt", `elb_status_code=200 user_agent="curl/8.0 (x)"`, `{"elb_status_code":"200","user_agent":"curl/8.0 (x)"}`},
+		{"raw", `elb_status_code=200 user_agent="curl/8.0 (x)"`, `{"elb_status_code":"200","user_agent":"curl/8.0 (x)"}`},
+	}
+	for _, tt := range tests {
+		fields, err := bulkFields(tt.format, tt.line)
+		if err != nil {
+			t.Fatalf("bulkFields(%s) error = %v", tt.format, err)
+		}
+		if got, _ := json.Marshal(fields); string(got) != tt.want {
+			t.Errorf("bulkFields(%s) = %s, want %s", tt.format, got, tt.want)
+		}
+	}
+	if _, err := bulkFields("json", "type=h2"); err == nil {
+		t.Error("bulkFields() of invalid json line error = nil")
+	}
+}
+
+func TestSanitizeIndex(t *testing.T) {
+	tests := map[string]string{
+		"alb-2024.03.01":       "alb-2024.03.01",
+		"alb-Shop Team/Web":    "alb-shop_team_web",
+		"_alb-a:b#c,d*e?f|g<h": "alb-a_b_c_d_e_f_g_h",
+		"+-alb":                "alb",
+	}
+	for name, want := range tests {
+		if got := sanitizeIndex(name); got != want {
+			t.Errorf("sanitizeIndex(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestBulkStatus(t *testing.T) {
+	const (
+		ok       = `{"errors":false,"items":[{"index":{"status":201}}]}`
+		retry    = `{"errors":true,"items":[{"index":{"status":429,"error":{"type":"es_rejected_execution_exception"}}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`
+		rejected = `{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}]}`
+	)
+	tests := []struct {
+		name       string
+		body       string
+		drop       bool
+		wantStatus int
+		wantErr    bool
+	}{
+		{name: "ok", body: ok, wantStatus: 200},
+		{name: "retry", body: retry, wantStatus: 429, wantErr: true},
+		{name: "rejected", body: rejected, wantStatus: 400, wantErr: true},
+		{name: "dropped", body: rejected, drop: true, wantStatus: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &lokiClient{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), dropRejected: tt.drop}
+			status, err := c.bulkStatus(http.StatusOK, strings.NewReader(tt.body))
+			if status != tt.wantStatus || (err != nil) != tt.wantErr {
+				t.Errorf("bulkStatus() = %d, %v, want %d, error %v", status, err, tt.wantStatus, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+type Options struct {
+	ConfigFile          string
+	BucketName          string
+	Prefix              string
+	BucketOwner         string
+	SSECKeyFile         string
+	WaitInterval        time.Duration
+	WaitMin             time.Duration
+	WaitMax             time.Duration
+	IdleAfter           time.Duration
+	IdleWait            time.Duration
+	SQSQueueURL         string
+	Format              string
+	FormatLabel         string
+	SchemeLabels        bool
+	Parser              string
+	SanitizeUTF8        bool
+	ExtraField          string
+	ProtocolField       bool
+	FieldMaxLength      map[string]int
+	Metadata            map[string]string
+	MetadataOnly        bool
+	MetadataS3Key       string
+	TieBreak            bool
+	CorrelateWindow     time.Duration
+	CorrelateMax        int
+	MTLSFields          bool
+	ShipConnections     bool
+	CloudFrontPrefix    string
+	Distributions       map[string]string
+	VPCFlowLogs         bool
+	WAFLogs             bool
+	Transforms          []string
+	LokiURL             string
+	Output              string
+	OTLPEndpoint        string
+	OTLPFormat          string
+	OpenSearchURL       string
+	OpenSearchIndex     string
+	OpenSearchDrop      bool
+	OpenSearchFormat    string
+	LokiUser            string
+	LokiTenant          string
+	LokiPassword        string
+	LokiEncoding        string
+	LokiAuth            []string
+	LokiBearerTokenFile string
+	LokiOAuth2TokenURL  string
+	LokiOAuth2ClientID  string
+	LokiOAuth2Secret    string
+	LokiOAuth2Scopes    []string
+	LokiUserAgent       string
+	LokiRequestID       string
+	LokiAddresses       []string
+	LokiMaxInflight     int
+	LokiStreamRate      float64
+	LokiBreakerAfter    int
+	LokiBreakerCooldown time.Duration
+	LokiCAFile          string
+	LokiCertFile        string
+	LokiKeyFile         string
+	LokiTLSSkipVerify   bool
+	ExecSink            string
+	ExecSinkQueue       int
+	SpoolDir            string
+	SpoolMaxSize        int64
+	BatchMaxSpan        time.Duration
+	BatchLines          int
+	BatchBytes          int
+	BatchMaxWait        time.Duration
+	PushPipeline        int
+	LokiResolveInterval time.Duration
+	RemoteWriteURL      string
+	RemoteWriteAuth     []string
+	RemoteWriteInterval time.Duration
+	Labels              map[string]string
+	TagLabels           map[string]string
+	AccountAliases      map[string]string
+	ResolveAliases      bool
+	Roles               map[string]string
+	ELBAPIRate          float64
+	Prefetch            bool
+	// templates of namespace and ingress labels for ALBs without ingress tags
+	FallbackNamespace string
+	FallbackIngress   string
+	DomainMetrics     map[string]bool
+	SLI               bool
+	SizeMetrics       bool
+	S3PutPrice        float64
+	S3GetPrice        float64
+	AnomalyWebhook    string
+	AnomalyExec       string
+	AnomalyWindow     time.Duration
+	AnomalyErrorRate  float64
+	AnomalyLatency    time.Duration
+	Audit             string
+	Journal           string
+	Workers           int
+	ParseWorkers      int
+	ParseThreads      int
+	Port              int
+	AdminPort         int
+	AdminBind         string
+	AdminTokenFile    string
+	PushgatewayURL    string
+	PushgatewayJob    string
+	SlowFiles         int
+	StuckAfter        time.Duration
+	ScanConcurrency   int
+	ScanMaxQueue      int
+	ScanMaxKeys       int
+	SkipEmpty         bool
+	MinAge            time.Duration
+	ShedQueue         int
+	ShedAfter         time.Duration
+	ShedRules         []string
+	DedupWindow       time.Duration
+	DedupBucket       string
+	DedupPrefix       string
+	DeleteAfter       time.Duration
+	ProcessedAction   string
+	ArchiveBucket     string
+	ArchivePrefix     string
+	ReplicaID         string
+	ClaimTTL          time.Duration
+	ClaimTable        string
+	SkipTags          map[string]string
+	RetryDelay        time.Duration
+	MaxAttempts       int
+	ParkAfter         int
+	ParkDuration      time.Duration
+	VolumeSummary     time.Duration
+	LogLevel          string
+	Version           bool
+	// values by flag name, to find options changed on reload of --config
+	Flags map[string]string
+}
+
+// parseOptions defines flags on the flag set, parses args and validates them
+func parseOptions(fs *pflag.FlagSet, args []string) (Options, error) {
+	var opts Options
+	opts.Labels = make(map[string]string)
+	opts.Distributions = make(map[string]string)
+	opts.FieldMaxLength = make(map[string]int)
+	opts.Metadata = make(map[string]string)
+	opts.TagLabels = make(map[string]string)
+	opts.SkipTags = make(map[string]string)
+	opts.AccountAliases = make(map[string]string)
+	opts.Roles = make(map[string]string)
+	opts.DomainMetrics = make(map[string]bool)
+	fs.StringVarP(&opts.ConfigFile, "config", "", "", "Path to YAML file with options by flag names, overridden by flags. Labels, transforms and shed rules are reloaded from it on SIGHUP")
+	fs.StringVarP(&opts.BucketName, "bucket-name", "b", "", "Name of the S3 bucket with ALB logs (required)")
+	fs.StringVarP(&opts.Prefix, "prefix", "", "", "Only list and ship keys under this prefix of the bucket, like AWSLogs/<account>/elasticloadbalancing/<region>/")
+	fs.StringVarP(&opts.BucketOwner, "expected-bucket-owner", "", "", "Account ID expected to own --bucket-name, S3 requests fail when the bucket is owned by another account")
+	fs.StringVarP(&opts.SSECKeyFile, "sse-c-key-file", "", "", "Path to file with base64 encoded 256-bit key to read objects encrypted with SSE-C customer-provided key. Archived copies are encrypted with it as well")
+	fs.DurationVarP(&opts.WaitInterval, "wait", "w", 60*time.Second, "Interval to wait between runs")
+	fs.DurationVarP(&opts.WaitMin, "wait-min", "", 0, "Shortest interval to wait between runs when a scan stops at --scan-max-keys (enables adaptive interval)")
+	fs.DurationVarP(&opts.WaitMax, "wait-max", "", 0, "Longest interval to wait between runs when scans find no files (enables adaptive interval)")
+	fs.DurationVarP(&opts.IdleAfter, "idle-after", "", 0, "Enter idle mode when scans find no files for this long: only one worker takes files, pooled buffers are released and scans wait for --idle-wait, until files are found (0 to disable)")
+	fs.DurationVarP(&opts.IdleWait, "idle-wait", "", 5*time.Minute, "Interval to wait between runs in idle mode")
+	fs.StringVarP(&opts.SQSQueueURL, "sqs-queue-url", "", "", "URL of SQS queue with S3 ObjectCreated event notifications of the bucket, to receive new keys from instead of listing the bucket each --wait")
+	fs.StringVarP(&opts.LokiURL, "loki-url", "H", "", "URL to Loki API (required with --output=loki)")
+	fs.StringVarP(&opts.Output, "output", "", "loki", "Where to push entries (loki, otlp, opensearch). Otlp pushes OTLP/HTTP protobuf to --otlp-endpoint, with fields of lines as attributes. Opensearch indexes fields of lines as documents to --opensearch-url by bulk API")
+	fs.StringVarP(&opts.OpenSearchURL, "opensearch-url", "", "", "URL of OpenSearch or Elasticsearch cluster for --output=opensearch, like https://search:9200")
+	fs.StringVarP(&opts.OpenSearchIndex, "opensearch-index", "", "alb-%{+yyyy.MM.dd}", "Index of documents for --output=opensearch, with %{+yyyy.MM.dd} date of the entry and %{label} stream label values. Rendered name is lowercased, and chars not allowed in index names are replaced with _")
+	fs.BoolVarP(&opts.OpenSearchDrop, "opensearch-drop-rejected", "", false, "Drop documents rejected by OpenSearch with non-retryable errors like mapping conflicts, instead of failing the file to retry it")
+	fs.StringVarP(&opts.OpenSearchFormat, "opensearch-format", "", "", "Format of lines to index fields of for --output=opensearch (logfmt, json, raw) (default --format)")
+	fs.StringVarP(&opts.OTLPEndpoint, "otlp-endpoint", "", "", "URL of OTLP/HTTP logs receiver for --output=otlp, like http://otel-collector:4318/v1/logs")
+	fs.StringVarP(&opts.OTLPFormat, "otlp-format", "", "", "Format of lines to map fields of to attributes for --output=otlp (logfmt, json, raw) (default --format)")
+	fs.StringVarP(&opts.LokiUser, "loki-user", "u", "", "User to use for Loki authentication")
+	fs.StringVarP(&opts.LokiTenant, "loki-tenant", "", "", "Tenant to send in X-Scope-OrgID header of push requests, could be a template of stream labels to route streams to tenants, like {{.account}} (empty to not send)")
+	fs.StringVarP(&opts.LokiEncoding, "loki-encoding", "", "snappy", "Encoding of Loki push requests (snappy, gzip, auto). Gzip sends JSON, auto switches to it when snappy protobuf is rejected")
+	fs.StringArrayVarP(&opts.LokiAuth, "loki-auth", "", []string{}, "Auth provider to apply to Loki push requests after basic auth, can be specified multiple times to chain (header:<name>=<value>, hmac:<header>=<secret-file>, sigv4:<service>/<region>)")
+	fs.StringVarP(&opts.LokiBearerTokenFile, "loki-bearer-token-file", "", "", "Path to file with token to send as Authorization: Bearer header to Loki, re-read when the file changes")
+	fs.StringVarP(&opts.LokiOAuth2TokenURL, "loki-oauth2-token-url", "", "", "URL of OAuth2 token endpoint to get Bearer token for Loki by client credentials flow, refreshed before it expires")
+	fs.StringVarP(&opts.LokiOAuth2ClientID, "loki-oauth2-client-id", "", "", "OAuth2 client ID of --loki-oauth2-token-url")
+	fs.StringVarP(&opts.LokiOAuth2Secret, "loki-oauth2-client-secret-file", "", "", "Path to file with OAuth2 client secret of --loki-oauth2-token-url")
+	fs.StringArrayVarP(&opts.LokiOAuth2Scopes, "loki-oauth2-scope", "", []string{}, "OAuth2 scope to request from --loki-oauth2-token-url, can be specified multiple times")
+	fs.StringVarP(&opts.LokiUserAgent, "loki-user-agent", "", "", "User-Agent of Loki push requests (default alb-logs-shipper/<version> (<replica-id>))")
+	fs.StringVarP(&opts.LokiRequestID, "loki-request-id-header", "", "X-Request-ID", "Header to send ID of each push request in, which is also logged, so Loki gateway logs could be correlated to the shipper (empty to disable)")
+	fs.StringArrayVarP(&opts.LokiAddresses, "loki-address", "", []string{}, "Address to connect to instead of resolving Loki hostname, can be specified multiple times to rotate across (host or host:port)")
+	fs.DurationVarP(&opts.LokiResolveInterval, "loki-resolve-interval", "", 0, "Re-resolve Loki hostname and rotate new connections across its addresses, closing idle ones at this interval (0 to disable)")
+	fs.IntVarP(&opts.LokiMaxInflight, "loki-max-inflight", "", 0, "Max concurrent push requests per Loki tenant, to not exceed its parallelism limits when many workers flush at once (0 for unlimited)")
+	fs.Float64VarP(&opts.LokiStreamRate, "loki-stream-rate", "", 0, "Max bytes per second to push to each stream, to not hit Loki per_stream_rate_limit while draining a backlog (0 for unlimited)")
+	fs.IntVarP(&opts.LokiBreakerAfter, "loki-breaker-after", "", 0, "Consecutive failed pushes (after retries) to stop pushing to Loki for --loki-breaker-cooldown (0 to disable)")
+	fs.DurationVarP(&opts.LokiBreakerCooldown, "loki-breaker-cooldown", "", time.Minute, "Time to stop pushing to Loki after --loki-breaker-after failures, before probing it again")
+	fs.StringVarP(&opts.LokiCAFile, "loki-ca-file", "", "", "Path to PEM bundle of CA certificates to verify Loki server certificate, instead of system ones")
+	fs.StringVarP(&opts.LokiCertFile, "loki-cert-file", "", "", "Path to PEM client certificate for mutual TLS with Loki, requires --loki-key-file. Re-read on new connections, so could be rotated")
+	fs.StringVarP(&opts.LokiKeyFile, "loki-key-file", "", "", "Path to PEM private key of --loki-cert-file")
+	fs.BoolVarP(&opts.LokiTLSSkipVerify, "loki-tls-insecure-skip-verify", "", false, "Do not verify Loki server certificate (insecure, for testing only)")
+	fs.IntVarP(&opts.BatchLines, "batch-lines", "", 100, "Flush batch to Loki when it has this many lines")
+	fs.IntVarP(&opts.BatchBytes, "batch-bytes", "", 0, "Flush batch to Loki before its lines and structured metadata exceed this many bytes, to stay under Loki request size limits (0 for unlimited)")
+	fs.DurationVarP(&opts.BatchMaxWait, "batch-max-wait", "", 0, "Flush batch to Loki when its first line was added this long ago, checked on reading the next line of a slow file (0 for unlimited)")
+	fs.IntVarP(&opts.PushPipeline, "push-pipeline", "", 0, "Batches of a file to push to Loki in background in order, while the next batch is parsed, to hide Loki latency (0 to push synchronously)")
+	fs.DurationVarP(&opts.BatchMaxSpan, "batch-max-span", "", 0, "Flush batch before its entries span more than this time range, to split pushes of files by time windows (0 to disable)")
+	fs.StringVarP(&opts.ExecSink, "exec-sink", "", "", "Command to start and write entries pushed to Loki to its stdin as NDJSON, for custom delivery. It is restarted on failures or after 10s exchange timeout, which do not fail pushes")
+	fs.IntVarP(&opts.ExecSinkQueue, "exec-sink-queue", "", 100, "Number of pushed batches to queue for --exec-sink, batches are dropped when it is full")
+	fs.StringVarP(&opts.SpoolDir, "spool-dir", "", "", "Directory to write batches to while Loki circuit breaker is open, and replay them when it recovers. Files are deleted from S3 only after replay")
+	fs.Int64VarP(&opts.SpoolMaxSize, "spool-max-size", "", 1<<30, "Max bytes of batches in --spool-dir, files are retried as usual when it is full")
+	fs.StringVarP(&opts.LogLevel, "log-level", "", "info", "Log level (info, debug)")
+	fs.StringVarP(&opts.Format, "format", "o", "raw", "Format to parse and ship log lines as (logfmt, json, raw)")
+	fs.StringVarP(&opts.FormatLabel, "format-label", "", "", "Name of Loki stream label to set to --format value, so LogQL pipelines could branch on how lines are encoded (empty to disable)")
+	fs.BoolVarP(&opts.TieBreak, "tie-break", "", false, "Add nanoseconds to timestamps of consecutive entries of a file with the same timestamp, so Loki does not drop entries with the same timestamp and line as duplicates")
+	fs.StringVarP(&opts.Parser, "parser", "", "fast", "Line tokenizer (fast, strict). Strict validates quoting, and falls back to regex on mismatch")
+	fs.BoolVarP(&opts.SanitizeUTF8, "sanitize-utf8", "", false, "Replace invalid UTF-8 sequences of field values with U+FFFD also in logfmt format (always done for json)")
+	fs.StringVarP(&opts.ExtraField, "extra-field", "", "", "Name of field to pack fields which are dropped by default, and trailing unknown fields to, as JSON object (empty to drop them)")
+	fs.BoolVarP(&opts.ProtocolField, "protocol-field", "", false, "Add protocol field after type, normalized to http (http, https), http2 (h2), grpc (grpcs) or websocket (ws, wss), and grpc_status field of gRPC lines after target_status_code")
+	var maxLengths = fs.StringArrayP("max-field-length", "", []string{}, "Truncate field to max length in bytes, can be specified multiple times (field=bytes)")
+	var metadata = fs.StringArrayP("metadata", "", []string{}, "Add field value to Loki structured metadata of each entry, can be specified multiple times (field=key)")
+	fs.BoolVarP(&opts.MetadataOnly, "metadata-only", "", false, "Drop fields of --metadata from lines, to keep them only in structured metadata")
+	fs.StringVarP(&opts.MetadataS3Key, "metadata-s3-key", "", "", "Structured metadata key to add S3 key of the source file of each entry as (empty to disable)")
+	fs.DurationVarP(&opts.CorrelateWindow, "correlate-connections", "", 0, "Read ALB connection logs and add tls_handshake_latency to access log entries by conn_trace_id within this window (0 to disable)")
+	fs.IntVarP(&opts.CorrelateMax, "correlate-max-connections", "", 1000000, "Max connections kept for --correlate-connections, the oldest minutes of connections are evicted above it (0 for unlimited)")
+	fs.BoolVarP(&opts.MTLSFields, "mtls-fields", "", false, "Also add client certificate fields of connection logs to access log entries (leaf_client_cert_subject, leaf_client_cert_validity, leaf_client_cert_serial_number, tls_verify_status), requires --correlate-connections")
+	fs.BoolVarP(&opts.ShipConnections, "ship-connections", "", false, "Ship ALB connection log files as entries of separate streams with label log_type=connection, and delete them as access log files")
+	fs.StringVarP(&opts.CloudFrontPrefix, "cloudfront-prefix", "", "", "Also ship CloudFront standard log files under this prefix of the bucket, with .Type=cloudfront and distribution ID as .LoadBalancer (empty to disable)")
+	var distributions = fs.StringArrayP("cloudfront-distribution", "", []string{}, "Namespace and ingress labels of CloudFront distribution, can be specified multiple times (distribution-id=namespace/ingress). Others get --fallback-namespace and --fallback-ingress")
+	fs.BoolVarP(&opts.VPCFlowLogs, "vpc-flow-logs", "", false, "Also ship VPC flow log files (AWSLogs/<account>/vpcflowlogs/) of default or custom text format, with .Type=vpcflow and flow log ID as .LoadBalancer")
+	fs.BoolVarP(&opts.WAFLogs, "waf-logs", "", false, "Also ship WAF log files (AWSLogs/<account>/WAFLogs/), with .Type=waf and web ACL name as .LoadBalancer")
+	fs.StringArrayVarP(&opts.Transforms, "transform", "", []string{}, "Transform fields of each line before formatting, can be specified multiple times to chain in order (drop:<field>, redact:<field>, redact-regex:<field>=<regex>, redact-query:<field>=<param>,..., keep-query:<field>=<param>,..., mask-ip:<field>, hash-ip:<field>=<key-file>, rename:<field>=<name>, derive:<field>=<template>, exec:<command>)")
+	var domains = fs.StringArrayP("domain-metrics", "", []string{}, "Count requests to the domain by status code class in metrics, can be specified multiple times")
+	fs.BoolVarP(&opts.SLI, "sli", "", false, "Expose availability and latency SLI metrics per ingress")
+	fs.BoolVarP(&opts.SizeMetrics, "size-metrics", "", false, "Expose histograms of request and response sizes per ingress")
+	fs.Float64VarP(&opts.S3PutPrice, "s3-put-price", "", 0.005, "Price of 1000 S3 PUT, COPY, POST and LIST requests, to estimate cost of S3 API requests")
+	fs.Float64VarP(&opts.S3GetPrice, "s3-get-price", "", 0.0004, "Price of 1000 S3 GET, HEAD and other requests, to estimate cost of S3 API requests")
+	fs.StringVarP(&opts.AnomalyWebhook, "anomaly-webhook", "", "", "URL to POST JSON to when ingress error rate or latency exceeds thresholds")
+	fs.StringVarP(&opts.AnomalyExec, "anomaly-exec", "", "", "Command to run with JSON on stdin when ingress error rate or latency exceeds thresholds")
+	fs.DurationVarP(&opts.AnomalyWindow, "anomaly-window", "", 5*time.Minute, "Window to evaluate ingress error rate and latency for anomaly hook")
+	fs.Float64VarP(&opts.AnomalyErrorRate, "anomaly-error-rate", "", 0.05, "Ratio of 5xx responses of an ingress to invoke anomaly hook (0 to disable)")
+	fs.DurationVarP(&opts.AnomalyLatency, "anomaly-latency", "", 0, "Average latency of an ingress to invoke anomaly hook (0 to disable)")
+	fs.BoolVarP(&opts.SchemeLabels, "scheme-labels", "", false, "Add scheme (internal, internet-facing) and ip_type (ipv4, dualstack) stream labels of load balancers, unless set by --label")
+	var labels = fs.StringArrayP("label", "l", []string{}, "Label to add to Loki stream, value is a template of ALB metadata, can be specified multiple times (key=value)")
+	var tagLabels = fs.StringArrayP("tag-label", "", []string{}, "Add ALB tag value as Loki stream label, can be specified multiple times (label=tag-key)")
+	var accountAliases = fs.StringArrayP("account-alias", "", []string{}, "Add account label with alias instead of account ID, can be specified multiple times (account-id=alias)")
+	fs.BoolVarP(&opts.ResolveAliases, "resolve-account-aliases", "", false, "Add account label with alias from iam:ListAccountAliases, for accounts not set via --account-alias")
+	var roles = fs.StringArrayP("role-arn", "a", []string{}, "ARN of the IAM role to assume to access ALB tags, can be specified multiple times")
+	fs.StringVarP(&opts.FallbackNamespace, "fallback-namespace", "", "{{or .Account .AccountID}}", "Template of namespace label for ALBs without ingress tags (.Account, .AccountID, .LoadBalancer, .Cluster)")
+	fs.StringVarP(&opts.FallbackIngress, "fallback-ingress", "", "{{.LoadBalancer}}", "Template of ingress label for ALBs without ingress tags (.Account, .AccountID, .LoadBalancer, .Cluster)")
+	fs.BoolVarP(&opts.Prefetch, "prefetch-metadata", "", false, "Describe all ALBs of own account and --role-arn accounts on start, to warm tags cache before shipping")
+	fs.Float64VarP(&opts.ELBAPIRate, "elb-api-rate", "", 5, "Max ELB/IAM API requests per second to look up ALB tags on cold cache")
+	fs.IntVarP(&opts.Workers, "workers", "n", 4, "Number of workers to download and ship files concurrently")
+	fs.IntVarP(&opts.ParseWorkers, "parse-workers", "", 0, "Number of files to decompress and parse concurrently (default GOMAXPROCS, sized to container CPU limit)")
+	fs.IntVarP(&opts.ParseThreads, "parse-threads", "", 0, "Number of goroutines locked to OS threads to dedicate to parsing lines, handed off by --parse-workers in chunks (0 to parse in workers)")
+	fs.IntVarP(&opts.Port, "port", "p", 8080, "Port to expose metrics on")
+	fs.IntVarP(&opts.AdminPort, "admin-port", "", 0, "Port to expose /debug endpoints and pprof on, separately from metrics (0 to expose /debug endpoints on --port, without pprof)")
+	fs.StringVarP(&opts.AdminBind, "admin-bind", "", "", "Address to bind --admin-port to, like 127.0.0.1 (default all interfaces)")
+	fs.StringVarP(&opts.AdminTokenFile, "admin-token-file", "", "", "Path to file with token which /debug endpoints require as 'Authorization: Bearer <token>' header")
+	fs.StringVarP(&opts.PushgatewayURL, "pushgateway-url", "", "", "URL of Prometheus Pushgateway to push metrics to on shutdown, grouped by job and --replica-id instance")
+	fs.StringVarP(&opts.PushgatewayJob, "pushgateway-job", "", "alb-logs-shipper", "Job name to push metrics to --pushgateway-url with")
+	fs.StringVarP(&opts.RemoteWriteURL, "remote-write-url", "", "", "URL of Prometheus remote-write endpoint (like Mimir) to push metrics to at --remote-write-interval and on shutdown")
+	fs.DurationVarP(&opts.RemoteWriteInterval, "remote-write-interval", "", time.Minute, "Interval to push metrics to --remote-write-url")
+	fs.StringArrayVarP(&opts.RemoteWriteAuth, "remote-write-auth", "", []string{}, "Auth provider to apply to remote-write requests, can be specified multiple times to chain (same as --loki-auth)")
+	fs.IntVarP(&opts.SlowFiles, "slow-files", "", 5, "Keep detailed trace (stage timings, batches, push attempts) of this many slowest files of the last hour at /debug/status (0 to disable)")
+	fs.DurationVarP(&opts.StuckAfter, "stuck-after", "", 5*time.Minute, "Count worker as stuck in alb_logs_shipper_stuck_workers metric when it is in the same stage of a file for longer than this (0 to disable)")
+	fs.IntVarP(&opts.ScanConcurrency, "scan-concurrency", "", 1, "Number of AWSLogs/<account>/elasticloadbalancing/<region>/ prefixes to list concurrently (1 for a single flat listing)")
+	fs.IntVarP(&opts.ScanMaxQueue, "scan-max-queue", "", 0, "Skip scan while more keys than this are waiting in queue, so the same keys are not enqueued again (0 to disable)")
+	fs.IntVarP(&opts.ScanMaxKeys, "scan-max-keys", "", 0, "Max keys to enqueue per scan, checked before each page of 1000 keys. The next scan continues listing after the last listed key (0 for unlimited, which lists the whole bucket on each scan)")
+	fs.BoolVarP(&opts.SkipEmpty, "skip-empty", "", false, "Do not enqueue zero-byte objects, they are kept in the bucket")
+	fs.DurationVarP(&opts.MinAge, "min-age", "", 0, "Do not enqueue objects modified less than this ago, which could still be written by replication. They are listed again by the next scans (0 to disable)")
+	fs.IntVarP(&opts.ShedQueue, "shed-queue", "", 0, "Queue length to start dropping lines by --shed-rule when it is exceeded for --shed-after, less than 10*--workers (0 to disable)")
+	fs.DurationVarP(&opts.ShedAfter, "shed-after", "", 5*time.Minute, "Time the queue should be over --shed-queue to start dropping lines")
+	fs.StringArrayVarP(&opts.ShedRules, "shed-rule", "", []string{}, "Drop access log lines of the status classes from streams which label matches the glob while the queue is overloaded, keeping the ratio of them, can be specified multiple times (<label>=<glob>:<class>,...[:<keep-ratio>])")
+	fs.DurationVarP(&opts.DedupWindow, "dedup-window", "", 0, "Remember deleted keys for this window, to count files which appear in the bucket again after deletion (0 to disable)")
+	fs.StringVarP(&opts.DedupBucket, "dedup-bucket", "", "", "Bucket to write markers of shipped files to, shared by shippers of replicated buckets, so each file is shipped from one of them only")
+	fs.StringVarP(&opts.DedupPrefix, "dedup-prefix", "", "alb-logs-shipper/dedup/", "Prefix of --dedup-bucket markers, expire them by S3 lifecycle rule")
+	fs.StringVarP(&opts.Audit, "audit", "", "", "Write audit trail of shipped and deleted files to file:<path>, s3:<prefix> of the bucket, or loki")
+	fs.StringVarP(&opts.Journal, "journal", "", "", "Path to local journal file, to delete only files with all batches acknowledged, and not ship again files which failed to be deleted")
+	var skipTags = fs.StringArrayP("skip-tag", "", []string{}, "Skip S3 objects with the tag (and value when set), like do-not-ship=true set by another process, can be specified multiple times (key[=value])")
+	fs.DurationVarP(&opts.DeleteAfter, "delete-after", "", 0, "Keep shipped files tagged in S3 for this retention before deleting them (0 to delete immediately)")
+	fs.StringVarP(&opts.ProcessedAction, "processed-action", "", "delete", "What to do with shipped files: delete, move (copy to --archive-prefix of --archive-bucket, then delete), or tag (keep tagged as shipped)")
+	fs.StringVarP(&opts.ArchiveBucket, "archive-bucket", "", "", "Bucket to move shipped files to with --processed-action=move (default --bucket-name)")
+	fs.StringVarP(&opts.ArchivePrefix, "archive-prefix", "", "processed/", "Prefix to move shipped files to with --processed-action=move, keys under it are not shipped")
+	fs.DurationVarP(&opts.ClaimTTL, "claim-ttl", "", 0, "Claim files via S3 object tag before processing, so multiple replicas don't ship the same file (best-effort, see --claim-table). Claims older than this are stale (0 to disable)")
+	fs.StringVarP(&opts.ClaimTable, "claim-table", "", "", "DynamoDB table (with `key` string partition key) to claim files in via conditional writes instead of S3 object tags, requires --claim-ttl")
+	fs.DurationVarP(&opts.RetryDelay, "retry-delay", "", time.Minute, "Delay before retrying a file which failed to ship, doubled on each attempt up to 1h")
+	fs.IntVarP(&opts.MaxAttempts, "max-attempts", "", 5, "Attempts to ship a file before it is quarantined (skipped until restart)")
+	fs.IntVarP(&opts.ParkAfter, "park-after", "", 3, "Consecutive failures of a load balancer to skip all its files for --park-duration, while shipping others (0 to disable)")
+	fs.DurationVarP(&opts.ParkDuration, "park-duration", "", 10*time.Minute, "Time to skip files of a parked load balancer before probing it again")
+	fs.StringVarP(&opts.ReplicaID, "replica-id", "", "", "ID of this replica for file claims (default hostname)")
+	fs.DurationVarP(&opts.VolumeSummary, "volume-summary", "", 0, "Interval to log shipped bytes and lines per cluster/namespace/ingress (0 to disable)")
+	fs.BoolVarP(&opts.Version, "version", "v", false, "Show version and exit")
+	if err := fs.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.ConfigFile != "" {
+		if err := loadConfig(fs, opts.ConfigFile); err != nil {
+			return opts, err
+		}
+	}
+	if opts.Version {
+		return opts, nil
+	}
+
+	if opts.BucketName == "" {
+		return opts, fmt.Errorf("--bucket-name is required")
+	}
+
+	switch opts.Output {
+	case "loki":
+		if opts.LokiURL == "" {
+			return opts, fmt.Errorf("--loki-url is required")
+		}
+	case "otlp":
+		if opts.OTLPEndpoint == "" {
+			return opts, fmt.Errorf("--otlp-endpoint is required for --output=otlp")
+		}
+	case "opensearch":
+		if opts.OpenSearchURL == "" {
+			return opts, fmt.Errorf("--opensearch-url is required for --output=opensearch")
+		}
+		if _, err := newIndexTemplate(opts.OpenSearchIndex); err != nil {
+			return opts, fmt.Errorf("invalid --opensearch-index: %w", err)
+		}
+	default:
+		return opts, fmt.Errorf("--output should be one of: loki, otlp, opensearch")
+	}
+	for name, format := range map[string]string{"otlp-format": opts.OTLPFormat, "opensearch-format": opts.OpenSearchFormat} {
+		if format != "" && !slices.Contains([]string{"logfmt", "json", "raw"}, format) {
+			return opts, fmt.Errorf("--%s should be one of: logfmt, json, raw", name)
+		}
+	}
+
+	if opts.Parser != "fast" && opts.Parser != "strict" {
+		return opts, fmt.Errorf("--parser should be one of: fast, strict")
+	}
+
+	if !slices.Contains([]string{"snappy", "gzip", "auto"}, opts.LokiEncoding) {
+		return opts, fmt.Errorf("--loki-encoding should be one of: snappy, gzip, auto")
+	}
+
+	if opts.LokiUser != "" && os.Getenv("LOKI_PASSWORD") == "" {
+		return opts, fmt.Errorf("LOKI_PASSWORD environment variable is required")
+	}
+	opts.LokiPassword = os.Getenv("LOKI_PASSWORD")
+
+	for _, label := range *labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return opts, fmt.Errorf("invalid label format (k=v): %s", label)
+		}
+		opts.Labels[parts[0]] = parts[1]
+	}
+	if opts.SchemeLabels {
+		for k, v := range map[string]string{"scheme": "{{.Scheme}}", "ip_type": "{{.IPType}}"} {
+			if _, ok := opts.Labels[k]; !ok {
+				opts.Labels[k] = v
+			}
+		}
+	}
+	if _, ok := opts.Labels[opts.FormatLabel]; ok {
+		return opts, fmt.Errorf("--format-label %s is already set by --label", opts.FormatLabel)
+	}
+
+	for _, d := range *domains {
+		opts.DomainMetrics[d] = true
+	}
+
+	if opts.WaitMin == 0 {
+		opts.WaitMin = opts.WaitInterval
+	}
+	if opts.WaitMax == 0 {
+		opts.WaitMax = opts.WaitInterval
+	}
+	if opts.WaitMin > opts.WaitInterval || opts.WaitMax < opts.WaitInterval {
+		return opts, fmt.Errorf("--wait should be between --wait-min and --wait-max")
+	}
+	if opts.AnomalyWindow <= 0 {
+		return opts, fmt.Errorf("--anomaly-window should be positive")
+	}
+	if opts.SpoolDir != "" && opts.LokiBreakerAfter <= 0 {
+		return opts, fmt.Errorf("--spool-dir requires --loki-breaker-after")
+	}
+	if opts.Workers < 1 {
+		return opts, fmt.Errorf("--workers should be at least 1")
+	}
+	if opts.MaxAttempts < 1 {
+		return opts, fmt.Errorf("--max-attempts should be at least 1")
+	}
+	if opts.LokiOAuth2TokenURL != "" && (opts.LokiOAuth2ClientID == "" || opts.LokiOAuth2Secret == "") {
+		return opts, fmt.Errorf("--loki-oauth2-token-url requires --loki-oauth2-client-id and --loki-oauth2-client-secret-file")
+	}
+	if opts.LokiOAuth2TokenURL != "" && opts.LokiBearerTokenFile != "" {
+		return opts, fmt.Errorf("--loki-oauth2-token-url and --loki-bearer-token-file are mutually exclusive")
+	}
+	if opts.LokiUser != "" && (opts.LokiOAuth2TokenURL != "" || opts.LokiBearerTokenFile != "") {
+		return opts, fmt.Errorf("--loki-user is mutually exclusive with --loki-bearer-token-file and --loki-oauth2-token-url, as both set Authorization header")
+	}
+	if (opts.LokiCertFile == "") != (opts.LokiKeyFile == "") {
+		return opts, fmt.Errorf("--loki-cert-file and --loki-key-file should be set together")
+	}
+	if opts.BatchLines < 1 {
+		return opts, fmt.Errorf("--batch-lines should be at least 1")
+	}
+	if opts.PushPipeline < 0 {
+		return opts, fmt.Errorf("--push-pipeline should not be negative")
+	}
+	if opts.S3PutPrice < 0 || opts.S3GetPrice < 0 {
+		return opts, fmt.Errorf("--s3-put-price and --s3-get-price should not be negative")
+	}
+
+	if opts.CorrelateMax < 0 {
+		return opts, fmt.Errorf("--correlate-max-connections should be >= 0")
+	}
+	if opts.MTLSFields && opts.CorrelateWindow <= 0 {
+		return opts, fmt.Errorf("--mtls-fields requires --correlate-connections")
+	}
+
+	if len(opts.ShedRules) > 0 && opts.ShedQueue <= 0 {
+		return opts, fmt.Errorf("--shed-rule requires --shed-queue")
+	}
+	if opts.ShedQueue >= 10*opts.Workers {
+		return opts, fmt.Errorf("--shed-queue should be less than the queue capacity of 10*--workers (%d)", 10*opts.Workers)
+	}
+
+	if opts.ExecSink != "" && opts.ExecSinkQueue <= 0 {
+		return opts, fmt.Errorf("--exec-sink-queue should be > 0")
+	}
+
+	if opts.AdminBind != "" && opts.AdminPort <= 0 {
+		return opts, fmt.Errorf("--admin-bind requires --admin-port")
+	}
+
+	if opts.Audit != "" {
+		kind, target, _ := strings.Cut(opts.Audit, ":")
+		if (kind != "file" && kind != "s3" || target == "") && opts.Audit != "loki" {
+			return opts, fmt.Errorf("invalid audit target %q (file:<path>, s3:<prefix>, loki)", opts.Audit)
+		}
+		// keys under the audit prefix are not listed, so it can't cover log files
+		if kind == "s3" && (strings.HasPrefix(opts.Prefix, target) || strings.HasPrefix("AWSLogs/", target) || strings.Contains(target, "AWSLogs/")) {
+			return opts, fmt.Errorf("--audit=s3:%s should be outside of --prefix and AWSLogs/", target)
+		}
+	}
+
+	switch opts.ProcessedAction {
+	case "delete", "tag":
+	case "move":
+		if opts.ArchiveBucket == "" {
+			opts.ArchiveBucket = opts.BucketName
+		}
+		if opts.ArchiveBucket == opts.BucketName && opts.ArchivePrefix == "" {
+			return opts, fmt.Errorf("--processed-action=move to the same bucket requires --archive-prefix")
+		}
+	default:
+		return opts, fmt.Errorf("invalid processed action %q (delete, move, tag)", opts.ProcessedAction)
+	}
+	if opts.DeleteAfter > 0 && opts.ProcessedAction != "delete" {
+		return opts, fmt.Errorf("--delete-after requires --processed-action=delete")
+	}
+	// files kept in the bucket are never received from SQS again
+	if opts.SQSQueueURL != "" && (opts.DeleteAfter > 0 || opts.ProcessedAction == "tag") {
+		return opts, fmt.Errorf("--sqs-queue-url can't be used with --delete-after or --processed-action=tag, as retained files are not listed")
+	}
+	if opts.SQSQueueURL != "" && opts.IdleAfter > 0 {
+		return opts, fmt.Errorf("--idle-after can't be used with --sqs-queue-url, as idle mode depends on scans of the bucket")
+	}
+
+	if opts.ReplicaID == "" {
+		opts.ReplicaID, _ = os.Hostname()
+	}
+	if opts.ClaimTable != "" && opts.ClaimTTL <= 0 {
+		return opts, fmt.Errorf("--claim-table requires --claim-ttl")
+	}
+
+	for _, ml := range *maxLengths {
+		parts := strings.SplitN(ml, "=", 2)
+		if len(parts) == 2 && knownField(opts, parts[0]) {
+			if n, err := strconv.Atoi(parts[1]); err == nil && n > len(truncatedMarker) {
+				opts.FieldMaxLength[parts[0]] = n
+				continue
+			}
+		}
+		return opts, fmt.Errorf("invalid max field length format (field=bytes, more than %d bytes of %s marker): %s", len(truncatedMarker), truncatedMarker, ml)
+	}
+
+	for _, m := range *metadata {
+		parts := strings.SplitN(m, "=", 2)
+		known := knownField(opts, parts[0]) || opts.MTLSFields && slices.Contains(connMTLSFields, parts[0])
+		if len(parts) < 2 || !known || len(parts[1]) == 0 {
+			return opts, fmt.Errorf("invalid metadata format (field=key): %s", m)
+		}
+		opts.Metadata[parts[0]] = parts[1]
+	}
+	// metadata and --extra-field are extracted before transformers
+	for _, name := range redactedFields(opts.Transforms) {
+		if _, ok := opts.Metadata[name]; ok {
+			return opts, fmt.Errorf("--metadata of field %s would not be redacted by --transform, as metadata is extracted before transformers", name)
+		}
+		if opts.ExtraField != "" && (skipFields[name] || nlbSkipFields[name]) {
+			return opts, fmt.Errorf("field %s packed to --extra-field would not be redacted by --transform, as it is packed before transformers", name)
+		}
+	}
+
+	for _, tl := range *tagLabels {
+		parts := strings.SplitN(tl, "=", 2)
+		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return opts, fmt.Errorf("invalid tag label format (label=tag-key): %s", tl)
+		}
+		opts.TagLabels[parts[0]] = parts[1]
+	}
+
+	if opts.CloudFrontPrefix != "" && strings.HasPrefix(opts.Prefix+"AWSLogs/", opts.CloudFrontPrefix) {
+		return opts, fmt.Errorf("--cloudfront-prefix should not include AWSLogs/ of load balancer logs")
+	}
+	for _, d := range *distributions {
+		id, v, _ := strings.Cut(d, "=")
+		if ns, ing, ok := strings.Cut(v, "/"); !ok || id == "" || ns == "" || ing == "" {
+			return opts, fmt.Errorf("invalid CloudFront distribution format (distribution-id=namespace/ingress): %s", d)
+		}
+		opts.Distributions[id] = v
+	}
+
+	for _, st := range *skipTags {
+		k, v, _ := strings.Cut(st, "=")
+		if k == "" {
+			return opts, fmt.Errorf("invalid skip tag format (key[=value]): %s", st)
+		}
+		opts.SkipTags[k] = v
+	}
+
+	for _, a := range *accountAliases {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) < 2 || !isAccountID(parts[0]) || len(parts[1]) == 0 {
+			return opts, fmt.Errorf("invalid account alias format (account-id=alias): %s", a)
+		}
+		opts.AccountAliases[parts[0]] = parts[1]
+	}
+
+	for _, role := range *roles {
+		id := strings.Split(role, ":")
+		if len(id) != 6 || !isAccountID(id[4]) {
+			return opts, fmt.Errorf("invalid role ARN: %s", role)
+		}
+		opts.Roles[id[4]] = role
+	}
+
+	opts.Flags = make(map[string]string)
+	fs.VisitAll(func(f *pflag.Flag) {
+		opts.Flags[f.Name] = f.Value.String()
+	})
+	return opts, nil
+}
+
+// isAccountID returns true for 12-digit AWS account ID
+func isAccountID(id string) bool {
+	if len(id) != 12 {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// knownField returns true for fields of access and NLB logs, and of log types
+// enabled by options, which could be used in --max-field-length and --metadata
+func knownField(opts Options, name string) bool {
+	return slices.Contains(subexpNames, name) || slices.Contains(nlbFields, name) ||
+		opts.ShipConnections && slices.Contains(connFields, name) ||
+		opts.CloudFrontPrefix != "" && slices.Contains(cfFields, name) ||
+		opts.VPCFlowLogs && slices.Contains(flowFields, name) ||
+		opts.WAFLogs && slices.Contains(wafFields, name)
+}
+
+// lineFormat returns format to ship lines to --output as, which is --format
+// unless overridden by --otlp-format or --opensearch-format of the output
+func lineFormat(opts Options) string {
+	switch {
+	case opts.Output == "otlp" && opts.OTLPFormat != "":
+		return opts.OTLPFormat
+	case opts.Output == "opensearch" && opts.OpenSearchFormat != "":
+		return opts.OpenSearchFormat
+	}
+	return opts.Format
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestParseOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "minimal", args: []string{"-b", "bucket", "-H", "http://loki"}},
+		{name: "no bucket", args: []string{"-H", "http://loki"}, wantErr: true},
+		{name: "no loki", args: []string{"-b", "bucket"}, wantErr: true},
+		{name: "label", args: []string{"-b", "bucket", "-H", "http://loki", "-l", "env=prod"}},
+		{name: "label without value", args: []string{"-b", "bucket", "-H", "http://loki", "-l", "env"}, wantErr: true},
+		{name: "no workers", args: []string{"-b", "bucket", "-H", "http://loki", "--workers", "0"}, wantErr: true},
+		{name: "label with empty value", args: []string{"-b", "bucket", "-H", "http://loki", "-l", "index="}, wantErr: true},
+		{name: "format label", args: []string{"-b", "bucket", "-H", "http://loki", "--format-label", "format"}},
+		{name: "format label set by label", args: []string{"-b", "bucket", "-H", "http://loki", "-l", "format=json", "--format-label", "format"}, wantErr: true},
+		{name: "role", args: []string{"-b", "bucket", "-H", "http://loki", "-a", "arn:aws:iam::123456789012:role/shipper"}},
+		{name: "role without account", args: []string{"-b", "bucket", "-H", "http://loki", "-a", "arn:aws:iam::shipper:role/shipper"}, wantErr: true},
+		{name: "account alias", args: []string{"-b", "bucket", "-H", "http://loki", "--account-alias", "123456789012=prod"}},
+		{name: "account alias not an id", args: []string{"-b", "bucket", "-H", "http://loki", "--account-alias", "prod=prod"}, wantErr: true},
+		{name: "audit", args: []string{"-b", "bucket", "-H", "http://loki", "--audit", "s3:audit/"}},
+		{name: "metadata of redacted field", args: []string{"-b", "bucket", "-H", "http://loki", "--metadata", "client=client", "--transform", "mask-ip:client"}, wantErr: true},
+		{name: "metadata of renamed redacted field", args: []string{"-b", "bucket", "-H", "http://loki", "--metadata", "client=client", "--transform", "rename:client=ip", "--transform", "hash-ip:ip=key"}, wantErr: true},
+		{name: "metadata of other field", args: []string{"-b", "bucket", "-H", "http://loki", "--metadata", "trace_id=trace", "--transform", "redact-query:request=token"}},
+		{name: "extra field redacted", args: []string{"-b", "bucket", "-H", "http://loki", "--extra-field", "extra", "--transform", "redact:chosen_cert_arn"}, wantErr: true},
+		{name: "sqs", args: []string{"-b", "bucket", "-H", "http://loki", "--sqs-queue-url", "https://sqs/queue"}},
+		{name: "sqs with delete-after", args: []string{"-b", "bucket", "-H", "http://loki", "--sqs-queue-url", "https://sqs/queue", "--delete-after", "72h"}, wantErr: true},
+		{name: "sqs with idle mode", args: []string{"-b", "bucket", "-H", "http://loki", "--sqs-queue-url", "https://sqs/queue", "--idle-after", "1h"}, wantErr: true},
+		{name: "sqs with tag action", args: []string{"-b", "bucket", "-H", "http://loki", "--sqs-queue-url", "https://sqs/queue", "--processed-action", "tag"}, wantErr: true},
+		{name: "audit unknown target", args: []string{"-b", "bucket", "-H", "http://loki", "--audit", "stdout"}, wantErr: true},
+		{name: "audit prefix of logs", args: []string{"-b", "bucket", "-H", "http://loki", "--audit", "s3:AWS"}, wantErr: true},
+		{name: "audit prefix of --prefix", args: []string{"-b", "bucket", "-H", "http://loki", "--prefix", "alb/AWSLogs/", "--audit", "s3:alb/"}, wantErr: true},
+		{name: "processed move", args: []string{"-b", "bucket", "-H", "http://loki", "--processed-action", "move"}},
+		{name: "processed move without prefix", args: []string{"-b", "bucket", "-H", "http://loki", "--processed-action", "move", "--archive-prefix", ""}, wantErr: true},
+		{name: "processed move to other bucket", args: []string{"-b", "bucket", "-H", "http://loki", "--processed-action", "move", "--archive-bucket", "archive", "--archive-prefix", ""}},
+		{name: "processed tag with delete after", args: []string{"-b", "bucket", "-H", "http://loki", "--processed-action", "tag", "--delete-after", "72h"}, wantErr: true},
+		{name: "processed unknown", args: []string{"-b", "bucket", "-H", "http://loki", "--processed-action", "keep"}, wantErr: true},
+		{name: "mtls fields", args: []string{"-b", "bucket", "-H", "http://loki", "--correlate-connections", "10m", "--mtls-fields", "--metadata", "leaf_client_cert_subject=client_cert"}},
+		{name: "metadata only", args: []string{"-b", "bucket", "-H", "http://loki", "-o", "json", "--metadata", "trace_id=trace_id", "--metadata-only", "--metadata-s3-key", "s3_key"}},
+		{name: "metadata only raw", args: []string{"-b", "bucket", "-H", "http://loki", "--metadata", "trace_id=trace_id", "--metadata-only"}},
+		{name: "otlp", args: []string{"-b", "bucket", "--output", "otlp", "--otlp-endpoint", "http://collector:4318/v1/logs", "-o", "json"}},
+		{name: "otlp without endpoint", args: []string{"-b", "bucket", "--output", "otlp", "-o", "json"}, wantErr: true},
+		{name: "otlp raw", args: []string{"-b", "bucket", "--output", "otlp", "--otlp-endpoint", "http://collector:4318/v1/logs"}},
+		{name: "opensearch", args: []string{"-b", "bucket", "--output", "opensearch", "--opensearch-url", "https://search:9200", "-o", "logfmt"}},
+		{name: "otlp format", args: []string{"-b", "bucket", "--output", "otlp", "--otlp-endpoint", "http://collector:4318/v1/logs", "--otlp-format", "json"}},
+		{name: "otlp invalid format", args: []string{"-b", "bucket", "--output", "otlp", "--otlp-endpoint", "http://collector:4318/v1/logs", "--otlp-format", "yaml"}, wantErr: true},
+		{name: "opensearch raw format", args: []string{"-b", "bucket", "--output", "opensearch", "--opensearch-url", "https://search:9200", "-o", "json", "--opensearch-format", "raw"}},
+		{name: "opensearch invalid index", args: []string{"-b", "bucket", "--output", "opensearch", "--opensearch-url", "https://search:9200", "-o", "json", "--opensearch-index", "alb-%{+yyyy"}, wantErr: true},
+		{name: "output unknown", args: []string{"-b", "bucket", "-H", "http://loki", "--output", "kafka"}, wantErr: true},
+		{name: "mtls fields without connections", args: []string{"-b", "bucket", "-H", "http://loki", "--mtls-fields"}, wantErr: true},
+		{name: "cloudfront", args: []string{"-b", "bucket", "-H", "http://loki", "--cloudfront-prefix", "cloudfront/", "--cloudfront-distribution", "E2QWRUHAPOMQZL=shop/web", "--metadata", "x_edge_request_id=edge_request_id"}},
+		{name: "cloudfront prefix of alb logs", args: []string{"-b", "bucket", "-H", "http://loki", "--cloudfront-prefix", "AWS"}, wantErr: true},
+		{name: "cloudfront distribution without ingress", args: []string{"-b", "bucket", "-H", "http://loki", "--cloudfront-distribution", "E2QWRUHAPOMQZL=shop"}, wantErr: true},
+		{name: "user with bearer token", args: []string{"-b", "bucket", "-H", "http://loki", "-u", "user", "--loki-bearer-token-file", "/token"}, wantErr: true},
+		{name: "user with oauth2", args: []string{"-b", "bucket", "-H", "http://loki", "-u", "user", "--loki-oauth2-token-url", "http://idp/token", "--loki-oauth2-client-id", "shipper", "--loki-oauth2-client-secret-file", "/secret"}, wantErr: true},
+		{name: "shed rule", args: []string{"-b", "bucket", "-H", "http://loki", "--shed-queue", "30", "--shed-rule", "namespace=staging-*:2xx"}},
+		{name: "shed queue over capacity", args: []string{"-b", "bucket", "-H", "http://loki", "--shed-queue", "1000", "--shed-rule", "namespace=staging-*:2xx"}, wantErr: true},
+		{name: "shed queue of workers", args: []string{"-b", "bucket", "-H", "http://loki", "--workers", "200", "--shed-queue", "1000", "--shed-rule", "namespace=staging-*:2xx"}},
+		{name: "shed rule without queue", args: []string{"-b", "bucket", "-H", "http://loki", "--shed-rule", "namespace=staging-*:2xx"}, wantErr: true},
+		{name: "skip tag", args: []string{"-b", "bucket", "-H", "http://loki", "--skip-tag", "do-not-ship=true", "--skip-tag", "legal-hold"}},
+		{name: "skip tag without key", args: []string{"-b", "bucket", "-H", "http://loki", "--skip-tag", "=true"}, wantErr: true},
+		{name: "wait out of bounds", args: []string{"-b", "bucket", "-H", "http://loki", "--wait-min", "2m"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOptions(pflag.NewFlagSet("test", pflag.ContinueOnError), tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseOptions_SchemeLabels(t *testing.T) {
+	args := []string{"-b", "bucket", "-H", "http://loki", "--scheme-labels", "-l", "scheme={{if eq .Scheme \"internal\"}}private{{else}}public{{end}}"}
+	opts, err := parseOptions(pflag.NewFlagSet("test", pflag.ContinueOnError), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Labels["ip_type"] != "{{.IPType}}" || !strings.HasPrefix(opts.Labels["scheme"], "{{if") {
+		t.Errorf("labels = %v, want ip_type added and scheme kept", opts.Labels)
+	}
+}
+
+func TestLineFormat(t *testing.T) {
+	tests := []struct {
+		opts Options
+		want string
+	}{
+		{Options{Output: "loki", Format: "logfmt", OTLPFormat: "json"}, "logfmt"},
+		{Options{Output: "otlp", Format: "logfmt"}, "logfmt"},
+		{Options{Output: "otlp", Format: "logfmt", OTLPFormat: "json", OpenSearchFormat: "raw"}, "json"},
+		{Options{Output: "opensearch", Format: "raw", OTLPFormat: "logfmt", OpenSearchFormat: "json"}, "json"},
+	}
+	for _, tt := range tests {
+		if got := lineFormat(tt.opts); got != tt.want {
+			t.Errorf("lineFormat(%+v) = %s, want %s", tt.opts, got, tt.want)
+		}
+	}
+}
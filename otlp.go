@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+	"github.com/prometheus/common/version"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+)
+
+// marshalOTLP returns the batch as OTLP ExportLogsServiceRequest protobuf, for
+// --output=otlp. Stream labels are resource attributes, and each entry is a log
+// record with the line as body, and its fields and structured metadata as
+// attributes
+func (b *batch) marshalOTLP() ([]byte, error) {
+	logs := plog.NewLogs()
+	if len(b.stream.Entries) > 0 {
+		rl := logs.ResourceLogs().AppendEmpty()
+		for l, v := range b.labels {
+			rl.Resource().Attributes().PutStr(l, v)
+		}
+		sl := rl.ScopeLogs().AppendEmpty()
+		sl.Scope().SetName("alb-logs-shipper")
+		sl.Scope().SetVersion(version.Version)
+		observed := pcommon.NewTimestampFromTime(time.Now())
+		records := sl.LogRecords()
+		records.EnsureCapacity(len(b.stream.Entries))
+		for _, e := range b.stream.Entries {
+			r := records.AppendEmpty()
+			r.SetTimestamp(pcommon.NewTimestampFromTime(e.Timestamp))
+			r.SetObservedTimestamp(observed)
+			r.Body().SetStr(e.Line)
+			otlpAttributes(r.Attributes(), b.client.otlpFormat, e.Line)
+			for _, m := range e.StructuredMetadata {
+				r.Attributes().PutStr(m.Name, m.Value)
+			}
+		}
+	}
+	return plogotlp.NewExportRequestFromLogs(logs).MarshalProto()
+}
+
+// otlpAttributes puts fields of the formatted line to attributes. Numbers of
+// json lines keep their type, and nested objects are maps. Raw lines are
+// formatted as logfmt. Lines which fail to decode are only shipped as body
+func otlpAttributes(attrs pcommon.Map, format, line string) {
+	switch format {
+	case "json":
+		d := json.NewDecoder(strings.NewReader(line))
+		d.UseNumber()
+		var fields map[string]any
+		if d.Decode(&fields) != nil {
+			return
+		}
+		attrs.EnsureCapacity(len(fields))
+		for k, v := range fields {
+			_ = attrs.PutEmpty(k).FromRaw(otlpValue(v))
+		}
+	case "logfmt", "raw":
+		d := logfmt.NewDecoder(strings.NewReader(line))
+		for d.ScanRecord() {
+			for d.ScanKeyval() {
+				attrs.PutStr(string(d.Key()), string(d.Value()))
+			}
+		}
+		if d.Err() != nil {
+			attrs.Clear()
+		}
+	}
+}
+
+// otlpValue converts json.Number of the decoded value to int64 or float64,
+// as pcommon.Value does not support it
+func otlpValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = otlpValue(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = otlpValue(e)
+		}
+	}
+	return v
+}
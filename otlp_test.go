@@ -0,0 +1,85 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/plog/plogotlp"
+)
+
+func TestPushOTLP(t *testing.T) {
+	tests := []struct {
+		format     string
+		otlpFormat string
+		line       string
+		want       map[string]any
+	}{
+		{"json", "", `{"type":"h2","elb_status_code":200,"target_processing_time":0.002,"user_agent":"curl/8.0","httpRequest":{"uri":"/"}}`,
+			map[string]any{"type": "h2", "elb_status_code": int64(200), "target_processing_time": 0.002, "user_agent": "curl/8.0", "httpRequest": map[string]any{"uri": "/"}, "trace": "Root=1"}},
+		{"logfmt", "", `type=h2 elb_status_code=200 user_agent="curl/8.0 (x)"`,
+			map[string]any{"type": "h2", "elb_status_code": "200", "user_agent": "curl/8.0 (x)", "trace": "Root=1"}},
+		{"raw", "", `type=h2 elb_status_code=200`,
+			map[string]any{"type": "h2", "elb_status_code": "200", "trace": "Root=1"}},
+		{"raw", "json", `{"type":"h2","user_agent":"curl/8.0"}`,
+			map[string]any{"type": "h2", "user_agent": "curl/8.0", "trace": "Root=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format+tt.otlpFormat, func(t *testing.T) {
+			var got plogotlp.ExportRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Content-Encoding") != "gzip" {
+					t.Errorf("push headers = %v", r.Header)
+				}
+				gz, err := gzip.NewReader(r.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(gz)
+				got = plogotlp.NewExportRequest()
+				if err = got.UnmarshalProto(body); err != nil {
+					t.Error(err)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			opts := Options{LokiURL: "http://loki", Output: "otlp", OTLPEndpoint: srv.URL, Format: tt.format, OTLPFormat: tt.otlpFormat}
+			client, err := newLokiClient(opts, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := newBatch(map[string]string{"ingress": "web"}, client)
+			ts := time.Date(2024, 1, 1, 0, 0, 0, 186641000, time.UTC)
+			b.add(logproto.Entry{Timestamp: ts, Line: tt.line, StructuredMetadata: []logproto.LabelAdapter{{Name: "trace", Value: "Root=1"}}})
+			if err = b.flush(); err != nil {
+				t.Fatalf("flush() error = %v", err)
+			}
+
+			rl := got.Logs().ResourceLogs()
+			if rl.Len() != 1 {
+				t.Fatalf("pushed %d resource logs, want 1", rl.Len())
+			}
+			if v, _ := rl.At(0).Resource().Attributes().Get("ingress"); v.Str() != "web" {
+				t.Errorf("resource attribute ingress = %q, want web", v.Str())
+			}
+			r := rl.At(0).ScopeLogs().At(0).LogRecords().At(0)
+			if !r.Timestamp().AsTime().Equal(ts) || r.Body().Str() != tt.line {
+				t.Errorf("pushed record %s %q", r.Timestamp(), r.Body().Str())
+			}
+			want := pcommon.NewMap()
+			if err = want.FromRaw(tt.want); err != nil {
+				t.Fatal(err)
+			}
+			if !r.Attributes().Equal(want) {
+				t.Errorf("attributes = %v, want %v", r.Attributes().AsRaw(), tt.want)
+			}
+		})
+	}
+}
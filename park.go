@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// parkedLB is a load balancer with consecutive failures
+type parkedLB struct {
+	failures int
+	until    time.Time
+}
+
+// parking isolates load balancers which keep failing (metadata lookup, push
+// to Loki), so their files are skipped without spending retry attempts, while
+// files of other load balancers are shipped
+type parking struct {
+	after    int
+	duration time.Duration
+	mu       sync.Mutex
+	lbs      map[string]*parkedLB
+}
+
+func newParking(after int, duration time.Duration) *parking {
+	p := &parking{
+		after:    after,
+		duration: duration,
+		lbs:      make(map[string]*parkedLB),
+	}
+	newGaugeFunc("alb_logs_shipper_parked_load_balancers", "Load balancers which files are skipped after --park-after consecutive failures", func() float64 {
+		return float64(p.parked())
+	})
+	return p
+}
+
+// isParked returns true while files of the load balancer should be skipped
+func (p *parking) isParked(lb string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.lbs[lb]
+	return ok && time.Now().Before(st.until)
+}
+
+// fail records failure of the load balancer, returns true when it gets parked.
+// After parking period the next file is a probe, and its failure parks again
+func (p *parking) fail(lb string) bool {
+	if p.after == 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.lbs[lb]
+	if !ok {
+		st = &parkedLB{}
+		p.lbs[lb] = st
+	}
+	st.failures++
+	if st.failures < p.after {
+		return false
+	}
+	st.until = time.Now().Add(p.duration)
+	return true
+}
+
+// ok resets failures of the load balancer
+func (p *parking) ok(lb string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.lbs, lb)
+}
+
+func (p *parking) parked() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	now := time.Now()
+	for _, st := range p.lbs {
+		if now.Before(st.until) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParking(t *testing.T) {
+	p := newParking(2, time.Minute)
+	if p.fail("123/lb1") || p.isParked("123/lb1") {
+		t.Fatal("load balancer should not be parked after first failure")
+	}
+	if !p.fail("123/lb1") || !p.isParked("123/lb1") {
+		t.Fatal("load balancer should be parked after second failure")
+	}
+	if p.isParked("123/lb2") || p.parked() != 1 {
+		t.Fatal("only failing load balancer should be parked")
+	}
+
+	p.lbs["123/lb1"].until = time.Now().Add(-time.Second)
+	if p.isParked("123/lb1") {
+		t.Fatal("load balancer should be probed after parking period")
+	}
+	if !p.fail("123/lb1") {
+		t.Fatal("failed probe should park again")
+	}
+	p.ok("123/lb1")
+	if p.isParked("123/lb1") || p.parked() != 0 {
+		t.Fatal("load balancer should be unparked after success")
+	}
+
+	if newParking(0, time.Minute).fail("123/lb1") {
+		t.Fatal("parking should be disabled with after=0")
+	}
+}
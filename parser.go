@@ -4,21 +4,32 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/sepich/alb-logs-shipper/albparse"
+	"golang.org/x/sync/errgroup"
 )
 
 var (
 	// source:  https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html#access-log-file-format
 	// format:  bucket[/prefix]/AWSLogs/aws-account-id/elasticloadbalancing/region/yyyy/mm/dd/aws-account-id_elasticloadbalancing_region_app.load-balancer-id_end-time_ip-address_random-string.log.gz
 	// example: my-bucket/AWSLogs/123456789012/elasticloadbalancing/us-east-1/2022/01/24/123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz
-	fnRegex    = regexp.MustCompile(`AWSLogs\/(?P<account_id>\d+)\/elasticloadbalancing\/(?P<region>[\w-]+)\/(?P<year>\d+)\/(?P<month>\d+)\/(?P<day>\d+)\/\d+\_elasticloadbalancing_(?:\w+-\w+-(?:\w+-)?\d)_app\.(?P<id>[a-zA-Z0-9\-]+)\..+\.log\.gz`)
+	// NLB:     my-bucket/AWSLogs/123456789012/elasticloadbalancing/us-east-2/2016/05/01/123456789012_elasticloadbalancing_us-east-2_net.my-loadbalancer.1234567890abcdef_201605010000Z_2soosksgsasd.log.gz
+	// AWS Organizations centralized logging adds org-id segment before or after AWSLogs/
+	fnRegex    = regexp.MustCompile(`(?:(?P<org>o-[a-z0-9]{10,32})\/)?AWSLogs\/(?:(?P<org_id>o-[a-z0-9]{10,32})\/)?(?P<account_id>\d+)\/elasticloadbalancing\/(?P<region>[\w-]+)\/(?P<year>\d+)\/(?P<month>\d+)\/(?P<day>\d+)\/\d+\_elasticloadbalancing_(?:\w+-\w+-(?:\w+-)?\d)_(?P<type>app|net)\.(?P<id>[a-zA-Z0-9\-]+)\..+\.log\.gz`)
 	tsRegex    = regexp.MustCompile(`(?P<timestamp>\d+-\d+-\d+T\d+:\d+:\d+(?:\.\d+Z)?)`)
 	evRegex    = regexp.MustCompile(`(?P<type>\S+) (?P<time>\S+) (?P<elb>\S+) (?P<client>\S+) (?P<target>\S+) (?P<request_processing_time>\S+) (?P<target_processing_time>\S+) (?P<response_processing_time>\S+) (?P<elb_status_code>\S+) (?P<target_status_code>\S+) (?P<received_bytes>\S+) (?P<sent_bytes>\S+) (?P<request>".+") (?P<user_agent>".*") (?P<ssl_cipher>\S+) (?P<ssl_protocol>\S+) (?P<target_group_arn>\S+) (?P<trace_id>".+") (?P<domain_name>".+") (?P<chosen_cert_arn>".+") (?P<matched_rule_priority>\S+) (?P<request_creation_time>\S+) (?P<actions_executed>".+") (?P<redirect_url>".+") (?P<error_reason>".+") (?P<targets>".+") (?P<target_status_code_list>".+") (?P<classification>".+") (?P<classification_reason>".+") (?P<conn_trace_id>\S+)`)
 	skipFields = map[string]bool{
@@ -32,21 +43,8 @@ var (
 		"classification_reason":   true, // not used
 		"conn_trace_id":           true, // only for connection logs
 	}
-	quoteFields = map[string]bool{
-		"request":                 true,
-		"user_agent":              true,
-		"trace_id":                true,
-		"domain_name":             true,
-		"chosen_cert_arn":         true,
-		"actions_executed":        true,
-		"redirect_url":            true,
-		"error_reason":            true,
-		"targets":                 true,
-		"target_status_code_list": true,
-		"classification":          true,
-		"classification_reason":   true,
-	}
-	numFields = map[string]bool{
+	quoteFields = albparse.Quoted
+	numFields   = map[string]bool{
 		"elb_status_code":          true,
 		"received_bytes":           true,
 		"request_processing_time":  true,
@@ -57,150 +55,1199 @@ var (
 	}
 )
 
+var truncatedListings = newCounter("alb_logs_shipper_truncated_listings_total", "Listings stopped at --scan-max-keys with more keys left for the next scan")
+
+var skippedScans = newCounter("alb_logs_shipper_skipped_scans_total", "Scans skipped because the previous one is still enqueueing, or queue is longer than --scan-max-queue", "reason")
+
+// errScanSkipped is returned when scan is not started, to be retried after the wait interval
+var errScanSkipped = errors.New("scan skipped")
+
+var skippedObjects = newCounter("alb_logs_shipper_skipped_objects_total", "Listed objects not enqueued by scans, by reason (empty, recent, retained, retry, spooled)", "reason")
+
+var skippedFiles = newCounter("alb_logs_shipper_skipped_files_total", "Keys not matching ALB access log filename format, by top-level prefix", "prefix")
+
+var otherLines = newCounter("alb_logs_shipper_other_lines_total", "Lines of access log files detected as other log format, which are not shipped", "kind")
+
+var queueWait = newHistogram("alb_logs_shipper_queue_wait_seconds", "Time S3 keys spent in queue before a worker picked them up", exponentialBuckets(0.1, 2, 16))
+
+// queueItem is an S3 key waiting to be processed by a worker
+type queueItem struct {
+	key      string
+	enqueued time.Time
+	ack      func(done bool) // called after processing, for keys from --sqs-queue-url
+	modified time.Time       // LastModified of listed keys
+}
+
 type Parser struct {
 	opts     Options
 	elbMeta  *ELBMeta
 	s3Client *s3.Client
 	logger   *slog.Logger
-	queue    chan *string
-	stop     bool
+	queue    chan queueItem
+	cpu      chan struct{}
+	conns    *connCache
+	retries  *retryQueue
+	parking  *parking
+	mu       sync.RWMutex // of labels, replaced on reload
+	labels   labelTemplates
+	chain    *transformChain // with --config, to replace transformers on reload
+	loki     *lokiClient
+	anomaly  *anomalies
+	audit    *auditLog
+	journal  *journal
+	spool    *spool
+	recent   *recentKeys
+	retained *retainedKeys // with --delete-after
+	dedup    *bucketDedup
+	shed     *shedder
+	claims   *tableClaims // with --claim-table, set by main
+	ssec     *sseCustomerKey
+	runs     *runs
+	status   *status
+	idle     *idleMode     // with --idle-after
+	stop     chan struct{} // closed by Stop, to unblock enqueue
+	stopped  atomic.Bool
+	qmu      sync.RWMutex // enqueue holds read lock, so queue is closed after sends
+	scanning atomic.Bool
+	cursors  sync.Map      // last listed key by prefix, for the next scan after --scan-max-keys
+	trigger  chan struct{} // to scan without waiting, by /debug/scan
+	slow     *slowFiles    // traces of the slowest files, for /debug/status
+	threads  chan *threadJob
 	line     LineParser
+	nlb      LineParser // for files of network load balancers
+	conn     LineParser // for connection log files, with --ship-connections
+	cf       LineParser // for CloudFront log files, with --cloudfront-prefix
+	flow     LineParser // for VPC flow log files without header, with --vpc-flow-logs
+	waf      LineParser // for WAF log files, with --waf-logs
+	fo       FieldOptions
 }
 
-func NewParser(opts Options, elbMeta *ELBMeta, s3Client *s3.Client, logger *slog.Logger) *Parser {
+func NewParser(opts Options, elbMeta *ELBMeta, s3Client *s3.Client, logger *slog.Logger) (*Parser, error) {
+	labels, err := newLabelTemplates(opts.TagLabels, opts.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FormatLabel != "" {
+		labels.set(opts.FormatLabel, opts.Format)
+	}
+	loki, err := newLokiClient(opts, logger)
+	if err != nil {
+		return nil, err
+	}
+	transformers, err := newTransformers(opts.Transforms)
+	if err != nil {
+		return nil, err
+	}
+	var chain *transformChain
+	if opts.ConfigFile != "" {
+		chain = newTransformChain(transformers)
+		transformers = []Transformer{chain}
+	}
+	fo := fieldOptions(opts, transformers)
+	if opts.CorrelateWindow > 0 {
+		fo.Connections = newConnCache(opts.CorrelateWindow, opts.CorrelateMax, opts.MTLSFields)
+	}
+	fo = fo.Compile()
+	var line LineParser = &LineSlice{fo}
+	if opts.Parser == "strict" {
+		line = &LineStrict{fo}
+	}
 	parser := &Parser{
 		opts:     opts,
 		elbMeta:  elbMeta,
 		s3Client: s3Client,
 		logger:   logger,
-		queue:    make(chan *string, 10*opts.Workers),
-		line:     &LineSlice{},
+		queue:    make(chan queueItem, 10*opts.Workers),
+		stop:     make(chan struct{}),
+		cpu:      make(chan struct{}, opts.ParseWorkers),
+		line:     line,
+		nlb:      &LineNLB{fo},
+		conn:     &LineConn{fo},
+		cf:       &LineCloudFront{fo},
+		waf:      &LineWAF{fo},
+		fo:       fo,
+		conns:    fo.Connections,
+		retries:  newRetryQueue(opts.RetryDelay, opts.MaxAttempts),
+		parking:  newParking(opts.ParkAfter, opts.ParkDuration),
+		labels:   labels,
+		chain:    chain,
+		loki:     loki,
+		runs:     newRuns(logger),
+		status:   newStatus(opts.Workers, opts.StuckAfter),
+		trigger:  make(chan struct{}, 1),
+	}
+	if opts.ParseThreads > 0 {
+		parser.startThreads(opts.ParseThreads)
+	}
+	if opts.IdleAfter > 0 {
+		parser.idle = newIdleMode(opts.IdleAfter, opts.IdleWait, logger, func() {
+			if loki != nil {
+				loki.transport.CloseIdleConnections()
+			}
+			freeMemory()
+		})
+	}
+	if opts.SlowFiles > 0 {
+		parser.slow = newSlowFiles(opts.SlowFiles)
+	}
+	if opts.AnomalyWebhook != "" || opts.AnomalyExec != "" {
+		parser.anomaly = newAnomalies(opts, logger)
+	}
+	if opts.Audit != "" {
+		if parser.audit, err = newAuditLog(opts, s3Client, loki, logger); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Journal != "" {
+		if parser.journal, err = openJournal(opts.Journal); err != nil {
+			return nil, fmt.Errorf("failed to open journal: %w", err)
+		}
+	}
+	if opts.DedupBucket != "" {
+		parser.dedup = &bucketDedup{client: s3Client, bucket: opts.DedupBucket, prefix: opts.DedupPrefix, own: opts.BucketName}
+	}
+	if opts.VPCFlowLogs {
+		if parser.flow, err = newLineFlow(fo, flowDefaultHeader); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ShedQueue > 0 {
+		if parser.shed, err = newShedder(opts.ShedQueue, opts.ShedAfter, opts.ShedRules); err != nil {
+			return nil, err
+		}
+	}
+	if opts.SSECKeyFile != "" {
+		if parser.ssec, err = newSSECustomerKey(opts.SSECKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if opts.DedupWindow > 0 {
+		parser.recent = newRecentKeys(opts.DedupWindow)
 	}
-	return parser
+	if opts.DeleteAfter > 0 {
+		parser.retained = newRetainedKeys(opts.DeleteAfter)
+	}
+	if opts.SpoolDir != "" {
+		if parser.spool, err = newSpool(opts.SpoolDir, opts.SpoolMaxSize, loki, logger); err != nil {
+			return nil, fmt.Errorf("failed to open spool: %w", err)
+		}
+	}
+	return parser, nil
+}
+
+// fieldOptions returns options of formatting fields of lines by the options
+func fieldOptions(opts Options, transformers []Transformer) FieldOptions {
+	return FieldOptions{MaxLength: opts.FieldMaxLength, Metadata: opts.Metadata, MetadataOnly: opts.MetadataOnly, Transformers: transformers, SanitizeUTF8: opts.SanitizeUTF8, Extra: opts.ExtraField, Protocol: opts.ProtocolField}
 }
 
-// Stop gracefully all workers
+// lineParser returns parser of lines of the log kind
+func (s *Parser) lineParser(kind string) LineParser {
+	switch kind {
+	case kindNLB:
+		return s.nlb
+	case kindConnection:
+		return s.conn
+	case kindCloudFront:
+		return s.cf
+	case kindFlow:
+		return s.flow
+	case kindWAF:
+		return s.waf
+	}
+	return s.line
+}
+
+// Stop gracefully all workers. Could be called concurrently with scans and
+// the SQS consumer, keys which they have not enqueued yet are dropped
 func (s *Parser) Stop() {
-	if s.stop {
+	if !s.stopped.CompareAndSwap(false, true) {
 		return
 	}
-	s.stop = true
+	close(s.stop)
+	s.idle.stop()
+	s.qmu.Lock()
+	defer s.qmu.Unlock()
 	close(s.queue)
 }
 
-func (s *Parser) scan() error {
-	num := 0
-	ctx := context.Background()
-	maxKeys := int32(1000) //no pager, tune interval to have less files per run
-	output, err := s.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket:  &s.opts.BucketName,
-		MaxKeys: &maxKeys,
-	})
-	if err != nil {
-		return err
+// enqueue adds item to the queue, returns false when the parser is stopped or
+// ctx is done before there is room in the queue
+func (s *Parser) enqueue(ctx context.Context, item queueItem) bool {
+	s.qmu.RLock()
+	defer s.qmu.RUnlock()
+	if s.stopped.Load() {
+		return false
+	}
+	select {
+	case s.queue <- item:
+		// a worker could be done with it already, but the run is kept open
+		// by runs.begin() of the scan until runs.end()
+		s.runs.enqueued()
+		return true
+	case <-s.stop:
+	case <-ctx.Done():
 	}
+	return false
+}
 
+// scan enqueues new keys from the bucket. Returns number of keys found and
+// whether listing was stopped at --scan-max-keys (more keys are waiting)
+func (s *Parser) scan() (int, bool, error) {
+	if !s.scanning.CompareAndSwap(false, true) {
+		skippedScans.Inc("running")
+		return 0, false, errScanSkipped
+	}
+	defer s.scanning.Store(false)
+	if s.opts.ScanMaxQueue > 0 && len(s.queue) > s.opts.ScanMaxQueue {
+		skippedScans.Inc("queue")
+		return 0, false, errScanSkipped
+	}
+	s.runs.begin()
+	defer s.runs.end()
+	ctx := context.Background()
 	start := time.Now()
-	for _, obj := range output.Contents {
-		if obj.Key == nil || s.stop {
-			continue
+	prefixes := []string{s.opts.Prefix}
+	partitioned := s.opts.ScanConcurrency > 1 && !strings.Contains(s.opts.Prefix, "AWSLogs/")
+	if partitioned {
+		var err error
+		if prefixes, err = s.partitions(ctx, s.opts.Prefix); err != nil {
+			return 0, false, fmt.Errorf("failed to list bucket partitions: %w", err)
 		}
-		s.queue <- obj.Key
-		num++
 	}
-	if num > 0 {
-		s.logger.Info("new files", "found", num, "duration", time.Since(start), "queue", len(s.queue))
+	// CloudFront logs are not under AWSLogs/ partitions
+	if cf := s.opts.CloudFrontPrefix; cf != "" && (partitioned || !strings.HasPrefix(cf, s.opts.Prefix)) {
+		prefixes = append(prefixes, cf)
+	}
+
+	var num atomic.Int64
+	var full atomic.Bool
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(s.opts.ScanConcurrency, 1))
+	for _, prefix := range prefixes {
+		g.Go(func() error {
+			_, truncated, err := s.list(ctx, prefix, &num)
+			if truncated {
+				full.Store(true)
+			}
+			return err
+		})
+	}
+	err := g.Wait()
+	if num.Load() > 0 {
+		s.logger.Info("new files", "found", num.Load(), "prefixes", len(prefixes), "duration", time.Since(start), "queue", len(s.queue))
 	}
-	return nil
+	return int(num.Load()), full.Load(), err
 }
 
-func (s *Parser) worker() error {
+// list enqueues keys under the prefix, returns number of keys found and if the
+// listing was stopped at --scan-max-keys, shared by all prefixes of the scan.
+// Stopped listing is continued by the next scan after the last listed key, so
+// keys which are listed again without being processed don't starve the rest
+func (s *Parser) list(ctx context.Context, prefix string, total *atomic.Int64) (int, bool, error) {
+	num := 0
+	input := &s3.ListObjectsV2Input{
+		Bucket:              &s.opts.BucketName,
+		ExpectedBucketOwner: &s.opts.BucketOwner,
+	}
+	if prefix != "" {
+		input.Prefix = &prefix
+	}
+	if after, ok := s.cursors.Load(prefix); ok {
+		input.StartAfter = after.(*string)
+	}
+	paginator := s3.NewListObjectsV2Paginator(s.s3Client, input)
+	now := time.Now()
+	var last *string
+	for paginator.HasMorePages() && !s.stopped.Load() {
+		if s.opts.ScanMaxKeys > 0 && total.Load() >= int64(s.opts.ScanMaxKeys) {
+			if last != nil {
+				s.cursors.Store(prefix, last)
+			}
+			truncatedListings.Inc()
+			return num, true, nil
+		}
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return num, false, err
+		}
+		if n := len(page.Contents); n > 0 {
+			last = page.Contents[n-1].Key
+		}
+		// connection logs go first, to be read before access logs they enrich
+		for _, conns := range []bool{true, false} {
+			if conns && s.conns == nil {
+				continue
+			}
+			for _, obj := range page.Contents {
+				if obj.Key == nil || s.stopped.Load() || s.ownKey(*obj.Key) || (s.conns != nil && connFnRegex.MatchString(*obj.Key) != conns) {
+					continue
+				}
+				if reason := s.skipObject(obj, now); reason != "" {
+					skippedObjects.Inc(reason)
+					continue
+				}
+				item := queueItem{key: *obj.Key, enqueued: time.Now()}
+				if obj.LastModified != nil {
+					item.modified = *obj.LastModified
+				}
+				if !s.enqueue(ctx, item) {
+					return num, false, nil
+				}
+				num++
+				total.Add(1)
+			}
+		}
+	}
+	if !s.stopped.Load() {
+		s.cursors.Delete(prefix)
+	}
+	return num, false, nil
+}
+
+// skipObject returns reason to not enqueue the listed object in this scan:
+// empty objects with --skip-empty, objects modified less than --min-age ago,
+// which could still be written by replication, shipped files retained for
+// --delete-after, which are not due for deletion yet, and files which would be
+// skipped by workers while waiting for retry or replay of spooled batches. So
+// they don't count to --scan-max-keys
+func (s *Parser) skipObject(obj types.Object, now time.Time) string {
+	if s.opts.SkipEmpty && obj.Size != nil && *obj.Size == 0 {
+		return "empty"
+	}
+	if s.opts.MinAge > 0 && obj.LastModified != nil && now.Sub(*obj.LastModified) < s.opts.MinAge {
+		return "recent"
+	}
+	if s.retained != nil && s.retained.retained(*obj.Key, now) {
+		return "retained"
+	}
+	if s.retries != nil && !s.retries.ready(*obj.Key) {
+		return "retry"
+	}
+	if s.spool != nil && s.spool.isHeld(*obj.Key) {
+		return "spooled"
+	}
+	return ""
+}
+
+// keyOrg returns AWS Organizations ID from matches of fnRegex or connFnRegex, if any
+func keyOrg(re *regexp.Regexp, matches []string) string {
+	if org := matches[re.SubexpIndex("org")]; org != "" {
+		return org
+	}
+	return matches[re.SubexpIndex("org_id")]
+}
+
+// orgPrefixRegex matches org-id "subdirectory" of centralized logging bucket
+var orgPrefixRegex = regexp.MustCompile(`(?:^|/)o-[a-z0-9]{10,32}/$`)
+
+// partitions returns AWSLogs/<account>/elasticloadbalancing/<region>/ prefixes existing under the prefix
+// of ALB logs, including ones under <org-id>/AWSLogs/ and AWSLogs/<org-id>/ of centralized logging
+func (s *Parser) partitions(ctx context.Context, prefix string) ([]string, error) {
+	roots := []string{prefix + "AWSLogs/"}
+	top, err := s.commonPrefixes(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range top {
+		if orgPrefixRegex.MatchString(p) {
+			roots = append(roots, p+"AWSLogs/")
+		}
+	}
+	var accounts []string
+	for _, root := range roots {
+		children, err := s.commonPrefixes(ctx, root)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range children {
+			if !orgPrefixRegex.MatchString(c) {
+				accounts = append(accounts, c)
+				continue
+			}
+			orgAccounts, err := s.commonPrefixes(ctx, c)
+			if err != nil {
+				return nil, err
+			}
+			accounts = append(accounts, orgAccounts...)
+		}
+	}
+	services := []string{"elasticloadbalancing/"}
+	if s.opts.VPCFlowLogs {
+		services = append(services, "vpcflowlogs/")
+	}
+	if s.opts.WAFLogs {
+		services = append(services, "WAFLogs/")
+	}
+	var res []string
+	for _, account := range accounts {
+		for _, service := range services {
+			regions, err := s.commonPrefixes(ctx, account+service)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, regions...)
+		}
+	}
+	return res, nil
+}
+
+// commonPrefixes returns "subdirectories" of the prefix
+func (s *Parser) commonPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	var res []string
+	delimiter := "/"
+	paginator := s3.NewListObjectsV2Paginator(s.s3Client, &s3.ListObjectsV2Input{
+		Bucket:              &s.opts.BucketName,
+		Prefix:              &prefix,
+		Delimiter:           &delimiter,
+		ExpectedBucketOwner: &s.opts.BucketOwner,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range page.CommonPrefixes {
+			if p.Prefix != nil {
+				res = append(res, *p.Prefix)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (s *Parser) worker(id int) {
 	ctx := context.Background() // limit time to process file? will restart of processing help?
 
-	for fn := range s.queue {
-		matches := fnRegex.FindStringSubmatch(*fn)
-		if len(matches) == 0 {
-			s.logger.Debug("skipping non-alb log file", "key", *fn)
+	for {
+		// all but the first worker stop waiting for files in idle mode
+		var idle <-chan struct{}
+		if id > 0 {
+			idle = s.idle.waitActive()
+		}
+		var item queueItem
+		var ok bool
+		select {
+		case item, ok = <-s.queue:
+		case <-idle:
 			continue
 		}
-		if err := s.parseFile(ctx, *fn, matches[fnRegex.SubexpIndex("account_id")], matches[fnRegex.SubexpIndex("id")]); err != nil {
-			s.logger.Error("failed to ship file", "key", *fn, "err", err)
-			return err // pod restart instead of deletion of not-shipped file
+		if !ok {
+			return
+		}
+		s.status.start(id, item.key)
+		done := s.process(ctx, item)
+		if item.ack != nil {
+			item.ack(done)
+		}
+		s.status.idle(id)
+		s.runs.done()
+	}
+}
+
+// process ships the queued file. Returns true when the file is completed, or
+// needs no processing (not a log file, or deleted meanwhile). Returns false
+// when it is skipped or failed, so its --sqs-queue-url message is received
+// again after the visibility timeout
+func (s *Parser) process(ctx context.Context, item queueItem) (completed bool) {
+	queueWait.Observe(time.Since(item.enqueued).Seconds())
+	fn := item.key
+	if s.shed != nil {
+		s.shed.update(len(s.queue), time.Now())
+	}
+	re, kind := fnRegex, kindAccess
+	if connFnRegex.MatchString(fn) {
+		if s.conns != nil {
+			if err := s.readConnections(ctx, fn); err != nil {
+				s.logger.Error("failed to read connection log", "key", fn, "err", err)
+				return false
+			}
+		}
+		if s.opts.ShipConnections {
+			re, kind = connFnRegex, kindConnection
+		} else if s.conns != nil {
+			// read to the cache only, and then deleted, moved or tagged
+			return s.complete(ctx, &shipment{key: fn})
+		}
+	}
+	if s.opts.CloudFrontPrefix != "" && strings.HasPrefix(fn, s.opts.CloudFrontPrefix) && cfFnRegex.MatchString(fn) {
+		re, kind = cfFnRegex, kindCloudFront
+	}
+	if s.opts.VPCFlowLogs && flowFnRegex.MatchString(fn) {
+		re, kind = flowFnRegex, kindFlow
+	}
+	if s.opts.WAFLogs && wafFnRegex.MatchString(fn) {
+		re, kind = wafFnRegex, kindWAF
+	}
+	matches := re.FindStringSubmatch(fn)
+	if len(matches) == 0 {
+		skippedFiles.Inc(topPrefix(fn))
+		s.logger.Debug("skipping non-alb log file", "key", fn)
+		return true
+	}
+	var accountID, org string
+	lbID := matches[re.SubexpIndex("id")]
+	lb := "cloudfront/" + lbID
+	if kind != kindCloudFront {
+		accountID, org = matches[re.SubexpIndex("account_id")], keyOrg(re, matches)
+		lb = accountID + "/" + lbID
+	}
+	if kind == kindAccess && matches[re.SubexpIndex("type")] == "net" {
+		kind = kindNLB
+	}
+	if s.parking.isParked(lb) {
+		s.logger.Debug("skipping file of parked load balancer", "key", fn, "lb", lb)
+		return false
+	}
+	if !s.retries.ready(fn) {
+		s.logger.Debug("skipping file waiting for retry", "key", fn)
+		return false
+	}
+	if s.spool != nil && s.spool.isHeld(fn) {
+		s.logger.Debug("skipping file waiting for replay of spooled batches", "key", fn)
+		return false
+	}
+	if s.journal != nil && s.journal.isShipped(fn) {
+		// shipped before, but delete failed
+		s.logger.Debug("completing shipped file", "key", fn)
+		return s.markShipped(ctx, fn) && s.complete(ctx, &shipment{key: fn})
+	}
+	tagClaims := s.opts.ClaimTTL > 0 && s.claims == nil
+	if s.opts.DeleteAfter > 0 || s.opts.ProcessedAction == "tag" || tagClaims || len(s.opts.SkipTags) > 0 {
+		s.status.stage(fn, "tags")
+		tags, err := s.getTags(ctx, fn)
+		if err != nil {
+			if strings.Contains(err.Error(), "NoSuchKey") {
+				s.logger.Debug("skipping non-existent file", "key", fn)
+				return true
+			}
+			s.logger.Error("failed to get tags", "key", fn, "err", err)
+			return false
+		}
+		if tag, ok := skipTag(tags, s.opts.SkipTags); ok {
+			skippedTagged.Inc(tag)
+			s.logger.Debug("skipping file with skip tag", "key", fn, "tag", tag)
+			return false
+		}
+		if ts, ok := shippedAt(tags); ok {
+			// kept for good with --processed-action=tag
+			if s.opts.ProcessedAction == "delete" && time.Since(ts) < s.opts.DeleteAfter {
+				s.retained.add(fn, item.modified)
+			} else if s.opts.ProcessedAction == "delete" {
+				if s.audit != nil {
+					s.audit.deleted(fn, nil, ts)
+				}
+				if !s.delete(ctx, fn) && s.audit != nil {
+					s.audit.failed("delete", fn)
+				}
+			}
+			return true
+		}
+		if tagClaims {
+			ok, err := s.claim(ctx, fn, tags)
+			if err != nil {
+				s.logger.Error("failed to claim file", "key", fn, "err", err)
+				return false
+			}
+			if !ok {
+				s.logger.Debug("skipping file claimed by another replica", "key", fn)
+				return false
+			}
+		}
+	}
+
+	var shipped bool
+	if s.claims != nil {
+		ok, err := s.claims.claim(ctx, fn)
+		if err != nil {
+			s.logger.Error("failed to claim file in table", "key", fn, "err", err)
+			return false
+		}
+		if !ok {
+			claimConflicts.Inc()
+			s.logger.Debug("skipping file claimed by another replica", "key", fn)
+			return false
+		}
+		defer func() {
+			// files which are not shipped are left to other replicas, shipped
+			// ones stay claimed until completed
+			if !completed && !shipped {
+				if err := s.claims.release(ctx, fn); err != nil {
+					s.logger.Warn("failed to release claim of file", "key", fn, "err", err)
+				}
+			}
+		}()
+	}
+
+	if s.dedup != nil {
+		owner, done, err := s.dedup.shippedBy(ctx, fn)
+		if err != nil {
+			s.logger.Error("failed to read dedup marker", "key", fn, "err", err)
+			return false
+		}
+		switch {
+		case done && owner == s.dedup.own:
+			s.logger.Debug("completing shipped file", "key", fn)
+			return s.complete(ctx, &shipment{key: fn})
+		case done:
+			duplicateFiles.Inc()
+			s.logger.Debug("completing file shipped from another bucket", "key", fn, "bucket", owner)
+			s.status.stage(fn, "complete")
+			return s.complete(ctx, &shipment{key: fn})
+		case owner != "" && owner != s.dedup.own:
+			// written before shipping by older version, which could fail
+			s.logger.Debug("skipping file marked by another bucket", "key", fn, "bucket", owner)
+			return false
+		}
+	}
+
+	if s.journal != nil {
+		if err := s.journal.intent(fn); err != nil {
+			s.logger.Error("failed to write journal", "key", fn, "err", err)
+			return false
+		}
+	}
+	sh, err := s.parseFile(ctx, fn, accountID, lbID, org, kind)
+	if err != nil {
+		// not-shipped file is kept in the bucket, and retried by the next scans
+		attempts, quarantined := s.retries.fail(fn)
+		if quarantined {
+			s.logger.Error("failed to ship file, quarantined until restart", "key", fn, "attempts", attempts, "err", err)
+		} else {
+			s.logger.Error("failed to ship file, will retry", "key", fn, "attempts", attempts, "err", err)
+		}
+		s.runs.failed(lb, fn, err)
+		s.status.failed(fn, err)
+		if s.spool != nil {
+			if n := s.spool.drop(fn); n > 0 {
+				s.logger.Debug("dropped spooled batches of failed file", "key", fn, "spooled", n)
+			}
+		}
+		if s.parking.fail(lb) {
+			s.logger.Warn("parking load balancer after consecutive failures", "lb", lb, "until", time.Now().Add(s.opts.ParkDuration).Format(time.RFC3339))
+		}
+		return false
+	}
+	shipped = true
+	s.retries.done(fn)
+	s.parking.ok(lb)
+	if sh != nil {
+		s.runs.shipped(lb, sh)
+		s.status.shipped(sh)
+	}
+	if sh != nil && s.recent != nil && s.recent.seen(fn) {
+		reappearedFiles.Inc()
+		s.logger.Warn("shipped again file which was deleted recently, check bucket replication and versioning", "key", fn)
+	}
+	if sh == nil {
+		// deleted by someone else meanwhile, nothing to complete or audit
+		s.logger.Debug("skipping non-existent file", "key", fn)
+		if s.journal != nil {
+			if err := s.journal.done(fn); err != nil {
+				s.logger.Error("failed to write journal", "key", fn, "err", err)
+			}
+		}
+		return true
+	} else if sh.spooled > 0 && s.spool.hold(sh) {
+		// kept in the bucket until Loki is back
+		s.logger.Debug("holding file with spooled batches", "key", fn, "spooled", sh.spooled)
+		return false
+	} else if s.journal != nil {
+		if err := s.journal.shipped(fn, sh.batches); err != nil {
+			s.logger.Error("failed to write journal", "key", fn, "err", err)
+			return false
 		}
+	}
+	if !s.markShipped(ctx, fn) {
+		return false
+	}
+	s.status.stage(fn, "complete")
+	return s.complete(ctx, sh)
+}
 
-		if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
-			Bucket: &s.opts.BucketName,
-			Key:    fn,
-		}); err != nil {
-			s.logger.Error("failed to delete file", "key", *fn, "err", err)
+// markShipped writes --dedup-bucket marker of the shipped file, so its copies
+// in other buckets are completed without shipping. Returns false on failure
+func (s *Parser) markShipped(ctx context.Context, fn string) bool {
+	if s.dedup == nil {
+		return true
+	}
+	owner, err := s.dedup.mark(ctx, fn)
+	if err != nil {
+		s.logger.Error("failed to write dedup marker", "key", fn, "err", err)
+		return false
+	}
+	if owner != "" {
+		s.logger.Warn("file is shipped from another bucket too", "key", fn, "bucket", owner)
+	}
+	return true
+}
+
+// replayed completes file held until its spooled batches are pushed
+func (s *Parser) replayed(sh *shipment) {
+	ctx := context.Background()
+	if s.journal != nil {
+		if err := s.journal.shipped(sh.key, sh.batches); err != nil {
+			s.logger.Error("failed to write journal", "key", sh.key, "err", err)
+			return
 		}
 	}
-	return nil
+	if s.markShipped(ctx, sh.key) {
+		s.complete(ctx, sh)
+	}
 }
 
-func (s *Parser) parseFile(ctx context.Context, fn string, accountID, lb string) error {
+// complete marks shipped file as processed, and records it in the journal.
+// Returns false when the file is not marked processed
+func (s *Parser) complete(ctx context.Context, sh *shipment) bool {
+	if !s.processed(ctx, sh) {
+		return false
+	}
+	if s.journal == nil {
+		return true
+	}
+	if err := s.journal.done(sh.key); err != nil {
+		s.logger.Error("failed to write journal", "key", sh.key, "err", err)
+	}
+	return true
+}
+
+// topPrefix returns first "directory" of the key, like "AWSLogs/", or "/" for keys in the root
+func topPrefix(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i+1]
+	}
+	return "/"
+}
+
+// processed deletes shipped file, or tags it to be deleted after retention,
+// moves it to the archive, or tags it to be kept per --processed-action.
+// Returns false on failure
+func (s *Parser) processed(ctx context.Context, sh *shipment) bool {
+	fn := sh.key
+	if s.opts.ProcessedAction == "move" {
+		key := s.opts.ArchivePrefix + fn
+		if s.audit != nil {
+			s.audit.moved(sh, s.opts.ArchiveBucket+"/"+key)
+		}
+		if !s.archive(ctx, fn, key) || !s.delete(ctx, fn) {
+			if s.audit != nil {
+				s.audit.failed("move", fn)
+			}
+			return false
+		}
+		return true
+	}
+	if s.opts.ProcessedAction == "delete" && s.opts.DeleteAfter == 0 {
+		if s.audit != nil {
+			s.audit.deleted(fn, sh, time.Time{})
+		}
+		if !s.delete(ctx, fn) {
+			if s.audit != nil {
+				s.audit.failed("delete", fn)
+			}
+			return false
+		}
+		return true
+	}
+	tags, err := s.getTags(ctx, fn)
+	if err == nil {
+		tags[shippedTag] = time.Now().UTC().Format(time.RFC3339)
+		err = s.putTags(ctx, fn, tags)
+	}
+	if err != nil {
+		s.logger.Error("failed to tag file as shipped", "key", fn, "err", err)
+		return false
+	}
+	if s.audit != nil {
+		s.audit.shipped(sh)
+	}
+	return true
+}
+
+// archive copies the file to the key in --archive-bucket, returns false on failure
+func (s *Parser) archive(ctx context.Context, fn, key string) bool {
+	source := s.opts.BucketName + "/" + url.PathEscape(fn)
+	in := &s3.CopyObjectInput{
+		Bucket:                    &s.opts.ArchiveBucket,
+		Key:                       &key,
+		CopySource:                &source,
+		ExpectedSourceBucketOwner: &s.opts.BucketOwner,
+	}
+	if s.opts.ArchiveBucket == s.opts.BucketName {
+		in.ExpectedBucketOwner = &s.opts.BucketOwner
+	}
+	s.ssec.copy(in)
+	if _, err := s.s3Client.CopyObject(ctx, in); err != nil {
+		deleteFailures.Inc()
+		s.logger.Error("failed to move file to archive", "key", fn, "archive", s.opts.ArchiveBucket+"/"+key, "err", err)
+		return false
+	}
+	return true
+}
+
+// ownKey returns true for keys written to the bucket by the shipper itself:
+// files moved to the archive, markers of --dedup-bucket and --audit records
+func (s *Parser) ownKey(key string) bool {
+	archived := s.opts.ProcessedAction == "move" && s.opts.ArchiveBucket == s.opts.BucketName && strings.HasPrefix(key, s.opts.ArchivePrefix)
+	marker := s.opts.DedupBucket == s.opts.BucketName && strings.HasPrefix(key, s.opts.DedupPrefix)
+	prefix, ok := strings.CutPrefix(s.opts.Audit, "s3:")
+	audit := ok && strings.HasPrefix(key, prefix)
+	return archived || marker || audit
+}
+
+// delete removes the file from the bucket, returns false on failure
+func (s *Parser) delete(ctx context.Context, fn string) bool {
+	if _, err := s.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:              &s.opts.BucketName,
+		Key:                 &fn,
+		ExpectedBucketOwner: &s.opts.BucketOwner,
+	}); err != nil {
+		deleteFailures.Inc()
+		s.logger.Error("failed to delete file", "key", fn, "err", err)
+		return false
+	}
+	if s.recent != nil {
+		s.recent.add(fn)
+	}
+	return true
+}
+
+// parseFile ships the file of lines of the kind (access, nlb, connection,
+// cloudfront, vpcflow or waf) to Loki, returns nil shipment if the file does not exist anymore
+func (s *Parser) parseFile(ctx context.Context, fn string, accountID, lb, org, kind string) (sh *shipment, err error) {
+	var tr *fileTrace
+	var lineCount int
+	if s.slow != nil {
+		tr = newFileTrace(fn)
+		defer func() {
+			if sh != nil || err != nil {
+				tr.finish(lineCount, err)
+				s.slow.add(tr)
+			}
+		}()
+	}
 	start := time.Now()
-	meta, err := s.elbMeta.Get(accountID, lb)
+	s.status.stage(fn, "metadata")
+	var meta Meta
+	switch kind {
+	case kindCloudFront:
+		meta, err = s.elbMeta.Distribution(lb)
+	case kindFlow, kindWAF:
+		meta, err = s.elbMeta.Resource(accountID, lb)
+	default:
+		meta, err = s.elbMeta.Get(accountID, lb)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get metadata for load balancer %s/%s: %w", accountID, lb, err)
+		return nil, fmt.Errorf("failed to get metadata for load balancer %s/%s: %w", accountID, lb, err)
 	}
-	labels := map[string]string{
-		"namespace": meta.Namespace,
-		"ingress":   meta.Ingress,
+	meta.Org, meta.Type, meta.LogType = org, "app", kindAccess
+	switch kind {
+	case kindNLB:
+		meta.Type = "net"
+	case kindCloudFront:
+		meta.Type = "cloudfront"
+	case kindFlow:
+		meta.Type = "vpcflow"
+	case kindWAF:
+		meta.Type = "waf"
+	case kindConnection:
+		meta.LogType = kindConnection
 	}
-	if meta.Cluster != "" {
-		labels["cluster"] = meta.Cluster
-		labels["index"] = meta.Cluster + "-" + meta.Namespace
+	labels, err := s.renderLabels(meta)
+	if err != nil {
+		return nil, err
+	}
+	b := newBatch(labels, s.loki)
+	if b.tenantErr != nil {
+		return nil, b.tenantErr
 	}
-	for k, v := range s.opts.Labels {
-		labels[k] = v
+	b.spool, b.key, b.span, b.trace = s.spool, fn, s.opts.BatchMaxSpan, tr
+	b.limits = batchLimits{lines: s.opts.BatchLines, bytes: s.opts.BatchBytes, wait: s.opts.BatchMaxWait}
+	if s.opts.PushPipeline > 0 {
+		b.pipe = newPushPipeline(s.opts.PushPipeline)
+		defer b.drain()
 	}
-	b := newBatch(labels, s.opts, s.logger)
+	tr.done("metadata")
+	s.status.stage(fn, "download")
 
-	obj, err := s.s3Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &s.opts.BucketName,
-		Key:    &fn,
-	})
+	gzreader, err := s.open(ctx, fn)
 	if err != nil {
 		if strings.Contains(err.Error(), "NoSuchKey") {
 			s.logger.Debug("skipping non-existent file", "key", fn)
-			return nil
+			return nil, nil
 		}
-		return fmt.Errorf("failed to get object %s: %w", fn, err)
+		return nil, err
 	}
-	defer obj.Body.Close()
+	defer gzreader.Close()
+	tr.done("download")
+	s.status.stage(fn, "cpu_wait")
 
-	gzreader, err := gzip.NewReader(obj.Body)
-	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+	// CPU-bound decompression and parsing is limited by --parse-workers,
+	// the slot is released while waiting for Loki
+	s.cpu <- struct{}{}
+	defer func() { <-s.cpu }()
+	tr.done("cpu_wait")
+	s.status.stage(fn, "parse")
+	flush := func() error {
+		<-s.cpu
+		s.status.stage(fn, "push")
+		defer func() {
+			s.status.stage(fn, "cpu_wait")
+			s.cpu <- struct{}{}
+			s.status.stage(fn, "parse")
+		}()
+		return b.flush()
+	}
+
+	// lines of NLB, connection, CloudFront, VPC flow and WAF log files have other
+	// fields, and are not observed by metrics of ALB requests
+	alb := kind == kindAccess
+	var sli sliStats
+	var sizes sizeStats
+	var shedding []shedRule
+	if s.shed != nil && alb {
+		shedding = s.shed.match(labels, time.Now())
+	}
+	lines := s.newLineReader(kind)
+	lines.other = func(k, line string) { s.otherLine(fn, k, line) }
+	handle := func(matches []string, entry logproto.Entry) error {
+		if len(s.opts.DomainMetrics) > 0 && alb {
+			s.observeDomain(matches)
+		}
+		if (s.opts.SLI || s.anomaly != nil) && alb {
+			sli.observe(matches)
+		}
+		if s.opts.SizeMetrics && alb {
+			sizes.observe(matches)
+		}
+		// dropped lines are still observed by metrics
+		if len(shedding) > 0 {
+			if rule, ok := shed(shedding, matches[statusIdx]); ok {
+				shedLines.Inc(rule)
+				return nil
+			}
+		}
+		if s.opts.MetadataS3Key != "" {
+			entry.StructuredMetadata = append(entry.StructuredMetadata, logproto.LabelAdapter{Name: s.opts.MetadataS3Key, Value: fn})
+		}
+		if b.exceeds(entry) {
+			if err := flush(); err != nil {
+				return fmt.Errorf("failed to send batch: %w", err)
+			}
+		}
+		b.add(entry)
+		if b.full() {
+			if err := flush(); err != nil {
+				return fmt.Errorf("failed to send batch: %w", err)
+			}
+		}
+		return nil
+	}
+	var pipe *threadPipe
+	if s.threads != nil && alb {
+		pipe = &threadPipe{s: s, lines: lines, handle: handle}
+		defer pipe.drain()
 	}
-	defer gzreader.Close()
 
-	var lineCount int
 	scanner := bufio.NewScanner(gzreader)
 	for scanner.Scan() {
 		lineCount++
-		ts, logLine, err := s.line.As(s.opts.Format, scanner.Text())
+		line := scanner.Text()
+		if pipe != nil {
+			if err = pipe.add(line); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		matches, entry, err := lines.read(line, b.arena.LineAs)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if matches == nil {
+			continue
 		}
-		if err = b.add(*ts, logLine); err != nil {
-			return fmt.Errorf("failed to send batch: %w", err)
+		if err = handle(matches, entry); err != nil {
+			return nil, err
 		}
 	}
 	if err = scanner.Err(); err != nil {
-		return fmt.Errorf("failed to scan file %s: %w", fn, err)
+		return nil, fmt.Errorf("failed to scan file %s: %w", fn, err)
+	}
+	if pipe != nil {
+		if err = pipe.flush(); err != nil {
+			return nil, err
+		}
+	}
+	if err = flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush batch: %w", err)
+	}
+	if err = b.drain(); err != nil {
+		return nil, fmt.Errorf("failed to send batch: %w", err)
+	}
+	tr.done("parse")
+	if s.opts.SLI && alb {
+		sli.record(labels)
 	}
-	if err = b.flush(); err != nil {
-		return fmt.Errorf("failed to flush batch: %w", err)
+	if s.opts.SizeMetrics && alb {
+		sizes.record(labels)
+	}
+	if s.anomaly != nil && alb {
+		s.anomaly.add(labels, &sli)
 	}
 	s.logger.Debug("shipped file", "key", fn, "labels", fmt.Sprintf("%v", labels), "lines", lineCount, "duration", time.Since(start), "lines/s", fmt.Sprintf("%.2f", float64(lineCount)/time.Since(start).Seconds()))
-	return nil
+	return &shipment{key: fn, size: gzreader.size, lines: lineCount, batches: b.ids, spooled: b.spooled}, nil
+}
+
+// lineReader turns lines of a log file to entries, the same way for shipping
+// and replay of fixtures: headers of CloudFront and VPC flow log files are
+// handled, lines of other kinds are skipped, and timestamps are made unique by
+// --tie-break. Kind of the file is detected by its first line when unknown
+type lineReader struct {
+	s     *Parser
+	kind  string
+	lp    LineParser
+	n     int // lines read
+	ties  tieBreaker
+	other func(kind, line string) // called for skipped lines of other kinds
+}
+
+func (s *Parser) newLineReader(kind string) *lineReader {
+	return &lineReader{s: s, kind: kind, lp: s.lineParser(kind)}
+}
+
+// read returns fields of the line and its entry formatted by as, or nil
+// fields for skipped lines
+func (r *lineReader) read(line string, as func(p LineParser, format, line string, matches []string) (logproto.Entry, error)) ([]string, logproto.Entry, error) {
+	r.n++
+	if r.kind == kindUnknown {
+		switch {
+		case strings.HasPrefix(line, "#"):
+			r.kind = kindCloudFront
+		case strings.HasPrefix(line, "{"):
+			r.kind = kindWAF
+		case isFlowHeader(line):
+			r.kind = kindFlow
+		default:
+			r.kind = lineKind(line)
+		}
+		if r.kind == kindUnknown {
+			return nil, logproto.Entry{}, fmt.Errorf("unknown kind of log file")
+		}
+		r.lp = r.s.lineParser(r.kind)
+	}
+	if r.kind == kindCloudFront && strings.HasPrefix(line, "#") {
+		return nil, logproto.Entry{}, nil // #Version and #Fields headers
+	}
+	if r.kind == kindFlow && r.n == 1 && isFlowHeader(line) {
+		// custom format of the file
+		lp, err := newLineFlow(r.s.fo, line)
+		if err != nil {
+			return nil, logproto.Entry{}, err
+		}
+		r.lp = lp
+		return nil, logproto.Entry{}, nil
+	}
+	matches, entry, err := r.parse(line, as)
+	if matches == nil || err != nil {
+		return nil, logproto.Entry{}, err
+	}
+	entry.Timestamp = r.timestamp(entry.Timestamp)
+	return matches, entry, nil
+}
+
+// parse returns fields of the line of the detected kind and its entry, or nil
+// fields for lines of other kinds. Unlike read it does not change the reader,
+// so lines of access log files are parsed by it concurrently in parse threads
+func (r *lineReader) parse(line string, as func(p LineParser, format, line string, matches []string) (logproto.Entry, error)) ([]string, logproto.Entry, error) {
+	if k := lineKind(line); k != r.kind && k != kindUnknown {
+		if r.other != nil {
+			r.other(k, line)
+		}
+		return nil, logproto.Entry{}, nil
+	}
+	matches, err := r.lp.Fields(line)
+	if err != nil {
+		return nil, logproto.Entry{}, err
+	}
+	entry, err := as(r.lp, lineFormat(r.s.opts), line, matches)
+	if err != nil {
+		return nil, logproto.Entry{}, err
+	}
+	return matches, entry, nil
+}
+
+// timestamp returns timestamp of the next entry of the file, made unique by
+// --tie-break
+func (r *lineReader) timestamp(ts time.Time) time.Time {
+	if !r.s.opts.TieBreak {
+		return ts
+	}
+	return r.ties.next(ts)
+}
+
+// otherLine handles line of access log file in other format. Connection log
+// lines are loaded to --correlate-connections cache, others are skipped
+func (s *Parser) otherLine(fn, kind, line string) {
+	otherLines.Inc(kind)
+	if kind != kindConnection || s.conns == nil {
+		return
+	}
+	id, info, err := s.conns.parse(line)
+	if err != nil {
+		s.logger.Debug("skipping invalid connection log line", "key", fn, "err", err)
+		return
+	}
+	if id != "" {
+		s.conns.add([]string{id}, []connInfo{info})
+	}
+}
+
+// open returns decompressed content of the S3 object
+func (s *Parser) open(ctx context.Context, fn string) (*gzipObject, error) {
+	in := &s3.GetObjectInput{
+		Bucket:              &s.opts.BucketName,
+		Key:                 &fn,
+		ExpectedBucketOwner: &s.opts.BucketOwner,
+	}
+	s.ssec.get(in)
+	obj, err := s.s3Client.GetObject(ctx, in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %w", fn, err)
+	}
+
+	gzreader, err := gzip.NewReader(obj.Body)
+	if err != nil {
+		obj.Body.Close()
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	var size int64
+	if obj.ContentLength != nil {
+		size = *obj.ContentLength
+	}
+	return &gzipObject{gzreader, obj.Body, size}, nil
+}
+
+type gzipObject struct {
+	*gzip.Reader
+	body io.ReadCloser
+	size int64 // compressed
+}
+
+func (g *gzipObject) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
 }
 
 func (s *Parser) metrics() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintf(w, "alb_logs_shipper_queue_length %d\n", len(s.queue))
+		s.writeMetrics(w)
 	})
 }
+
+// writeMetrics writes all metrics in Prometheus text exposition format
+func (s *Parser) writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "alb_logs_shipper_queue_length %d\n", len(s.queue))
+	for _, m := range registry {
+		m.write(w)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestTopPrefix(t *testing.T) {
+	tests := map[string]string{
+		"AWSLogs/123456789012/elasticloadbalancing/eu-central-1/2025/05/30/file.log.gz": "AWSLogs/",
+		"audit/2025/05/30/080000.000-r1.jsonl":                                          "audit/",
+		"ELBAccessLogTestFile":                                                          "/",
+	}
+	for key, want := range tests {
+		if got := topPrefix(key); got != want {
+			t.Errorf("topPrefix(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestStop_enqueue(t *testing.T) {
+	s := &Parser{queue: make(chan queueItem, 1), stop: make(chan struct{}), runs: newRuns(slog.New(slog.NewTextHandler(io.Discard, nil)))}
+	ctx := context.Background()
+	if !s.enqueue(ctx, queueItem{key: "a"}) {
+		t.Fatal("enqueue() to empty queue = false")
+	}
+	blocked := make(chan bool)
+	go func() {
+		blocked <- s.enqueue(ctx, queueItem{key: "b"})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Stop()
+	s.Stop()
+	if <-blocked {
+		t.Error("enqueue() to full queue = true after Stop()")
+	}
+	if s.enqueue(ctx, queueItem{key: "c"}) {
+		t.Error("enqueue() = true after Stop()")
+	}
+	if item := <-s.queue; item.key != "a" {
+		t.Errorf("queued %s, want a", item.key)
+	}
+	if _, ok := <-s.queue; ok {
+		t.Error("queue is not closed by Stop()")
+	}
+}
+
+func TestScanSkipped(t *testing.T) {
+	s := &Parser{opts: Options{ScanMaxQueue: 1}, queue: make(chan queueItem, 10)}
+	s.queue <- queueItem{key: "a"}
+	s.queue <- queueItem{key: "b"}
+	if _, _, err := s.scan(); !errors.Is(err, errScanSkipped) {
+		t.Errorf("scan() with long queue error = %v, want %v", err, errScanSkipped)
+	}
+
+	s.scanning.Store(true)
+	s.opts.ScanMaxQueue = 0
+	if _, _, err := s.scan(); !errors.Is(err, errScanSkipped) {
+		t.Errorf("scan() while running error = %v, want %v", err, errScanSkipped)
+	}
+}
+
+func TestKeyOrg(t *testing.T) {
+	const file = "123456789012/elasticloadbalancing/us-east-1/2022/01/24/123456789012_elasticloadbalancing_us-east-1_app.my-loadbalancer.b13ea9d19f16d015_20220124T0000Z_0.0.0.0_2et2e1mx.log.gz"
+	tests := map[string]string{
+		"AWSLogs/" + file:                      "",
+		"prefix/AWSLogs/" + file:               "",
+		"o-a1b2c3d4e5/AWSLogs/" + file:         "o-a1b2c3d4e5",
+		"central/o-a1b2c3d4e5/AWSLogs/" + file: "o-a1b2c3d4e5",
+		"AWSLogs/o-a1b2c3d4e5/" + file:         "o-a1b2c3d4e5",
+	}
+	for key, want := range tests {
+		matches := fnRegex.FindStringSubmatch(key)
+		if len(matches) == 0 {
+			t.Errorf("fnRegex does not match %q", key)
+			continue
+		}
+		if got := keyOrg(fnRegex, matches); got != want {
+			t.Errorf("keyOrg(%q) = %q, want %q", key, got, want)
+		}
+		if got := matches[fnRegex.SubexpIndex("account_id")]; got != "123456789012" {
+			t.Errorf("account_id of %q = %q", key, got)
+		}
+	}
+
+	nlb := "AWSLogs/123456789012/elasticloadbalancing/us-east-2/2016/05/01/123456789012_elasticloadbalancing_us-east-2_net.my-loadbalancer.1234567890abcdef_201605010000Z_2soosksgsasd.log.gz"
+	matches := fnRegex.FindStringSubmatch(nlb)
+	if len(matches) == 0 || matches[fnRegex.SubexpIndex("type")] != "net" || matches[fnRegex.SubexpIndex("id")] != "my-loadbalancer" {
+		t.Errorf("fnRegex does not match NLB key %q: %q", nlb, matches)
+	}
+}
+
+func TestThreadPipe(t *testing.T) {
+	s := &Parser{opts: Options{Format: "logfmt"}, line: &LineSlice{}}
+	s.startThreads(2)
+	var got []string
+	p := &threadPipe{s: s, lines: s.newLineReader(kindAccess), handle: func(matches []string, entry logproto.Entry) error {
+		got = append(got, matches[3])
+		return nil
+	}}
+	n := 3*threadChunk*threadInflight + 1
+	for i := range n {
+		line := fmt.Sprintf(`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.0.1:%d 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`, i)
+		if i%100 == 0 {
+			line = `2023-12-04T18:45:52.456000Z 10.0.1.252 48160 443 TLSv1.2 ECDHE-RSA-AES128-GCM-SHA256 4 "-" - - - TID_1234abcd5678ef90`
+		}
+		if err := p.add(line); err != nil {
+			t.Fatalf("threadPipe.add() error = %v", err)
+		}
+	}
+	if err := p.flush(); err != nil {
+		t.Fatalf("threadPipe.flush() error = %v", err)
+	}
+	j := 0
+	for i := range n {
+		if i%100 == 0 {
+			continue
+		}
+		if want := fmt.Sprintf("10.0.0.1:%d", i); j >= len(got) || got[j] != want {
+			t.Fatalf("threadPipe entry %d = %v, want %s", j, got[j:min(j+1, len(got))], want)
+		}
+		j++
+	}
+	if j != len(got) {
+		t.Errorf("threadPipe handled %d entries, want %d", len(got), j)
+	}
+
+	if err := p.add("invalid"); err != nil {
+		t.Fatalf("threadPipe.add() error = %v", err)
+	}
+	if err := p.flush(); err == nil {
+		t.Errorf("threadPipe.flush() of invalid line error = nil, want error")
+	}
+
+	// chunks after the failed one are drained
+	var err error
+	for i := 0; err == nil && i < threadChunk*(threadInflight+1); i++ {
+		line := "invalid"
+		if i > 0 {
+			line = fmt.Sprintf(`http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.0.1:%d 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`, i)
+		}
+		err = p.add(line)
+	}
+	if err == nil || len(p.pending) != 0 || p.chunk != nil {
+		t.Errorf("threadPipe after error = %v has %d pending chunks", err, len(p.pending))
+	}
+}
+
+// listServer returns S3 client of bucket with sorted keys, listed by pages of
+// pageSize keys
+func listServer(t *testing.T, keys []string, pageSize int) *s3.Client {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+		if after := r.URL.Query().Get("start-after"); i == 0 && after != "" {
+			for i < len(keys) && keys[i] <= after {
+				i++
+			}
+		}
+		end := min(i+pageSize, len(keys))
+		next := ""
+		if end < len(keys) {
+			next = fmt.Sprintf("<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+		}
+		fmt.Fprintf(w, `<ListBucketResult>%s`, next)
+		for _, k := range keys[i:end] {
+			fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, k)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+	t.Cleanup(srv.Close)
+	return s3.New(s3.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), UsePathStyle: true, Credentials: aws.AnonymousCredentials{}})
+}
+
+func TestListPages(t *testing.T) {
+	// 3 pages of 2 keys
+	client := listServer(t, []string{"0-a", "0-b", "1-a", "1-b", "2-a", "2-b"}, 2)
+
+	tests := []struct {
+		maxKeys   int
+		want      []int // keys found by consecutive scans
+		truncated []bool
+	}{
+		{maxKeys: 0, want: []int{6, 6}, truncated: []bool{false, false}},
+		{maxKeys: 3, want: []int{4, 2, 4}, truncated: []bool{true, false, true}},
+		{maxKeys: 6, want: []int{6, 6}, truncated: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		s := &Parser{opts: Options{BucketName: "logs", ScanMaxKeys: tt.maxKeys}, s3Client: client, queue: make(chan queueItem, 20), runs: newRuns(slog.New(slog.NewTextHandler(io.Discard, nil)))}
+		for i, want := range tt.want {
+			var total atomic.Int64
+			n, truncated, err := s.list(t.Context(), "", &total)
+			if err != nil {
+				t.Fatalf("list() error = %v", err)
+			}
+			if n != want || truncated != tt.truncated[i] {
+				t.Errorf("list() #%d with --scan-max-keys=%d = %d, %v, want %d, %v", i, tt.maxKeys, n, truncated, want, tt.truncated[i])
+			}
+			for range n {
+				<-s.queue
+			}
+		}
+	}
+}
+
+func TestListRetained(t *testing.T) {
+	// more retained keys than --scan-max-keys ahead of a new one
+	var keys []string
+	s := &Parser{opts: Options{BucketName: "logs", ScanMaxKeys: 1000}, queue: make(chan queueItem, 10), retained: newRetainedKeys(72 * time.Hour), runs: newRuns(slog.New(slog.NewTextHandler(io.Discard, nil)))}
+	for i := range 1500 {
+		keys = append(keys, fmt.Sprintf("a-%04d.log.gz", i))
+		s.retained.add(keys[i], time.Now().Add(-time.Hour))
+	}
+	keys = append(keys, "b-new.log.gz")
+	s.s3Client = listServer(t, keys, 1000)
+
+	var total atomic.Int64
+	n, truncated, err := s.list(t.Context(), "", &total)
+	if err != nil {
+		t.Fatalf("list() error = %v", err)
+	}
+	if n != 1 || truncated || len(s.queue) != 1 || (<-s.queue).key != "b-new.log.gz" {
+		t.Fatalf("list() = %d, %v, want the new key only", n, truncated)
+	}
+	// not processed keys don't make scans more frequent
+	opts := Options{WaitInterval: time.Minute, WaitMin: 10 * time.Second, WaitMax: 10 * time.Minute}
+	if got := nextWait(time.Minute, n, truncated, opts); got != time.Minute {
+		t.Errorf("nextWait() after scan of retained keys = %v, want %v", got, time.Minute)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	keys := []string{
+		"alb/AWSLogs/111111111111/elasticloadbalancing/us-east-1/2024/01/01/a.log.gz",
+		"alb/AWSLogs/111111111111/elasticloadbalancing/eu-west-1/2024/01/01/b.log.gz",
+		"alb/o-abcdefghij/AWSLogs/222222222222/elasticloadbalancing/us-east-1/2024/01/01/c.log.gz",
+		"AWSLogs/333333333333/elasticloadbalancing/us-east-1/2024/01/01/d.log.gz",
+		"AWSLogs/333333333333/CloudTrail/us-east-1/2024/01/01/e.json.gz",
+	}
+	// common prefixes of keys by prefix and delimiter
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+		var common []string
+		for _, k := range keys {
+			rest, ok := strings.CutPrefix(k, prefix)
+			if !ok {
+				continue
+			}
+			if i := strings.Index(rest, delimiter); i >= 0 && !slices.Contains(common, prefix+rest[:i+1]) {
+				common = append(common, prefix+rest[:i+1])
+			}
+		}
+		fmt.Fprint(w, `<ListBucketResult>`)
+		for _, p := range common {
+			fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, p)
+		}
+		fmt.Fprint(w, `</ListBucketResult>`)
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), UsePathStyle: true, Credentials: aws.AnonymousCredentials{}})
+
+	tests := map[string][]string{
+		"": {"AWSLogs/333333333333/elasticloadbalancing/us-east-1/"},
+		"alb/": {
+			"alb/AWSLogs/111111111111/elasticloadbalancing/eu-west-1/",
+			"alb/AWSLogs/111111111111/elasticloadbalancing/us-east-1/",
+			"alb/o-abcdefghij/AWSLogs/222222222222/elasticloadbalancing/us-east-1/",
+		},
+	}
+	for prefix, want := range tests {
+		s := &Parser{opts: Options{BucketName: "logs"}, s3Client: client}
+		got, err := s.partitions(t.Context(), prefix)
+		if err != nil {
+			t.Fatalf("partitions(%q) error = %v", prefix, err)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("partitions(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestProcessedMove(t *testing.T) {
+	var reqs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs = append(reqs, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Amz-Copy-Source"))
+		if r.Method == http.MethodPut {
+			fmt.Fprint(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	client := s3.New(s3.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), UsePathStyle: true, Credentials: aws.AnonymousCredentials{}})
+
+	opts := Options{BucketName: "logs", ProcessedAction: "move", ArchiveBucket: "logs", ArchivePrefix: "processed/"}
+	s := &Parser{opts: opts, s3Client: client, logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	if !s.processed(t.Context(), &shipment{key: "AWSLogs/123/a.log.gz"}) {
+		t.Fatalf("processed() = false, want true")
+	}
+	want := []string{
+		"PUT /logs/processed/AWSLogs/123/a.log.gz logs/AWSLogs%2F123%2Fa.log.gz",
+		"DELETE /logs/AWSLogs/123/a.log.gz ",
+	}
+	if !slices.Equal(reqs, want) {
+		t.Errorf("processed() requests = %q, want %q", reqs, want)
+	}
+	if !s.ownKey("processed/AWSLogs/123/a.log.gz") || s.ownKey("AWSLogs/123/a.log.gz") {
+		t.Errorf("ownKey() does not match --archive-prefix")
+	}
+	s.opts.Audit = "s3:audit/"
+	if !s.ownKey("audit/2025/05/30/082500.000-r1.jsonl") {
+		t.Errorf("ownKey() does not match --audit prefix")
+	}
+}
+
+func TestSkipObject(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		opts Options
+		obj  types.Object
+		want string
+	}{
+		{name: "disabled", obj: types.Object{Size: aws.Int64(0), LastModified: aws.Time(now)}},
+		{name: "empty", opts: Options{SkipEmpty: true}, obj: types.Object{Size: aws.Int64(0)}, want: "empty"},
+		{name: "not empty", opts: Options{SkipEmpty: true}, obj: types.Object{Size: aws.Int64(10)}},
+		{name: "recent", opts: Options{MinAge: time.Minute}, obj: types.Object{Size: aws.Int64(10), LastModified: aws.Time(now.Add(-10 * time.Second))}, want: "recent"},
+		{name: "old", opts: Options{MinAge: time.Minute}, obj: types.Object{Size: aws.Int64(10), LastModified: aws.Time(now.Add(-2 * time.Minute))}},
+	}
+	for _, tt := range tests {
+		s := &Parser{opts: tt.opts}
+		if got := s.skipObject(tt.obj, now); got != tt.want {
+			t.Errorf("%s: skipObject() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	s := &Parser{retained: newRetainedKeys(72 * time.Hour)}
+	s.retained.add("shipped.log.gz", now.Add(-time.Hour))
+	for key, want := range map[string]string{"shipped.log.gz": "retained", "new.log.gz": ""} {
+		if got := s.skipObject(types.Object{Key: aws.String(key), LastModified: aws.Time(now.Add(-time.Hour))}, now); got != want {
+			t.Errorf("skipObject(%s) with --delete-after = %q, want %q", key, got, want)
+		}
+	}
+}
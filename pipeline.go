@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+// pushPipeline pushes batches of a file in order by a goroutine, so the next
+// batch is parsed while the previous one is pushed. Up to --push-pipeline
+// batches are pushed or queued, then flush waits. After a failed push the
+// queued batches are dropped, as the file is shipped again anyway
+type pushPipeline struct {
+	queue   chan *batch
+	done    chan struct{}
+	mu      sync.Mutex
+	err     error
+	ids     []string // of sent push requests, in order
+	spooled int
+}
+
+func newPushPipeline(depth int) *pushPipeline {
+	p := &pushPipeline{queue: make(chan *batch, depth-1), done: make(chan struct{})}
+	go p.run()
+	return p
+}
+
+func (p *pushPipeline) run() {
+	defer close(p.done)
+	for b := range p.queue {
+		if p.error() != nil {
+			continue
+		}
+		err := b.flush()
+		p.mu.Lock()
+		p.err = err
+		p.ids = append(p.ids, b.ids...)
+		p.spooled += b.spooled
+		p.mu.Unlock()
+	}
+}
+
+func (p *pushPipeline) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// add queues the batch to push, and returns error of a previous push if any
+func (p *pushPipeline) add(b *batch) error {
+	if err := p.error(); err != nil {
+		return err
+	}
+	p.queue <- b
+	return nil
+}
+
+// wait returns when all queued batches are pushed
+func (p *pushPipeline) wait() error {
+	close(p.queue)
+	<-p.done
+	return p.err
+}
+
+// detach returns the batch with current entries to be pushed by the pipeline,
+// and resets the batch for the next entries
+func (b *batch) detach() *batch {
+	d := *b
+	d.stream = &logproto.Stream{Labels: b.stream.Labels, Entries: b.stream.Entries}
+	d.pipe, d.ids, d.spooled, d.piped = nil, nil, 0, true
+	b.lines, b.bytes = 0, 0
+	b.stream.Entries = make([]logproto.Entry, 0, cap(b.stream.Entries))
+	return &d
+}
+
+// drain waits for pushes of the pipeline, and collects their IDs. It is safe
+// to call multiple times, like deferred on errors
+func (b *batch) drain() error {
+	if b.pipe == nil {
+		return nil
+	}
+	p := b.pipe
+	b.pipe = nil
+	err := p.wait()
+	b.ids = append(b.ids, p.ids...)
+	b.spooled += p.spooled
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestPushPipeline(t *testing.T) {
+	var mu sync.Mutex
+	var pushed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		raw, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+		}
+		var req logproto.PushRequest
+		if err = req.Unmarshal(raw); err != nil {
+			t.Error(err)
+		}
+		line := req.Streams[0].Entries[0].Line
+		if line == "fail" {
+			http.Error(w, "entry too far behind", http.StatusBadRequest)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		pushed = append(pushed, line)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	client, err := newLokiClient(Options{LokiURL: srv.URL, LokiEncoding: "snappy"}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBatch(map[string]string{"ingress": "web"}, client)
+	b.pipe = newPushPipeline(2)
+	want := []string{"1", "2", "3", "4", "5"}
+	for _, line := range want {
+		b.add(logproto.Entry{Timestamp: time.Unix(1, 0), Line: line})
+		if err = b.flush(); err != nil {
+			t.Fatalf("flush() error = %v", err)
+		}
+		if b.lines != 0 || len(b.stream.Entries) != 0 {
+			t.Fatalf("flush() kept %d lines in the batch", b.lines)
+		}
+	}
+	if err = b.drain(); err != nil {
+		t.Fatalf("drain() error = %v", err)
+	}
+	if !slices.Equal(pushed, want) {
+		t.Errorf("pushed %v, want %v", pushed, want)
+	}
+	if len(b.ids) != len(want) {
+		t.Errorf("drain() collected %d push IDs, want %d", len(b.ids), len(want))
+	}
+	if err = b.drain(); err != nil {
+		t.Errorf("second drain() error = %v", err)
+	}
+
+	b.pipe = newPushPipeline(1)
+	for _, line := range []string{"fail", "6"} {
+		b.add(logproto.Entry{Timestamp: time.Unix(1, 0), Line: line})
+		if err = b.flush(); err != nil {
+			break
+		}
+	}
+	if err = b.drain(); err == nil {
+		t.Errorf("drain() after failed push error = nil")
+	}
+	if slices.Contains(pushed, "6") {
+		t.Errorf("pushed batch queued after failed push")
+	}
+}
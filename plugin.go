@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+var (
+	execErrors         = newCounter("alb_logs_shipper_exec_errors_total", "Failed exchanges with processes of --transform=exec and --exec-sink, which are restarted", "command")
+	droppedSinkEntries = newCounter("alb_logs_shipper_exec_sink_dropped_entries_total", "Entries not written to --exec-sink, as its queue is full")
+)
+
+// execTimeout limits each exchange with a plugin process, which is killed and
+// restarted when it does not read the lines or reply in time
+const execTimeout = 10 * time.Second
+
+// execProcess is a long running plugin process, which reads NDJSON lines on
+// stdin and, for transformers, writes a NDJSON line to stdout for each of them.
+// It is started on the first exchange, and restarted after a failure
+type execProcess struct {
+	command string
+	args    []string
+	reply   bool // process writes response line for each request line
+	timeout time.Duration
+	mu      sync.Mutex
+	closed  bool
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+}
+
+func newExecProcess(command string, reply bool) (*execProcess, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	}
+	return &execProcess{command: command, args: args, reply: reply, timeout: execTimeout}, nil
+}
+
+// splitCommand splits the command to args by spaces, like shell does without
+// expansions: args could be quoted by ' or ", and \ escapes the next char
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var quote rune
+	inArg, escaped := false, false
+	for _, r := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in command %s", command)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	return args, nil
+}
+
+func (p *execProcess) start() error {
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = time.Second // for children holding the pipes after kill
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if p.reply {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		p.stdout = bufio.NewReaderSize(stdout, 64<<10)
+	} else {
+		cmd.Stdout = os.Stderr
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd, p.stdin = cmd, stdin
+	return nil
+}
+
+// stop kills the process, to start a new one on the next exchange
+func (p *execProcess) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+	p.cmd, p.stdin, p.stdout = nil, nil, nil
+}
+
+// close stops the process after the current exchange, and it is not started
+// again
+func (p *execProcess) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	p.stop()
+}
+
+// exchange writes the lines, and returns response line of the process when
+// it replies. Lines should end with newline. The process is killed when the
+// exchange takes longer than timeout, which unblocks its pipes
+func (p *execProcess) exchange(lines []byte) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, fmt.Errorf("%s is closed", p.command)
+	}
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return nil, fmt.Errorf("failed to start %s: %w", p.command, err)
+		}
+	}
+	process := p.cmd.Process
+	timer := time.AfterFunc(p.timeout, func() { process.Kill() })
+	resp, err := p.roundTrip(lines)
+	if !timer.Stop() {
+		err = fmt.Errorf("%s timed out after %s", p.command, p.timeout)
+	}
+	if err != nil {
+		p.stop()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (p *execProcess) roundTrip(lines []byte) ([]byte, error) {
+	if _, err := p.stdin.Write(lines); err != nil {
+		return nil, fmt.Errorf("failed to write to %s: %w", p.command, err)
+	}
+	if !p.reply {
+		return nil, nil
+	}
+	resp, err := p.stdout.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from %s: %w", p.command, err)
+	}
+	return resp, nil
+}
+
+// execTransformer sends fields of each line as JSON object of unquoted values
+// to the process, and replaces them with fields of the JSON object it replies
+// with, in the same order. Fields with null value are dropped. On failure the
+// fields are kept as is
+type execTransformer struct{ p *execProcess }
+
+// Close stops the process, when the transformer is replaced on reload
+func (t execTransformer) Close() error {
+	t.p.close()
+	return nil
+}
+
+func (t execTransformer) Transform(fields []Field) []Field {
+	resp, err := t.p.exchange(marshalFields(fields))
+	if err == nil {
+		var res []Field
+		if res, err = unmarshalFields(resp, fields); err == nil {
+			return res
+		}
+	}
+	execErrors.Inc(t.p.command)
+	return fields
+}
+
+// marshalFields returns NDJSON line of the fields, numbers and objects are
+// written as is
+func marshalFields(fields []Field) []byte {
+	b := []byte{'{'}
+	for i, f := range fields {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b, _ = appendJSONString(b, f.Name)
+		b = append(b, ':')
+		switch {
+		case f.Object, f.Number && isNumber(f.Value):
+			b = append(b, f.Value...)
+		default:
+			b, _ = appendJSONString(b, unquote(f.Value))
+		}
+	}
+	return append(b, '}', '\n')
+}
+
+func appendJSONString(b []byte, s string) ([]byte, error) {
+	v, err := json.Marshal(s)
+	return append(b, v...), err
+}
+
+// unmarshalFields parses JSON object of the line to fields. Strings are quoted
+// unless the field was not, and the value is plain
+func unmarshalFields(line []byte, orig []Field) ([]Field, error) {
+	quoted := make(map[string]bool, len(orig))
+	for _, f := range orig {
+		quoted[f.Name] = f.Quoted
+	}
+	pairs, err := jsonPairs(line)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Field, 0, len(orig))
+	for i := 0; i < len(pairs); i += 2 {
+		q, ok := quoted[pairs[i]]
+		if f, ok := jsonField(pairs[i], pairs[i+1], !ok || q); ok {
+			res = append(res, f)
+		}
+	}
+	return res, nil
+}
+
+// jsonPairs splits JSON object to its keys and raw values, in order
+func jsonPairs(line []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object: %s", line)
+	}
+	var res []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		name, _ := t.(string)
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		res = append(res, name, string(raw))
+	}
+	return res, nil
+}
+
+// jsonField returns field of the raw JSON value, false for null. Strings are
+// quoted when quoted is set, or the value is not plain
+func jsonField(name, raw string, quoted bool) (Field, bool) {
+	switch raw[0] {
+	case 'n':
+		return Field{}, false
+	case '"':
+		var s string
+		if err := json.Unmarshal([]byte(raw), &s); err != nil {
+			return Field{}, false
+		}
+		if quoted || !isPlain(s) || s == "" {
+			return Field{Name: name, Value: quote(s), Quoted: true}, true
+		}
+		return Field{Name: name, Value: s}, true
+	case '{', '[':
+		return Field{Name: name, Value: raw, Object: true}, true
+	case 't', 'f':
+		return Field{Name: name, Value: raw}, true
+	}
+	return Field{Name: name, Value: raw, Number: true}, true
+}
+
+// execSink writes shipped entries to --exec-sink process as NDJSON lines, for
+// custom delivery besides Loki. Batches are queued to not block pushes to
+// Loki, and dropped when the queue is full. Failures do not fail pushes
+type execSink struct {
+	p      *execProcess
+	logger *slog.Logger
+	queue  chan sinkBatch
+}
+
+// sinkBatch is NDJSON lines of entries of a pushed batch
+type sinkBatch struct {
+	lines   []byte
+	entries int
+}
+
+// sinkEntry is NDJSON line of an entry written to --exec-sink
+type sinkEntry struct {
+	Labels    map[string]string `json:"labels"`
+	Timestamp time.Time         `json:"timestamp"`
+	Line      string            `json:"line"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// newExecSink starts writer of queued batches, up to size of them
+func newExecSink(command string, size int, logger *slog.Logger) (*execSink, error) {
+	p, err := newExecProcess(command, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &execSink{p: p, logger: logger, queue: make(chan sinkBatch, size)}
+	go s.run()
+	return s, nil
+}
+
+func (s *execSink) run() {
+	for b := range s.queue {
+		if _, err := s.p.exchange(b.lines); err != nil {
+			execErrors.Inc(s.p.command)
+			s.logger.Error("failed to write entries to exec sink", "entries", b.entries, "err", err)
+		}
+	}
+}
+
+// write queues the entries, or drops them when the queue is full
+func (s *execSink) write(labels map[string]string, entries []logproto.Entry) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		se := sinkEntry{Labels: labels, Timestamp: e.Timestamp, Line: e.Line}
+		if len(e.StructuredMetadata) > 0 {
+			se.Metadata = make(map[string]string, len(e.StructuredMetadata))
+			for _, l := range e.StructuredMetadata {
+				se.Metadata[l.Name] = l.Value
+			}
+		}
+		if err := enc.Encode(se); err != nil {
+			s.logger.Error("failed to encode entry for exec sink", "err", err)
+			return
+		}
+	}
+	select {
+	case s.queue <- sinkBatch{buf.Bytes(), len(entries)}:
+	default:
+		droppedSinkEntries.Add(float64(len(entries)))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestExecTransformer(t *testing.T) {
+	fields := []Field{
+		{Name: "elb", Value: "app/my-lb/50dc6c495c0c9188"},
+		{Name: "request", Value: `"GET http://example.com:80/ HTTP/1.1"`, Quoted: true},
+		{Name: "received_bytes", Value: "34", Number: true},
+	}
+	tests := []struct {
+		name    string
+		command string
+		want    []Field
+	}{
+		{name: "echo", command: "cat", want: fields},
+		{name: "rename", command: "sed -u s/\"elb\"/\"alb\"/", want: []Field{
+			{Name: "alb", Value: `"app/my-lb/50dc6c495c0c9188"`, Quoted: true},
+			fields[1], fields[2],
+		}},
+		{name: "failed", command: "true", want: fields},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newTransformer("exec:" + tt.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 2 {
+				if got := tr.Transform(fields); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Transform() = %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+	for _, spec := range []string{"exec:", "exec:cat 'a", `exec:cat \`} {
+		if _, err := newTransformer(spec); err == nil {
+			t.Errorf("newTransformer(%q) error = nil", spec)
+		}
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{`/bin/plugin --flag`, []string{"/bin/plugin", "--flag"}},
+		{`  /bin/plugin   a  `, []string{"/bin/plugin", "a"}},
+		{`'/opt/my plugins/enrich' --name "a b" c\ d ''`, []string{"/opt/my plugins/enrich", "--name", "a b", "c d", ""}},
+		{`sed s/"elb"/"alb"/`, []string{"sed", "s/elb/alb/"}},
+	}
+	for _, tt := range tests {
+		if got, err := splitCommand(tt.command); err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitCommand(%s) = %q, %v, want %q", tt.command, got, err, tt.want)
+		}
+	}
+}
+
+func TestExecProcess_timeout(t *testing.T) {
+	p, err := newExecProcess("sleep 10", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.timeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, err = p.exchange([]byte("{}\n")); err == nil {
+		t.Error("exchange() with stuck process error = nil")
+	}
+	if time.Since(start) > 5*time.Second || p.cmd != nil {
+		t.Errorf("stuck process is not killed in %s", time.Since(start))
+	}
+}
+
+func TestUnmarshalFields(t *testing.T) {
+	orig := []Field{{Name: "client", Value: "192.168.131.39:2817"}, {Name: "user_agent", Value: `"curl/7.46.0"`, Quoted: true}}
+	got, err := unmarshalFields([]byte(`{"client":"192.168.131.39:2817","user_agent":null,"geo":{"country":"NL"},"score":0.5,"bot":false,"note":"a b"}`+"\n"), orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Field{
+		{Name: "client", Value: "192.168.131.39:2817"},
+		{Name: "geo", Value: `{"country":"NL"}`, Object: true},
+		{Name: "score", Value: "0.5", Number: true},
+		{Name: "bot", Value: "false"},
+		{Name: "note", Value: `"a b"`, Quoted: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unmarshalFields() = %+v, want %+v", got, want)
+	}
+	if _, err = unmarshalFields([]byte("[]\n"), orig); err == nil {
+		t.Error("unmarshalFields() of array error = nil")
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.ndjson")
+	s, err := newExecSink("tee '"+out+"'", 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.write(map[string]string{"namespace": "default"}, []logproto.Entry{
+		{Timestamp: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), Line: "elb=app/my-lb"},
+	})
+	want := `{"labels":{"namespace":"default"},"timestamp":"2024-03-01T00:00:00Z","line":"elb=app/my-lb"}` + "\n"
+	var got []byte
+	for range 50 {
+		if got, _ = os.ReadFile(out); len(got) > 0 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if string(got) != want {
+		t.Errorf("exec sink got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pushMetrics replaces metrics of job/instance group in Prometheus Pushgateway
+// with the current values, so they are not lost when the process exits
+// between scrapes
+func (s *Parser) pushMetrics(gateway, job, instance string) error {
+	var buf bytes.Buffer
+	s.writeMetrics(&buf)
+	u := fmt.Sprintf("%s/metrics/%s/%s", strings.TrimSuffix(gateway, "/"), groupingLabel("job", job), groupingLabel("instance", instance))
+	req, err := http.NewRequest(http.MethodPut, u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned HTTP status %s", u, resp.Status)
+	}
+	return nil
+}
+
+// groupingLabel returns URL path of Pushgateway grouping label, values with
+// `/` or empty are base64 encoded
+func groupingLabel(name, value string) string {
+	if value == "" {
+		return name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return name + "@base64/" + base64.URLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
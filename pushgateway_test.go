@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPushMetrics(t *testing.T) {
+	var method, path, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.EscapedPath(), string(b)
+	}))
+	defer srv.Close()
+
+	s := &Parser{queue: make(chan queueItem, 1)}
+	if err := s.pushMetrics(srv.URL+"/", "alb-logs-shipper", "pod/1"); err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPut || path != "/metrics/job/alb-logs-shipper/instance@base64/cG9kLzE=" {
+		t.Errorf("pushed with %s %s", method, path)
+	}
+	if !strings.Contains(body, "alb_logs_shipper_queue_length 0\n") || !strings.Contains(body, "# TYPE alb_logs_shipper_parser_mismatches_total counter\n") {
+		t.Errorf("pushed body %s", body)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteWriter pushes all metrics to Prometheus remote-write endpoint (like
+// Mimir) at the interval and on shutdown, for runs shorter than scrape interval
+type remoteWriter struct {
+	url    string
+	labels []prompb.Label // added to each series, like job and instance
+	auth   []authProvider
+	write  func(w io.Writer)
+	http   *http.Client
+	logger *slog.Logger
+}
+
+func newRemoteWriter(opts Options, write func(w io.Writer), logger *slog.Logger) (*remoteWriter, error) {
+	r := &remoteWriter{
+		url: opts.RemoteWriteURL,
+		labels: []prompb.Label{
+			{Name: "instance", Value: opts.ReplicaID},
+			{Name: "job", Value: "alb-logs-shipper"},
+		},
+		write:  write,
+		http:   &http.Client{Timeout: 10 * time.Second},
+		logger: logger,
+	}
+	for _, spec := range opts.RemoteWriteAuth {
+		a, err := newAuthProvider(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --remote-write-auth %q: %w", spec, err)
+		}
+		r.auth = append(r.auth, a)
+	}
+	return r, nil
+}
+
+// run pushes metrics at the interval until ctx is done
+func (r *remoteWriter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.push(); err != nil {
+				r.logger.Error("failed to remote-write metrics", "err", err)
+			}
+		}
+	}
+}
+
+// push sends current values of all metrics
+func (r *remoteWriter) push() error {
+	var buf bytes.Buffer
+	r.write(&buf)
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(&buf)
+	if err != nil {
+		return err
+	}
+	req := prompb.WriteRequest{Timeseries: r.series(families, time.Now().UnixMilli())}
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	body := snappy.Encode(nil, data)
+
+	hr, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hr.Header.Set("Content-Type", "application/x-protobuf")
+	hr.Header.Set("Content-Encoding", "snappy")
+	hr.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	for _, a := range r.auth {
+		if err = a.auth(hr, body); err != nil {
+			return err
+		}
+	}
+	resp, err := r.http.Do(hr)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned HTTP status %s: %s", r.url, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// series converts metric families to remote-write series. Histograms are
+// written as classic _bucket, _sum and _count series
+func (r *remoteWriter) series(families map[string]*dto.MetricFamily, ts int64) []prompb.TimeSeries {
+	var res []prompb.TimeSeries
+	add := func(name string, m *dto.Metric, value float64, extra ...prompb.Label) {
+		ls := append([]prompb.Label{{Name: "__name__", Value: name}}, r.labels...)
+		for _, l := range m.GetLabel() {
+			ls = append(ls, prompb.Label{Name: l.GetName(), Value: l.GetValue()})
+		}
+		ls = append(ls, extra...)
+		sort.Slice(ls, func(i, j int) bool { return ls[i].Name < ls[j].Name })
+		res = append(res, prompb.TimeSeries{Labels: ls, Samples: []prompb.Sample{{Value: value, Timestamp: ts}}})
+	}
+	for _, name := range sortedKeys(families) {
+		for _, m := range families[name].GetMetric() {
+			switch {
+			case m.Counter != nil:
+				add(name, m, m.Counter.GetValue())
+			case m.Gauge != nil:
+				add(name, m, m.Gauge.GetValue())
+			case m.Untyped != nil:
+				add(name, m, m.Untyped.GetValue())
+			case m.Histogram != nil:
+				h := m.Histogram
+				inf := false
+				for _, b := range h.GetBucket() {
+					inf = inf || math.IsInf(b.GetUpperBound(), 1)
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), prompb.Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+				}
+				if !inf {
+					add(name+"_bucket", m, float64(h.GetSampleCount()), prompb.Label{Name: "le", Value: "+Inf"})
+				}
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	var got prompb.WriteRequest
+	var tenant string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		if err == nil {
+			err = got.Unmarshal(data)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		tenant = r.Header.Get("X-Scope-OrgID")
+	}))
+	defer srv.Close()
+
+	write := func(w io.Writer) {
+		fmt.Fprint(w, "# TYPE files_total counter\nfiles_total{ingress=\"web\"} 3\n")
+		fmt.Fprint(w, "# TYPE size_bytes histogram\nsize_bytes_bucket{le=\"256\"} 1\nsize_bytes_bucket{le=\"+Inf\"} 2\nsize_bytes_sum 1000\nsize_bytes_count 2\n")
+	}
+	r, err := newRemoteWriter(Options{RemoteWriteURL: srv.URL, RemoteWriteAuth: []string{"header:X-Scope-OrgID=tenant"}, ReplicaID: "pod"}, write, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.push(); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "tenant" {
+		t.Errorf("X-Scope-OrgID = %q, want tenant", tenant)
+	}
+	want := []string{
+		`{__name__="files_total", ingress="web", instance="pod", job="alb-logs-shipper"} 3`,
+		`{__name__="size_bytes_bucket", instance="pod", job="alb-logs-shipper", le="256"} 1`,
+		`{__name__="size_bytes_bucket", instance="pod", job="alb-logs-shipper", le="+Inf"} 2`,
+		`{__name__="size_bytes_sum", instance="pod", job="alb-logs-shipper"} 1000`,
+		`{__name__="size_bytes_count", instance="pod", job="alb-logs-shipper"} 2`,
+	}
+	if len(got.Timeseries) != len(want) {
+		t.Fatalf("got %d series, want %d: %v", len(got.Timeseries), len(want), got.Timeseries)
+	}
+	for i, ts := range got.Timeseries {
+		s := "{"
+		for j, l := range ts.Labels {
+			if j > 0 {
+				s += ", "
+			}
+			s += fmt.Sprintf("%s=%q", l.Name, l.Value)
+		}
+		s += fmt.Sprintf("} %v", ts.Samples[0].Value)
+		if s != want[i] {
+			t.Errorf("series %d = %s, want %s", i, s, want[i])
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+	"github.com/spf13/pflag"
+)
+
+// runReplay formats fixture log files of --dir the same way as the shipper
+// does with the same flags, and compares the output to expected files next to
+// them byte-for-byte. With --update it writes the expected files instead.
+// Returns exit code
+func runReplay(args []string) int {
+	flags := pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	dir := flags.StringP("dir", "", "testdata/fixtures", "Directory with fixture *.gz log files, under their S3 keys or file names")
+	update := flags.BoolP("update", "", false, "Write expected output files instead of comparing to them")
+	// bucket and Loki are not used, but required by the shipper options
+	opts, err := parseOptions(flags, append([]string{"--bucket-name=fixtures", "--loki-url=http://localhost"}, args...))
+	if err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s, err := newReplayParser(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var fixtures []string
+	err = filepath.WalkDir(*dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.HasSuffix(path, ".gz") {
+			fixtures = append(fixtures, path)
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(fixtures) == 0 {
+		fmt.Fprintf(os.Stderr, "no *.gz fixtures in %s\n", *dir)
+		return 1
+	}
+
+	code := 0
+	for _, fn := range fixtures {
+		expected := fn + "." + opts.Format
+		got, err := s.replay(fn)
+		if err == nil && *update {
+			err = os.WriteFile(expected, got, 0o644)
+		}
+		if err == nil && !*update {
+			err = compareReplay(expected, got)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", fn, err)
+			code = 1
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "OK   %s\n", fn)
+	}
+	return code
+}
+
+// newReplayParser returns Parser with only line parsers of the options
+func newReplayParser(opts Options) (*Parser, error) {
+	transformers, err := newTransformers(opts.Transforms)
+	if err != nil {
+		return nil, err
+	}
+	fo := fieldOptions(opts, transformers).Compile()
+	s := &Parser{
+		opts: opts,
+		line: &LineSlice{fo},
+		nlb:  &LineNLB{fo},
+		conn: &LineConn{fo},
+		cf:   &LineCloudFront{fo},
+		waf:  &LineWAF{fo},
+		fo:   fo,
+	}
+	if opts.Parser == "strict" {
+		s.line = &LineStrict{fo}
+	}
+	if s.flow, err = newLineFlow(fo, flowDefaultHeader); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay returns formatted entries of the fixture, one per line as timestamp,
+// line and structured metadata separated by tabs
+func (s *Parser) replay(fn string) ([]byte, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var out bytes.Buffer
+	lines := s.newLineReader(fixtureKind(filepath.ToSlash(fn)))
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		matches, entry, err := lines.read(scanner.Text(), lineAs)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lines.n, err)
+		}
+		if matches != nil {
+			writeReplayEntry(&out, entry)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// lineAs formats the line by its parser, without arena of batches
+func lineAs(p LineParser, format, line string, matches []string) (logproto.Entry, error) {
+	return p.LineAs(format, line, matches)
+}
+
+// fixtureKind returns kind of log file by its path, like the shipper does by
+// S3 key, or kindUnknown to detect it by the first line
+func fixtureKind(fn string) string {
+	switch {
+	case connFnRegex.MatchString(fn):
+		return kindConnection
+	case flowFnRegex.MatchString(fn):
+		return kindFlow
+	case wafFnRegex.MatchString(fn):
+		return kindWAF
+	case cfFnRegex.MatchString(fn):
+		return kindCloudFront
+	}
+	if m := fnRegex.FindStringSubmatch(fn); m != nil {
+		if m[fnRegex.SubexpIndex("type")] == "net" {
+			return kindNLB
+		}
+		return kindAccess
+	}
+	return kindUnknown
+}
+
+func writeReplayEntry(w *bytes.Buffer, entry logproto.Entry) {
+	w.WriteString(entry.Timestamp.UTC().Format("2006-01-02T15:04:05.000000000Z"))
+	w.WriteByte('\t')
+	w.WriteString(entry.Line)
+	for i, m := range entry.StructuredMetadata {
+		if i == 0 {
+			w.WriteByte('\t')
+		} else {
+			w.WriteByte(' ')
+		}
+		w.WriteString(m.Name + "=" + strconv.Quote(m.Value))
+	}
+	w.WriteByte('\n')
+}
+
+// compareReplay returns error with the first differing line of the output
+func compareReplay(expected string, got []byte) error {
+	want, err := os.ReadFile(expected)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	gotLines, wantLines := bytes.SplitAfter(got, []byte("\n")), bytes.SplitAfter(want, []byte("\n"))
+	for i := 0; ; i++ {
+		var g, w []byte
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if !bytes.Equal(g, w) {
+			return fmt.Errorf("output differs from %s at line %d:\n got: %q\nwant: %q", expected, i+1, g, w)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunReplay(t *testing.T) {
+	dir := t.TempDir()
+	fixtures := map[string]string{
+		"alb.log.gz": `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-" TID_1234abcd5678ef90`,
+		"nlb.log.gz": `tls 2.0 2018-12-20T02:59:40 net/my-network-loadbalancer/c6e77e28c25b2234 g3d4b5e8bb8464cd 72.21.218.154:51341 172.100.100.185:443 5 2 98 246 - arn:aws:acm:us-east-2:671290407336:certificate/2a108f19-aded-46b0-8493-c63eb1ef4a99 - ECDHE-RSA-AES128-SHA tlsv12 - my-network-loadbalancer-c6e77e28c25b2234.elb.us-east-2.amazonaws.com - - - 2018-12-20T02:59:30`,
+	}
+	for name, line := range fixtures {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write([]byte(line + "\n"))
+		gz.Close()
+		if err := os.WriteFile(filepath.Join(dir, name), b.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{"--dir", dir, "-o", "logfmt", "--metadata", "trace_id=trace"}
+	if code := runReplay(append(args, "--update")); code != 0 {
+		t.Fatalf("runReplay(--update) = %d", code)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "alb.log.gz.logfmt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2018-07-02T22:23:00.186641000Z\ttype=http "; !strings.HasPrefix(string(got), want) {
+		t.Errorf("expected output = %s, want prefix %s", got, want)
+	}
+	if want := "\ttrace=\"Root=1-58337262-36d228ad5d99923122bbe354\"\n"; !strings.HasSuffix(string(got), want) {
+		t.Errorf("expected output = %s, want suffix %s", got, want)
+	}
+	if code := runReplay(args); code != 0 {
+		t.Errorf("runReplay() = %d, want 0", code)
+	}
+
+	// output of other transforms differs
+	if code := runReplay(append(args, "--transform", "drop:user_agent")); code != 1 {
+		t.Errorf("runReplay() of other transforms = %d, want 1", code)
+	}
+	if code := runReplay([]string{"--dir", dir, "-o", "json"}); code != 1 {
+		t.Errorf("runReplay() without expected files = %d, want 1", code)
+	}
+}
+
+func TestFixtureKind(t *testing.T) {
+	tests := map[string]string{
+		"AWSLogs/123456789012/elasticloadbalancing/us-east-2/2022/05/01/123456789012_elasticloadbalancing_us-east-2_app.my-loadbalancer.1234567890abcdef_20220215T2340Z_172.160.001.192_20jd1d7n.log.gz":          kindAccess,
+		"AWSLogs/123456789012/elasticloadbalancing/us-east-2/2022/05/01/123456789012_elasticloadbalancing_us-east-2_net.my-loadbalancer.1234567890abcdef_20220215T2340Z_172.160.001.192_20jd1d7n.log.gz":          kindNLB,
+		"AWSLogs/123456789012/elasticloadbalancing/us-east-2/2022/05/01/conn_log.123456789012_elasticloadbalancing_us-east-2_app.my-loadbalancer.1234567890abcdef_20220215T2340Z_172.160.001.192_20jd1d7n.log.gz": kindConnection,
+		"cdn/E2K2LNL5N3WR51.2024-05-01-10.a1b2c3d4.gz": kindCloudFront,
+		"alb.log.gz": kindUnknown,
+	}
+	for fn, want := range tests {
+		if got := fixtureKind(fn); got != want {
+			t.Errorf("fixtureKind(%s) = %s, want %s", fn, got, want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRetryDelay caps exponential delay between attempts of a file
+const maxRetryDelay = time.Hour
+
+var retriesTotal = newCounter("alb_logs_shipper_retries_total", "Failed attempts to ship files, which are retried later")
+
+// retryState is a failed file waiting for the next attempt
+type retryState struct {
+	attempts    int
+	next        time.Time
+	quarantined bool
+}
+
+// retryQueue keeps failed S3 keys with their attempt counts. Failed files stay
+// in the bucket, so they are listed again by the next scans, and retryQueue
+// decides whether the delay has passed
+type retryQueue struct {
+	delay       time.Duration
+	maxAttempts int
+	mu          sync.Mutex
+	keys        map[string]*retryState
+}
+
+func newRetryQueue(delay time.Duration, maxAttempts int) *retryQueue {
+	q := &retryQueue{
+		delay:       delay,
+		maxAttempts: maxAttempts,
+		keys:        make(map[string]*retryState),
+	}
+	newGaugeFunc("alb_logs_shipper_quarantined_files", "Files which failed to ship after --max-attempts, and are skipped until restart", func() float64 {
+		return float64(q.quarantined())
+	})
+	return q
+}
+
+// ready returns false if the key is quarantined or waiting for retry delay
+func (q *retryQueue) ready(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st, ok := q.keys[key]
+	return !ok || !st.quarantined && time.Now().After(st.next)
+}
+
+// fail records failed attempt, returns number of attempts and whether the key
+// is quarantined
+func (q *retryQueue) fail(key string) (int, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st, ok := q.keys[key]
+	if !ok {
+		st = &retryState{}
+		q.keys[key] = st
+	}
+	st.attempts++
+	if st.attempts >= q.maxAttempts {
+		st.quarantined = true
+		return st.attempts, true
+	}
+	retriesTotal.Inc()
+	st.next = time.Now().Add(min(q.delay<<min(st.attempts-1, 16), maxRetryDelay))
+	return st.attempts, false
+}
+
+// done forgets the key after it is shipped
+func (q *retryQueue) done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.keys, key)
+}
+
+func (q *retryQueue) quarantined() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, st := range q.keys {
+		if st.quarantined {
+			n++
+		}
+	}
+	return n
+}
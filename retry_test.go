@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryQueue(t *testing.T) {
+	q := newRetryQueue(time.Minute, 3)
+	key := "AWSLogs/123/elasticloadbalancing/eu-central-1/2025/05/30/file.log.gz"
+	if !q.ready(key) {
+		t.Fatal("new key should be ready")
+	}
+	for i := 1; i <= 3; i++ {
+		attempts, quarantined := q.fail(key)
+		if attempts != i || quarantined != (i == 3) {
+			t.Fatalf("fail() = %d, %v on attempt %d", attempts, quarantined, i)
+		}
+		if q.ready(key) {
+			t.Fatalf("key should not be ready after attempt %d", i)
+		}
+	}
+	if got := q.quarantined(); got != 1 {
+		t.Errorf("quarantined() = %d, want 1", got)
+	}
+
+	q.keys[key].next = time.Now().Add(-time.Second)
+	if q.ready(key) {
+		t.Error("quarantined key should not be ready")
+	}
+	q.done(key)
+	if !q.ready(key) || q.quarantined() != 0 {
+		t.Error("key should be ready after done()")
+	}
+}
+
+func TestNewGaugeFunc_sameName(t *testing.T) {
+	newRetryQueue(time.Minute, 3)
+	q := newRetryQueue(time.Minute, 1)
+	q.fail("file.log.gz")
+	var exposed bytes.Buffer
+	for _, m := range registry {
+		m.write(&exposed)
+	}
+	if n := strings.Count(exposed.String(), "# TYPE alb_logs_shipper_quarantined_files "); n != 1 {
+		t.Errorf("quarantined files gauge registered %d times, want 1", n)
+	}
+	if !strings.Contains(exposed.String(), "\nalb_logs_shipper_quarantined_files 1\n") {
+		t.Error("gauge should report the last retry queue")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rotator dials Loki host round-robin across its addresses, so keep-alive
+// connections don't pin all pushes to a single gateway pod behind a headless
+// service. Addresses are --loki-address list, or A records of the hostname
+// re-resolved each --loki-resolve-interval
+type rotator struct {
+	host     string // of --loki-url
+	port     string
+	static   bool
+	interval time.Duration
+	dialer   net.Dialer
+	resolver *net.Resolver
+
+	mu       sync.Mutex
+	addrs    []string
+	next     int
+	resolved time.Time
+}
+
+func newRotator(lokiURL string, addrs []string, interval time.Duration) (*rotator, error) {
+	u, err := url.Parse(lokiURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	r := &rotator{host: u.Hostname(), port: port, interval: interval, resolver: net.DefaultResolver}
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			a = net.JoinHostPort(a, port)
+		}
+		r.addrs = append(r.addrs, a)
+	}
+	r.static = len(r.addrs) > 0
+	return r, nil
+}
+
+// refresh re-resolves the hostname when interval has passed, and returns true
+// when idle connections should be closed to spread the load again
+func (r *rotator) refresh(ctx context.Context) bool {
+	if r.interval <= 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.resolved) < r.interval {
+		return false
+	}
+	r.resolved = time.Now()
+	if !r.static {
+		ips, err := r.resolver.LookupHost(ctx, r.host)
+		if err != nil || len(ips) == 0 {
+			return false // keep the previous addresses
+		}
+		slices.Sort(ips)
+		addrs := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, r.port))
+		}
+		r.addrs = addrs
+	}
+	return true
+}
+
+// pick returns the next address to dial
+func (r *rotator) pick() (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) == 0 {
+		return "", false
+	}
+	addr := r.addrs[r.next%len(r.addrs)]
+	r.next++
+	return addr, true
+}
+
+// dial is http.Transport DialContext, other hosts are dialed as is
+func (r *rotator) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host != r.host {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	target, ok := r.pick()
+	if !ok {
+		return r.dialer.DialContext(ctx, network, addr)
+	}
+	conn, err := r.dialer.DialContext(ctx, network, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s at %s: %w", addr, target, err)
+	}
+	return conn, nil
+}
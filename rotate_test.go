@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRotator(t *testing.T) {
+	r, err := newRotator("https://loki.example.com/loki/api/v1/push", []string{"10.0.0.1", "10.0.0.2:3100"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for range 3 {
+		addr, _ := r.pick()
+		got = append(got, addr)
+	}
+	want := []string{"10.0.0.1:443", "10.0.0.2:3100", "10.0.0.1:443"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pick() = %v, want %v", got, want)
+			break
+		}
+	}
+	if !r.refresh(context.Background()) {
+		t.Errorf("first refresh() = false, want true")
+	}
+	if r.refresh(context.Background()) {
+		t.Errorf("refresh() within interval = true, want false")
+	}
+
+	r, err = newRotator("http://localhost:3100", nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.pick(); ok {
+		t.Errorf("pick() before resolve returned address")
+	}
+	if !r.refresh(context.Background()) {
+		t.Fatalf("refresh() of localhost = false, want true")
+	}
+	if addr, ok := r.pick(); !ok || addr != "127.0.0.1:3100" && addr != "[::1]:3100" {
+		t.Errorf("pick() after resolve = %q", addr)
+	}
+}
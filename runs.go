@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxRunErrors limits errors kept in a run summary
+const maxRunErrors = 10
+
+// lbSummary is a per load balancer breakdown of a run
+type lbSummary struct {
+	Files  int   `json:"files"`
+	Lines  int   `json:"lines"`
+	Bytes  int64 `json:"bytes"`
+	Errors int   `json:"errors"`
+}
+
+// runError is a file which failed to ship in a run
+type runError struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// runSummary covers files enqueued by scans until the queue is drained
+type runSummary struct {
+	Start         time.Time             `json:"start"`
+	Duration      string                `json:"duration"`
+	Files         int                   `json:"files"`
+	Failed        int                   `json:"failed"`
+	Lines         int                   `json:"lines"`
+	Bytes         int64                 `json:"bytes"`
+	LoadBalancers map[string]*lbSummary `json:"load_balancers"`
+	Errors        []runError            `json:"errors"`
+}
+
+// runs tracks scan/drain cycles, and logs summary of each one
+type runs struct {
+	logger  *slog.Logger
+	mu      sync.Mutex
+	listing bool
+	pending int
+	cur     *runSummary
+	last    *runSummary
+}
+
+func newRuns(logger *slog.Logger) *runs {
+	return &runs{logger: logger}
+}
+
+// begin is called when scan starts listing
+func (r *runs) begin() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listing = true
+}
+
+// end is called when scan has enqueued all keys
+func (r *runs) end() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listing = false
+	r.finish()
+}
+
+// enqueued counts key added to the queue
+func (r *runs) enqueued() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == nil {
+		r.cur = &runSummary{Start: time.Now(), LoadBalancers: make(map[string]*lbSummary), Errors: []runError{}}
+	}
+	r.pending++
+}
+
+// done counts key processed by a worker
+func (r *runs) done() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending--
+	r.finish()
+}
+
+func (r *runs) lb(name string) *lbSummary {
+	st, ok := r.cur.LoadBalancers[name]
+	if !ok {
+		st = &lbSummary{}
+		r.cur.LoadBalancers[name] = st
+	}
+	return st
+}
+
+// shipped records file shipped in the current run
+func (r *runs) shipped(lb string, sh *shipment) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == nil {
+		return
+	}
+	st := r.lb(lb)
+	st.Files++
+	st.Lines += sh.lines
+	st.Bytes += sh.size
+	r.cur.Files++
+	r.cur.Lines += sh.lines
+	r.cur.Bytes += sh.size
+}
+
+// failed records file failed to ship in the current run
+func (r *runs) failed(lb, key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cur == nil {
+		return
+	}
+	r.lb(lb).Errors++
+	r.cur.Failed++
+	if len(r.cur.Errors) < maxRunErrors {
+		r.cur.Errors = append(r.cur.Errors, runError{Key: key, Error: err.Error()})
+	}
+}
+
+// finish logs summary when the run is drained, should be called under lock
+func (r *runs) finish() {
+	if r.listing || r.pending > 0 || r.cur == nil {
+		return
+	}
+	d := time.Since(r.cur.Start)
+	r.cur.Duration = d.String()
+	r.logger.Info("run summary", "files", r.cur.Files, "failed", r.cur.Failed, "lines", r.cur.Lines, "bytes", r.cur.Bytes, "load-balancers", len(r.cur.LoadBalancers), "duration", d)
+	r.last, r.cur = r.cur, nil
+}
+
+// handler returns summary of the last finished run as JSON
+func (r *runs) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.last == nil {
+			http.Error(w, "no finished runs yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		_ = e.Encode(r.last)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestRuns(t *testing.T) {
+	r := newRuns(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	r.begin()
+	r.enqueued()
+	r.enqueued()
+	r.shipped("123/lb-a", &shipment{key: "a", lines: 10, size: 100})
+	r.done()
+	r.end()
+	if r.last != nil {
+		t.Fatalf("run finished with pending files")
+	}
+
+	r.begin()
+	r.enqueued()
+	r.end()
+	r.failed("123/lb-b", "b", errors.New("push failed"))
+	r.done()
+	r.done()
+	if r.last == nil {
+		t.Fatalf("run not finished after the queue is drained")
+	}
+	if r.last.Files != 1 || r.last.Failed != 1 || r.last.Lines != 10 || r.last.Bytes != 100 || len(r.last.LoadBalancers) != 2 || len(r.last.Errors) != 1 {
+		t.Errorf("run summary = %+v", r.last)
+	}
+	if r.cur != nil {
+		t.Errorf("new run started without enqueued files")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var (
+	s3Requests = newCounter("alb_logs_shipper_s3_requests_total", "S3 API requests by operation, including retries", "operation")
+	s3Cost     = newCounter("alb_logs_shipper_s3_request_cost_dollars_total", "Estimated cost of S3 API requests by operation, by --s3-put-price and --s3-get-price", "operation")
+)
+
+// s3Costs accounts S3 API requests and their estimated cost, as billed per
+// HTTP request. Prices are per 1000 requests
+type s3Costs struct {
+	putPrice float64 // PUT, COPY, POST, LIST
+	getPrice float64 // GET, HEAD and others, DELETE is free
+	mu       sync.Mutex
+	minutes  [60]float64 // cost by minute of the last hour
+	last     int64       // unix minute of the latest request
+}
+
+func newS3Costs(putPrice, getPrice float64) *s3Costs {
+	c := &s3Costs{putPrice: putPrice, getPrice: getPrice}
+	newGaugeFunc("alb_logs_shipper_s3_request_cost_dollars_per_hour", "Estimated cost of S3 API requests during the last hour", func() float64 {
+		return c.hourly(time.Now())
+	})
+	return c
+}
+
+// price returns price of a request of the S3 operation
+func (c *s3Costs) price(op string) float64 {
+	switch {
+	case strings.HasPrefix(op, "Delete"), strings.HasPrefix(op, "Abort"):
+		return 0
+	case strings.HasPrefix(op, "Put"), strings.HasPrefix(op, "Copy"), strings.HasPrefix(op, "List"),
+		strings.HasPrefix(op, "Create"), strings.HasPrefix(op, "Complete"), strings.HasPrefix(op, "Upload"):
+		return c.putPrice / 1000
+	}
+	return c.getPrice / 1000
+}
+
+// observe accounts a request of the S3 operation
+func (c *s3Costs) observe(op string, now time.Time) {
+	cost := c.price(op)
+	s3Requests.Inc(op)
+	s3Cost.Add(cost, op)
+	minute := now.Unix() / 60
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(minute)
+	if minute > c.last-60 {
+		c.minutes[minute%60] += cost
+	}
+}
+
+// hourly returns cost of requests during the last hour
+func (c *s3Costs) hourly(now time.Time) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(now.Unix() / 60)
+	sum := 0.0
+	for _, v := range c.minutes {
+		sum += v
+	}
+	return sum
+}
+
+// advance resets minutes passed since the latest request
+func (c *s3Costs) advance(minute int64) {
+	if minute <= c.last {
+		return
+	}
+	for m := max(c.last+1, minute-59); m <= minute; m++ {
+		c.minutes[m%60] = 0
+	}
+	c.last = minute
+}
+
+// apply adds middleware to S3 client options, which observes each HTTP
+// request of an operation, so retries are accounted as well
+func (c *s3Costs) apply(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("S3Costs", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			c.observe(awsmiddleware.GetOperationName(ctx), time.Now())
+			return next.HandleFinalize(ctx, in)
+		}), middleware.After)
+	})
+}
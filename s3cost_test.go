@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestS3Costs(t *testing.T) {
+	c := &s3Costs{putPrice: 0.005, getPrice: 0.0004}
+	now := time.Unix(1700000000, 0)
+	for range 1000 {
+		c.observe("ListObjectsV2", now)
+		c.observe("GetObject", now.Add(30*time.Minute))
+		c.observe("DeleteObject", now.Add(30*time.Minute))
+	}
+	tests := []struct {
+		at   time.Duration
+		want float64
+	}{
+		{30 * time.Minute, 0.0054},
+		{59 * time.Minute, 0.0054},
+		{61 * time.Minute, 0.0004}, // list requests are older than hour
+		{3 * time.Hour, 0},
+	}
+	for _, tt := range tests {
+		if got := c.hourly(now.Add(tt.at)); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("hourly() after %s = %v, want %v", tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestS3CostsMiddleware(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	c := &s3Costs{putPrice: 5, getPrice: 0.4}
+	client := s3.New(s3.Options{Region: "us-east-1", BaseEndpoint: aws.String(srv.URL), UsePathStyle: true, Credentials: aws.AnonymousCredentials{}}, c.apply)
+	if _, err := client.DeleteObject(context.Background(), &s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.HeadBucket(context.Background(), &s3.HeadBucketInput{Bucket: aws.String("bucket")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.hourly(time.Now()); math.Abs(got-0.0004) > 1e-9 {
+		t.Errorf("hourly() = %v, want cost of HeadBucket only", got)
+	}
+}
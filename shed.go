@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var shedLines = newCounter("alb_logs_shipper_shed_lines_total", "Access log lines dropped by --shed-rule while the queue is overloaded", "rule")
+
+// shedRule drops lines of the status classes from streams which label
+// matches the glob, except for the kept ratio
+type shedRule struct {
+	spec    string // for metrics
+	label   string
+	pattern string
+	classes []string
+	keep    float64
+}
+
+// newShedRule parses spec like `<label>=<glob>:<class>,...[:<keep-ratio>]`
+func newShedRule(spec string) (shedRule, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return shedRule{}, fmt.Errorf("should be <label>=<glob>:<class>,...[:<keep-ratio>]")
+	}
+	label, pattern, ok := strings.Cut(parts[0], "=")
+	if !ok || label == "" {
+		return shedRule{}, fmt.Errorf("invalid label selector %q", parts[0])
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return shedRule{}, fmt.Errorf("invalid glob %q: %w", pattern, err)
+	}
+	r := shedRule{spec: spec, label: label, pattern: pattern, classes: strings.Split(parts[1], ",")}
+	for _, c := range r.classes {
+		if statusClass(strings.ReplaceAll(c, "x", "0")) != c {
+			return shedRule{}, fmt.Errorf("invalid status class %q", c)
+		}
+	}
+	if len(parts) == 3 {
+		keep, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || keep < 0 || keep >= 1 {
+			return shedRule{}, fmt.Errorf("invalid keep ratio %q", parts[2])
+		}
+		r.keep = keep
+	}
+	return r, nil
+}
+
+// shedder drops low-priority access log lines by --shed-rule while the queue
+// is longer than --shed-queue for --shed-after, so files are shipped faster
+// and error logs stay fresh under sustained overload
+type shedder struct {
+	queue int
+	after time.Duration
+	rules []shedRule
+	mu    sync.Mutex
+	above time.Time // since when the queue is over the threshold, zero when it is not
+}
+
+func newShedder(queue int, after time.Duration, specs []string) (*shedder, error) {
+	rules, err := newShedRules(specs)
+	if err != nil {
+		return nil, err
+	}
+	s := &shedder{queue: queue, after: after, rules: rules}
+	newGaugeFunc("alb_logs_shipper_shedding", "Whether lines are dropped by --shed-rule, as the queue is over --shed-queue for --shed-after", func() float64 {
+		if s.active(time.Now()) {
+			return 1
+		}
+		return 0
+	})
+	return s, nil
+}
+
+func newShedRules(specs []string) ([]shedRule, error) {
+	var res []shedRule
+	for _, spec := range specs {
+		r, err := newShedRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --shed-rule %q: %w", spec, err)
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// setRules replaces rules on reload of --config
+func (s *shedder) setRules(rules []shedRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = rules
+}
+
+// update records length of the queue
+func (s *shedder) update(queued int, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case queued <= s.queue:
+		s.above = time.Time{}
+	case s.above.IsZero():
+		s.above = now
+	}
+}
+
+// active returns true when the queue is over the threshold for long enough
+func (s *shedder) active(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.above.IsZero() && now.Sub(s.above) >= s.after
+}
+
+// match returns rules of the stream labels while shedding, nil otherwise
+func (s *shedder) match(labels map[string]string, now time.Time) []shedRule {
+	if !s.active(now) {
+		return nil
+	}
+	s.mu.Lock()
+	rules := s.rules
+	s.mu.Unlock()
+	var res []shedRule
+	for _, r := range rules {
+		if ok, _ := path.Match(r.pattern, labels[r.label]); ok {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// shed returns the first rule which drops the line of the status code
+func shed(rules []shedRule, status string) (string, bool) {
+	class := statusClass(status)
+	for _, r := range rules {
+		if slices.Contains(r.classes, class) && (r.keep == 0 || rand.Float64() >= r.keep) {
+			return r.spec, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewShedRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    shedRule
+		wantErr bool
+	}{
+		{spec: "namespace=staging-*:2xx", want: shedRule{spec: "namespace=staging-*:2xx", label: "namespace", pattern: "staging-*", classes: []string{"2xx"}}},
+		{spec: "ingress=web:2xx,3xx:0.1", want: shedRule{spec: "ingress=web:2xx,3xx:0.1", label: "ingress", pattern: "web", classes: []string{"2xx", "3xx"}, keep: 0.1}},
+		{spec: "namespace=staging", wantErr: true},
+		{spec: "=staging:2xx", wantErr: true},
+		{spec: "namespace=[:2xx", wantErr: true},
+		{spec: "namespace=staging:200", wantErr: true},
+		{spec: "namespace=staging:2xx:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := newShedRule(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newShedRule(%q) error = %v, wantErr %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (got.label != tt.want.label || got.pattern != tt.want.pattern || got.keep != tt.want.keep || len(got.classes) != len(tt.want.classes) || got.spec != tt.want.spec) {
+			t.Errorf("newShedRule(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestShedder(t *testing.T) {
+	s, err := newShedder(100, 5*time.Minute, []string{"namespace=staging-*:2xx,3xx", "ingress=web:2xx:0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staging := map[string]string{"namespace": "staging-shop", "ingress": "api"}
+	start := time.Now()
+	s.update(200, start)
+	if s.match(staging, start.Add(time.Minute)) != nil {
+		t.Fatal("shedding should wait for --shed-after")
+	}
+	s.update(200, start.Add(4*time.Minute))
+	rules := s.match(staging, start.Add(5*time.Minute))
+	if len(rules) != 1 {
+		t.Fatalf("match() = %+v, want staging rule", rules)
+	}
+	if _, ok := shed(rules, "200"); !ok {
+		t.Error("2xx line of staging should be dropped")
+	}
+	if _, ok := shed(rules, "502"); ok {
+		t.Error("5xx line should be kept")
+	}
+	if rules := s.match(map[string]string{"namespace": "prod", "ingress": "api"}, start.Add(5*time.Minute)); len(rules) != 0 {
+		t.Errorf("match() of prod = %+v, want none", rules)
+	}
+
+	dropped := 0
+	web := s.match(map[string]string{"namespace": "prod", "ingress": "web"}, start.Add(5*time.Minute))
+	for range 1000 {
+		if _, ok := shed(web, "200"); ok {
+			dropped++
+		}
+	}
+	if dropped < 400 || dropped > 600 {
+		t.Errorf("dropped %d of 1000 lines with keep ratio 0.5", dropped)
+	}
+
+	s.update(50, start.Add(6*time.Minute))
+	if s.active(start.Add(6 * time.Minute)) {
+		t.Error("shedding should stop when the queue is below threshold")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+)
+
+var (
+	receivedIdx = slices.Index(subexpNames, "received_bytes")
+	sentIdx     = slices.Index(subexpNames, "sent_bytes")
+
+	// 256B to 64MiB
+	sizeBuckets  = exponentialBuckets(256, 4, 10)
+	sizeReceived = newHistogram("alb_logs_shipper_request_size_bytes", "Size of requests (received_bytes) per ingress", sizeBuckets, volumeLabels...)
+	sizeSent     = newHistogram("alb_logs_shipper_response_size_bytes", "Size of responses (sent_bytes) per ingress", sizeBuckets, volumeLabels...)
+)
+
+// sizeStats accumulates request and response sizes of a file, to update
+// metrics once per file
+type sizeStats struct {
+	received []float64
+	sent     []float64
+}
+
+// observe adds sizes of the line. Size is `-` for requests which were not
+// completed, and is skipped
+func (st *sizeStats) observe(matches []string) {
+	if v, err := strconv.ParseFloat(matches[receivedIdx], 64); err == nil {
+		st.received = append(st.received, v)
+	}
+	if v, err := strconv.ParseFloat(matches[sentIdx], 64); err == nil {
+		st.sent = append(st.sent, v)
+	}
+}
+
+// record updates metrics with stats of the stream labels
+func (st *sizeStats) record(labels map[string]string) {
+	values := make([]string, len(volumeLabels))
+	for i, l := range volumeLabels {
+		values[i] = labels[l]
+	}
+	for _, v := range st.received {
+		sizeReceived.Observe(v, values...)
+	}
+	for _, v := range st.sent {
+		sizeSent.Observe(v, values...)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSizeStats_observe(t *testing.T) {
+	line := func(received, sent string) []string {
+		m := make([]string, len(subexpNames))
+		m[receivedIdx], m[sentIdx] = received, sent
+		return m
+	}
+	var st sizeStats
+	st.observe(line("5", "257"))
+	st.observe(line("1024", "-"))
+	st.observe(line("-", "-"))
+
+	if want := []float64{5, 1024}; !slices.Equal(st.received, want) {
+		t.Errorf("got received %v, want %v", st.received, want)
+	}
+	if want := []float64{257}; !slices.Equal(st.sent, want) {
+		t.Errorf("got sent %v, want %v", st.sent, want)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+)
+
+var (
+	latencyIdx = []int{
+		slices.Index(subexpNames, "request_processing_time"),
+		slices.Index(subexpNames, "target_processing_time"),
+		slices.Index(subexpNames, "response_processing_time"),
+	}
+
+	sliRequests = newCounter("alb_logs_shipper_sli_requests_total", "Requests per ingress for availability SLI", volumeLabels...)
+	sliErrors   = newCounter("alb_logs_shipper_sli_errors_total", "Requests per ingress with 5xx ELB status code for availability SLI", volumeLabels...)
+	sliLatency  = newHistogram("alb_logs_shipper_sli_latency_seconds", "Total processing time of requests per ingress for latency SLI", exponentialBuckets(0.005, 2, 12), volumeLabels...)
+)
+
+// sliStats accumulates SLI of a file, to update metrics once per file
+type sliStats struct {
+	requests  int
+	errors    int
+	latencies []float64
+}
+
+// observe adds request of the line. Latency is unknown (-1) for requests
+// which ALB could not dispatch to a target, these are counted as requests only.
+// So are websocket connections, which processing times cover the connection
+func (st *sliStats) observe(matches []string) {
+	st.requests++
+	if statusClass(matches[statusIdx]) == "5xx" {
+		st.errors++
+	}
+	if protocol(matches[typeIdx]) == "websocket" {
+		return
+	}
+	total := 0.0
+	for _, i := range latencyIdx {
+		v, err := strconv.ParseFloat(matches[i], 64)
+		if err != nil || v < 0 {
+			return
+		}
+		total += v
+	}
+	st.latencies = append(st.latencies, total)
+}
+
+// record updates metrics with stats of the stream labels
+func (st *sliStats) record(labels map[string]string) {
+	values := make([]string, len(volumeLabels))
+	for i, l := range volumeLabels {
+		values[i] = labels[l]
+	}
+	sliRequests.Add(float64(st.requests), values...)
+	sliErrors.Add(float64(st.errors), values...)
+	for _, v := range st.latencies {
+		sliLatency.Observe(v, values...)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSliStats_observe(t *testing.T) {
+	line := func(status, reqTime, targetTime, respTime string) []string {
+		m := make([]string, len(subexpNames))
+		m[typeIdx] = "https"
+		m[statusIdx] = status
+		m[latencyIdx[0]], m[latencyIdx[1]], m[latencyIdx[2]] = reqTime, targetTime, respTime
+		return m
+	}
+	var st sliStats
+	st.observe(line("200", "0.001", "0.250", "0.001"))
+	st.observe(line("502", "0.001", "0.010", "0.000"))
+	st.observe(line("503", "-1", "-1", "-1"))
+	st.observe(line("-", "0.000", "0.000", "0.000"))
+	ws := line("101", "0.000", "35.120", "0.000")
+	ws[typeIdx] = "wss"
+	st.observe(ws)
+
+	if st.requests != 5 || st.errors != 2 {
+		t.Errorf("got %d requests and %d errors, want 5 and 2", st.requests, st.errors)
+	}
+	want := []float64{0.252, 0.011, 0}
+	if len(st.latencies) != len(want) {
+		t.Fatalf("got latencies %v, want %v", st.latencies, want)
+	}
+	for i, v := range want {
+		if d := st.latencies[i] - v; d > 1e-9 || d < -1e-9 {
+			t.Errorf("latency %d = %v, want %v", i, st.latencies[i], v)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// spoolSegment is an encoded push request written to disk
+type spoolSegment struct {
+	path     string
+	encoding string
+	orgID    string // X-Scope-OrgID of the batch
+	size     int64
+	key      string // S3 key of the file the batch belongs to
+}
+
+// spool keeps encoded batches on disk while Loki circuit breaker is open, so
+// workers keep consuming S3. Files with spooled batches are not deleted from
+// the bucket until all their batches are replayed, so spool is not persisted
+// across restarts: such files are shipped again
+type spool struct {
+	dir      string
+	max      int64
+	client   *lokiClient
+	logger   *slog.Logger
+	mu       sync.Mutex
+	seq      int
+	size     int64
+	segments []spoolSegment
+	held     map[string]*shipment // files waiting for replay of their segments
+}
+
+func newSpool(dir string, max int64, client *lokiClient, logger *slog.Logger) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*.batch"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range old {
+		if err = os.Remove(fn); err != nil {
+			return nil, err
+		}
+	}
+	s := &spool{dir: dir, max: max, client: client, logger: logger, held: make(map[string]*shipment)}
+	newGaugeFunc("alb_logs_shipper_spool_bytes", "Bytes of batches spooled to --spool-dir while Loki circuit breaker is open", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(s.size)
+	})
+	return s, nil
+}
+
+// add writes encoded batch of the S3 key to disk
+func (s *spool) add(key string, buf []byte, encoding, orgID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size+int64(len(buf)) > s.max {
+		return fmt.Errorf("spool is full (%d bytes)", s.size)
+	}
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%012d.%s.batch", s.seq, encoding))
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		return err
+	}
+	s.size += int64(len(buf))
+	s.segments = append(s.segments, spoolSegment{path: path, encoding: encoding, orgID: orgID, size: int64(len(buf)), key: key})
+	return nil
+}
+
+// hold keeps the shipped file until its spooled segments are replayed,
+// returns false when they are already replayed
+func (s *spool) hold(sh *shipment) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.ContainsFunc(s.segments, func(seg spoolSegment) bool { return seg.key == sh.key }) {
+		return false
+	}
+	s.held[sh.key] = sh
+	return true
+}
+
+// drop removes spooled segments of the file which failed to ship, as it is
+// shipped again from the start by the next attempt. Returns number of segments
+func (s *spool) drop(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	s.segments = slices.DeleteFunc(s.segments, func(seg spoolSegment) bool {
+		if seg.key != key {
+			return false
+		}
+		if err := os.Remove(seg.path); err != nil {
+			s.logger.Warn("failed to remove spooled batch", "path", seg.path, "err", err)
+		}
+		s.size -= seg.size
+		n++
+		return true
+	})
+	return n
+}
+
+// isHeld returns true when the file waits for replay, and should be skipped
+func (s *spool) isHeld(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.held[key]
+	return ok
+}
+
+// run replays segments in order while circuit is closed, and calls done for
+// held files which have no more segments
+func (s *spool) run(ctx context.Context, done func(*shipment)) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.replay(done)
+		}
+	}
+}
+
+func (s *spool) replay(done func(*shipment)) {
+	for !s.client.breaker.isOpen() {
+		s.mu.Lock()
+		if len(s.segments) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		seg := s.segments[0]
+		s.mu.Unlock()
+
+		buf, err := os.ReadFile(seg.path)
+		if err == nil {
+			err = s.client.send(buf, seg.encoding, seg.orgID)
+		}
+		if err != nil {
+			s.logger.Warn("failed to replay spooled batch", "key", seg.key, "err", err)
+			return
+		}
+		if err = os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			s.logger.Warn("failed to remove spooled batch", "path", seg.path, "err", err)
+		}
+
+		s.mu.Lock()
+		// could be dropped meanwhile, when its file has failed
+		if i := slices.IndexFunc(s.segments, func(o spoolSegment) bool { return o.path == seg.path }); i >= 0 {
+			s.segments = slices.Delete(s.segments, i, i+1)
+			s.size -= seg.size
+		}
+		sh, ok := s.held[seg.key]
+		complete := ok && !slices.ContainsFunc(s.segments, func(o spoolSegment) bool { return o.key == seg.key })
+		if complete {
+			delete(s.held, seg.key)
+		}
+		s.mu.Unlock()
+		if complete {
+			done(sh)
+		}
+	}
+}
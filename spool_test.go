@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(2, time.Minute)
+	if b.done(true) || b.isOpen() {
+		t.Errorf("breaker opened after the first failure")
+	}
+	if b.done(false); b.done(true) {
+		t.Errorf("breaker opened after success reset")
+	}
+	if !b.done(true) || !b.isOpen() {
+		t.Errorf("breaker not opened after consecutive failures")
+	}
+}
+
+func TestSpool(t *testing.T) {
+	var pushed [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushed = append(pushed, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	client, err := newLokiClient(Options{LokiURL: srv.URL, LokiBreakerAfter: 1, LokiBreakerCooldown: time.Minute}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "000000000001.snappy.batch"), []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSpool(dir, 10, client, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old, _ := filepath.Glob(filepath.Join(dir, "*")); len(old) != 0 {
+		t.Errorf("stale segments are not removed: %v", old)
+	}
+
+	if err = s.add("a", []byte("batch1"), "snappy", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.add("b", []byte("batch2"), "snappy", ""); err == nil {
+		t.Errorf("add() over max size succeeded")
+	}
+	if s.hold(&shipment{key: "b"}) {
+		t.Errorf("hold() of file without segments = true")
+	}
+	if !s.hold(&shipment{key: "a"}) || !s.isHeld("a") {
+		t.Fatalf("file with segments is not held")
+	}
+
+	client.breaker.done(true)
+	var done []string
+	s.replay(func(sh *shipment) { done = append(done, sh.key) })
+	if len(pushed) != 0 {
+		t.Errorf("replayed while circuit is open")
+	}
+
+	client.breaker.until = time.Time{}
+	s.replay(func(sh *shipment) { done = append(done, sh.key) })
+	if len(pushed) != 1 || string(pushed[0]) != "batch1" || len(done) != 1 || done[0] != "a" || s.isHeld("a") || s.size != 0 {
+		t.Errorf("replay() pushed %q, done %v", pushed, done)
+	}
+}
+
+func TestSpool_drop(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err := newSpool(t.TempDir(), 100, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "a"} {
+		if err = s.add(key, []byte("batch"), "snappy", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := s.drop("a"); n != 2 || len(s.segments) != 1 || s.size != 5 {
+		t.Errorf("drop() = %d, left %d segments of %d bytes", n, len(s.segments), s.size)
+	}
+	if left, _ := filepath.Glob(filepath.Join(s.dir, "*.batch")); len(left) != 1 {
+		t.Errorf("drop() left files %v", left)
+	}
+}
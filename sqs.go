@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+var sqsMessages = newCounter("alb_logs_shipper_sqs_messages_total", "Messages received from --sqs-queue-url, by result (deleted, retried, ignored)", "result")
+
+// s3Event is S3 event notification, sent to SQS directly or via SNS topic
+type s3Event struct {
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+	Message string `json:"Message"` // of SNS notification
+}
+
+// eventKeys returns keys of objects created in the bucket under the prefix
+// from S3 event notification. Keys in notifications are URL encoded
+func eventKeys(body, bucket, prefix string) ([]string, error) {
+	var ev s3Event
+	if err := json.Unmarshal([]byte(body), &ev); err != nil {
+		return nil, err
+	}
+	if ev.Message != "" && len(ev.Records) == 0 {
+		return eventKeys(ev.Message, bucket, prefix)
+	}
+	var keys []string
+	for _, r := range ev.Records {
+		if !strings.HasPrefix(r.EventName, "ObjectCreated:") || r.S3.Bucket.Name != bucket {
+			continue
+		}
+		key, err := url.QueryUnescape(r.S3.Object.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sqsConsumer enqueues keys of S3 event notifications instead of listing the
+// bucket. A message is deleted when all of its keys are processed, otherwise
+// it is received again after the queue visibility timeout
+type sqsConsumer struct {
+	client *sqs.Client
+	url    string
+	parser *Parser
+	logger *slog.Logger
+}
+
+func newSQSConsumer(client *sqs.Client, url string, parser *Parser, logger *slog.Logger) *sqsConsumer {
+	return &sqsConsumer{client: client, url: url, parser: parser, logger: logger}
+}
+
+// run receives messages until ctx is done
+func (c *sqsConsumer) run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		out, err := c.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            &c.url,
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		c.parser.runs.begin()
+		for _, m := range out.Messages {
+			if m.Body == nil || m.ReceiptHandle == nil {
+				continue
+			}
+			keys, err := eventKeys(*m.Body, c.parser.opts.BucketName, c.parser.opts.Prefix)
+			if err != nil {
+				c.logger.Warn("skipping invalid S3 event notification", "err", err)
+			}
+			keys = slices.DeleteFunc(keys, c.parser.ownKey)
+			if len(keys) == 0 {
+				// test events, other buckets, event types and own keys
+				sqsMessages.Inc("ignored")
+				c.delete(*m.ReceiptHandle)
+				continue
+			}
+			ack := c.ack(*m.ReceiptHandle, len(keys))
+			for _, key := range keys {
+				if !c.parser.enqueue(ctx, queueItem{key: key, enqueued: time.Now(), ack: ack}) {
+					c.parser.runs.end()
+					return nil
+				}
+			}
+		}
+		c.parser.runs.end()
+	}
+	return nil
+}
+
+// ack returns callback which deletes the message when all of its keys are
+// processed, or leaves it in the queue to be retried if any has failed
+func (c *sqsConsumer) ack(receipt string, keys int) func(bool) {
+	var pending atomic.Int32
+	var failed atomic.Bool
+	pending.Store(int32(keys))
+	return func(done bool) {
+		if !done {
+			failed.Store(true)
+		}
+		if pending.Add(-1) > 0 {
+			return
+		}
+		if failed.Load() {
+			sqsMessages.Inc("retried")
+			return
+		}
+		sqsMessages.Inc("deleted")
+		c.delete(receipt)
+	}
+}
+
+func (c *sqsConsumer) delete(receipt string) {
+	if _, err := c.client.DeleteMessage(context.Background(), &sqs.DeleteMessageInput{
+		QueueUrl:      &c.url,
+		ReceiptHandle: &receipt,
+	}); err != nil {
+		c.logger.Error("failed to delete SQS message", "err", err)
+	}
+}
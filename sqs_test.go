@@ -0,0 +1,57 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEventKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		prefix string
+		want   []string
+		err    bool
+	}{
+		{
+			name: "created",
+			body: `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"AWSLogs/123/elasticloadbalancing/us-east-1/2024/01/01/a+b%3D.log.gz"}}},{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"logs"},"object":{"key":"removed"}}}]}`,
+			want: []string{"AWSLogs/123/elasticloadbalancing/us-east-1/2024/01/01/a b=.log.gz"},
+		},
+		{
+			name: "sns",
+			body: `{"Type":"Notification","Message":"{\"Records\":[{\"eventName\":\"ObjectCreated:CompleteMultipartUpload\",\"s3\":{\"bucket\":{\"name\":\"logs\"},\"object\":{\"key\":\"a.log.gz\"}}}]}"}`,
+			want: []string{"a.log.gz"},
+		},
+		{
+			name:   "prefix",
+			body:   `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"alb/a.log.gz"}}},{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"cloudtrail/b.json.gz"}}}]}`,
+			prefix: "alb/",
+			want:   []string{"alb/a.log.gz"},
+		},
+		{
+			name: "other bucket",
+			body: `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"other"},"object":{"key":"a.log.gz"}}}]}`,
+		},
+		{
+			name: "test event",
+			body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"logs"}`,
+		},
+		{
+			name: "invalid",
+			body: `not json`,
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := eventKeys(tt.body, "logs", tt.prefix)
+			if (err != nil) != tt.err {
+				t.Fatalf("eventKeys() error = %v, want error %v", err, tt.err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("eventKeys() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
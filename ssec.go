@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var sseAlgorithm = "AES256"
+
+// sseCustomerKey is customer-provided key of --sse-c-key-file, to read objects
+// encrypted with SSE-C. Values are base64 encoded, as sent in headers
+type sseCustomerKey struct {
+	key string
+	md5 string
+}
+
+// newSSECustomerKey reads base64 encoded 256-bit key from the file, like
+// generated by `openssl rand -base64 32`
+func newSSECustomerKey(file string) (*sseCustomerKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --sse-c-key-file: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("--sse-c-key-file should have base64 encoded 256-bit key")
+	}
+	sum := md5.Sum(key)
+	return &sseCustomerKey{key: base64.StdEncoding.EncodeToString(key), md5: base64.StdEncoding.EncodeToString(sum[:])}, nil
+}
+
+// get sets the key to read the object
+func (k *sseCustomerKey) get(in *s3.GetObjectInput) {
+	if k == nil {
+		return
+	}
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = &sseAlgorithm, &k.key, &k.md5
+}
+
+// copy sets the key to read the source object, and to encrypt the copy with
+func (k *sseCustomerKey) copy(in *s3.CopyObjectInput) {
+	if k == nil {
+		return
+	}
+	in.CopySourceSSECustomerAlgorithm, in.CopySourceSSECustomerKey, in.CopySourceSSECustomerKeyMD5 = &sseAlgorithm, &k.key, &k.md5
+	in.SSECustomerAlgorithm, in.SSECustomerKey, in.SSECustomerKeyMD5 = &sseAlgorithm, &k.key, &k.md5
+}
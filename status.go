@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxStatusErrors limits recent errors kept for /debug/status
+const maxStatusErrors = 20
+
+// workerStatus is a file being processed by a worker, and its current stage
+type workerStatus struct {
+	Key          string    `json:"key,omitempty"`
+	Started      time.Time `json:"started,omitempty"`
+	Stage        string    `json:"stage,omitempty"` // start, tags, metadata, download, cpu_wait, parse, push, complete
+	StageStarted time.Time `json:"stage_started,omitempty"`
+}
+
+// statusError is a recent failure to ship a file
+type statusError struct {
+	Time  time.Time `json:"time"`
+	Key   string    `json:"key"`
+	Error string    `json:"error"`
+}
+
+// statusSnapshot is served at /debug/status for `top` command
+type statusSnapshot struct {
+	Time    time.Time      `json:"time"`
+	Queue   int            `json:"queue"`
+	Files   int64          `json:"files"`
+	Lines   int64          `json:"lines"`
+	Bytes   int64          `json:"bytes"`
+	Workers []workerStatus `json:"workers"`
+	Errors  []statusError  `json:"errors"`
+	// traces of the slowest files of the last hour, with --slow-files
+	SlowFiles []*fileTrace `json:"slow_files,omitempty"`
+}
+
+// status tracks live state of workers
+type status struct {
+	mu         sync.Mutex
+	files      int64
+	lines      int64
+	bytes      int64
+	workers    []workerStatus
+	errors     []statusError
+	stuckAfter time.Duration
+}
+
+func newStatus(workers int, stuckAfter time.Duration) *status {
+	s := &status{workers: make([]workerStatus, workers), stuckAfter: stuckAfter}
+	newGaugeFunc("alb_logs_shipper_stuck_workers", "Workers in the same stage of a file for longer than --stuck-after", func() float64 {
+		return float64(s.stuck(time.Now()))
+	})
+	return s
+}
+
+// start records the file taken by the worker
+func (s *status) start(worker int, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if worker < len(s.workers) {
+		now := time.Now()
+		s.workers[worker] = workerStatus{Key: key, Started: now, Stage: "start", StageStarted: now}
+	}
+}
+
+// stage records the stage of processing of the file by its worker
+func (s *status) stage(key, stage string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.workers {
+		if s.workers[i].Key == key {
+			s.workers[i].Stage, s.workers[i].StageStarted = stage, time.Now()
+			return
+		}
+	}
+}
+
+// stuck returns number of workers in the same stage for longer than stuckAfter
+func (s *status) stuck(now time.Time) int {
+	if s.stuckAfter <= 0 {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, wk := range s.workers {
+		if wk.Key != "" && now.Sub(wk.StageStarted) > s.stuckAfter {
+			n++
+		}
+	}
+	return n
+}
+
+// idle records the worker waits for the next file
+func (s *status) idle(worker int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if worker < len(s.workers) {
+		s.workers[worker] = workerStatus{}
+	}
+}
+
+func (s *status) shipped(sh *shipment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files++
+	s.lines += int64(sh.lines)
+	s.bytes += sh.size
+}
+
+func (s *status) failed(key string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, statusError{Time: time.Now(), Key: key, Error: err.Error()})
+	if len(s.errors) > maxStatusErrors {
+		s.errors = s.errors[len(s.errors)-maxStatusErrors:]
+	}
+}
+
+func (s *status) snapshot(queue int) statusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return statusSnapshot{
+		Time:    time.Now(),
+		Queue:   queue,
+		Files:   s.files,
+		Lines:   s.lines,
+		Bytes:   s.bytes,
+		Workers: append([]workerStatus(nil), s.workers...),
+		Errors:  append([]statusError{}, s.errors...),
+	}
+}
+
+// debugStatus returns handler with queue, workers, recent errors and traces
+// of the slowest files as JSON
+func (s *Parser) debugStatus() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap := s.status.snapshot(len(s.queue))
+		if s.slow != nil {
+			snap.SlowFiles = s.slow.list()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(snap)
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatus_stuck(t *testing.T) {
+	s := newStatus(3, time.Minute)
+	s.start(0, "a.log.gz")
+	s.start(1, "b.log.gz")
+	s.stage("b.log.gz", "push")
+	if got := s.workers[1].Stage; got != "push" {
+		t.Errorf("stage() = %s, want push", got)
+	}
+	if got := s.stuck(time.Now()); got != 0 {
+		t.Errorf("stuck() = %d, want 0", got)
+	}
+	s.stage("a.log.gz", "download")
+	s.workers[0].StageStarted = time.Now().Add(-2 * time.Minute)
+	if got := s.stuck(time.Now()); got != 1 {
+		t.Errorf("stuck() = %d, want 1", got)
+	}
+	s.idle(0)
+	if got := s.stuck(time.Now()); got != 0 {
+		t.Errorf("stuck() after idle = %d, want 0", got)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// shippedTag marks objects which are shipped to Loki, but retained for --delete-after
+	shippedTag = "alb-logs-shipper/shipped"
+	// claimTag marks objects being processed by a replica, value is `replica-id/time`
+	claimTag = "alb-logs-shipper/claim"
+	// claimSettle is time to wait for concurrent claims before checking who won
+	claimSettle = time.Second
+)
+
+var (
+	claimConflicts = newCounter("alb_logs_shipper_claim_conflicts_total", "Files skipped because they are claimed by another replica")
+	skippedTagged  = newCounter("alb_logs_shipper_skipped_tagged_total", "Files skipped because they have --skip-tag", "tag")
+)
+
+// retainedKeys remembers files shipped and retained for --delete-after with
+// their LastModified, so tags of such files are not fetched on each scan while
+// they are younger than the retention, as they are shipped after creation
+type retainedKeys struct {
+	after  time.Duration
+	mu     sync.Mutex
+	keys   map[string]time.Time
+	pruned time.Time
+}
+
+func newRetainedKeys(after time.Duration) *retainedKeys {
+	return &retainedKeys{after: after, keys: make(map[string]time.Time)}
+}
+
+// add records retained key of the listed object
+func (r *retainedKeys) add(key string, modified time.Time) {
+	if modified.IsZero() {
+		return
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.pruned) > time.Minute {
+		for k, ts := range r.keys {
+			if now.Sub(ts) >= r.after {
+				delete(r.keys, k)
+			}
+		}
+		r.pruned = now
+	}
+	r.keys[key] = modified
+}
+
+// retained returns true if the key is known to be shipped, and could not be
+// due for deletion yet by its LastModified
+func (r *retainedKeys) retained(key string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ts, ok := r.keys[key]
+	return ok && now.Sub(ts) < r.after
+}
+
+// getTags returns S3 object tags as a map
+func (s *Parser) getTags(ctx context.Context, key string) (map[string]string, error) {
+	out, err := s.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:              &s.opts.BucketName,
+		Key:                 &key,
+		ExpectedBucketOwner: &s.opts.BucketOwner,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, t := range out.TagSet {
+		if t.Key != nil && t.Value != nil {
+			tags[*t.Key] = *t.Value
+		}
+	}
+	return tags, nil
+}
+
+// putTags replaces S3 object tags with the map
+func (s *Parser) putTags(ctx context.Context, key string, tags map[string]string) error {
+	set := make([]types.Tag, 0, len(tags))
+	for _, k := range sortedKeys(tags) {
+		v := tags[k]
+		set = append(set, types.Tag{Key: &k, Value: &v})
+	}
+	_, err := s.s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:              &s.opts.BucketName,
+		Key:                 &key,
+		Tagging:             &types.Tagging{TagSet: set},
+		ExpectedBucketOwner: &s.opts.BucketOwner,
+	})
+	return err
+}
+
+// shippedAt returns time when the object was shipped, if it is tagged so
+func shippedAt(tags map[string]string) (time.Time, bool) {
+	v, ok := tags[shippedTag]
+	if !ok {
+		return time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ts, true
+}
+
+// claim tags the object as being processed by this replica. S3 has no
+// compare-and-swap for tags, so the claim is written, and then re-read after
+// claimSettle: the last writer wins, and all other replicas back off. This is
+// best-effort: a replica which writes its claim after another one has re-read
+// tags ships the file too, and tags changed by others between getTags and
+// putTags are overwritten. --claim-table has atomic claims instead
+func (s *Parser) claim(ctx context.Context, key string, tags map[string]string) (bool, error) {
+	if owner, ts, ok := claimedBy(tags); ok && owner != s.opts.ReplicaID && time.Since(ts) < s.opts.ClaimTTL {
+		claimConflicts.Inc()
+		return false, nil
+	}
+
+	value := s.opts.ReplicaID + "/" + time.Now().UTC().Format(time.RFC3339)
+	tags[claimTag] = value
+	if err := s.putTags(ctx, key, tags); err != nil {
+		return false, err
+	}
+	time.Sleep(claimSettle)
+	current, err := s.getTags(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if current[claimTag] != value {
+		claimConflicts.Inc()
+		return false, nil
+	}
+	return true, nil
+}
+
+// claimedBy returns replica and time of the claim, if the object is claimed
+func claimedBy(tags map[string]string) (string, time.Time, bool) {
+	v, ok := tags[claimTag]
+	if !ok {
+		return "", time.Time{}, false
+	}
+	i := strings.LastIndex(v, "/")
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	ts, err := time.Parse(time.RFC3339, v[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return v[:i], ts, true
+}
+
+// skipTag returns the first tag of --skip-tag the object has. Empty value
+// of skip tag matches any value
+func skipTag(tags, skip map[string]string) (string, bool) {
+	for _, k := range sortedKeys(skip) {
+		if v, ok := tags[k]; ok && (skip[k] == "" || skip[k] == v) {
+			return k, true
+		}
+	}
+	return "", false
+}
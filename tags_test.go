@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkipTag(t *testing.T) {
+	skip := map[string]string{"do-not-ship": "true", "legal-hold": ""}
+	tests := []struct {
+		tags map[string]string
+		want string
+	}{
+		{map[string]string{"do-not-ship": "true"}, "do-not-ship"},
+		{map[string]string{"do-not-ship": "false"}, ""},
+		{map[string]string{"legal-hold": "case-1"}, "legal-hold"},
+		{map[string]string{shippedTag: "2024-01-01T00:00:00Z"}, ""},
+	}
+	for _, tt := range tests {
+		got, ok := skipTag(tt.tags, skip)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("skipTag(%v) = %q, %v, want %q", tt.tags, got, ok, tt.want)
+		}
+	}
+}
+
+func TestRetainedKeys(t *testing.T) {
+	r := newRetainedKeys(72 * time.Hour)
+	now := time.Now()
+	r.add("new.log.gz", now.Add(-time.Hour))
+	r.add("old.log.gz", now.Add(-73*time.Hour))
+	r.add("sqs.log.gz", time.Time{})
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"new.log.gz", true},
+		{"old.log.gz", false},
+		{"sqs.log.gz", false},
+		{"unknown.log.gz", false},
+	}
+	for _, tt := range tests {
+		if got := r.retained(tt.key, now); got != tt.want {
+			t.Errorf("retained(%s) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+	if r.retained("new.log.gz", now.Add(72*time.Hour)) {
+		t.Error("retained() = true after retention by LastModified")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+const (
+	// threadChunk is the number of lines handed off to a parse thread at once
+	threadChunk = 512
+	// threadInflight is the number of chunks of a file parsed concurrently
+	threadInflight = 4
+)
+
+// threadJob is a chunk of lines of a file parsed by a parse thread. Jobs are
+// reused with their buffers, as entries are copied to batch on handoff
+type threadJob struct {
+	reader  *lineReader // of the file
+	lines   []string
+	matches [][]string // nil for lines which are not access log
+	entries []logproto.Entry
+	arena   lineArena // lines of entries are formatted to
+	err     error
+	done    chan struct{}
+}
+
+var threadJobs = sync.Pool{New: func() any { return &threadJob{done: make(chan struct{}, 1)} }}
+
+// startThreads runs --parse-threads goroutines locked to OS threads, which
+// only parse lines handed off by workers. This keeps hot parse loops off the
+// scheduler run queues shared with network bound workers
+func (s *Parser) startThreads(n int) {
+	s.threads = make(chan *threadJob, n)
+	for range n {
+		go func() {
+			runtime.LockOSThread()
+			for job := range s.threads {
+				s.parseChunk(job)
+				job.done <- struct{}{}
+			}
+		}()
+	}
+}
+
+// parseChunk parses lines of the job by line reader of the file, the same way
+// as lines read by workers, except for --tie-break applied by threadPipe
+func (s *Parser) parseChunk(job *threadJob) {
+	job.matches, job.entries, job.err = job.matches[:0], job.entries[:0], nil
+	for _, line := range job.lines {
+		matches, entry, err := job.reader.parse(line, job.arena.LineAs)
+		if err != nil {
+			job.err = err
+			return
+		}
+		job.matches = append(job.matches, matches)
+		job.entries = append(job.entries, entry)
+	}
+}
+
+// threadPipe hands off lines of a file to parse threads in chunks, and
+// returns parsed entries in order of lines
+type threadPipe struct {
+	s       *Parser
+	lines   *lineReader // of the file, with detected kind
+	chunk   *threadJob
+	pending []*threadJob
+	handle  func(matches []string, entry logproto.Entry) error
+}
+
+func (p *threadPipe) add(line string) error {
+	if p.chunk == nil {
+		p.chunk = threadJobs.Get().(*threadJob)
+		p.chunk.reader, p.chunk.lines = p.lines, p.chunk.lines[:0]
+	}
+	p.chunk.lines = append(p.chunk.lines, line)
+	if len(p.chunk.lines) < threadChunk {
+		return nil
+	}
+	p.s.threads <- p.chunk
+	p.pending = append(p.pending, p.chunk)
+	p.chunk = nil
+	if len(p.pending) < threadInflight {
+		return nil
+	}
+	return p.next()
+}
+
+// next waits for the oldest chunk and handles its entries. On error the rest
+// of chunks are drained, as the file is not read further
+func (p *threadPipe) next() (err error) {
+	job := p.pending[0]
+	p.pending = p.pending[1:]
+	<-job.done
+	defer func() {
+		putThreadJob(job)
+		if err != nil {
+			p.drain()
+		}
+	}()
+	if job.err != nil {
+		return job.err
+	}
+	for i, matches := range job.matches {
+		if matches == nil {
+			continue
+		}
+		entry := job.entries[i]
+		entry.Timestamp = p.lines.timestamp(entry.Timestamp)
+		if err = p.handle(matches, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drain waits for chunks still parsed by threads, and returns them and the
+// chunk being added to the pool without handling their entries
+func (p *threadPipe) drain() {
+	for _, job := range p.pending {
+		<-job.done
+		putThreadJob(job)
+	}
+	p.pending = nil
+	if p.chunk != nil {
+		putThreadJob(p.chunk)
+		p.chunk = nil
+	}
+}
+
+// putThreadJob returns the handled job to the pool, not keeping line reader
+// of its file
+func putThreadJob(job *threadJob) {
+	job.reader = nil
+	threadJobs.Put(job)
+}
+
+// flush handles all the lines added
+func (p *threadPipe) flush() error {
+	if p.chunk != nil {
+		p.s.threads <- p.chunk
+		p.pending = append(p.pending, p.chunk)
+		p.chunk = nil
+	}
+	for len(p.pending) > 0 {
+		if err := p.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// lokiTLSConfig returns TLS config of Loki client by --loki-ca-file,
+// --loki-cert-file, --loki-key-file and --loki-tls-insecure-skip-verify, or
+// nil when none is set. Client certificate is read on each handshake, so
+// rotated certificates are used for new connections without restart
+func lokiTLSConfig(opts Options) (*tls.Config, error) {
+	if opts.LokiCAFile == "" && opts.LokiCertFile == "" && !opts.LokiTLSSkipVerify {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: opts.LokiTLSSkipVerify}
+	if opts.LokiCAFile != "" {
+		pem, err := os.ReadFile(opts.LokiCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --loki-ca-file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in --loki-ca-file %s", opts.LokiCAFile)
+		}
+	}
+	if opts.LokiCertFile != "" {
+		// fail on start instead of on the first push
+		if _, err := tls.LoadX509KeyPair(opts.LokiCertFile, opts.LokiKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load --loki-cert-file: %w", err)
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(opts.LokiCertFile, opts.LokiKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load --loki-cert-file: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLokiTLS(t *testing.T) {
+	dir := t.TempDir()
+	// self-signed client certificate, trusted by the server
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "alb-logs-shipper"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := x509.ParseCertificate(der)
+	certFile, keyFile, caFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"), filepath.Join(dir, "ca.crt")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(client)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // handshake errors
+	srv.StartTLS()
+	defer srv.Close()
+	if err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name string
+		opts Options
+		ok   bool
+	}{
+		{"mtls", Options{LokiCAFile: caFile, LokiCertFile: certFile, LokiKeyFile: keyFile}, true},
+		{"skip verify", Options{LokiTLSSkipVerify: true, LokiCertFile: certFile, LokiKeyFile: keyFile}, true},
+		{"no client cert", Options{LokiCAFile: caFile}, false},
+		{"unknown ca", Options{LokiCertFile: certFile, LokiKeyFile: keyFile}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.LokiURL = srv.URL
+			c, err := newLokiClient(tt.opts, logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = c.req(nil, "snappy", "", ""); (err == nil) != tt.ok {
+				t.Errorf("req() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+
+	if _, err = newLokiClient(Options{LokiURL: srv.URL, LokiCAFile: keyFile}, logger); err == nil {
+		t.Error("newLokiClient() of --loki-ca-file without certificates error = nil")
+	}
+}
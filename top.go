@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// runTop polls /debug/status of a running shipper and redraws the terminal,
+// like top. Returns exit code
+func runTop(args []string) int {
+	fs := pflag.NewFlagSet("top", pflag.ContinueOnError)
+	url := fs.StringP("url", "", "http://localhost:8080", "URL of alb-logs-shipper --port, or --admin-port when set")
+	tokenFile := fs.StringP("token-file", "", "", "Path to file with --admin-token-file token")
+	interval := fs.DurationP("interval", "", 2*time.Second, "Interval to refresh")
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	var prev *statusSnapshot
+	for {
+		cur, err := fetchStatus(client, strings.TrimSuffix(*url, "/")+"/debug/status", token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Print("\033[H\033[2J") // clear screen
+		renderTop(os.Stdout, cur, prev)
+		prev = cur
+		time.Sleep(*interval)
+	}
+}
+
+func fetchStatus(client *http.Client, url, token string) (*statusSnapshot, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned HTTP status %s", url, resp.Status)
+	}
+	var st statusSnapshot
+	if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// renderTop writes status, rates are computed since the previous snapshot
+func renderTop(w io.Writer, cur, prev *statusSnapshot) {
+	var files, lines, bytes float64
+	if prev != nil {
+		if d := cur.Time.Sub(prev.Time).Seconds(); d > 0 {
+			files = float64(cur.Files-prev.Files) / d
+			lines = float64(cur.Lines-prev.Lines) / d
+			bytes = float64(cur.Bytes-prev.Bytes) / d
+		}
+	}
+	busy := 0
+	for _, wk := range cur.Workers {
+		if wk.Key != "" {
+			busy++
+		}
+	}
+	fmt.Fprintf(w, "alb-logs-shipper - %s\n", cur.Time.Format(time.TimeOnly))
+	fmt.Fprintf(w, "Queue: %d  Workers: %d/%d busy\n", cur.Queue, busy, len(cur.Workers))
+	fmt.Fprintf(w, "Shipped: %d files, %d lines, %d bytes\n", cur.Files, cur.Lines, cur.Bytes)
+	fmt.Fprintf(w, "Rate: %.1f files/s, %.0f lines/s, %.0f bytes/s\n\n", files, lines, bytes)
+
+	fmt.Fprintf(w, "%-4s %-8s %-8s %-8s %s\n", "WID", "TIME", "STAGE", "IN STAGE", "FILE")
+	for i, wk := range cur.Workers {
+		if wk.Key == "" {
+			fmt.Fprintf(w, "%-4d %-8s %-8s %-8s %s\n", i, "-", "-", "-", "idle")
+			continue
+		}
+		fmt.Fprintf(w, "%-4d %-8s %-8s %-8s %s\n", i, cur.Time.Sub(wk.Started).Truncate(time.Second), wk.Stage, cur.Time.Sub(wk.StageStarted).Truncate(time.Second), wk.Key)
+	}
+
+	if len(cur.Errors) > 0 {
+		fmt.Fprintf(w, "\nRecent errors:\n")
+		for i := len(cur.Errors) - 1; i >= 0; i-- {
+			e := cur.Errors[i]
+			fmt.Fprintf(w, "%s %s: %s\n", e.Time.Format(time.TimeOnly), e.Key, e.Error)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderTop(t *testing.T) {
+	now := time.Now()
+	prev := &statusSnapshot{Time: now.Add(-2 * time.Second), Files: 1, Lines: 100, Bytes: 1000}
+	cur := &statusSnapshot{
+		Time:    now,
+		Queue:   5,
+		Files:   3,
+		Lines:   300,
+		Bytes:   3000,
+		Workers: []workerStatus{{Key: "AWSLogs/a.log.gz", Started: now.Add(-3 * time.Second), Stage: "push", StageStarted: now.Add(-time.Second)}, {}},
+		Errors:  []statusError{{Time: now, Key: "AWSLogs/b.log.gz", Error: "push failed"}},
+	}
+	var b bytes.Buffer
+	renderTop(&b, cur, prev)
+	for _, want := range []string{"Queue: 5  Workers: 1/2 busy", "Rate: 1.0 files/s, 100 lines/s, 1000 bytes/s", "3s       push     1s       AWSLogs/a.log.gz", "idle", "AWSLogs/b.log.gz: push failed"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("renderTop() output does not contain %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// slowWindow is time range of files kept by slowFiles
+const slowWindow = time.Hour
+
+// pushAttempt is a single push request of a batch
+type pushAttempt struct {
+	Status  int     `json:"status"`
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+// batchTrace is a batch pushed to Loki, with retries
+type batchTrace struct {
+	ID       string        `json:"request_id"` // of the last encoding pushed
+	Lines    int           `json:"lines"`
+	Bytes    int           `json:"bytes"`
+	Seconds  float64       `json:"seconds"`
+	Attempts []pushAttempt `json:"attempts"`
+	// pushed with --push-pipeline, while the next batch was parsed
+	Pipelined bool `json:"pipelined,omitempty"`
+}
+
+// fileTrace is detailed timing of a file, kept for the slowest files
+type fileTrace struct {
+	Key     string             `json:"key"`
+	Started time.Time          `json:"started"`
+	Seconds float64            `json:"seconds"`
+	Stages  map[string]float64 `json:"stages_seconds"` // metadata, download, parse, push
+	Lines   int                `json:"lines"`
+	Error   string             `json:"error,omitempty"`
+	Batches []batchTrace       `json:"batches"`
+
+	stage time.Time  // start of the current stage
+	mu    sync.Mutex // of stages and batches pushed by --push-pipeline
+}
+
+// newFileTrace starts trace of the file. Methods of nil trace do nothing
+func newFileTrace(key string) *fileTrace {
+	now := time.Now()
+	return &fileTrace{Key: key, Started: now, Stages: map[string]float64{}, stage: now}
+}
+
+// done records time since the previous stage as the stage
+func (t *fileTrace) done(stage string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Stages[stage] += now.Sub(t.stage).Seconds()
+	t.stage = now
+}
+
+// batch records the pushed batch. Push time is excluded from parse stage
+func (t *fileTrace) batch(b batchTrace) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Batches = append(t.Batches, b)
+	t.Stages["push"] += b.Seconds
+	if !b.Pipelined {
+		t.Stages["parse"] -= b.Seconds
+	}
+}
+
+func (t *fileTrace) finish(lines int, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Seconds = time.Since(t.Started).Seconds()
+	t.Lines = lines
+	if err != nil {
+		t.Error = err.Error()
+	}
+}
+
+// slowFiles keeps traces of the slowest files of the last hour
+type slowFiles struct {
+	n      int
+	mu     sync.Mutex
+	traces []*fileTrace // sorted by duration, slowest first
+}
+
+func newSlowFiles(n int) *slowFiles {
+	return &slowFiles{n: n}
+}
+
+func (s *slowFiles) add(t *fileTrace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	i, _ := slices.BinarySearchFunc(s.traces, t, func(a, b *fileTrace) int {
+		if a.Seconds > b.Seconds {
+			return -1
+		}
+		return 1
+	})
+	if i >= s.n {
+		return
+	}
+	s.traces = slices.Insert(s.traces, i, t)
+	if len(s.traces) > s.n {
+		s.traces = s.traces[:s.n]
+	}
+}
+
+// list returns traces of the last hour, slowest first
+func (s *slowFiles) list() []*fileTrace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	return slices.Clone(s.traces)
+}
+
+func (s *slowFiles) expire() {
+	s.traces = slices.DeleteFunc(s.traces, func(t *fileTrace) bool {
+		return time.Since(t.Started) > slowWindow
+	})
+}
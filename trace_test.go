@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestSlowFiles(t *testing.T) {
+	s := newSlowFiles(2)
+	now := time.Now()
+	for _, tr := range []*fileTrace{
+		{Key: "a", Started: now, Seconds: 1},
+		{Key: "b", Started: now, Seconds: 3},
+		{Key: "old", Started: now.Add(-2 * time.Hour), Seconds: 10},
+		{Key: "c", Started: now, Seconds: 2},
+		{Key: "d", Started: now, Seconds: 0.5},
+	} {
+		s.add(tr)
+	}
+	got := s.list()
+	if len(got) != 2 || got[0].Key != "b" || got[1].Key != "c" {
+		t.Errorf("list() = %+v, want b, c", got)
+	}
+}
+
+func TestBatchTrace(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls++; calls == 1 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+	}))
+	defer srv.Close()
+	client, err := newLokiClient(Options{LokiURL: srv.URL}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newFileTrace("key")
+	b := newBatch(map[string]string{"ingress": "web"}, client)
+	b.trace = tr
+	b.add(logproto.Entry{Timestamp: time.Now(), Line: "line"})
+	if err = b.flush(); err != nil {
+		t.Fatal(err)
+	}
+	tr.done("parse")
+	tr.finish(1, nil)
+
+	if len(tr.Batches) != 1 || tr.Batches[0].Lines != 1 || tr.Batches[0].Bytes == 0 {
+		t.Fatalf("batches = %+v", tr.Batches)
+	}
+	if a := tr.Batches[0].Attempts; len(a) != 2 || a[0].Status != 429 || a[1].Status != 200 {
+		t.Errorf("attempts = %+v, want 429 and 200", a)
+	}
+	if tr.Stages["push"] <= 0 || tr.Stages["parse"] < 0 {
+		t.Errorf("stages = %v", tr.Stages)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"text/template"
+)
+
+// Field is a named value of a parsed line
+type Field struct {
+	Name   string
+	Value  string
+	Quoted bool // value is in quotes, with ALB escaping
+	Number bool // value is written to JSON as is
+	Object bool // value is JSON object, written to JSON as is and quoted in logfmt
+}
+
+// Transformer modifies fields of a parsed line before it is formatted
+type Transformer interface {
+	Transform(fields []Field) []Field
+}
+
+// redactedValue replaces values of redacted fields
+const redactedValue = "[redacted]"
+
+// newTransformers parses --transform specs to an ordered chain
+func newTransformers(specs []string) ([]Transformer, error) {
+	var res []Transformer
+	for _, spec := range specs {
+		t, err := newTransformer(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --transform %q: %w", spec, err)
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
+
+// redactedFields returns original names of fields which values are dropped
+// or redacted by --transform specs, following renames before them
+func redactedFields(specs []string) []string {
+	var res []string
+	renamed := map[string]string{} // to original name
+	original := func(name string) string {
+		if orig, ok := renamed[name]; ok {
+			return orig
+		}
+		return name
+	}
+	for _, spec := range specs {
+		kind, arg, _ := strings.Cut(spec, ":")
+		name, value, _ := strings.Cut(arg, "=")
+		switch kind {
+		case "rename":
+			renamed[value] = original(name)
+		case "drop", "redact", "mask-ip":
+			res = append(res, original(arg))
+		case "redact-regex", "redact-query", "keep-query", "hash-ip":
+			res = append(res, original(name))
+		}
+	}
+	return res
+}
+
+// newTransformer parses spec like `drop:user_agent`, `rename:elb=alb`,
+// `redact:client`, `derive:status_class={{slice .elb_status_code 0 1}}xx`,
+// `redact-regex:request=[^@/?&=]+@[^@/?&=]+`, `redact-query:request=token,email`,
+// `keep-query:request=page,utm_source`, `mask-ip:client`, `hash-ip:client=/path/to/key`
+// or `exec:/path/to/plugin --flag`
+func newTransformer(spec string) (Transformer, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "drop":
+		if arg == "" {
+			return nil, fmt.Errorf("should be drop:<field>")
+		}
+		return dropField(arg), nil
+	case "redact":
+		if arg == "" {
+			return nil, fmt.Errorf("should be redact:<field>")
+		}
+		return redactField(arg), nil
+	case "rename":
+		from, to, ok := strings.Cut(arg, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("should be rename:<field>=<name>")
+		}
+		return renameField{from, to}, nil
+	case "redact-regex":
+		name, expr, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || expr == "" {
+			return nil, fmt.Errorf("should be redact-regex:<field>=<regex>")
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		return redactRegex{name, re}, nil
+	case "redact-query":
+		name, params, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || params == "" {
+			return nil, fmt.Errorf("should be redact-query:<field>=<param>[,<param>...]")
+		}
+		// value of the params in query string, up to the next param, space or quote
+		re := regexp.MustCompile(`([?&](?:` + strings.Join(quoteMetas(strings.Split(params, ",")), "|") + `)=)[^&#\s"]*`)
+		return redactRegex{name, re}, nil
+	case "keep-query":
+		name, params, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("should be keep-query:<field>=[<param>,...]")
+		}
+		keep := map[string]bool{}
+		for _, p := range strings.Split(params, ",") {
+			if p != "" {
+				keep[p] = true
+			}
+		}
+		return keepQuery{name, keep}, nil
+	case "mask-ip":
+		if arg == "" {
+			return nil, fmt.Errorf("should be mask-ip:<field>")
+		}
+		return maskIP(arg), nil
+	case "hash-ip":
+		name, file, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || file == "" {
+			return nil, fmt.Errorf("should be hash-ip:<field>=<key-file>")
+		}
+		key, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return hashIP{name, []byte(strings.TrimSpace(string(key)))}, nil
+	case "derive":
+		name, text, ok := strings.Cut(arg, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("should be derive:<field>=<template>")
+		}
+		tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, err
+		}
+		return deriveField{name, tmpl}, nil
+	case "exec":
+		if strings.TrimSpace(arg) == "" {
+			return nil, fmt.Errorf("should be exec:<command>")
+		}
+		p, err := newExecProcess(arg, true)
+		if err != nil {
+			return nil, err
+		}
+		return execTransformer{p}, nil
+	}
+	return nil, fmt.Errorf("unknown transformer %s (drop, redact, redact-regex, redact-query, keep-query, mask-ip, hash-ip, rename, derive, exec)", kind)
+}
+
+// transformChain applies transformers, which are replaced on reload of --config
+type transformChain struct {
+	current atomic.Pointer[[]Transformer]
+}
+
+func newTransformChain(transformers []Transformer) *transformChain {
+	c := &transformChain{}
+	c.current.Store(&transformers)
+	return c
+}
+
+func (c *transformChain) Transform(fields []Field) []Field {
+	for _, t := range *c.current.Load() {
+		fields = t.Transform(fields)
+	}
+	return fields
+}
+
+// store replaces transformers, and returns the previous ones
+func (c *transformChain) store(transformers []Transformer) []Transformer {
+	if prev := c.current.Swap(&transformers); prev != nil {
+		return *prev
+	}
+	return nil
+}
+
+// closeTransformers stops processes of exec transformers
+func closeTransformers(transformers []Transformer) {
+	for _, t := range transformers {
+		if c, ok := t.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// dropField removes the field
+type dropField string
+
+func (t dropField) Transform(fields []Field) []Field {
+	return slices.DeleteFunc(fields, func(f Field) bool { return f.Name == string(t) })
+}
+
+// redactField replaces value of the field
+type redactField string
+
+func (t redactField) Transform(fields []Field) []Field {
+	for i := range fields {
+		if fields[i].Name == string(t) {
+			fields[i].Value = quote(redactedValue)
+			fields[i].Quoted, fields[i].Number, fields[i].Object = true, false, false
+		}
+	}
+	return fields
+}
+
+// redactRegex replaces matches of regex in the field value. When regex has
+// a capture group, it is kept, like param name of redact-query
+type redactRegex struct {
+	name string
+	re   *regexp.Regexp
+}
+
+func (t redactRegex) Transform(fields []Field) []Field {
+	repl := redactedValue
+	if t.re.NumSubexp() > 0 {
+		repl = "${1}" + redactedValue
+	}
+	for i := range fields {
+		if fields[i].Name == t.name {
+			setValue(&fields[i], t.re.ReplaceAllString(unquote(fields[i].Value), repl))
+		}
+	}
+	return fields
+}
+
+// queryRegex matches query string of URL, up to fragment, space or quote
+var queryRegex = regexp.MustCompile(`\?[^#\s"]*`)
+
+// keepQuery drops query string params of the field value which are not
+// in the allowlist. Query string without params left is removed
+type keepQuery struct {
+	name string
+	keep map[string]bool
+}
+
+func (t keepQuery) Transform(fields []Field) []Field {
+	for i := range fields {
+		if fields[i].Name == t.name {
+			setValue(&fields[i], queryRegex.ReplaceAllStringFunc(unquote(fields[i].Value), t.filter))
+		}
+	}
+	return fields
+}
+
+// filter returns `?query` with allowlisted params only
+func (t keepQuery) filter(query string) string {
+	var kept []string
+	for _, p := range strings.Split(query[1:], "&") {
+		name, _, _ := strings.Cut(p, "=")
+		if t.keep[name] {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	return "?" + strings.Join(kept, "&")
+}
+
+// maskIP zeroes the last octet of IPv4, or the last 64 bits of IPv6 address
+// of the field, port is kept
+type maskIP string
+
+func (t maskIP) Transform(fields []Field) []Field {
+	for i := range fields {
+		if fields[i].Name == string(t) {
+			setValue(&fields[i], maskAddr(unquote(fields[i].Value)))
+		}
+	}
+	return fields
+}
+
+// maskAddr masks `ip` or `ip:port` value, other values are returned as is
+func maskAddr(value string) string {
+	return mapAddr(value, func(ip netip.Addr) string { return maskPrefix(ip).String() })
+}
+
+// mapAddr replaces ip of `ip` or `ip:port` value with fn result, port and
+// brackets are kept. Other values are returned as is
+func mapAddr(value string, fn func(netip.Addr) string) string {
+	host, port := value, ""
+	if ip, err := netip.ParseAddr(value); err == nil {
+		return fn(ip)
+	}
+	if i := strings.LastIndexByte(value, ':'); i > 0 {
+		host, port = strings.Trim(value[:i], "[]"), value[i:]
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return value
+	}
+	if strings.HasPrefix(value, "[") {
+		return "[" + fn(ip) + "]" + port
+	}
+	return fn(ip) + port
+}
+
+func maskPrefix(ip netip.Addr) netip.Addr {
+	bits := 24
+	if ip.Is6() {
+		bits = 64
+	}
+	p, _ := ip.Prefix(bits)
+	return p.Addr()
+}
+
+// hashIP replaces ip address of the field with truncated hex HMAC-SHA256 of
+// it, which is stable for the key. Port is kept
+type hashIP struct {
+	name string
+	key  []byte
+}
+
+func (t hashIP) Transform(fields []Field) []Field {
+	for i := range fields {
+		if fields[i].Name == t.name {
+			setValue(&fields[i], mapAddr(unquote(fields[i].Value), t.hash))
+		}
+	}
+	return fields
+}
+
+func (t hashIP) hash(ip netip.Addr) string {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(ip.String()))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// setValue replaces field value, quoting it for quoted fields
+func setValue(f *Field, value string) {
+	if f.Quoted {
+		value = quote(value)
+	}
+	f.Value = value
+}
+
+func quoteMetas(values []string) []string {
+	res := make([]string, len(values))
+	for i, v := range values {
+		res[i] = regexp.QuoteMeta(v)
+	}
+	return res
+}
+
+// renameField changes name of the field
+type renameField struct {
+	from, to string
+}
+
+func (t renameField) Transform(fields []Field) []Field {
+	for i := range fields {
+		if fields[i].Name == t.from {
+			fields[i].Name = t.to
+		}
+	}
+	return fields
+}
+
+// deriveField adds field rendered from a template of unquoted field values,
+// empty result is not added
+type deriveField struct {
+	name string
+	tmpl *template.Template
+}
+
+func (t deriveField) Transform(fields []Field) []Field {
+	data := make(map[string]string, len(fields))
+	for _, f := range fields {
+		data[f.Name] = unquote(f.Value)
+	}
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, data); err != nil || b.Len() == 0 {
+		return fields
+	}
+	return append(fields, Field{Name: t.name, Value: quote(b.String()), Quoted: true})
+}
+
+// quote returns value in quotes with ALB escaping, to be decoded by writeUnescaped
+func quote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransformers(t *testing.T) {
+	in := `h2 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 10.0.1.252:48160 10.0.0.66:9000 0.000 0.002 0.000 200 200 5 257 "GET https://10.0.2.105:773/ HTTP/2.0" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337327-72bd00b0343d75b906739c42" "-" "-" 1 2018-07-02T22:22:48.364000Z "redirect" "https://example.com:80/" "-" "10.0.0.66:9000" "200" "-" "-" TID_1234abcd5678ef90`
+	transformers, err := newTransformers([]string{
+		"drop:user_agent",
+		"rename:elb=alb",
+		"redact:client",
+		"derive:status_class={{slice .elb_status_code 0 1}}xx",
+		"derive:empty={{.missing}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := &LineSlice{FieldOptions{Transformers: transformers}}
+	entry, err := ls.As("json", in)
+	if err != nil {
+		t.Fatalf("LineSlice.As() error = %v", err)
+	}
+	for _, want := range []string{`"alb":"app/my-loadbalancer/50dc6c495c0c9188"`, `"client":"[redacted]"`, `"status_class":"2xx"}`} {
+		if !strings.Contains(entry.Line, want) {
+			t.Errorf("LineSlice.As() = %s, does not contain %s", entry.Line, want)
+		}
+	}
+	for _, unwanted := range []string{"user_agent", `"elb"`, "10.0.1.252", "empty"} {
+		if strings.Contains(entry.Line, unwanted) {
+			t.Errorf("LineSlice.As() = %s, contains %s", entry.Line, unwanted)
+		}
+	}
+
+	for _, spec := range []string{"drop:", "rename:elb", "derive:x={{", "upper:request"} {
+		if _, err = newTransformer(spec); err == nil {
+			t.Errorf("newTransformer(%q) succeeded, want error", spec)
+		}
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	tests := []struct {
+		spec string
+		in   Field
+		want string
+	}{
+		{"mask-ip:client", Field{Name: "client", Value: "10.0.1.252:48160"}, "10.0.1.0:48160"},
+		{"mask-ip:client", Field{Name: "client", Value: "2001:db8:1:2:3:4:5:6:48160"}, "2001:db8:1:2:::48160"},
+		{"mask-ip:client", Field{Name: "client", Value: "[2001:db8:1:2:3:4:5:6]:48160"}, "[2001:db8:1:2::]:48160"},
+		{"mask-ip:client", Field{Name: "client", Value: "-"}, "-"},
+		{"redact-query:request=token,email", Field{Name: "request", Value: `"GET https://example.com/a?token=abc&x=1&email=a@b.c HTTP/2.0"`, Quoted: true}, `"GET https://example.com/a?token=[redacted]&x=1&email=[redacted] HTTP/2.0"`},
+		{"redact-query:request=token", Field{Name: "request", Value: `"GET https://example.com/a?mytoken=abc HTTP/2.0"`, Quoted: true}, `"GET https://example.com/a?mytoken=abc HTTP/2.0"`},
+		{"keep-query:request=page,utm_source", Field{Name: "request", Value: `"GET https://example.com/a?token=abc&page=2&utm_source=x&email=a@b.c#top HTTP/2.0"`, Quoted: true}, `"GET https://example.com/a?page=2&utm_source=x#top HTTP/2.0"`},
+		{"keep-query:request=", Field{Name: "request", Value: `"GET https://example.com/a?token=abc HTTP/2.0"`, Quoted: true}, `"GET https://example.com/a HTTP/2.0"`},
+		{`redact-regex:request=[^@/?&=\s]+@[^@/?&=\s]+`, Field{Name: "request", Value: `"GET https://example.com/u/john@example.com HTTP/2.0"`, Quoted: true}, `"GET https://example.com/u/[redacted] HTTP/2.0"`},
+	}
+	for _, tt := range tests {
+		tr, err := newTransformer(tt.spec)
+		if err != nil {
+			t.Fatalf("newTransformer(%q) error = %v", tt.spec, err)
+		}
+		if got := tr.Transform([]Field{tt.in})[0].Value; got != tt.want {
+			t.Errorf("%s of %s = %s, want %s", tt.spec, tt.in.Value, got, tt.want)
+		}
+	}
+}
+
+func TestHashIP(t *testing.T) {
+	key := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(key, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tr, err := newTransformer("hash-ip:client=" + key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("10.0.1.252"))
+	hash := hex.EncodeToString(mac.Sum(nil)[:8])
+
+	for in, want := range map[string]string{
+		"10.0.1.252:48160": hash + ":48160",
+		"10.0.1.252":       hash,
+		"-":                "-",
+	} {
+		if got := tr.Transform([]Field{{Name: "client", Value: in}})[0].Value; got != want {
+			t.Errorf("hash-ip of %s = %s, want %s", in, got, want)
+		}
+	}
+	if _, err := newTransformer("hash-ip:client=" + key + ".missing"); err == nil {
+		t.Error("expected error for missing key file")
+	}
+}
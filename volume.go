@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+var (
+	volumeLabels = []string{"cluster", "namespace", "ingress"}
+	shippedBytes = newCounter("alb_logs_shipper_shipped_bytes_total", "Bytes of log lines shipped to Loki", volumeLabels...)
+	shippedLines = newCounter("alb_logs_shipper_shipped_lines_total", "Log lines shipped to Loki", volumeLabels...)
+)
+
+// volumes accumulates shipped volume per cluster/namespace/ingress between summaries
+var volumes = &volumeStats{data: make(map[string]*volume)}
+
+type volume struct {
+	values []string
+	bytes  int
+	lines  int
+}
+
+type volumeStats struct {
+	mu   sync.Mutex
+	data map[string]*volume
+}
+
+// record accounts shipped entries to the stream labels
+func (v *volumeStats) record(labels map[string]string, entries []logproto.Entry) {
+	values := make([]string, len(volumeLabels))
+	for i, l := range volumeLabels {
+		values[i] = labels[l]
+	}
+	size := 0
+	for _, e := range entries {
+		size += len(e.Line)
+	}
+	shippedBytes.Add(float64(size), values...)
+	shippedLines.Add(float64(len(entries)), values...)
+
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.data[key]
+	if !ok {
+		s = &volume{values: values}
+		v.data[key] = s
+	}
+	s.bytes += size
+	s.lines += len(entries)
+}
+
+// summary logs volume shipped since the previous summary, largest first
+func (v *volumeStats) summary(logger *slog.Logger, interval time.Duration) {
+	v.mu.Lock()
+	data := v.data
+	v.data = make(map[string]*volume)
+	v.mu.Unlock()
+
+	list := make([]*volume, 0, len(data))
+	for _, s := range data {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].bytes > list[j].bytes })
+	for _, s := range list {
+		logger.Info("shipped volume", "cluster", s.values[0], "namespace", s.values[1], "ingress", s.values[2], "bytes", s.bytes, "lines", s.lines, "interval", interval)
+	}
+}
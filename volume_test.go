@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+func TestVolumeStats_record(t *testing.T) {
+	v := &volumeStats{data: make(map[string]*volume)}
+	labels := map[string]string{"cluster": "prod", "namespace": "ns", "ingress": "ing", "job": "alb"}
+	v.record(labels, []logproto.Entry{{Line: "abc"}, {Line: "de"}})
+	v.record(labels, []logproto.Entry{{Line: "f"}})
+	v.record(map[string]string{"namespace": "other"}, []logproto.Entry{{Line: "xyz"}})
+
+	if len(v.data) != 2 {
+		t.Fatalf("got %d series, want 2", len(v.data))
+	}
+	s := v.data["prod\xffns\xffing"]
+	if s == nil || s.bytes != 6 || s.lines != 3 {
+		t.Errorf("got %+v, want 6 bytes and 3 lines", s)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+	"unsafe"
+
+	"github.com/grafana/loki/v3/pkg/logproto"
+)
+
+var (
+	// source:  https://docs.aws.amazon.com/waf/latest/developerguide/logging-s3.html
+	// format:  bucket[/prefix]/AWSLogs/aws-account-id/WAFLogs/region/web-acl-name/YYYY/MM/dd/HH/mm/aws-account-id_waflogs_region_web-acl-name_YYYYMMDDTHHmmZ_hash.log.gz
+	wafFnRegex = regexp.MustCompile(`(?:(?P<org>o-[a-z0-9]{10,32})\/)?AWSLogs\/(?:(?P<org_id>o-[a-z0-9]{10,32})\/)?(?P<account_id>\d+)\/WAFLogs\/(?P<region>[\w-]+)\/(?P<id>[\w-]+)\/(?P<year>\d+)\/(?P<month>\d+)\/(?P<day>\d+)\/\d+\/\d+\/\d+_waflogs_[\w-]+_\w+_\w+\.log\.gz`)
+	// wafFields are top-level fields of WAF log records, for --max-field-length and --metadata
+	wafFields = []string{"timestamp", "formatVersion", "webaclId", "terminatingRuleId", "terminatingRuleType", "action", "terminatingRuleMatchDetails", "httpSourceName", "httpSourceId", "ruleGroupList", "rateBasedRuleList", "nonTerminatingMatchingRules", "requestHeadersInserted", "responseCodeSent", "httpRequest", "labels", "captchaResponse", "challengeResponse", "ja3Fingerprint", "ja4Fingerprint", "oversizeFields", "requestBodySize", "requestBodySizeInspectedByWAF"}
+)
+
+// LineWAF parses WAF log records, which are JSON objects. Top-level fields
+// are kept in their order, nested objects are kept as is
+type LineWAF struct {
+	FieldOptions
+}
+
+var _ LineParser = &LineWAF{}
+
+// As parses WAF log record and converts it to the specified format
+func (r *LineWAF) As(format, line string) (logproto.Entry, error) {
+	matches, err := r.Fields(line)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	return r.LineAs(format, line, matches)
+}
+
+// Fields splits WAF log record to its top-level keys and raw JSON values
+func (r *LineWAF) Fields(line string) ([]string, error) {
+	matches, err := jsonPairs([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse WAF log record %w", err)
+	}
+	return matches, nil
+}
+
+// LineAs converts fields of WAF log record to the specified format
+func (r *LineWAF) LineAs(format, line string, matches []string) (logproto.Entry, error) {
+	buf, entry, err := r.AppendLine(make([]byte, 0, 2048), format, line, matches)
+	if err != nil {
+		return logproto.Entry{}, err
+	}
+	entry.Line = unsafe.String(unsafe.SliceData(buf), len(buf))
+	return entry, nil
+}
+
+// AppendLine appends fields of WAF log record in the specified format to dst.
+// Timestamp of the entry is `timestamp` field in unix milliseconds
+func (r *LineWAF) AppendLine(dst []byte, format, line string, matches []string) ([]byte, logproto.Entry, error) {
+	var entry logproto.Entry
+	idx := slices.Index(matches, "timestamp")
+	if idx < 0 || idx%2 != 0 {
+		return dst, logproto.Entry{}, fmt.Errorf("skipping WAF log record without timestamp: %s", line)
+	}
+	ms, err := strconv.ParseInt(matches[idx+1], 10, 64)
+	if err != nil {
+		return dst, logproto.Entry{}, fmt.Errorf("skipping WAF log record with invalid timestamp %w: %s", err, line)
+	}
+	entry.Timestamp = time.UnixMilli(ms).UTC()
+
+	pooled := fieldsPool.Get().(*[]Field)
+	defer fieldsPool.Put(pooled)
+	fields := (*pooled)[:0]
+	for i := 0; i < len(matches); i += 2 {
+		f, ok := jsonField(matches[i], matches[i+1], true)
+		if !ok {
+			continue
+		}
+		if limit := r.MaxLength[f.Name]; f.Quoted && limit > 0 && len(f.Value) > limit {
+			f.Value = truncate(f.Value, limit, true)
+			truncatedFields.Inc(f.Name)
+		}
+		if key, ok := r.Metadata[f.Name]; ok {
+			r.addMetadata(&entry, key, unquote(f.Value))
+			if r.MetadataOnly {
+				continue
+			}
+		}
+		fields = append(fields, f)
+	}
+	dst = r.appendFields(dst, format, fields)
+	*pooled = fields[:0]
+	return dst, entry, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const wafLine = `{"timestamp":1576280412771,"formatVersion":1,"webaclId":"arn:aws:wafv2:ap-southeast-2:111122223333:regional/webacl/STMTest/1EXAMPLE-2ARN-3ARN-4ARN-123456EXAMPLE","terminatingRuleId":"STMTest_SQLi_XSS","terminatingRuleType":"REGULAR","action":"BLOCK","terminatingRuleMatchDetails":[{"conditionType":"SQL_INJECTION","location":"UNKNOWN","matchedData":["10","AND","1"]}],"httpSourceName":"-","httpSourceId":"-","ruleGroupList":[],"rateBasedRuleList":[],"nonTerminatingMatchingRules":[],"requestHeadersInserted":null,"responseCodeSent":null,"httpRequest":{"clientIp":"1.1.1.1","country":"AU","headers":[{"name":"Host","value":"localhost:1989"}],"uri":"/myUri","args":"","httpVersion":"HTTP/1.1","httpMethod":"GET","requestId":null},"labels":[{"name":"value"}]}`
+
+func TestLineWAF_As(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		out    string
+	}{
+		{
+			name:   "json",
+			format: "json",
+			out:    `{"timestamp":1576280412771,"formatVersion":1,"webaclId":"arn:aws:wafv2:ap-southeast-2:111122223333:regional/webacl/STMTest/1EXAMPLE-2ARN-3ARN-4ARN-123456EXAMPLE","terminatingRuleId":"STMTest_SQLi_XSS","terminatingRuleType":"REGULAR","action":"BLOCK","terminatingRuleMatchDetails":[{"conditionType":"SQL_INJECTION","location":"UNKNOWN","matchedData":["10","AND","1"]}],"httpSourceName":"-","httpSourceId":"-","ruleGroupList":[],"rateBasedRuleList":[],"nonTerminatingMatchingRules":[],"httpRequest":{"clientIp":"1.1.1.1","country":"AU","headers":[{"name":"Host","value":"localhost:1989"}],"uri":"/myUri","args":"","httpVersion":"HTTP/1.1","httpMethod":"GET","requestId":null},"labels":[{"name":"value"}]}`,
+		},
+		{
+			name:   "logfmt",
+			format: "logfmt",
+			out:    `timestamp=1576280412771 formatVersion=1 webaclId="arn:aws:wafv2:ap-southeast-2:111122223333:regional/webacl/STMTest/1EXAMPLE-2ARN-3ARN-4ARN-123456EXAMPLE" terminatingRuleId="STMTest_SQLi_XSS" terminatingRuleType="REGULAR" action="BLOCK" terminatingRuleMatchDetails="[{\"conditionType\":\"SQL_INJECTION\",\"location\":\"UNKNOWN\",\"matchedData\":[\"10\",\"AND\",\"1\"]}]" httpSourceName="-" httpSourceId="-" ruleGroupList="[]" rateBasedRuleList="[]" nonTerminatingMatchingRules="[]" httpRequest="{\"clientIp\":\"1.1.1.1\",\"country\":\"AU\",\"headers\":[{\"name\":\"Host\",\"value\":\"localhost:1989\"}],\"uri\":\"/myUri\",\"args\":\"\",\"httpVersion\":\"HTTP/1.1\",\"httpMethod\":\"GET\",\"requestId\":null}" labels="[{\"name\":\"value\"}]"`,
+		},
+	}
+	lp := &LineWAF{FieldOptions{Metadata: map[string]string{"action": "action"}}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, err := lp.As(tt.format, wafLine)
+			if err != nil {
+				t.Fatalf("LineWAF.As() error = %v", err)
+			}
+			if want := time.UnixMilli(1576280412771); !entry.Timestamp.Equal(want) {
+				t.Errorf("LineWAF.As() ts = %v, want %v", entry.Timestamp, want)
+			}
+			if entry.Line != tt.out {
+				t.Errorf("LineWAF.As() out:\n%v\nwant:\n%v", entry.Line, tt.out)
+			}
+			if tt.format == "json" && !json.Valid([]byte(entry.Line)) {
+				t.Errorf("LineWAF.As() out is not valid JSON")
+			}
+			if len(entry.StructuredMetadata) != 1 || entry.StructuredMetadata[0].Value != "BLOCK" {
+				t.Errorf("LineWAF.As() metadata = %v, want action=BLOCK", entry.StructuredMetadata)
+			}
+		})
+	}
+
+	for _, line := range []string{`{"action":"BLOCK"}`, `{"timestamp":"now"}`, `not json`} {
+		if _, err := lp.As("json", line); err == nil {
+			t.Errorf("LineWAF.As(%q) error = nil", line)
+		}
+	}
+}
+
+func TestWAFFnRegex(t *testing.T) {
+	tests := map[string]string{
+		"AWSLogs/111122223333/WAFLogs/us-east-1/TEST-WEBACL/2021/10/28/19/50/111122223333_waflogs_us-east-1_TEST-WEBACL_20211028T1950Z_e0ca43b5.log.gz":             "TEST-WEBACL",
+		"waf/AWSLogs/111122223333/WAFLogs/cloudfront/cf-acl/2021/10/28/19/50/111122223333_waflogs_cloudfront_cf-acl_20211028T1950Z_e0ca43b5.log.gz":                 "cf-acl",
+		"AWSLogs/111122223333/elasticloadbalancing/us-east-1/2021/10/28/111122223333_elasticloadbalancing_us-east-1_app.my-lb.1234_20211028T1950Z_1.2.3.4_x.log.gz": "",
+	}
+	for key, want := range tests {
+		var got string
+		if matches := wafFnRegex.FindStringSubmatch(key); matches != nil {
+			got = matches[wafFnRegex.SubexpIndex("id")]
+		}
+		if got != want {
+			t.Errorf("web ACL of %q = %q, want %q", key, got, want)
+		}
+	}
+}